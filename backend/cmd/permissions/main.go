@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"turbodriver/internal/auth"
+	"turbodriver/internal/dispatch"
+)
+
+// Lists the effective permissions of each role (or a single role).
+func main() {
+	role := flag.String("role", "", "only show this role")
+	asJSON := flag.Bool("json", false, "print JSON instead of text")
+	flag.Parse()
+
+	roles := auth.Roles()
+	if *role != "" {
+		if !auth.ValidRole(dispatch.IdentityRole(*role)) {
+			log.Fatalf("unknown role %q", *role)
+		}
+		roles = []dispatch.IdentityRole{dispatch.IdentityRole(*role)}
+	}
+
+	if *asJSON {
+		out := make(map[dispatch.IdentityRole][]auth.Permission, len(roles))
+		for _, r := range roles {
+			out[r] = auth.PermissionsFor(r)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			log.Fatalf("encode: %v", err)
+		}
+		return
+	}
+	for _, r := range roles {
+		fmt.Printf("%s\n", r)
+		for _, p := range auth.PermissionsFor(r) {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+}
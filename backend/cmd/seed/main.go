@@ -22,14 +22,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("db connect failed: %v", err)
 	}
-	if err := storage.EnsureSchema(ctx, pool); err != nil {
-		log.Fatalf("schema ensure failed: %v", err)
+	if err := storage.Migrate(ctx, pool); err != nil {
+		log.Fatalf("migrations failed: %v", err)
 	}
 
 	idStore := storage.NewIdentityStore(pool)
-	if err := idStore.EnsureSchema(ctx); err != nil {
-		log.Fatalf("identity schema failed: %v", err)
-	}
 	pg := storage.NewPostgres(pool)
 
 	mem := auth.NewInMemoryStore()
@@ -39,10 +36,6 @@ func main() {
 	driver, _ := mem.Register(dispatch.RoleDriver, ttl)
 	admin, _ := mem.Register(dispatch.RoleAdmin, ttl)
 
-	mem.Seed(passenger)
-	mem.Seed(driver)
-	mem.Seed(admin)
-
 	for _, ident := range []dispatch.Identity{passenger, driver, admin} {
 		if _, err := idStore.Save(ctx, ident, ttl); err != nil {
 			log.Fatalf("save identity failed: %v", err)
@@ -51,7 +44,7 @@ func main() {
 	}
 
 	// seed driver location (NYC) for quick testing
-	_ = pg.SaveDriver(dispatch.DriverState{
+	if err := pg.SaveDriver(ctx, dispatch.DriverState{
 		ID:        driver.ID,
 		Available: true,
 		Location: dispatch.Coordinate{
@@ -63,7 +56,9 @@ func main() {
 		UpdatedAt: time.Now(),
 		Status:    "idle",
 		RadiusKM:  3,
-	})
+	}); err != nil {
+		log.Fatalf("seed driver failed: %v", err)
+	}
 }
 
 func envOrDefault(key, fallback string) string {
@@ -10,12 +10,14 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 
 	"turbodriver/internal/api"
 	"turbodriver/internal/auth"
 	"turbodriver/internal/dispatch"
 	"turbodriver/internal/geo"
+	"turbodriver/internal/pii"
 	"turbodriver/internal/storage"
 )
 
@@ -23,7 +25,7 @@ func main() {
 	addr := envOrDefault("HTTP_ADDR", ":8080")
 	env := envOrDefault("ENV", "dev")
 
-	store, authStore, identityDB, authTTL, eventLogger, rideLister, appStore := initStore(env)
+	store, authStore, identityDB, authTTL, eventLogger, rideLister, appStore, limits := initStore(env)
 	hub := dispatch.NewHub()
 	go hub.Run()
 	go startDriverPrune(store)
@@ -34,7 +36,8 @@ func main() {
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-API-Key", "If-Match", "Idempotency-Key"},
+		ExposedHeaders:   []string{"ETag", "Idempotent-Replayed"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
@@ -50,7 +53,7 @@ func main() {
 		w.Write([]byte("ready"))
 	})
 
-	api.AttachRoutes(r, store, hub, authStore, identityDB, authTTL, eventLogger, rideLister, appStore)
+	api.AttachRoutes(r, store, hub, authStore, identityDB, authTTL, eventLogger, rideLister, appStore, limits)
 
 	server := &http.Server{
 		Addr:              addr,
@@ -71,7 +74,7 @@ func envOrDefault(key, fallback string) string {
 	return fallback
 }
 
-func initStore(env string) (*dispatch.Store, *auth.InMemoryStore, *storage.IdentityStore, time.Duration, storage.EventLogger, dispatch.RideLister, api.ApplicationStore) {
+func initStore(env string) (*dispatch.Store, *auth.InMemoryStore, *storage.IdentityStore, time.Duration, storage.EventLogger, dispatch.RideLister, api.ApplicationStore, api.RateLimitBackend) {
 	dbURL := os.Getenv("DATABASE_URL")
 	redisURL := envOrDefault("REDIS_URL", "redis://redis:6379")
 	authEnabled := envOrDefault("AUTH_MODE", "memory")
@@ -91,7 +94,9 @@ func initStore(env string) (*dispatch.Store, *auth.InMemoryStore, *storage.Ident
 		idemDB   *storage.IdempotencyStore
 		dbPing   func(context.Context) error
 		redisFn  func(context.Context) error
+		rdb      *redis.Client
 		appStore api.ApplicationStore
+		limits   api.RateLimitBackend
 	)
 
 	if dbURL != "" {
@@ -101,28 +106,50 @@ func initStore(env string) (*dispatch.Store, *auth.InMemoryStore, *storage.Ident
 			if env == "prod" {
 				log.Fatal("DATABASE_URL required in prod")
 			}
-		} else if err := storage.EnsureSchema(ctx, pool); err != nil {
-			log.Printf("schema init failed, falling back to in-memory: %v", err)
+		} else if err := migrateOnStart(pool); err != nil {
+			log.Printf("migrations failed, falling back to in-memory: %v", err)
 			if env == "prod" {
-				log.Fatal("schema init required in prod")
+				log.Fatal("migrations required in prod")
 			}
 		} else {
 			log.Printf("using PostgreSQL persistence")
 			pg := storage.NewPostgres(pool)
+			if spec := os.Getenv("ARCHIVE_STORE"); spec != "" {
+				blobs, err := storage.BlobStoreFromSpec(spec)
+				if err != nil {
+					log.Fatalf("ARCHIVE_STORE: %v", err)
+				}
+				pg.AttachArchive(blobs)
+			}
+			uploadSpec := os.Getenv("UPLOAD_STORE")
+			if uploadSpec == "" {
+				uploadSpec = "uploads"
+			}
+			uploads, err := storage.BlobStoreFromSpec(uploadSpec)
+			if err != nil {
+				log.Fatalf("UPLOAD_STORE: %v", err)
+			}
+			pg.AttachUploads(uploads)
+			if keyFile := os.Getenv("PII_KEY_FILE"); keyFile != "" {
+				enc, err := pii.LoadEncryptor(keyFile)
+				if err != nil {
+					log.Fatalf("PII_KEY_FILE: %v", err)
+				}
+				pg.AttachEncryption(enc)
+			} else if env == "prod" {
+				log.Fatal("PII_KEY_FILE required in prod")
+			} else {
+				log.Printf("PII_KEY_FILE not set; personal data is stored unencrypted")
+			}
 			persist = pg
 			events = pg
 			rideLst = pg
 			appStore = pg
 			idDB = storage.NewIdentityStore(pool)
-			if err := idDB.EnsureSchema(ctx); err != nil {
-				log.Printf("identity schema init failed: %v", err)
-				idDB = nil
+			if err := idDB.HashLegacyTokens(ctx); err != nil {
+				log.Printf("legacy token migration failed: %v", err)
 			}
 			idemDB = storage.NewIdempotencyStore(pool, idemTTL)
-			if err := idemDB.EnsureSchema(ctx); err != nil {
-				log.Printf("idempotency schema init failed: %v", err)
-				idemDB = nil
-			}
 			dbPing = pool.Ping
 		}
 	}
@@ -140,6 +167,8 @@ func initStore(env string) (*dispatch.Store, *auth.InMemoryStore, *storage.Ident
 				log.Printf("using Redis geo index")
 				geoLoc = redisGeoLocator{idx: geo.NewIndex(client)}
 				redisFn = func(c context.Context) error { return client.Ping(c).Err() }
+				rdb = client
+				limits = api.NewRedisRateLimit(client)
 			}
 		} else {
 			log.Printf("redis URL parse error, geo fallback to in-memory: %v", err)
@@ -153,7 +182,12 @@ func initStore(env string) (*dispatch.Store, *auth.InMemoryStore, *storage.Ident
 		authMem = auth.NewInMemoryStore()
 		log.Printf("auth: in-memory token issuance enabled")
 		if idDB != nil {
-			seedIdentities(ctx, idDB, authMem)
+			authMem.SetCacheTTL(parseDuration(envOrDefault("AUTH_CACHE_TTL", "5m")))
+		}
+		if rdb != nil {
+			revocations := auth.NewRedisRevocations(rdb)
+			authMem.AttachRevocations(revocations)
+			go revocations.Listen(context.Background(), authMem)
 		}
 	}
 
@@ -167,8 +201,26 @@ func initStore(env string) (*dispatch.Store, *auth.InMemoryStore, *storage.Ident
 		if os.Getenv("ALLOW_SIGNUP") == "true" && os.Getenv("SIGNUP_SECRET") == "" {
 			log.Fatal("SIGNUP_SECRET required when ALLOW_SIGNUP=true in prod")
 		}
+		if os.Getenv("LIVENESS_VERIFIER") == "fake" {
+			log.Fatal("LIVENESS_VERIFIER=fake not allowed in prod")
+		}
+		if sms, err := auth.SMSSenderFromSpec(os.Getenv("SMS_SINK")); err != nil || !auth.DeliversSMS(sms) {
+			log.Fatal("SMS_SINK must be an SMS gateway URL in prod")
+		}
 	}
-	return store, authMem, idDB, authTTL, events, rideLst, appStore
+	return store, authMem, idDB, authTTL, events, rideLst, appStore, limits
+}
+
+// migrateOnStart applies pending migrations unless MIGRATE_ON_START=false, in
+// which case they are expected to run separately via cmd/migrate. Waiting on
+// another replica's migration lock can outlast the startup timeout.
+func migrateOnStart(pool *pgxpool.Pool) error {
+	if os.Getenv("MIGRATE_ON_START") == "false" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return storage.Migrate(ctx, pool)
 }
 
 func parseDuration(val string) time.Duration {
@@ -179,19 +231,6 @@ func parseDuration(val string) time.Duration {
 	return d
 }
 
-func seedIdentities(ctx context.Context, db *storage.IdentityStore, mem *auth.InMemoryStore) {
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
-	all, err := db.All(ctx)
-	if err != nil {
-		log.Printf("failed to preload identities: %v", err)
-		return
-	}
-	for _, ident := range all {
-		mem.Seed(ident)
-	}
-}
-
 func startDriverPrune(store *dispatch.Store) {
 	ttl := parseDuration(envOrDefault("DRIVER_TTL", "5m"))
 	ticker := time.NewTicker(time.Minute)
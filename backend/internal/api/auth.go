@@ -2,10 +2,16 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+
 	"turbodriver/internal/auth"
 	"turbodriver/internal/dispatch"
 )
@@ -16,20 +22,55 @@ type authConfig struct {
 	ttl   time.Duration
 	signupSecret string
 	allowSignup  bool
+	// sessions is set when AUTH_TOKEN_MODE=signed; opaque tokens keep working alongside.
+	sessions *auth.Sessions
+	// keys authenticates partner API keys, accepted alongside bearer tokens.
+	keys *auth.APIKeys
 }
 
 type IdentityDB interface {
 	Lookup(ctx context.Context, token string) (dispatch.Identity, bool, error)
 	Save(ctx context.Context, ident dispatch.Identity, ttl time.Duration) (dispatch.Identity, error)
+	RevokeToken(ctx context.Context, token string) (bool, error)
+	RevokeIdentity(ctx context.Context, identityID string) (int64, error)
 }
 
 func newAuthConfig(store *auth.InMemoryStore, db IdentityDB, ttl time.Duration, signupSecret string, allowSignup bool) authConfig {
 	return authConfig{store: store, db: db, ttl: ttl, signupSecret: signupSecret, allowSignup: allowSignup}
 }
 
+// sessionsFromEnv enables signed access tokens when AUTH_TOKEN_MODE=signed.
+// Refresh tokens live in Postgres when available, otherwise in memory.
+func sessionsFromEnv(refresh auth.RefreshStore) *auth.Sessions {
+	if os.Getenv("AUTH_TOKEN_MODE") != "signed" {
+		return nil
+	}
+	keys, err := auth.ParseKeyring(os.Getenv("AUTH_SIGNING_KEYS"))
+	if err != nil {
+		log.Printf("auth: signed tokens disabled: %v", err)
+		return nil
+	}
+	if refresh == nil {
+		refresh = auth.NewMemoryRefreshStore()
+	}
+	return auth.NewSessions(keys, refresh, parseDurationEnv("ACCESS_TOKEN_TTL", "15m"), parseDurationEnv("REFRESH_TOKEN_TTL", "720h"))
+}
+
 func (a authConfig) middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if a.store == nil && a.db == nil {
+		if raw := parseAPIKey(r); raw != "" && a.keys != nil {
+			key, err := a.keys.Authenticate(r.Context(), raw)
+			if err != nil {
+				respondError(w, http.StatusForbidden, "invalid api key")
+				return
+			}
+			ctx := context.WithValue(r.Context(), identityCtxKey{}, key.Identity())
+			ctx = context.WithValue(ctx, apiKeyCtxKey{}, key)
+			ctx = dispatch.ContextWithActor(ctx, key.Identity())
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		if a.store == nil && a.db == nil && a.sessions == nil {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -44,10 +85,40 @@ func (a authConfig) middleware(next http.Handler) http.Handler {
 			return
 		}
 		ctx := context.WithValue(r.Context(), identityCtxKey{}, identity)
+		ctx = dispatch.ContextWithActor(ctx, identity)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// permit declares the permissions a route requires; holding any one is enough.
+// Routes for self-service roles are open when auth is disabled (dev mode), but
+// staff-only routes always require an authenticated identity.
+func (a authConfig) permit(perms ...auth.Permission) func(http.Handler) http.Handler {
+	staffOnly := auth.StaffOnly(perms...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if a.store == nil && !staffOnly {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id, ok := identityFromContext(r.Context())
+			if !ok {
+				respondError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			if !auth.CanAny(id.Role, perms...) {
+				respondError(w, http.StatusForbidden, "forbidden")
+				return
+			}
+			if key, ok := apiKeyFromContext(r.Context()); ok && !key.Allows(perms...) {
+				respondError(w, http.StatusForbidden, "api key lacks scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // authorized returns identity when present and valid.
 func (a authConfig) authorized(r *http.Request) (dispatch.Identity, bool) {
 	token := parseToken(r)
@@ -64,7 +135,22 @@ func identityFromContext(ctx context.Context) (dispatch.Identity, bool) {
 	return id, ok
 }
 
+type apiKeyCtxKey struct{}
+
+// apiKeyFromContext returns the partner key the request authenticated with.
+func apiKeyFromContext(ctx context.Context) (auth.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyCtxKey{}).(auth.APIKey)
+	return key, ok
+}
+
 func (a authConfig) lookup(ctx context.Context, token string) (dispatch.Identity, bool) {
+	if a.sessions != nil && auth.IsSignedToken(token) {
+		claims, err := a.sessions.Verify(token)
+		if err != nil || (a.store != nil && a.store.SignedRevoked(claims)) {
+			return dispatch.Identity{}, false
+		}
+		return claims.Identity(), true
+	}
 	if a.store != nil {
 		if id, ok := a.store.Lookup(token); ok {
 			return id, true
@@ -73,12 +159,26 @@ func (a authConfig) lookup(ctx context.Context, token string) (dispatch.Identity
 	if a.db != nil {
 		id, ok, err := a.db.Lookup(ctx, token)
 		if err == nil && ok {
+			if a.store != nil {
+				a.store.Cache(token, id)
+			}
 			return id, true
 		}
 	}
 	return dispatch.Identity{}, false
 }
 
+// parseAPIKey reads a partner key from X-API-Key or an Authorization bearer.
+func parseAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token := parseToken(r); auth.IsAPIKey(token) {
+		return token
+	}
+	return ""
+}
+
 func parseToken(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
 	if strings.HasPrefix(authHeader, "Bearer ") {
@@ -89,3 +189,172 @@ func parseToken(r *http.Request) string {
 	}
 	return ""
 }
+
+// Logout revokes the bearer token used for the request.
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	token := parseToken(r)
+	if token == "" {
+		respondError(w, http.StatusUnauthorized, "missing token")
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refreshToken,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if h.auth.sessions != nil && auth.IsSignedToken(token) {
+		if claims, err := h.auth.sessions.Verify(token); err == nil && h.auth.store != nil {
+			h.auth.store.RevokeSigned(ctx, claims)
+		}
+		if body.RefreshToken != "" {
+			if err := h.auth.sessions.RevokeRefresh(ctx, body.RefreshToken); err != nil {
+				respondError(w, http.StatusInternalServerError, "failed to revoke refresh token")
+				return
+			}
+		}
+		respondJSON(w, http.StatusOK, map[string]bool{"revoked": true})
+		return
+	}
+	if h.auth.db != nil {
+		if _, err := h.auth.db.RevokeToken(ctx, token); err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to revoke token")
+			return
+		}
+	}
+	if h.auth.store != nil {
+		h.auth.store.Revoke(ctx, token)
+	}
+	respondJSON(w, http.StatusOK, map[string]bool{"revoked": true})
+}
+
+// RevokeIdentityTokens lets an admin sign an identity out everywhere.
+func (h *Handler) RevokeIdentityTokens(w http.ResponseWriter, r *http.Request) {
+	identityID := chi.URLParam(r, "identityID")
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	revoked, err := h.revokeIdentity(ctx, identityID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"identityId": identityID,
+		"revoked":    revoked,
+	})
+}
+
+// revokeIdentity revokes every bearer, signed and refresh token of the
+// identity, returning how many bearer tokens were revoked.
+func (h *Handler) revokeIdentity(ctx context.Context, identityID string) (int64, error) {
+	var revoked int64
+	if h.auth.db != nil {
+		n, err := h.auth.db.RevokeIdentity(ctx, identityID)
+		if err != nil {
+			return 0, errors.New("failed to revoke tokens")
+		}
+		revoked = n
+	}
+	if h.auth.sessions != nil {
+		if err := h.auth.sessions.RevokeIdentity(ctx, identityID); err != nil {
+			return revoked, errors.New("failed to revoke refresh tokens")
+		}
+	}
+	if h.auth.store != nil {
+		if n := int64(h.auth.store.RevokeIdentity(ctx, identityID)); h.auth.db == nil {
+			revoked = n
+		}
+	}
+	return revoked, nil
+}
+
+// sessionResponse is returned when signed tokens are enabled; Token carries the
+// short-lived access token.
+type sessionResponse struct {
+	ID               string                `json:"id"`
+	Role             dispatch.IdentityRole `json:"role"`
+	Token            string                `json:"token"`
+	ExpiresAt        time.Time             `json:"expiresAt"`
+	RefreshToken     string                `json:"refreshToken"`
+	RefreshExpiresAt time.Time             `json:"refreshExpiresAt"`
+}
+
+func newSessionResponse(id dispatch.Identity, pair auth.TokenPair) sessionResponse {
+	return sessionResponse{
+		ID:               id.ID,
+		Role:             id.Role,
+		Token:            pair.AccessToken,
+		ExpiresAt:        pair.AccessExpiresAt,
+		RefreshToken:     pair.RefreshToken,
+		RefreshExpiresAt: pair.RefreshExpiresAt,
+	}
+}
+
+// issueIdentity creates an identity for the role along with its credentials.
+func (h *Handler) issueIdentity(ctx context.Context, role dispatch.IdentityRole, ttl time.Duration) (any, error) {
+	identity, err := auth.NewIdentity(role)
+	if err != nil {
+		return nil, err
+	}
+	return h.issueCredentials(ctx, identity, ttl)
+}
+
+// issueCredentials signs an identity in: a signed access/refresh pair when
+// enabled, otherwise a legacy opaque token. The identity row is upserted.
+func (h *Handler) issueCredentials(ctx context.Context, identity dispatch.Identity, ttl time.Duration) (any, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if h.auth.sessions == nil {
+		identity = h.auth.store.IssueToken(identity, ttl)
+		if h.auth.db != nil {
+			h.auth.db.Save(ctx, identity, ttl)
+		}
+		return identity, nil
+	}
+	if h.auth.db != nil {
+		if _, err := h.auth.db.Save(ctx, identity, ttl); err != nil {
+			return nil, err
+		}
+	}
+	pair, err := h.auth.sessions.Issue(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+	return newSessionResponse(identity, pair), nil
+}
+
+// RefreshSession rotates a refresh token into a new access/refresh pair.
+func (h *Handler) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	if h.auth.sessions == nil {
+		respondError(w, http.StatusNotFound, "signed tokens not enabled")
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "refreshToken required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	identity, pair, err := h.auth.sessions.Refresh(ctx, body.RefreshToken)
+	switch {
+	case errors.Is(err, auth.ErrRefreshReused):
+		log.Printf("auth: refresh token reuse detected, family revoked")
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	case errors.Is(err, auth.ErrInvalidRefresh):
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, "failed to refresh session")
+		return
+	}
+	respondJSON(w, http.StatusOK, newSessionResponse(identity, pair))
+}
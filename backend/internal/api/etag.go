@@ -0,0 +1,90 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Ride responses carry the ride version as a strong ETag ("3"). Transition
+// endpoints accept If-Match with one or more such tags and answer 409 with the
+// current ride when it has moved on.
+
+func rideETag(ride dispatch.Ride) string {
+	return `"` + strconv.Itoa(ride.Version) + `"`
+}
+
+// parseIfMatch returns the versions listed in an If-Match header. An empty
+// header or "*" imposes no precondition.
+func parseIfMatch(header string) ([]int, bool, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return nil, false, nil
+	}
+	var versions []int
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		// If-Match uses strong comparison, so weak tags can never match.
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		v, err := strconv.Unquote(tag)
+		if err != nil {
+			return nil, false, errors.New("invalid If-Match")
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, false, errors.New("invalid If-Match")
+		}
+		versions = append(versions, n)
+	}
+	return versions, true, nil
+}
+
+// ifMatch attaches the request's If-Match precondition for the store to check.
+func ifMatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versions, ok, err := parseIfMatch(r.Header.Get("If-Match"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if ok {
+			r = r.WithContext(dispatch.ContextWithExpectedVersions(r.Context(), versions))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// respondRide writes the ride as the caller may see it, tagged with its version.
+func (h *Handler) respondRide(w http.ResponseWriter, r *http.Request, status int, ride dispatch.Ride) {
+	w.Header().Set("ETag", rideETag(ride))
+	respondJSON(w, status, rideForViewer(r, h.auth.store != nil, ride))
+}
+
+// respondRideError reports a failed ride transition: version conflicts are 409
+// with the current ride, persistence failures 503 so clients retry, anything
+// else a rejected transition.
+func (h *Handler) respondRideError(w http.ResponseWriter, r *http.Request, err error) {
+	var conflict *dispatch.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		current := conflict.Current
+		w.Header().Set("ETag", rideETag(current))
+		if !canAccessRide(r, h.auth.store != nil, current) {
+			respondError(w, http.StatusConflict, err.Error())
+			return
+		}
+		respondJSON(w, http.StatusConflict, map[string]any{
+			"error": err.Error(),
+			"ride":  rideForViewer(r, h.auth.store != nil, current),
+		})
+	case errors.Is(err, dispatch.ErrPersistence):
+		respondError(w, http.StatusServiceUnavailable, "failed to save ride, try again")
+	default:
+		respondError(w, http.StatusBadRequest, err.Error())
+	}
+}
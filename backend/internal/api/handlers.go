@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -14,27 +17,11 @@ import (
 
 	"github.com/go-chi/chi/v5"
 
+	"turbodriver/internal/auth"
 	"turbodriver/internal/dispatch"
+	"turbodriver/internal/liveness"
 )
 
-func requireRole(w http.ResponseWriter, r *http.Request, enforce bool, allowed ...dispatch.IdentityRole) bool {
-	if !enforce {
-		return true
-	}
-	id, ok := identityFromContext(r.Context())
-	if !ok {
-		respondError(w, http.StatusUnauthorized, "unauthorized")
-		return false
-	}
-	for _, role := range allowed {
-		if id.Role == role {
-			return true
-		}
-	}
-	respondError(w, http.StatusForbidden, "forbidden")
-	return false
-}
-
 func matchIdentity(w http.ResponseWriter, r *http.Request, enforce bool, targetID string) bool {
 	if !enforce {
 		return true
@@ -44,7 +31,7 @@ func matchIdentity(w http.ResponseWriter, r *http.Request, enforce bool, targetI
 		respondError(w, http.StatusUnauthorized, "unauthorized")
 		return false
 	}
-	if id.Role == dispatch.RoleAdmin {
+	if auth.Can(id.Role, auth.PermIdentitiesActAs) {
 		return true
 	}
 	if id.ID != targetID {
@@ -54,6 +41,14 @@ func matchIdentity(w http.ResponseWriter, r *http.Request, enforce bool, targetI
 	return true
 }
 
+// matchIdentityOr is matchIdentity that also admits holders of perm.
+func matchIdentityOr(w http.ResponseWriter, r *http.Request, enforce bool, targetID string, perm auth.Permission) bool {
+	if enforce && hasPermission(r, perm) {
+		return true
+	}
+	return matchIdentity(w, r, enforce, targetID)
+}
+
 func canAccessRide(r *http.Request, enforce bool, ride dispatch.Ride) bool {
 	if !enforce {
 		return true
@@ -66,7 +61,7 @@ func canAccessRide(r *http.Request, enforce bool, ride dispatch.Ride) bool {
 }
 
 func canAccessRideWithIdentity(id dispatch.Identity, ride dispatch.Ride) bool {
-	if id.Role == dispatch.RoleAdmin {
+	if auth.Can(id.Role, auth.PermRidesReadAny) {
 		return true
 	}
 	if id.Role == dispatch.RolePassenger && ride.PassengerID == id.ID {
@@ -75,6 +70,9 @@ func canAccessRideWithIdentity(id dispatch.Identity, ride dispatch.Ride) bool {
 	if id.Role == dispatch.RoleDriver && ride.DriverID == id.ID {
 		return true
 	}
+	if id.Role == dispatch.RolePartner && ride.BookedBy == id.ID {
+		return true
+	}
 	return false
 }
 
@@ -95,13 +93,35 @@ type ApplicationStore interface {
 	GetRatingsForProfile(ctx context.Context, profileID string) ([]dispatch.Rating, error)
 }
 
+// ArchivedEventReader finds ride events that cmd/archive moved out of the log.
+type ArchivedEventReader interface {
+	ListArchivedRideEvents(ctx context.Context, rideID string) ([]dispatch.RideEvent, error)
+}
+
 type Handler struct {
-	store  *dispatch.Store
-	hub    *dispatch.Hub
-	auth   authConfig
-	events dispatch.EventLogger
-	db     dispatch.RideLister
-	apps   ApplicationStore
+	store     *dispatch.Store
+	hub       *dispatch.Hub
+	auth      authConfig
+	events    dispatch.EventLogger
+	archive   ArchivedEventReader
+	db        dispatch.RideLister
+	apps      ApplicationStore
+	messages  MessageStore
+	shares    ShareStore
+	safety    SafetyStore
+	locations LocationSettingsStore
+	privacy   PrivacyStore
+	uploads   UploadStore
+	rules     LocationRulesStore
+	reviews   ReviewStore
+	lookup    PIILookup
+	liveness  LivenessStore
+	verifier  liveness.Verifier
+	notifier  dispatch.Notifier
+	monitor   *dispatch.TripMonitor
+	otp       *auth.OTPService
+	limiter   *rateLimiter
+	relay     *dispatch.OutboxRelay
 
 	eventsLogged    int64
 	rideStarts      int64
@@ -114,6 +134,10 @@ type Handler struct {
 	reqErrors       int64
 	reqLatencyNS    int64
 	staleTTL        time.Duration
+	shareTTL        time.Duration
+	challengeTTL    time.Duration
+	acceptances     *acceptanceCache
+	pinDefault      bool
 	matchLatencyNS  int64
 	acceptLatencyNS int64
 	matchBuckets    bucketCounter
@@ -133,9 +157,6 @@ type driverLocationPayload struct {
 
 func (h *Handler) UpdateDriverLocation(w http.ResponseWriter, r *http.Request) {
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RoleDriver, dispatch.RoleAdmin) {
-		return
-	}
 	driverID := chi.URLParam(r, "driverID")
 	if !matchIdentity(w, r, enforce, driverID) {
 		return
@@ -145,6 +166,9 @@ func (h *Handler) UpdateDriverLocation(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "invalid payload")
 		return
 	}
+	if !h.requireCurrentRules(w, r, driverID) {
+		return
+	}
 
 	ts := time.Now()
 	if payload.Timestamp > 0 {
@@ -157,27 +181,27 @@ func (h *Handler) UpdateDriverLocation(w http.ResponseWriter, r *http.Request) {
 		At:        ts,
 	}
 
-	state, err := h.store.UpdateDriverLocation(driverID, loc)
+	state, err := h.store.UpdateDriverLocation(r.Context(), driverID, loc)
 	if err != nil {
 		respondError(w, http.StatusServiceUnavailable, "failed to persist driver location")
 		return
 	}
 	h.hub.PublishDriverUpdate(driverID, state)
+	h.monitorTrip(r.Context(), state)
 	respondJSON(w, http.StatusOK, state)
 }
 
 type rideRequestPayload struct {
-	PassengerID string  `json:"passengerId"`
-	PickupLat   float64 `json:"pickupLat"`
-	PickupLong  float64 `json:"pickupLong"`
-	Idempotency string  `json:"idempotencyKey,omitempty"`
+	PassengerID  string   `json:"passengerId"`
+	PickupLat    float64  `json:"pickupLat"`
+	PickupLong   float64  `json:"pickupLong"`
+	DropoffLat   *float64 `json:"dropoffLat,omitempty"`
+	DropoffLong  *float64 `json:"dropoffLong,omitempty"`
+	LocationCode string   `json:"locationCode,omitempty"`
+	Idempotency  string   `json:"idempotencyKey,omitempty"`
 }
 
 func (h *Handler) RequestRide(w http.ResponseWriter, r *http.Request) {
-	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RolePassenger, dispatch.RoleAdmin) {
-		return
-	}
 	identity, _ := identityFromContext(r.Context())
 	var payload rideRequestPayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -187,33 +211,39 @@ func (h *Handler) RequestRide(w http.ResponseWriter, r *http.Request) {
 
 	// Idempotency: reuse existing ride when key matches
 	if payload.Idempotency != "" {
-		if ride, ok := h.store.LookupIdempotent(payload.Idempotency); ok {
-			respondJSON(w, http.StatusOK, ride)
+		if ride, ok := h.store.LookupIdempotent(r.Context(), payload.Idempotency); ok {
+			h.respondRide(w, r, http.StatusOK, ride)
 			return
 		}
 	}
 
-	passengerID := payload.PassengerID
-	if identity.Role == dispatch.RolePassenger {
+	passengerID, bookedBy := payload.PassengerID, ""
+	switch identity.Role {
+	case dispatch.RolePassenger:
 		passengerID = identity.ID
+	case dispatch.RolePartner:
+		// Partners book for guests who have no identity of their own.
+		passengerID, bookedBy = fmt.Sprintf("guest_%d", time.Now().UnixNano()), identity.ID
 	}
 
-	ride, err := h.store.CreateRide(passengerID, dispatch.Coordinate{
+	var dropoff *dispatch.Coordinate
+	if payload.DropoffLat != nil && payload.DropoffLong != nil {
+		dropoff = &dispatch.Coordinate{Latitude: *payload.DropoffLat, Longitude: *payload.DropoffLong}
+	}
+	ride, err := h.store.CreateRide(r.Context(), passengerID, bookedBy, dispatch.Coordinate{
 		Latitude:  payload.PickupLat,
 		Longitude: payload.PickupLong,
 		At:        time.Now(),
-	}, payload.Idempotency)
+	}, dropoff, payload.LocationCode, payload.Idempotency)
+	if errors.Is(err, dispatch.ErrPersistence) {
+		respondError(w, http.StatusServiceUnavailable, "failed to save ride")
+		return
+	}
 	if err != nil {
 		respondError(w, http.StatusServiceUnavailable, err.Error())
 		return
 	}
 
-	h.hub.PublishRideUpdate(ride)
-	h.logRideEvent(r.Context(), ride, "ride_requested", map[string]any{
-		"passengerId": ride.PassengerID,
-		"driverId":    ride.DriverID,
-		"statusTo":    ride.Status,
-	})
 	h.rideStarts++
 	if ride.CreatedAt.After(time.Time{}) {
 		latency := time.Since(ride.CreatedAt)
@@ -225,17 +255,22 @@ func (h *Handler) RequestRide(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	go h.awaitAcceptance(ride.ID, ride.DriverID)
-	respondJSON(w, http.StatusAccepted, ride)
+	h.respondRide(w, r, http.StatusAccepted, ride)
 }
 
 func (h *Handler) GetRide(w http.ResponseWriter, r *http.Request) {
 	rideID := chi.URLParam(r, "rideID")
-	ride, ok := h.store.GetRide(rideID)
+	ride, ok := h.store.GetRide(r.Context(), rideID)
 	if !ok {
 		respondError(w, http.StatusNotFound, "ride not found")
 		return
 	}
-	respondJSON(w, http.StatusOK, ride)
+	enforce := h.auth.store != nil
+	if !canAccessRide(r, enforce, ride) {
+		respondError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	h.respondRide(w, r, http.StatusOK, ride)
 }
 
 type acceptRidePayload struct {
@@ -244,9 +279,6 @@ type acceptRidePayload struct {
 
 func (h *Handler) AcceptRide(w http.ResponseWriter, r *http.Request) {
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RoleDriver, dispatch.RoleAdmin) {
-		return
-	}
 	rideID := chi.URLParam(r, "rideID")
 	var payload acceptRidePayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -260,16 +292,11 @@ func (h *Handler) AcceptRide(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "driver heartbeat too old")
 		return
 	}
-	ride, prevStatus, err := h.store.AcceptRide(rideID, payload.DriverID)
+	ride, err := h.store.AcceptRide(r.Context(), rideID, payload.DriverID)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
+		h.respondRideError(w, r, err)
 		return
 	}
-	h.logRideEvent(r.Context(), ride, "ride_accepted", map[string]any{
-		"driverId":   payload.DriverID,
-		"statusFrom": prevStatus,
-		"statusTo":   ride.Status,
-	})
 	h.rideAccepts++
 	// acceptance latency: from assigned to accepted
 	if ride.CreatedAt.After(time.Time{}) {
@@ -279,85 +306,77 @@ func (h *Handler) AcceptRide(w http.ResponseWriter, r *http.Request) {
 		atomic.AddInt64(&h.acceptCount, 1)
 		atomic.AddInt64(&h.acceptSumNS, latency.Nanoseconds())
 	}
-	h.hub.PublishRideUpdate(ride)
-	respondJSON(w, http.StatusOK, ride)
+	h.respondRide(w, r, http.StatusOK, ride)
 }
 
 func (h *Handler) CancelRide(w http.ResponseWriter, r *http.Request) {
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RolePassenger, dispatch.RoleDriver, dispatch.RoleAdmin) {
-		return
-	}
 	rideID := chi.URLParam(r, "rideID")
-	ride, prevStatus, err := h.store.CancelRide(rideID)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
+	if current, ok := h.store.GetRide(r.Context(), rideID); ok && !canAccessRide(r, enforce, current) {
+		respondError(w, http.StatusForbidden, "forbidden")
 		return
 	}
-	if !canAccessRide(r, enforce, ride) {
-		respondError(w, http.StatusForbidden, "forbidden")
+	ride, err := h.store.CancelRide(r.Context(), rideID)
+	if err != nil {
+		h.respondRideError(w, r, err)
 		return
 	}
-	h.logRideEvent(r.Context(), ride, "ride_cancelled", map[string]any{
-		"statusFrom": prevStatus,
-		"statusTo":   ride.Status,
-	})
 	h.rideCancels++
-	h.hub.PublishRideUpdate(ride)
-	respondJSON(w, http.StatusOK, ride)
+	h.monitor.Forget(ride.ID)
+	h.respondRide(w, r, http.StatusOK, ride)
 }
 
 func (h *Handler) CompleteRide(w http.ResponseWriter, r *http.Request) {
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RoleDriver, dispatch.RoleAdmin) {
+	rideID := chi.URLParam(r, "rideID")
+	current, ok := h.store.GetRide(r.Context(), rideID)
+	if !ok {
+		respondError(w, http.StatusNotFound, "ride not found")
 		return
 	}
-	rideID := chi.URLParam(r, "rideID")
-	ride, prevStatus, err := h.store.CompleteRide(rideID)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
+	// Check the caller before the store commits the transition and its outbox entry.
+	if !matchIdentity(w, r, enforce, current.DriverID) {
 		return
 	}
-	if !matchIdentity(w, r, enforce, ride.DriverID) {
+	if current.Status == dispatch.RideAccepted && h.pickupPINRequired(r.Context(), current) {
+		respondError(w, http.StatusConflict, "trip not started: pickup pin verification required")
+		return
+	}
+	ride, err := h.store.CompleteRide(r.Context(), rideID)
+	if err != nil {
+		h.respondRideError(w, r, err)
 		return
 	}
-	h.logRideEvent(r.Context(), ride, "ride_completed", map[string]any{
-		"driverId":   ride.DriverID,
-		"statusFrom": prevStatus,
-		"statusTo":   ride.Status,
-	})
 	h.rideCompletes++
-	h.hub.PublishRideUpdate(ride)
-	respondJSON(w, http.StatusOK, ride)
+	h.monitor.Forget(ride.ID)
+	h.respondRide(w, r, http.StatusOK, ride)
 }
 
 func (h *Handler) awaitAcceptance(rideID, driverID string) {
 	const window = 15 * time.Second
 	time.Sleep(window)
 
-	ride, changed, err := h.store.ReassignIfUnaccepted(rideID, driverID)
-	if err != nil || !changed {
-		if err == nil && !changed {
-			h.acceptTimeouts++
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, changed, err := h.store.ReassignIfUnaccepted(ctx, rideID, driverID)
+	if err != nil {
+		log.Printf("reassign %s: %v", rideID, err)
 		return
 	}
-	h.logRideEvent(context.Background(), ride, "ride_reassigned", map[string]any{
-		"previousDriver": driverID,
-		"newDriver":      ride.DriverID,
-		"statusTo":       ride.Status,
-	})
-	h.hub.PublishRideUpdate(ride)
+	if !changed {
+		h.acceptTimeouts++
+	}
 }
 
 func (h *Handler) RideWebsocket(w http.ResponseWriter, r *http.Request) {
 	rideID := chi.URLParam(r, "rideID")
-	ride, ok := h.store.GetRide(rideID)
+	ride, ok := h.store.GetRide(r.Context(), rideID)
 	if !ok {
 		respondError(w, http.StatusNotFound, "ride not found")
 		return
 	}
-	if id, ok := h.auth.authorized(r); !ok {
+	id, ok := h.auth.authorized(r)
+	if !ok {
 		respondError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	} else if h.auth.store != nil {
@@ -366,7 +385,11 @@ func (h *Handler) RideWebsocket(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	h.hub.ServeRide(w, r, ride.ID)
+	role := id.Role
+	if role == dispatch.RolePassenger && id.ID != ride.PassengerID {
+		role = ""
+	}
+	h.hub.ServeRide(w, r, ride.ID, role)
 }
 
 func (h *Handler) RegisterIdentity(w http.ResponseWriter, r *http.Request) {
@@ -374,9 +397,6 @@ func (h *Handler) RegisterIdentity(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusServiceUnavailable, "auth not configured")
 		return
 	}
-	if !requireRole(w, r, true, dispatch.RoleAdmin) {
-		return
-	}
 	var payload struct {
 		Role string `json:"role"`
 		TTL  string `json:"ttl,omitempty"`
@@ -391,31 +411,39 @@ func (h *Handler) RegisterIdentity(w http.ResponseWriter, r *http.Request) {
 			ttl = parsed
 		}
 	}
-	if h.auth.signupSecret != "" {
-		secret := r.Header.Get("X-Signup-Secret")
-		if secret == "" {
-			respondError(w, http.StatusUnauthorized, "missing signup secret")
-			return
-		}
-		if subtle.ConstantTimeCompare([]byte(secret), []byte(h.auth.signupSecret)) != 1 {
-			respondError(w, http.StatusForbidden, "invalid signup secret")
-			return
-		}
+	if !h.checkSignupSecret(w, r) {
+		return
 	}
-	identity, err := h.auth.store.Register(dispatch.IdentityRole(payload.Role), ttl)
+	identity, err := h.issueIdentity(r.Context(), dispatch.IdentityRole(payload.Role), ttl)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if h.auth.db != nil {
-		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
-		defer cancel()
-		h.auth.db.Save(ctx, identity, ttl)
-	}
+	w.Header().Set("Cache-Control", "no-store")
 	respondJSON(w, http.StatusOK, identity)
 }
 
-// SignupIdentity issues a token without admin (pilot convenience).
+// checkSignupSecret requires the X-Signup-Secret header when SIGNUP_SECRET is
+// set, writing the error response itself on failure.
+func (h *Handler) checkSignupSecret(w http.ResponseWriter, r *http.Request) bool {
+	if h.auth.signupSecret == "" {
+		return true
+	}
+	secret := r.Header.Get("X-Signup-Secret")
+	if secret == "" {
+		respondError(w, http.StatusUnauthorized, "missing signup secret")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(h.auth.signupSecret)) != 1 {
+		respondError(w, http.StatusForbidden, "invalid signup secret")
+		return false
+	}
+	return true
+}
+
+// SignupIdentity issues a token without admin (pilot convenience). It is only
+// mounted with ALLOW_SIGNUP=true; real users sign in with a phone through
+// /api/auth/otp. Tokens cannot outlive AUTH_TTL.
 func (h *Handler) SignupIdentity(w http.ResponseWriter, r *http.Request) {
 	if h.auth.store == nil {
 		respondError(w, http.StatusServiceUnavailable, "auth not configured")
@@ -429,22 +457,28 @@ func (h *Handler) SignupIdentity(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "invalid payload")
 		return
 	}
+	if !auth.SelfService(dispatch.IdentityRole(payload.Role)) {
+		respondError(w, http.StatusForbidden, "only passenger and driver identities can self-register")
+		return
+	}
 	ttl := h.auth.ttl
 	if payload.TTL != "" {
-		if parsed, err := time.ParseDuration(payload.TTL); err == nil {
-			ttl = parsed
+		parsed, err := time.ParseDuration(payload.TTL)
+		if err != nil || parsed <= 0 || parsed > h.auth.ttl {
+			respondError(w, http.StatusBadRequest, "ttl must be a positive duration up to "+h.auth.ttl.String())
+			return
 		}
+		ttl = parsed
+	}
+	if !h.checkSignupSecret(w, r) {
+		return
 	}
-	identity, err := h.auth.store.Register(dispatch.IdentityRole(payload.Role), ttl)
+	identity, err := h.issueIdentity(r.Context(), dispatch.IdentityRole(payload.Role), ttl)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if h.auth.db != nil {
-		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
-		defer cancel()
-		h.auth.db.Save(ctx, identity, ttl)
-	}
+	w.Header().Set("Cache-Control", "no-store")
 	respondJSON(w, http.StatusOK, identity)
 }
 
@@ -453,25 +487,51 @@ func (h *Handler) ListRideEvents(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusServiceUnavailable, "event log unavailable")
 		return
 	}
-	if !requireRole(w, r, true, dispatch.RoleAdmin) {
-		return
-	}
 	rideID := chi.URLParam(r, "rideID")
 	limit := parseLimit(r.URL.Query().Get("limit"), 100)
 	offset := parseOffset(r.URL.Query().Get("offset"))
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
-	events, err := h.events.ListRideEvents(ctx, rideID, limit, offset)
-	total, _ := h.events.CountRideEvents(ctx, rideID)
+	var archived []dispatch.RideEvent
+	if h.archive != nil {
+		// Archives are read from blob storage, which can take longer.
+		actx, acancel := context.WithTimeout(r.Context(), 15*time.Second)
+		var err error
+		archived, err = h.archive.ListArchivedRideEvents(actx, rideID)
+		acancel()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to fetch archived events")
+			return
+		}
+	}
+	total, countErr := h.events.CountRideEvents(ctx, rideID)
+	var (
+		events []dispatch.RideEvent
+		err    error
+	)
+	switch {
+	case len(archived) == 0:
+		events, err = h.events.ListRideEvents(ctx, rideID, limit, offset)
+	case countErr != nil:
+		err = countErr
+	default:
+		// Merge the archived events into the live ones and page over both.
+		events, err = h.events.ListRideEvents(ctx, rideID, total, 0)
+		events = append(archived, events...)
+		sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+		total = len(events)
+		events = events[min(offset, total):min(offset+limit, total)]
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "failed to fetch events")
 		return
 	}
 	respondJSON(w, http.StatusOK, map[string]any{
-		"data":   events,
-		"limit":  limit,
-		"offset": offset,
-		"total":  total,
+		"data":     events,
+		"limit":    limit,
+		"offset":   offset,
+		"total":    total,
+		"archived": len(archived),
 	})
 }
 
@@ -566,30 +626,37 @@ type licBody struct {
 	Number      string `json:"number"`
 	Country     string `json:"country,omitempty"`
 	Region      string `json:"region,omitempty"`
+	IssuedAt    string `json:"issuedAt,omitempty"`
 	ExpiresAt   string `json:"expiresAt,omitempty"`
 	Remunerated bool   `json:"remunerated"`
-	DocumentURL string `json:"documentUrl,omitempty"`
+	// DocumentUploadID and the other upload IDs below name the caller's own
+	// completed uploads; see CreateUpload.
+	DocumentUploadID string `json:"documentUploadId,omitempty"`
 }
 
 type vehBody struct {
-	Type            string `json:"type"`
-	PlateNumber     string `json:"plateNumber,omitempty"`
-	DocumentNumber  string `json:"documentNumber,omitempty"`
-	DocumentURL     string `json:"documentUrl,omitempty"`
-	DocumentExpires string `json:"documentExpiresAt,omitempty"`
-	Ownership       string `json:"ownership"`
-	ContractURL     string `json:"contractUrl,omitempty"`
-	ContractExpires string `json:"contractExpiresAt,omitempty"`
+	Type             string `json:"type"`
+	PlateNumber      string `json:"plateNumber,omitempty"`
+	Year             int    `json:"year,omitempty"`
+	DocumentNumber   string `json:"documentNumber,omitempty"`
+	DocumentUploadID string `json:"documentUploadId,omitempty"`
+	DocumentExpires  string `json:"documentExpiresAt,omitempty"`
+	Ownership        string `json:"ownership"`
+	ContractUploadID string `json:"contractUploadId,omitempty"`
+	ContractExpires  string `json:"contractExpiresAt,omitempty"`
 }
 
 type photo struct {
 	Angle    string `json:"angle"`
-	PhotoURL string `json:"photoUrl"`
+	UploadID string `json:"uploadId"`
 }
 
 type liveBody struct {
-	ChallengeSequence []string          `json:"challengeSequence"`
-	Captures          map[string]string `json:"captures"`
+	// ChallengeID names the challenge the captures answer; see
+	// CreateLivenessChallenge.
+	ChallengeID string `json:"challengeId"`
+	// Captures maps each direction to the upload ID of its capture.
+	Captures map[string]string `json:"captures"`
 }
 
 func (h *Handler) SubmitDriverApplication(w http.ResponseWriter, r *http.Request) {
@@ -598,9 +665,6 @@ func (h *Handler) SubmitDriverApplication(w http.ResponseWriter, r *http.Request
 		return
 	}
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RoleDriver, dispatch.RoleAdmin) {
-		return
-	}
 	driverID := chi.URLParam(r, "driverID")
 	if !matchIdentity(w, r, enforce, driverID) {
 		return
@@ -630,72 +694,37 @@ func (h *Handler) SubmitDriverApplication(w http.ResponseWriter, r *http.Request
 
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
-
-	// License
-	lic := dispatch.DriverLicense{
-		DriverID:    driverID,
-		Number:      payload.License.Number,
-		Country:     payload.License.Country,
-		Region:      payload.License.Region,
-		Remunerated: payload.License.Remunerated,
-		DocumentURL: payload.License.DocumentURL,
-	}
-	if t := parseOptionalTime(payload.License.ExpiresAt); t != nil {
-		lic.ExpiresAt = t
-	}
-	if _, err := h.apps.UpsertDriverLicense(ctx, lic); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to save license")
+	rule, ok := h.applicationRules(ctx, w, payload.LocationCode, payload.RulesVersionID)
+	if !ok {
 		return
 	}
 
-	// Vehicle
-	veh := dispatch.DriverVehicle{
-		DriverID:       driverID,
-		Type:           strings.ToLower(payload.Vehicle.Type),
-		PlateNumber:    payload.Vehicle.PlateNumber,
-		DocumentNumber: payload.Vehicle.DocumentNumber,
-		DocumentURL:    payload.Vehicle.DocumentURL,
-		Ownership:      strings.ToLower(payload.Vehicle.Ownership),
-		ContractURL:    payload.Vehicle.ContractURL,
-	}
-	if t := parseOptionalTime(payload.Vehicle.DocumentExpires); t != nil {
-		veh.DocumentExpires = t
-	}
-	if t := parseOptionalTime(payload.Vehicle.ContractExpires); t != nil {
-		veh.ContractExpires = t
-	}
-	vehID, err := h.apps.UpsertDriverVehicle(ctx, veh)
+	existing, _, err := h.apps.GetDriverApplication(ctx, driverID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to save vehicle")
+		respondError(w, http.StatusInternalServerError, "failed to load application")
 		return
 	}
-
-	// Photos
-	var photos []dispatch.VehiclePhoto
-	for _, p := range payload.Photos {
-		photos = append(photos, dispatch.VehiclePhoto{
-			VehicleID: vehID,
-			Angle:     strings.ToLower(p.Angle),
-			PhotoURL:  p.PhotoURL,
-		})
+	if existing.Status == dispatch.ApplicationChangesRequested {
+		respondError(w, http.StatusConflict, "changes were requested; resubmit the requested sections with PATCH /api/drivers/"+driverID+"/application")
+		return
 	}
-	if len(photos) > 0 {
-		if err := h.apps.ReplaceVehiclePhotos(ctx, vehID, photos); err != nil {
-			respondError(w, http.StatusInternalServerError, "failed to save photos")
+	// Once a reviewer has looked at the application, a resubmission goes back
+	// to them whatever the rules say.
+	reviewed := false
+	if h.reviews != nil {
+		reviews, err := h.reviews.ListApplicationReviews(ctx, driverID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to load application")
 			return
 		}
+		reviewed = len(reviews) > 0
 	}
-
-	// Liveness
-	capturesJSON, _ := json.Marshal(payload.Liveness.Captures)
-	liv := dispatch.DriverLiveness{
-		DriverID:          driverID,
-		ChallengeSequence: payload.Liveness.ChallengeSequence,
-		Captures:          capturesJSON,
-		Verified:          false,
-	}
-	if _, err := h.apps.UpsertLiveness(ctx, liv); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to save liveness")
+	if !h.saveApplicationSections(ctx, w, driverID, applicationSections{
+		License:  &payload.License,
+		Vehicle:  &payload.Vehicle,
+		Photos:   payload.Photos,
+		Liveness: &payload.Liveness,
+	}, 0) {
 		return
 	}
 
@@ -706,6 +735,13 @@ func (h *Handler) SubmitDriverApplication(w http.ResponseWriter, r *http.Request
 		RulesVersion: payload.RulesVersionID,
 		Status:       dispatch.ApplicationPending,
 	}
+	if reviewed {
+		app.Status = dispatch.ApplicationNeedsReview
+	}
+	if app.RulesVersion != nil {
+		now := time.Now().UTC()
+		app.RulesAcceptedAt = &now
+	}
 	if _, err := h.apps.UpsertDriverApplication(ctx, app); err != nil {
 		respondError(w, http.StatusInternalServerError, "failed to save application")
 		return
@@ -716,71 +752,209 @@ func (h *Handler) SubmitDriverApplication(w http.ResponseWriter, r *http.Request
 		respondError(w, http.StatusInternalServerError, "failed to load application")
 		return
 	}
+	if rule != nil {
+		if full, err = h.evaluateApplication(ctx, *rule, full, reviewed); err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to evaluate application")
+			return
+		}
+	}
+	full = h.flagDuplicateLicense(ctx, full)
 	respondJSON(w, http.StatusOK, full)
 }
 
-func (h *Handler) GetDriverApplication(w http.ResponseWriter, r *http.Request) {
-	if h.apps == nil {
-		respondError(w, http.StatusServiceUnavailable, "application store unavailable")
-		return
+// applicationSections are the parts of a driver application; nil sections are
+// left as stored.
+type applicationSections struct {
+	License  *licBody  `json:"license,omitempty"`
+	Vehicle  *vehBody  `json:"vehicle,omitempty"`
+	Photos   []photo   `json:"photos,omitempty"`
+	Liveness *liveBody `json:"liveness,omitempty"`
+}
+
+// names lists the sections present, in SectionLicense.. order.
+func (s applicationSections) names() []string {
+	var out []string
+	if s.License != nil {
+		out = append(out, dispatch.SectionLicense)
 	}
-	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RoleDriver, dispatch.RoleAdmin) {
-		return
+	if s.Vehicle != nil {
+		out = append(out, dispatch.SectionVehicle)
 	}
-	driverID := chi.URLParam(r, "driverID")
-	if !matchIdentity(w, r, enforce, driverID) {
-		return
+	if s.Photos != nil {
+		out = append(out, dispatch.SectionPhotos)
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
-	defer cancel()
-	app, ok, err := h.apps.LoadApplicationDetails(ctx, driverID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to load application")
-		return
+	if s.Liveness != nil {
+		out = append(out, dispatch.SectionLiveness)
 	}
-	if !ok {
-		respondError(w, http.StatusNotFound, "application not found")
-		return
+	return out
+}
+
+// saveApplicationSections resolves the uploads the sections reference and
+// saves them, writing the error response itself on failure. Photos are saved
+// against vehicleID unless the vehicle section is sent too.
+func (h *Handler) saveApplicationSections(ctx context.Context, w http.ResponseWriter, driverID string, s applicationSections, vehicleID int64) bool {
+	// Documents must be the driver's own completed uploads.
+	var uploadErr error
+	resolve := func(field, id, purpose string) dispatch.Upload {
+		if uploadErr != nil {
+			return dispatch.Upload{}
+		}
+		up, err := h.applicationUpload(ctx, driverID, field, id, purpose)
+		uploadErr = err
+		return up
 	}
-	respondJSON(w, http.StatusOK, app)
+	upload := func(field, id, purpose string) string {
+		if up := resolve(field, id, purpose); up.ID != "" {
+			return up.ContentURL()
+		}
+		return ""
+	}
+	var licenseDoc, vehicleDoc, contract string
+	if s.License != nil {
+		licenseDoc = upload("license.documentUploadId", s.License.DocumentUploadID, dispatch.UploadLicenseDocument)
+	}
+	if s.Vehicle != nil {
+		vehicleDoc = upload("vehicle.documentUploadId", s.Vehicle.DocumentUploadID, dispatch.UploadVehicleDocument)
+		contract = upload("vehicle.contractUploadId", s.Vehicle.ContractUploadID, dispatch.UploadVehicleContract)
+	}
+	photoURLs := make([]string, len(s.Photos))
+	for i, p := range s.Photos {
+		photoURLs[i] = upload("photos."+strings.ToLower(p.Angle), p.UploadID, dispatch.UploadVehiclePhoto)
+	}
+	var (
+		captures       map[string]string
+		captureUploads map[string]dispatch.Upload
+	)
+	if s.Liveness != nil {
+		captures = make(map[string]string, len(s.Liveness.Captures))
+		captureUploads = make(map[string]dispatch.Upload, len(s.Liveness.Captures))
+		for dir, id := range s.Liveness.Captures {
+			up := resolve("liveness.captures."+dir, id, dispatch.UploadLivenessCapture)
+			captures[dir] = up.ContentURL()
+			captureUploads[dir] = up
+		}
+	}
+	switch {
+	case errors.Is(uploadErr, errInvalidUpload):
+		respondError(w, http.StatusUnprocessableEntity, uploadErr.Error())
+		return false
+	case errors.Is(uploadErr, errUploadsUnavailable):
+		respondError(w, http.StatusServiceUnavailable, uploadErr.Error())
+		return false
+	case uploadErr != nil:
+		respondError(w, http.StatusInternalServerError, "failed to load uploads")
+		return false
+	}
+
+	// Spend the challenge only once everything else checks out.
+	var challenge dispatch.LivenessChallenge
+	if s.Liveness != nil {
+		ch, ok := h.consumeLivenessChallenge(ctx, w, driverID, s.Liveness.ChallengeID, captureUploads)
+		if !ok {
+			return false
+		}
+		challenge = ch
+	}
+
+	if s.License != nil {
+		lic := dispatch.DriverLicense{
+			DriverID:    driverID,
+			Number:      s.License.Number,
+			Country:     s.License.Country,
+			Region:      s.License.Region,
+			Remunerated: s.License.Remunerated,
+			DocumentURL: licenseDoc,
+		}
+		if t := parseOptionalTime(s.License.IssuedAt); t != nil {
+			lic.IssuedAt = t
+		}
+		if t := parseOptionalTime(s.License.ExpiresAt); t != nil {
+			lic.ExpiresAt = t
+		}
+		if _, err := h.apps.UpsertDriverLicense(ctx, lic); err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to save license")
+			return false
+		}
+	}
+
+	if s.Vehicle != nil {
+		veh := dispatch.DriverVehicle{
+			DriverID:       driverID,
+			Type:           strings.ToLower(s.Vehicle.Type),
+			PlateNumber:    s.Vehicle.PlateNumber,
+			Year:           s.Vehicle.Year,
+			DocumentNumber: s.Vehicle.DocumentNumber,
+			DocumentURL:    vehicleDoc,
+			Ownership:      strings.ToLower(s.Vehicle.Ownership),
+			ContractURL:    contract,
+		}
+		if t := parseOptionalTime(s.Vehicle.DocumentExpires); t != nil {
+			veh.DocumentExpires = t
+		}
+		if t := parseOptionalTime(s.Vehicle.ContractExpires); t != nil {
+			veh.ContractExpires = t
+		}
+		id, err := h.apps.UpsertDriverVehicle(ctx, veh)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to save vehicle")
+			return false
+		}
+		vehicleID = id
+	}
+
+	if len(s.Photos) > 0 {
+		var photos []dispatch.VehiclePhoto
+		for i, p := range s.Photos {
+			photos = append(photos, dispatch.VehiclePhoto{
+				VehicleID: vehicleID,
+				Angle:     strings.ToLower(p.Angle),
+				PhotoURL:  photoURLs[i],
+			})
+		}
+		if err := h.apps.ReplaceVehiclePhotos(ctx, vehicleID, photos); err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to save photos")
+			return false
+		}
+	}
+
+	if s.Liveness != nil {
+		capturesJSON, _ := json.Marshal(captures)
+		liv := dispatch.DriverLiveness{
+			DriverID:          driverID,
+			ChallengeID:       challenge.ID,
+			ChallengeSequence: challenge.Sequence,
+			Captures:          capturesJSON,
+			Verified:          false,
+		}
+		if _, err := h.apps.UpsertLiveness(ctx, liv); err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to save liveness")
+			return false
+		}
+	}
+	return true
 }
 
-func (h *Handler) UpdateApplicationStatus(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetDriverApplication(w http.ResponseWriter, r *http.Request) {
 	if h.apps == nil {
 		respondError(w, http.StatusServiceUnavailable, "application store unavailable")
 		return
 	}
-	if !requireRole(w, r, true, dispatch.RoleAdmin) {
-		return
-	}
+	enforce := h.auth.store != nil
 	driverID := chi.URLParam(r, "driverID")
-	var body struct {
-		Status string `json:"status"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid payload")
-		return
-	}
-	newStatus := dispatch.DriverApplicationStatus(strings.ToLower(body.Status))
-	switch newStatus {
-	case dispatch.ApplicationPending, dispatch.ApplicationApproved, dispatch.ApplicationRejected, dispatch.ApplicationNeedsReview:
-	default:
-		respondError(w, http.StatusBadRequest, "invalid status")
+	if !matchIdentityOr(w, r, enforce, driverID, auth.PermApplicationsReadAny) {
 		return
 	}
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
-	if err := h.apps.UpdateApplicationStatus(ctx, driverID, newStatus); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to update status")
+	app, ok, err := h.apps.LoadApplicationDetails(ctx, driverID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load application")
 		return
 	}
-	app, ok, err := h.apps.LoadApplicationDetails(ctx, driverID)
-	if err != nil || !ok {
-		respondJSON(w, http.StatusOK, map[string]string{"status": string(newStatus)})
+	if !ok {
+		respondError(w, http.StatusNotFound, "application not found")
 		return
 	}
-	app.Status = newStatus
 	respondJSON(w, http.StatusOK, app)
 }
 
@@ -792,9 +966,6 @@ func (h *Handler) UpsertPassengerProfile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RolePassenger, dispatch.RoleAdmin) {
-		return
-	}
 	pid := chi.URLParam(r, "passengerID")
 	if !matchIdentity(w, r, enforce, pid) {
 		return
@@ -838,11 +1009,8 @@ func (h *Handler) GetPassengerProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RolePassenger, dispatch.RoleAdmin) {
-		return
-	}
 	pid := chi.URLParam(r, "passengerID")
-	if !matchIdentity(w, r, enforce, pid) {
+	if !matchIdentityOr(w, r, enforce, pid, auth.PermProfilesReadAny) {
 		return
 	}
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
@@ -865,12 +1033,8 @@ func (h *Handler) RateRide(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusServiceUnavailable, "rating store unavailable")
 		return
 	}
-	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, dispatch.RolePassenger, dispatch.RoleDriver, dispatch.RoleAdmin) {
-		return
-	}
 	rideID := chi.URLParam(r, "rideID")
-	ride, ok := h.store.GetRide(rideID)
+	ride, ok := h.store.GetRide(r.Context(), rideID)
 	if !ok {
 		respondError(w, http.StatusNotFound, "ride not found")
 		return
@@ -919,9 +1083,6 @@ func (h *Handler) RateRide(w http.ResponseWriter, r *http.Request) {
 		rating.RaterRole = dispatch.RoleDriver
 		rating.RaterID = id.ID
 		rating.RateeID = ride.PassengerID
-	case dispatch.RoleAdmin:
-		respondError(w, http.StatusForbidden, "admin cannot rate")
-		return
 	default:
 		respondError(w, http.StatusForbidden, "forbidden")
 		return
@@ -950,16 +1111,13 @@ func (h *Handler) getRatingsForProfile(w http.ResponseWriter, r *http.Request, r
 		return
 	}
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, role, dispatch.RoleAdmin) {
-		return
-	}
 	var id string
 	if role == dispatch.RoleDriver {
 		id = chi.URLParam(r, "driverID")
 	} else {
 		id = chi.URLParam(r, "passengerID")
 	}
-	if !matchIdentity(w, r, enforce, id) && !(enforce && isAdmin(r)) {
+	if !matchIdentityOr(w, r, enforce, id, auth.PermProfilesReadAny) {
 		return
 	}
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
@@ -984,9 +1142,9 @@ func (h *Handler) getRatingsForProfile(w http.ResponseWriter, r *http.Request, r
 	})
 }
 
-func isAdmin(r *http.Request) bool {
+func hasPermission(r *http.Request, perm auth.Permission) bool {
 	id, ok := identityFromContext(r.Context())
-	return ok && id.Role == dispatch.RoleAdmin
+	return ok && auth.Can(id.Role, perm)
 }
 
 // Summaries: profile + ride counts + ratings.
@@ -1004,16 +1162,13 @@ func (h *Handler) getSummary(w http.ResponseWriter, r *http.Request, role dispat
 		return
 	}
 	enforce := h.auth.store != nil
-	if !requireRole(w, r, enforce, role, dispatch.RoleAdmin) {
-		return
-	}
 	var id string
 	if role == dispatch.RoleDriver {
 		id = chi.URLParam(r, "driverID")
 	} else {
 		id = chi.URLParam(r, "passengerID")
 	}
-	if !matchIdentity(w, r, enforce, id) && !(enforce && isAdmin(r)) {
+	if !matchIdentityOr(w, r, enforce, id, auth.PermProfilesReadAny) {
 		return
 	}
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
@@ -1082,8 +1237,8 @@ func validateVehicle(v vehBody) error {
 	if own != "owns" && own != "renting" && own != "lent" {
 		return fmt.Errorf("vehicle.ownership must be owns, renting, or lent")
 	}
-	if (own == "renting" || own == "lent") && v.ContractURL == "" {
-		return fmt.Errorf("vehicle.contractUrl required when ownership is renting or lent")
+	if (own == "renting" || own == "lent") && v.ContractUploadID == "" {
+		return fmt.Errorf("vehicle.contractUploadId required when ownership is renting or lent")
 	}
 	return nil
 }
@@ -1093,6 +1248,9 @@ func validatePhotos(ph []photo) error {
 	for _, p := range ph {
 		angle := strings.ToLower(p.Angle)
 		if _, ok := required[angle]; ok {
+			if p.UploadID == "" {
+				return fmt.Errorf("vehicle photo %s: uploadId required", angle)
+			}
 			required[angle] = true
 		}
 	}
@@ -1105,17 +1263,11 @@ func validatePhotos(ph []photo) error {
 }
 
 func validateLiveness(l liveBody) error {
-	if len(l.ChallengeSequence) == 0 {
-		return fmt.Errorf("liveness.challengeSequence required")
-	}
-	required := map[string]bool{"up": false, "down": false, "left": false, "right": false}
-	for _, dir := range l.ChallengeSequence {
-		if _, ok := required[strings.ToLower(dir)]; ok {
-			required[strings.ToLower(dir)] = true
-		}
+	if l.ChallengeID == "" {
+		return fmt.Errorf("liveness.challengeId required")
 	}
-	for dir := range required {
-		if _, ok := l.Captures[dir]; !ok {
+	for _, dir := range liveness.Directions {
+		if l.Captures[dir] == "" {
 			return fmt.Errorf("liveness.captures missing direction: %s", dir)
 		}
 	}
@@ -1142,6 +1294,9 @@ func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "turbodriver_ride_cancels %d\n", h.rideCancels)
 	fmt.Fprintf(w, "turbodriver_ride_completes %d\n", h.rideCompletes)
 	fmt.Fprintf(w, "turbodriver_ride_accept_timeouts %d\n", h.acceptTimeouts)
+	fmt.Fprintf(w, "turbodriver_persistence_failures_total %d\n", h.store.PersistFailures())
+	h.limiter.writeMetrics(w)
+	h.relay.WriteMetrics(w)
 	uptime := time.Since(h.startTime).Seconds()
 	fmt.Fprintf(w, "turbodriver_prunes %d\n", h.store.PruneCount())
 	total, available, stale := h.store.SnapshotDrivers(h.staleTTL)
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Mutating requests may carry an Idempotency-Key header. The first request with
+// a key runs and its response is stored; retries with the same key and request
+// get the stored response back (marked Idempotent-Replayed: true) instead of
+// applying twice. Keys are scoped to the caller.
+const (
+	maxIdempotencyKeyLen = 255
+	// maxIdempotentBody bounds the request bodies kept in memory and the
+	// responses stored for replay.
+	maxIdempotentBody = 1 << 20
+	// maxSpooledBody bounds larger request bodies, spooled to a temporary file
+	// while they are fingerprinted; it matches the upload limit.
+	maxSpooledBody = maxUploadBytes + 1<<20
+	// idempotencyLock outlasts the slowest handler (30s for uploads and account
+	// deletion) so a retry cannot run a request that is still in flight.
+	idempotencyLock = 2 * time.Minute
+)
+
+// replayedHeaders are the response headers kept with a stored response.
+var replayedHeaders = []string{"Content-Type", "ETag", "Location", "Retry-After"}
+
+type idempotency struct {
+	store dispatch.RequestIdempotency
+	ttl   time.Duration
+}
+
+func (i idempotency) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			respondError(w, http.StatusBadRequest, "Idempotency-Key too long")
+			return
+		}
+		sum := sha256.New()
+		io.WriteString(sum, r.Method+"\n"+r.URL.RequestURI()+"\n")
+		body, err := readIdempotentBody(r.Body, sum)
+		if errors.Is(err, errIdempotentBodyTooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge, "body too large")
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+		defer body.Close()
+		r.Body = body
+
+		scope := "anonymous"
+		if id, ok := identityFromContext(r.Context()); ok {
+			scope = string(id.Role) + ":" + id.ID
+		}
+		storeKey := "http:" + scope + ":" + key
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		outcome, stored, err := i.store.BeginRequest(ctx, storeKey, fingerprint, idempotencyLock)
+		cancel()
+		if err != nil {
+			respondError(w, http.StatusServiceUnavailable, "idempotency store unavailable")
+			return
+		}
+		switch outcome {
+		case dispatch.IdempotencyMismatch:
+			respondError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			return
+		case dispatch.IdempotencyInFlight:
+			w.Header().Set("Retry-After", "1")
+			respondError(w, http.StatusConflict, "a request with this Idempotency-Key is in progress")
+			return
+		case dispatch.IdempotencyReplay:
+			for name, val := range stored.Header {
+				w.Header().Set(name, val)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Server errors and rate limiting did not apply the request; free the key
+		// so the client's retry runs it. Responses marked no-store carry secrets
+		// (tokens, API keys) that must not be kept at rest, so they are not
+		// replayable either.
+		ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if rec.status >= 500 || rec.status == http.StatusTooManyRequests || rec.overflow ||
+			strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+			if err := i.store.ReleaseRequest(ctx, storeKey, fingerprint); err != nil {
+				log.Printf("idempotency: release %s: %v", storeKey, err)
+			}
+			return
+		}
+		resp := dispatch.IdempotentResponse{Status: rec.status, Body: rec.body.Bytes(), Header: map[string]string{}}
+		for _, name := range replayedHeaders {
+			if val := w.Header().Get(name); val != "" {
+				resp.Header[name] = val
+			}
+		}
+		kept, err := i.store.CompleteRequest(ctx, storeKey, fingerprint, resp, i.ttl)
+		switch {
+		case err != nil:
+			log.Printf("idempotency: store %s: %v", storeKey, err)
+		case !kept:
+			log.Printf("idempotency: %s: lock lapsed before the response was stored", storeKey)
+		}
+	})
+}
+
+var errIdempotentBodyTooLarge = errors.New("body too large")
+
+// readIdempotentBody reads the request body through sum and returns a copy for
+// the handler. Bodies up to maxIdempotentBody stay in memory; larger ones, such
+// as uploads, are spooled to a temporary file removed on Close.
+func readIdempotentBody(r io.Reader, sum hash.Hash) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(&buf, sum), io.LimitReader(r, maxIdempotentBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= maxIdempotentBody {
+		return io.NopCloser(&buf), nil
+	}
+	f, err := os.CreateTemp("", "idempotent-body-*")
+	if err != nil {
+		return nil, err
+	}
+	spool := spooledBody{f}
+	if _, err := buf.WriteTo(f); err != nil {
+		spool.Close()
+		return nil, err
+	}
+	rest, err := io.Copy(io.MultiWriter(f, sum), io.LimitReader(r, maxSpooledBody-n+1))
+	if err == nil && n+rest > maxSpooledBody {
+		err = errIdempotentBodyTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// spooledBody is a request body in a temporary file.
+type spooledBody struct {
+	*os.File
+}
+
+func (b spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+// responseRecorder passes the response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.body.Len()+len(b) > maxIdempotentBody {
+		r.overflow = true
+	} else {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/dispatch"
+	"turbodriver/internal/liveness"
+)
+
+// LivenessStore keeps liveness challenges and the verification of captures.
+type LivenessStore interface {
+	CreateLivenessChallenge(ctx context.Context, ch dispatch.LivenessChallenge) (dispatch.LivenessChallenge, error)
+	ConsumeLivenessChallenge(ctx context.Context, driverID, id string) (dispatch.LivenessChallenge, bool, error)
+	ClaimLivenessChecks(ctx context.Context, limit int, lease time.Duration) ([]dispatch.DriverLiveness, error)
+	SaveLivenessResult(ctx context.Context, liv dispatch.DriverLiveness) (bool, error)
+}
+
+const (
+	livenessBatch = 10
+	// livenessLease is how long a claimed check waits before another attempt,
+	// whether its worker failed or died.
+	livenessLease = 2 * time.Minute
+	// livenessMaxAttempts bounds verifier failures before a reviewer takes over.
+	livenessMaxAttempts = 5
+)
+
+// CreateLivenessChallenge issues the order in which the driver turns their
+// head for the captures of their next submission. A challenge expires after
+// LIVENESS_CHALLENGE_TTL and answers one submission.
+func (h *Handler) CreateLivenessChallenge(w http.ResponseWriter, r *http.Request) {
+	if h.liveness == nil {
+		respondError(w, http.StatusServiceUnavailable, "liveness store unavailable")
+		return
+	}
+	enforce := h.auth.store != nil
+	driverID := chi.URLParam(r, "driverID")
+	if !matchIdentity(w, r, enforce, driverID) {
+		return
+	}
+	id, err := newLivenessChallengeID()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to create challenge")
+		return
+	}
+	seq, err := challengeSequence()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to create challenge")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	ch, err := h.liveness.CreateLivenessChallenge(ctx, dispatch.LivenessChallenge{
+		ID:        id,
+		DriverID:  driverID,
+		Sequence:  seq,
+		ExpiresAt: time.Now().Add(h.challengeTTL).UTC(),
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to create challenge")
+		return
+	}
+	respondJSON(w, http.StatusCreated, ch)
+}
+
+// consumeLivenessChallenge spends the challenge a submission answers, writing
+// the error response itself on failure. Captures must have been uploaded after
+// the challenge was issued.
+func (h *Handler) consumeLivenessChallenge(ctx context.Context, w http.ResponseWriter, driverID, id string, captures map[string]dispatch.Upload) (dispatch.LivenessChallenge, bool) {
+	if h.liveness == nil {
+		respondError(w, http.StatusServiceUnavailable, "liveness store unavailable")
+		return dispatch.LivenessChallenge{}, false
+	}
+	ch, ok, err := h.liveness.ConsumeLivenessChallenge(ctx, driverID, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to check liveness challenge")
+		return ch, false
+	}
+	if !ok {
+		respondError(w, http.StatusUnprocessableEntity, "liveness challenge expired or already used; request a new one")
+		return ch, false
+	}
+	for _, dir := range liveness.Directions {
+		if up, found := captures[dir]; found && up.CreatedAt.Before(ch.CreatedAt) {
+			respondError(w, http.StatusUnprocessableEntity, fmt.Sprintf("liveness.captures.%s: upload %q was made before the challenge was issued", dir, up.ID))
+			return ch, false
+		}
+	}
+	return ch, true
+}
+
+// challengeSequence shuffles the directions with crypto/rand so the order
+// cannot be predicted or replayed.
+func challengeSequence() ([]string, error) {
+	seq := append([]string(nil), liveness.Directions...)
+	for i := len(seq) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return nil, err
+		}
+		seq[i], seq[j.Int64()] = seq[j.Int64()], seq[i]
+	}
+	return seq, nil
+}
+
+func newLivenessChallengeID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "lch_" + hex.EncodeToString(b), nil
+}
+
+// runLivenessChecks verifies submitted captures every interval until ctx is
+// done.
+func (h *Handler) runLivenessChecks(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			n, err := h.verifyLivenessChecks(ctx)
+			if err != nil {
+				log.Printf("liveness: claim failed: %v", err)
+			}
+			if err != nil || n < livenessBatch {
+				break
+			}
+		}
+	}
+}
+
+// verifyLivenessChecks verifies one batch of pending captures and returns how
+// many it claimed.
+func (h *Handler) verifyLivenessChecks(ctx context.Context) (int, error) {
+	claimCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	checks, err := h.liveness.ClaimLivenessChecks(claimCtx, livenessBatch, livenessLease)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	for _, liv := range checks {
+		h.verifyLiveness(ctx, liv)
+	}
+	return len(checks), nil
+}
+
+// verifyLiveness runs the verifier on a claimed check and stores the result.
+// Verifier errors leave the check to be claimed again after the lease, up to
+// livenessMaxAttempts; captures that are not uploads will never verify and
+// go to a reviewer at once.
+func (h *Handler) verifyLiveness(ctx context.Context, liv dispatch.DriverLiveness) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	result, err := h.checkLiveness(ctx, liv)
+	now := time.Now().UTC()
+	switch {
+	case err != nil && liv.Attempts < livenessMaxAttempts && !errors.Is(err, errInvalidUpload):
+		log.Printf("liveness %d (driver %s): attempt %d: %v", liv.ID, liv.DriverID, liv.Attempts, err)
+		return
+	case err != nil:
+		log.Printf("liveness %d (driver %s): giving up after attempt %d: %v", liv.ID, liv.DriverID, liv.Attempts, err)
+		liv.Status = dispatch.LivenessError
+		result = dispatch.LivenessResult{Provider: h.verifier.Name(), Reason: "verification failed; a reviewer will check the captures"}
+	case result.Passed():
+		liv.Status = dispatch.LivenessVerified
+		liv.Verified = true
+		liv.VerifiedAt = &now
+	default:
+		liv.Status = dispatch.LivenessFailed
+	}
+	result.CheckedAt = now
+	liv.Result = &result
+	saved, err := h.liveness.SaveLivenessResult(ctx, liv)
+	if err != nil {
+		log.Printf("liveness %d (driver %s): save result: %v", liv.ID, liv.DriverID, err)
+		return
+	}
+	if !saved {
+		// The driver sent new captures meanwhile; those get their own check.
+		return
+	}
+	h.reviewLivenessResult(ctx, liv)
+}
+
+// checkLiveness loads the captures and the license document and asks the
+// verifier about them.
+func (h *Handler) checkLiveness(ctx context.Context, liv dispatch.DriverLiveness) (dispatch.LivenessResult, error) {
+	var urls map[string]string
+	if err := json.Unmarshal(liv.Captures, &urls); err != nil {
+		return dispatch.LivenessResult{}, fmt.Errorf("captures: %w", err)
+	}
+	req := liveness.Request{
+		DriverID: liv.DriverID,
+		Sequence: liv.ChallengeSequence,
+		Captures: make(map[string]liveness.Image, len(urls)),
+	}
+	for dir, url := range urls {
+		img, err := h.livenessImage(ctx, url)
+		if err != nil {
+			return dispatch.LivenessResult{}, fmt.Errorf("capture %s: %w", dir, err)
+		}
+		req.Captures[dir] = img
+	}
+	app, ok, err := h.apps.LoadApplicationDetails(ctx, liv.DriverID)
+	if err != nil {
+		return dispatch.LivenessResult{}, err
+	}
+	if ok && app.License.DocumentURL != "" {
+		img, err := h.livenessImage(ctx, app.License.DocumentURL)
+		if err != nil {
+			return dispatch.LivenessResult{}, fmt.Errorf("license document: %w", err)
+		}
+		req.Reference = &img
+	}
+	return h.verifier.Verify(ctx, req)
+}
+
+func (h *Handler) livenessImage(ctx context.Context, contentURL string) (liveness.Image, error) {
+	up, body, err := h.readUpload(ctx, contentURL)
+	if err != nil {
+		return liveness.Image{}, err
+	}
+	return liveness.Image{UploadID: up.ID, ContentType: up.ContentType, SHA256: up.SHA256, Data: body}, nil
+}
+
+// reviewLivenessResult feeds a verification into the application: rules that
+// check liveness are evaluated again, and captures that did not verify send
+// the application to a reviewer even if the rules approved it. Decisions a
+// reviewer made stand.
+func (h *Handler) reviewLivenessResult(ctx context.Context, liv dispatch.DriverLiveness) {
+	app, ok, err := h.apps.LoadApplicationDetails(ctx, liv.DriverID)
+	if err != nil || !ok {
+		if err != nil {
+			log.Printf("liveness %d (driver %s): load application: %v", liv.ID, liv.DriverID, err)
+		}
+		return
+	}
+	var reviews []dispatch.ApplicationReview
+	if h.reviews != nil {
+		if reviews, err = h.reviews.ListApplicationReviews(ctx, liv.DriverID); err != nil {
+			log.Printf("liveness %d (driver %s): load reviews: %v", liv.ID, liv.DriverID, err)
+			return
+		}
+	}
+	waiting := app.Status == dispatch.ApplicationPending || app.Status == dispatch.ApplicationNeedsReview
+	if waiting && h.rules != nil && app.RulesVersion != nil && app.RulesReport != nil {
+		rule, found, err := h.rules.GetLocationRule(ctx, *app.RulesVersion)
+		if err == nil && found {
+			app, err = h.evaluateApplication(ctx, rule, app, len(reviews) > 0)
+		}
+		if err != nil {
+			log.Printf("liveness %d (driver %s): evaluate application: %v", liv.ID, liv.DriverID, err)
+			return
+		}
+	}
+	if liv.Verified || h.reviews == nil {
+		return
+	}
+	switch app.Status {
+	case dispatch.ApplicationRejected, dispatch.ApplicationChangesRequested:
+		return
+	case dispatch.ApplicationApproved:
+		if decidedByReviewer(app.Status, reviews) {
+			return
+		}
+	}
+	verdict := "unreadable"
+	switch {
+	case liv.Status != dispatch.LivenessFailed:
+	case !liv.Result.Live:
+		verdict = "rejected"
+	case !liv.Result.FaceMatch:
+		verdict = "mismatch"
+	}
+	if _, _, err := h.reviews.RecordApplicationReview(ctx, dispatch.ApplicationReview{
+		DriverID: liv.DriverID,
+		Decision: dispatch.ApplicationNeedsReview,
+		Reason:   "liveness " + liv.Status + ": " + liv.Result.Reason,
+		Findings: []dispatch.DocumentFinding{{Document: dispatch.SectionLiveness, Verdict: verdict, Note: liv.Result.Reason}},
+	}); err != nil {
+		log.Printf("liveness %d (driver %s): record review: %v", liv.ID, liv.DriverID, err)
+	}
+}
+
+// decidedByReviewer reports whether the latest review set the application to
+// status. Automatic reviews only ever send applications to needs_review, so a
+// recorded approval came from a person.
+func decidedByReviewer(status dispatch.DriverApplicationStatus, reviews []dispatch.ApplicationReview) bool {
+	if len(reviews) == 0 {
+		return false
+	}
+	return reviews[len(reviews)-1].Decision == status
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PIILookup finds identities by an encrypted value through its blind index.
+// Lookups find nothing while PII encryption is not configured.
+type PIILookup interface {
+	FindPassengersByGovernmentID(ctx context.Context, governmentID string) ([]string, error)
+	FindDriversByLicenseNumber(ctx context.Context, number string) ([]string, error)
+}
+
+// LookupIdentities finds the passengers holding a government ID or the drivers
+// holding a license number. The value travels in the body so it stays out of
+// URLs and access logs.
+func (h *Handler) LookupIdentities(w http.ResponseWriter, r *http.Request) {
+	if h.lookup == nil {
+		respondError(w, http.StatusServiceUnavailable, "lookups unavailable")
+		return
+	}
+	var body struct {
+		GovernmentID  string `json:"governmentId,omitempty"`
+		LicenseNumber string `json:"licenseNumber,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	govID, license := strings.TrimSpace(body.GovernmentID), strings.TrimSpace(body.LicenseNumber)
+	if (govID == "") == (license == "") {
+		respondError(w, http.StatusBadRequest, "send one of governmentId or licenseNumber")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if govID != "" {
+		ids, err := h.lookup.FindPassengersByGovernmentID(ctx, govID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to look up passengers")
+			return
+		}
+		if ids == nil {
+			ids = []string{}
+		}
+		respondJSON(w, http.StatusOK, map[string]any{"passengerIds": ids})
+		return
+	}
+	ids, err := h.lookup.FindDriversByLicenseNumber(ctx, license)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to look up drivers")
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"driverIds": ids})
+}
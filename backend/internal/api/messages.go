@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+const maxMessageLength = 1000
+
+// MessageStore persists in-ride chat between passenger and driver.
+type MessageStore interface {
+	InsertRideMessage(ctx context.Context, msg dispatch.RideMessage) (dispatch.RideMessage, error)
+	ListRideMessages(ctx context.Context, rideID string, limit, offset int) ([]dispatch.RideMessage, error)
+	CountRideMessages(ctx context.Context, rideID string) (int, error)
+	MarkRideMessagesRead(ctx context.Context, rideID, readerID string, upTo int64) (int64, error)
+}
+
+// chatRide loads the ride and verifies the caller is a participant.
+func (h *Handler) chatRide(w http.ResponseWriter, r *http.Request) (dispatch.Ride, dispatch.Identity, bool) {
+	if h.messages == nil {
+		respondError(w, http.StatusServiceUnavailable, "chat unavailable")
+		return dispatch.Ride{}, dispatch.Identity{}, false
+	}
+	enforce := h.auth.store != nil
+	rideID := chi.URLParam(r, "rideID")
+	ride, ok := h.store.GetRide(r.Context(), rideID)
+	if !ok {
+		respondError(w, http.StatusNotFound, "ride not found")
+		return dispatch.Ride{}, dispatch.Identity{}, false
+	}
+	if !canAccessRide(r, enforce, ride) {
+		respondError(w, http.StatusForbidden, "forbidden")
+		return dispatch.Ride{}, dispatch.Identity{}, false
+	}
+	id, _ := identityFromContext(r.Context())
+	return ride, id, true
+}
+
+// SendRideMessage posts a chat message from the passenger or driver of an accepted ride.
+func (h *Handler) SendRideMessage(w http.ResponseWriter, r *http.Request) {
+	ride, id, ok := h.chatRide(w, r)
+	if !ok {
+		return
+	}
+	if ride.Status.IsTerminal() {
+		respondError(w, http.StatusConflict, "chat closed")
+		return
+	}
+	if ride.Status != dispatch.RideAccepted && ride.Status != dispatch.RideEnRoute {
+		respondError(w, http.StatusConflict, "chat opens once the ride is accepted")
+		return
+	}
+	var body struct {
+		Body       string `json:"body"`
+		QuickReply string `json:"quickReply,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	msg := dispatch.RideMessage{
+		RideID:     ride.ID,
+		SenderID:   id.ID,
+		SenderRole: id.Role,
+		Body:       strings.TrimSpace(body.Body),
+	}
+	if body.QuickReply != "" {
+		qr, found := dispatch.LookupQuickReply(id.Role, body.QuickReply)
+		if !found {
+			respondError(w, http.StatusBadRequest, "unknown quick reply")
+			return
+		}
+		msg.Body = qr.Body
+		msg.QuickReply = qr.Key
+	}
+	if msg.Body == "" {
+		respondError(w, http.StatusBadRequest, "body or quickReply required")
+		return
+	}
+	if len(msg.Body) > maxMessageLength {
+		respondError(w, http.StatusBadRequest, "message too long")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	saved, err := h.messages.InsertRideMessage(ctx, msg)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to save message")
+		return
+	}
+	h.hub.PublishRideMessage(saved)
+	respondJSON(w, http.StatusCreated, saved)
+}
+
+// ListRideMessages returns the chat thread for a ride.
+func (h *Handler) ListRideMessages(w http.ResponseWriter, r *http.Request) {
+	ride, _, ok := h.chatRide(w, r)
+	if !ok {
+		return
+	}
+	limit := parseLimit(r.URL.Query().Get("limit"), 100)
+	offset := parseOffset(r.URL.Query().Get("offset"))
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	msgs, err := h.messages.ListRideMessages(ctx, ride.ID, limit, offset)
+	total, _ := h.messages.CountRideMessages(ctx, ride.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to fetch messages")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"data":   msgs,
+		"limit":  limit,
+		"offset": offset,
+		"total":  total,
+		"closed": ride.Status.IsTerminal(),
+	})
+}
+
+// MarkRideMessagesRead records read receipts for messages from the other party.
+func (h *Handler) MarkRideMessagesRead(w http.ResponseWriter, r *http.Request) {
+	ride, id, ok := h.chatRide(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		UpTo int64 `json:"upTo,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	updated, err := h.messages.MarkRideMessagesRead(ctx, ride.ID, id.ID, body.UpTo)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to mark messages read")
+		return
+	}
+	if updated > 0 {
+		h.hub.PublishMessagesRead(ride.ID, id.ID, body.UpTo)
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"updated": updated})
+}
+
+// ListQuickReplies returns the canned replies available to the caller's role.
+func (h *Handler) ListQuickReplies(w http.ResponseWriter, r *http.Request) {
+	if id, ok := identityFromContext(r.Context()); ok {
+		if replies, found := dispatch.QuickReplies[id.Role]; found {
+			respondJSON(w, http.StatusOK, map[string]any{"data": replies})
+			return
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"data": dispatch.QuickReplies})
+}
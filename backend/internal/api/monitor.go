@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+// monitorTrip runs route deviation and prolonged-stop checks after a heartbeat
+// from a driver on a ride in progress.
+func (h *Handler) monitorTrip(ctx context.Context, state dispatch.DriverState) {
+	if h.monitor == nil || state.RideID == "" {
+		return
+	}
+	ride, ok := h.store.GetRide(ctx, state.RideID)
+	if !ok {
+		return
+	}
+	for _, alert := range h.monitor.Evaluate(ride, h.store.RecentTrack(ride.ID, 0)) {
+		h.raiseTripAlert(ride, alert)
+	}
+}
+
+// raiseTripAlert records the alert, queues it for admins and prompts the passenger.
+func (h *Handler) raiseTripAlert(ride dispatch.Ride, alert dispatch.TripAlert) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var incidentID int64
+	if h.safety != nil {
+		inc, err := h.safety.CreateSafetyIncident(ctx, dispatch.SafetyIncident{
+			RideID:   ride.ID,
+			Kind:     alert.Kind,
+			Status:   dispatch.IncidentOpen,
+			Note:     describeTripAlert(alert),
+			Snapshot: h.safetySnapshot(ride),
+		})
+		if err == nil {
+			incidentID = inc.ID
+			h.hub.PublishSafetyIncident(inc)
+		}
+	}
+	if incidentID == 0 {
+		h.hub.PublishAdmin(map[string]any{
+			"type":  "trip_alert",
+			"alert": alert,
+		})
+	}
+	h.logRideEvent(ctx, ride, alert.Kind, map[string]any{
+		"incidentId":  incidentID,
+		"location":    alert.Location,
+		"deviationKm": alert.DeviationKM,
+		"stoppedSec":  alert.StoppedFor.Seconds(),
+	})
+	h.hub.PublishSafetyCheck(alert, incidentID)
+}
+
+func describeTripAlert(alert dispatch.TripAlert) string {
+	switch alert.Kind {
+	case dispatch.AlertRouteDeviation:
+		return fmt.Sprintf("driver %.1f km outside expected corridor", alert.DeviationKM)
+	case dispatch.AlertProlongedStop:
+		return fmt.Sprintf("driver stopped for %s", alert.StoppedFor.Round(time.Second))
+	}
+	return alert.Kind
+}
+
+// RespondSafetyCheck records the passenger's answer to an "are you OK?" prompt;
+// a negative answer escalates the linked incident.
+func (h *Handler) RespondSafetyCheck(w http.ResponseWriter, r *http.Request) {
+	enforce := h.auth.store != nil
+	ride, ok := h.store.GetRide(r.Context(), chi.URLParam(r, "rideID"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "ride not found")
+		return
+	}
+	if id, _ := identityFromContext(r.Context()); enforce && id.ID != ride.PassengerID {
+		respondError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	var body struct {
+		OK         bool  `json:"ok"`
+		IncidentID int64 `json:"incidentId,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	h.logRideEvent(r.Context(), ride, "safety_check_response", map[string]any{
+		"ok":         body.OK,
+		"incidentId": body.IncidentID,
+	})
+	h.hub.PublishAdmin(map[string]any{
+		"type":       "safety_check_response",
+		"rideId":     ride.ID,
+		"ok":         body.OK,
+		"incidentId": body.IncidentID,
+	})
+	if !body.OK && body.IncidentID > 0 && h.safety != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		inc, found, err := h.safety.GetSafetyIncident(ctx, body.IncidentID)
+		if err == nil && found && inc.RideID == ride.ID && inc.Status.CanTransition(dispatch.IncidentEscalated) {
+			id, _ := identityFromContext(r.Context())
+			if updated, ok, err := h.safety.TransitionSafetyIncident(ctx, inc.ID, inc.Status, dispatch.IncidentEscalated, id.ID, "passenger reported not OK"); err == nil && ok {
+				h.hub.PublishSafetyIncident(updated)
+			}
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"ok": body.OK})
+}
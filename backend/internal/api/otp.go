@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"turbodriver/internal/auth"
+	"turbodriver/internal/dispatch"
+)
+
+type otpPayload struct {
+	Phone string `json:"phone"`
+	Role  string `json:"role"`
+	Code  string `json:"code,omitempty"`
+}
+
+// decodeOTPPayload validates the phone and restricts OTP login to riders and drivers;
+// admin identities are only issued by other admins.
+func decodeOTPPayload(w http.ResponseWriter, r *http.Request) (otpPayload, bool) {
+	var payload otpPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return otpPayload{}, false
+	}
+	phone, err := auth.NormalizePhone(payload.Phone)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return otpPayload{}, false
+	}
+	payload.Phone = phone
+	role := dispatch.IdentityRole(payload.Role)
+	if role != dispatch.RolePassenger && role != dispatch.RoleDriver {
+		respondError(w, http.StatusBadRequest, "role must be passenger or driver")
+		return otpPayload{}, false
+	}
+	return payload, true
+}
+
+// StartOTP texts a one-time login code to the phone.
+func (h *Handler) StartOTP(w http.ResponseWriter, r *http.Request) {
+	if h.otp == nil || (h.auth.store == nil && h.auth.sessions == nil) {
+		respondError(w, http.StatusServiceUnavailable, "auth not configured")
+		return
+	}
+	payload, ok := decodeOTPPayload(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	wait, err := h.otp.Start(ctx, payload.Phone, dispatch.IdentityRole(payload.Role))
+	if errors.Is(err, auth.ErrOTPCooldown) || errors.Is(err, auth.ErrOTPLocked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusBadGateway, "failed to send code")
+		return
+	}
+	respondJSON(w, http.StatusAccepted, map[string]string{"status": "sent"})
+}
+
+// VerifyOTP exchanges a valid code for credentials. Each phone maps to one
+// identity per role, created on first successful verification.
+func (h *Handler) VerifyOTP(w http.ResponseWriter, r *http.Request) {
+	if h.otp == nil || (h.auth.store == nil && h.auth.sessions == nil) {
+		respondError(w, http.StatusServiceUnavailable, "auth not configured")
+		return
+	}
+	payload, ok := decodeOTPPayload(w, r)
+	if !ok {
+		return
+	}
+	role := dispatch.IdentityRole(payload.Role)
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	switch err := h.otp.Verify(ctx, payload.Phone, role, payload.Code); {
+	case errors.Is(err, auth.ErrOTPInvalid):
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	case errors.Is(err, auth.ErrOTPLocked):
+		respondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, "failed to verify code")
+		return
+	}
+
+	phones := h.otp.Store()
+	identityID, found, err := phones.PhoneIdentity(ctx, payload.Phone, role)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to resolve identity")
+		return
+	}
+	identity := dispatch.Identity{ID: identityID, Role: role}
+	if !found {
+		identity, err = auth.NewIdentity(role)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// The identity row must exist before the phone link references it.
+		if h.auth.db != nil {
+			if _, err := h.auth.db.Save(ctx, identity, h.auth.ttl); err != nil {
+				respondError(w, http.StatusInternalServerError, "failed to create identity")
+				return
+			}
+		}
+		if identity.ID, err = phones.LinkPhoneIdentity(ctx, payload.Phone, role, identity.ID); err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to link phone")
+			return
+		}
+	}
+	creds, err := h.issueCredentials(ctx, identity, h.auth.ttl)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to issue credentials")
+		return
+	}
+	respondJSON(w, http.StatusOK, creds)
+}
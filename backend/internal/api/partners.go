@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/auth"
+)
+
+type apiKeyPayload struct {
+	Name          string            `json:"name"`
+	Scopes        []auth.Permission `json:"scopes"`
+	RatePerMinute int               `json:"ratePerMinute"`
+}
+
+// CreatePartnerKey issues an API key for a partner org. The plaintext key is
+// only ever returned here.
+func (h *Handler) CreatePartnerKey(w http.ResponseWriter, r *http.Request) {
+	if h.auth.keys == nil {
+		respondError(w, http.StatusServiceUnavailable, "api keys not configured")
+		return
+	}
+	var payload apiKeyPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	key, plaintext, err := h.auth.keys.Create(ctx, chi.URLParam(r, "orgID"), payload.Name, payload.Scopes, payload.RatePerMinute)
+	if errors.Is(err, auth.ErrAPIKeySpec) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to create key")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, http.StatusCreated, map[string]any{
+		"key":    key,
+		"apiKey": plaintext,
+	})
+}
+
+// ListPartnerKeys returns an org's keys with their usage counters.
+func (h *Handler) ListPartnerKeys(w http.ResponseWriter, r *http.Request) {
+	if h.auth.keys == nil {
+		respondError(w, http.StatusServiceUnavailable, "api keys not configured")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	keys, err := h.auth.keys.List(ctx, chi.URLParam(r, "orgID"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to list keys")
+		return
+	}
+	if keys == nil {
+		keys = []auth.APIKey{}
+	}
+	respondJSON(w, http.StatusOK, keys)
+}
+
+// RevokePartnerKey disables a key immediately.
+func (h *Handler) RevokePartnerKey(w http.ResponseWriter, r *http.Request) {
+	if h.auth.keys == nil {
+		respondError(w, http.StatusServiceUnavailable, "api keys not configured")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	revoked, err := h.auth.keys.Revoke(ctx, chi.URLParam(r, "keyID"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to revoke key")
+		return
+	}
+	if !revoked {
+		respondError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]bool{"revoked": true})
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+// LocationSettingsStore persists per-location feature switches.
+type LocationSettingsStore interface {
+	GetLocationSettings(ctx context.Context, locationCode string) (dispatch.LocationSettings, bool, error)
+	UpsertLocationSettings(ctx context.Context, settings dispatch.LocationSettings) (dispatch.LocationSettings, error)
+}
+
+// rideForViewer hides the pickup PIN from everyone except the ride's passenger.
+func rideForViewer(r *http.Request, enforce bool, ride dispatch.Ride) dispatch.Ride {
+	if !enforce {
+		return ride
+	}
+	id, ok := identityFromContext(r.Context())
+	if ok && id.Role == dispatch.RolePassenger && id.ID == ride.PassengerID {
+		return ride
+	}
+	// The booking partner relays the PIN to its guest.
+	if ok && id.Role == dispatch.RolePartner && ride.BookedBy != "" && id.ID == ride.BookedBy {
+		return ride
+	}
+	return ride.WithoutPIN()
+}
+
+// pickupPINRequired resolves whether the ride's location enforces PIN verification,
+// falling back to PICKUP_PIN_REQUIRED when the location has no explicit setting.
+func (h *Handler) pickupPINRequired(ctx context.Context, ride dispatch.Ride) bool {
+	if h.locations == nil || ride.LocationCode == "" {
+		return h.pinDefault
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	settings, ok, err := h.locations.GetLocationSettings(ctx, ride.LocationCode)
+	if err != nil || !ok {
+		return h.pinDefault
+	}
+	return settings.PickupPINRequired
+}
+
+type startRidePayload struct {
+	DriverID string `json:"driverId"`
+	PIN      string `json:"pin,omitempty"`
+}
+
+// StartRide begins the trip after pickup; the driver presents the passenger's PIN
+// when the ride's location requires it.
+func (h *Handler) StartRide(w http.ResponseWriter, r *http.Request) {
+	enforce := h.auth.store != nil
+	rideID := chi.URLParam(r, "rideID")
+	var payload startRidePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if !matchIdentity(w, r, enforce, payload.DriverID) {
+		return
+	}
+	current, ok := h.store.GetRide(r.Context(), rideID)
+	if !ok {
+		respondError(w, http.StatusNotFound, "ride not found")
+		return
+	}
+	requirePIN := h.pickupPINRequired(r.Context(), current)
+	ride, err := h.store.StartRide(r.Context(), rideID, payload.DriverID, payload.PIN, requirePIN)
+	switch {
+	case errors.Is(err, dispatch.ErrPINMismatch):
+		h.logRideEvent(r.Context(), current, "pickup_pin_failed", map[string]any{
+			"driverId": payload.DriverID,
+		})
+		respondError(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, dispatch.ErrPINReissued):
+		respondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	case errors.Is(err, dispatch.ErrPINLocked):
+		h.logRideEvent(r.Context(), current, "pickup_pin_locked", map[string]any{
+			"driverId": payload.DriverID,
+		})
+		respondError(w, http.StatusLocked, err.Error())
+		return
+	case err != nil:
+		h.respondRideError(w, r, err)
+		return
+	}
+	h.respondRide(w, r, http.StatusOK, ride)
+}
+
+func (h *Handler) GetLocationSettings(w http.ResponseWriter, r *http.Request) {
+	if h.locations == nil {
+		respondError(w, http.StatusServiceUnavailable, "location settings unavailable")
+		return
+	}
+	code := chi.URLParam(r, "locationCode")
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	settings, ok, err := h.locations.GetLocationSettings(ctx, code)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	if !ok {
+		settings = dispatch.LocationSettings{LocationCode: code, PickupPINRequired: h.pinDefault}
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
+
+func (h *Handler) UpdateLocationSettings(w http.ResponseWriter, r *http.Request) {
+	if h.locations == nil {
+		respondError(w, http.StatusServiceUnavailable, "location settings unavailable")
+		return
+	}
+	var body struct {
+		PickupPINRequired bool `json:"pickupPinRequired"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	admin, _ := identityFromContext(r.Context())
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	saved, err := h.locations.UpsertLocationSettings(ctx, dispatch.LocationSettings{
+		LocationCode:      chi.URLParam(r, "locationCode"),
+		PickupPINRequired: body.PickupPINRequired,
+		UpdatedBy:         admin.ID,
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to save settings")
+		return
+	}
+	respondJSON(w, http.StatusOK, saved)
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+// PrivacyStore serves data subject requests: exporting and erasing what is
+// held about an identity, with every step kept in a compliance audit log.
+type PrivacyStore interface {
+	ExportSubject(ctx context.Context, subject dispatch.Identity) (dispatch.DataExport, error)
+	EraseSubject(ctx context.Context, subject dispatch.Identity, requestID, actorID string) (string, []dispatch.ErasureStep, error)
+	RecordComplianceEvent(ctx context.Context, ev dispatch.ComplianceEvent) error
+}
+
+// privacySubject returns the caller, who may only export or erase themselves.
+func (h *Handler) privacySubject(w http.ResponseWriter, r *http.Request) (dispatch.Identity, bool) {
+	if h.privacy == nil {
+		respondError(w, http.StatusServiceUnavailable, "privacy requests unavailable")
+		return dispatch.Identity{}, false
+	}
+	id, ok := identityFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return dispatch.Identity{}, false
+	}
+	return id, true
+}
+
+// ExportMyData returns a ZIP of everything held about the caller: identity,
+// profile or driver application and its reviews, rides, ratings, chat
+// messages, track points and the list of uploaded files.
+func (h *Handler) ExportMyData(w http.ResponseWriter, r *http.Request) {
+	subject, ok := h.privacySubject(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	export, err := h.privacy.ExportSubject(ctx, subject)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to export data")
+		return
+	}
+	// Tracks of rides still in progress only live in memory.
+	for _, ride := range export.Rides {
+		for _, c := range h.store.RecentTrack(ride.ID, 0) {
+			export.TrackPoints = append(export.TrackPoints, dispatch.TrackPoint{RideID: ride.ID, Source: "ride", Coordinate: c})
+		}
+	}
+	requestID, err := newRequestID()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to export data")
+		return
+	}
+	if err := h.privacy.RecordComplianceEvent(ctx, dispatch.ComplianceEvent{
+		RequestID: requestID, SubjectID: subject.ID, SubjectRole: subject.Role,
+		Request: dispatch.ComplianceExport, Step: "exported", ActorID: subject.ID,
+		Detail: map[string]any{
+			"rides":       len(export.Rides),
+			"ratings":     len(export.Ratings),
+			"messages":    len(export.Messages),
+			"trackPoints": len(export.TrackPoints),
+			"uploads":     len(export.Uploads),
+		},
+	}); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to record export")
+		return
+	}
+
+	var profile any
+	if export.Profile != nil {
+		profile = export.Profile
+	} else if export.Application != nil {
+		profile = export.Application
+	}
+	files := []struct {
+		name string
+		body any
+	}{
+		{"identity.json", export.Identity},
+		{"profile.json", profile},
+		{"application_reviews.json", export.Reviews},
+		{"rides.json", export.Rides},
+		{"ratings.json", export.Ratings},
+		{"messages.json", export.Messages},
+		{"track_points.json", export.TrackPoints},
+		{"uploads.json", export.Uploads},
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="turbodriver-export-%s.zip"`, time.Now().UTC().Format("20060102")))
+	w.Header().Set("Cache-Control", "no-store")
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			log.Printf("privacy export %s: %v", requestID, err)
+			return
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.body); err != nil {
+			log.Printf("privacy export %s: %v", requestID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("privacy export %s: %v", requestID, err)
+	}
+}
+
+// DeleteMyAccount erases the caller: tokens are revoked, personal data and
+// documents deleted and the ride history kept only under a pseudonym. Callers
+// on an unfinished ride must finish or cancel it first.
+func (h *Handler) DeleteMyAccount(w http.ResponseWriter, r *http.Request) {
+	subject, ok := h.privacySubject(w, r)
+	if !ok {
+		return
+	}
+	if ride, active := h.store.ActiveRideFor(subject.ID); active {
+		respondJSON(w, http.StatusConflict, map[string]string{
+			"error":  "finish or cancel the active ride first",
+			"rideId": ride.ID,
+		})
+		return
+	}
+	requestID, err := newRequestID()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to start erasure")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	record := func(step string, detail map[string]any) error {
+		return h.privacy.RecordComplianceEvent(ctx, dispatch.ComplianceEvent{
+			RequestID: requestID, SubjectID: subject.ID, SubjectRole: subject.Role,
+			Request: dispatch.ComplianceErasure, Step: step, Detail: detail, ActorID: subject.ID,
+		})
+	}
+	if err := record("requested", nil); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to start erasure")
+		return
+	}
+	pseudonym, steps, err := h.privacy.EraseSubject(ctx, subject, requestID, subject.ID)
+	if pseudonym == "" {
+		// Nothing was erased and the caller is still signed in to retry.
+		log.Printf("privacy erasure %s: %v", requestID, err)
+		record("failed", map[string]any{"step": "erase"})
+		respondError(w, http.StatusInternalServerError, "failed to erase account")
+		return
+	}
+	h.store.ForgetIdentity(subject.ID, pseudonym)
+	var warnings []string
+	if err != nil {
+		// The data is erased; leftover files are in the audit log for follow-up.
+		log.Printf("privacy erasure %s: %v", requestID, err)
+		warnings = append(warnings, err.Error())
+	}
+	// Deleting the identity took its stored tokens with it; this drops cached
+	// and signed sessions on every replica.
+	if revoked, err := h.revokeIdentity(ctx, subject.ID); err != nil {
+		log.Printf("privacy erasure %s: revoke tokens: %v", requestID, err)
+		warnings = append(warnings, "tokens: "+err.Error())
+	} else {
+		record("tokens_revoked", map[string]any{"tokens": revoked})
+	}
+	if len(warnings) > 0 {
+		record("completed", map[string]any{"warning": strings.Join(warnings, "; ")})
+	} else {
+		record("completed", nil)
+	}
+
+	// Never replay this response: the identity it names no longer exists.
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, http.StatusOK, map[string]any{
+		"erased":    true,
+		"requestId": requestID,
+		"steps":     steps,
+	})
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "dsr_" + hex.EncodeToString(b), nil
+}
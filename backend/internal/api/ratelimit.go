@@ -0,0 +1,260 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RatePolicy is a token bucket: Burst requests at once, refilled at Rate per second.
+type RatePolicy struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+// RateLimitBackend stores token buckets. Allow consumes one token for key and,
+// when none is left, reports how long until the next one is available.
+type RateLimitBackend interface {
+	Allow(ctx context.Context, key string, policy RatePolicy) (bool, time.Duration, error)
+}
+
+// Route groups with their default policies; override with RATE_LIMIT_<NAME>="count/period:burst",
+// e.g. RATE_LIMIT_AUTH="10/1m:5".
+var defaultRatePolicies = map[string]RatePolicy{
+	"auth":         {Name: "auth", Rate: 10.0 / 60, Burst: 5},
+	"ride_request": {Name: "ride_request", Rate: 6.0 / 60, Burst: 3},
+	"heartbeat":    {Name: "heartbeat", Rate: 1, Burst: 5},
+	"api":          {Name: "api", Rate: 10, Burst: 40},
+}
+
+type rateLimiter struct {
+	backend  RateLimitBackend
+	policies map[string]RatePolicy
+	disabled bool
+
+	rejected map[string]*int64
+	errors   int64
+}
+
+func newRateLimiter(backend RateLimitBackend) *rateLimiter {
+	if backend == nil {
+		backend = NewMemoryRateLimit()
+	}
+	rl := &rateLimiter{
+		backend:  backend,
+		policies: make(map[string]RatePolicy, len(defaultRatePolicies)),
+		disabled: os.Getenv("RATE_LIMIT_DISABLED") == "true",
+		rejected: make(map[string]*int64),
+	}
+	for name, policy := range defaultRatePolicies {
+		if spec := os.Getenv("RATE_LIMIT_" + strings.ToUpper(name)); spec != "" {
+			if parsed, err := parseRatePolicy(name, spec); err == nil {
+				policy = parsed
+			} else {
+				log.Printf("ratelimit: ignoring %s: %v", name, err)
+			}
+		}
+		rl.policies[name] = policy
+		rl.rejected[name] = new(int64)
+	}
+	rl.rejected["partner"] = new(int64)
+	return rl
+}
+
+// parseRatePolicy reads "count/period:burst"; burst defaults to count.
+func parseRatePolicy(name, spec string) (RatePolicy, error) {
+	ratePart, burstPart, hasBurst := strings.Cut(spec, ":")
+	countStr, periodStr, ok := strings.Cut(ratePart, "/")
+	if !ok {
+		return RatePolicy{}, fmt.Errorf("want count/period[:burst], got %q", spec)
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count <= 0 {
+		return RatePolicy{}, fmt.Errorf("invalid count %q", countStr)
+	}
+	period, err := time.ParseDuration(periodStr)
+	if err != nil || period <= 0 {
+		return RatePolicy{}, fmt.Errorf("invalid period %q", periodStr)
+	}
+	burst := count
+	if hasBurst {
+		if burst, err = strconv.Atoi(burstPart); err != nil || burst <= 0 {
+			return RatePolicy{}, fmt.Errorf("invalid burst %q", burstPart)
+		}
+	}
+	return RatePolicy{Name: name, Rate: float64(count) / period.Seconds(), Burst: burst}, nil
+}
+
+// limit applies the named policy, keyed by the caller's identity when
+// authenticated and by client IP otherwise. Partner API keys are limited once per
+// request, at the "api" group, by their own per-minute allowance. Backend errors
+// fail open.
+func (rl *rateLimiter) limit(name string) func(http.Handler) http.Handler {
+	policy, ok := rl.policies[name]
+	if !ok {
+		panic("unknown rate limit policy " + name)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rl.disabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key, counter, applied := "ip:"+clientIP(r), name, policy
+			if id, ok := identityFromContext(r.Context()); ok && id.ID != "" {
+				key = "id:" + id.ID
+			}
+			if apiKey, ok := apiKeyFromContext(r.Context()); ok {
+				if name != "api" {
+					next.ServeHTTP(w, r)
+					return
+				}
+				key, counter = "key:"+apiKey.ID, "partner"
+				if apiKey.RatePerMinute > 0 {
+					applied = RatePolicy{Name: "partner", Rate: float64(apiKey.RatePerMinute) / 60, Burst: apiKey.RatePerMinute}
+				}
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), 250*time.Millisecond)
+			allowed, wait, err := rl.backend.Allow(ctx, applied.Name+":"+key, applied)
+			cancel()
+			if err != nil {
+				atomic.AddInt64(&rl.errors, 1)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !allowed {
+				atomic.AddInt64(rl.rejected[counter], 1)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+				respondError(w, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeMetrics emits rejection counters per policy.
+func (rl *rateLimiter) writeMetrics(w http.ResponseWriter) {
+	names := make([]string, 0, len(rl.rejected))
+	for name := range rl.rejected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "turbodriver_rate_limited_total{policy=\"%s\"} %d\n", name, atomic.LoadInt64(rl.rejected[name]))
+	}
+	fmt.Fprintf(w, "turbodriver_rate_limit_errors_total %d\n", atomic.LoadInt64(&rl.errors))
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// MemoryRateLimit keeps buckets in process; suitable for a single replica.
+type MemoryRateLimit struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewMemoryRateLimit() *MemoryRateLimit {
+	return &MemoryRateLimit{buckets: make(map[string]*tokenBucket)}
+}
+
+func (m *MemoryRateLimit) Allow(_ context.Context, key string, policy RatePolicy) (bool, time.Duration, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.calls%10000 == 0 {
+		m.pruneLocked(now)
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(policy.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(policy.Burst), b.tokens+now.Sub(b.last).Seconds()*policy.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / policy.Rate * float64(time.Second))
+	return false, wait, nil
+}
+
+// pruneLocked drops buckets idle long enough to have refilled completely.
+func (m *MemoryRateLimit) pruneLocked(now time.Time) {
+	for key, b := range m.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// RedisRateLimit shares buckets across replicas. The refill-and-take runs as a
+// Lua script so concurrent replicas cannot double-spend a token.
+type RedisRateLimit struct {
+	client *redis.Client
+}
+
+func NewRedisRateLimit(client *redis.Client) *RedisRateLimit {
+	return &RedisRateLimit{client: client}
+}
+
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local data = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(data[1]) or burst
+local ts = tonumber(data[2]) or now
+tokens = math.min(burst, tokens + (now - ts) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return {allowed, wait}
+`)
+
+func (r *RedisRateLimit) Allow(ctx context.Context, key string, policy RatePolicy) (bool, time.Duration, error) {
+	perMS := policy.Rate / 1000
+	res, err := tokenBucketScript.Run(ctx, r.client, []string{"turbodriver:ratelimit:" + key}, perMS, policy.Burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit reply %v", res)
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
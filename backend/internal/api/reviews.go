@@ -0,0 +1,390 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/auth"
+	"turbodriver/internal/dispatch"
+)
+
+// ReviewStore keeps reviewer decisions on driver applications.
+type ReviewStore interface {
+	RecordApplicationReview(ctx context.Context, review dispatch.ApplicationReview) (dispatch.ApplicationReview, bool, error)
+	ListApplicationReviews(ctx context.Context, driverID string) ([]dispatch.ApplicationReview, error)
+	ListApplicationQueue(ctx context.Context, statuses []dispatch.DriverApplicationStatus, minAge time.Duration, limit, offset int) ([]dispatch.ApplicationQueueItem, int, error)
+}
+
+var findingVerdicts = map[string]bool{
+	"accepted": true, "rejected": true, "unreadable": true, "expired": true, "mismatch": true,
+}
+
+var applicationSectionNames = map[string]bool{
+	dispatch.SectionLicense: true, dispatch.SectionVehicle: true, dispatch.SectionPhotos: true, dispatch.SectionLiveness: true,
+}
+
+type reviewPayload struct {
+	Status   string                     `json:"status"`
+	Reason   string                     `json:"reason,omitempty"`
+	Findings []dispatch.DocumentFinding `json:"findings,omitempty"`
+	Sections []string                   `json:"sections,omitempty"`
+}
+
+// review validates the payload into a review. Rejections and change requests
+// need a reason; change requests name the sections to resubmit.
+func (p reviewPayload) review() (dispatch.ApplicationReview, error) {
+	rv := dispatch.ApplicationReview{
+		Decision: dispatch.DriverApplicationStatus(strings.ToLower(p.Status)),
+		Reason:   strings.TrimSpace(p.Reason),
+		Findings: []dispatch.DocumentFinding{},
+	}
+	switch rv.Decision {
+	case dispatch.ApplicationPending, dispatch.ApplicationApproved, dispatch.ApplicationNeedsReview:
+	case dispatch.ApplicationRejected, dispatch.ApplicationChangesRequested:
+		if rv.Reason == "" {
+			return rv, fmt.Errorf("reason is required to set %s", rv.Decision)
+		}
+	default:
+		return rv, fmt.Errorf("invalid status")
+	}
+	for i, f := range p.Findings {
+		f.Document = strings.TrimSpace(f.Document)
+		f.Verdict = strings.ToLower(f.Verdict)
+		if f.Document == "" || !findingVerdicts[f.Verdict] {
+			return rv, fmt.Errorf("findings[%d]: document and verdict (accepted, rejected, unreadable, expired or mismatch) are required", i)
+		}
+		rv.Findings = append(rv.Findings, f)
+	}
+	seen := map[string]bool{}
+	for _, section := range p.Sections {
+		section = strings.ToLower(section)
+		if !applicationSectionNames[section] {
+			return rv, fmt.Errorf("unknown section %q", section)
+		}
+		if !seen[section] {
+			seen[section] = true
+			rv.Sections = append(rv.Sections, section)
+		}
+	}
+	switch {
+	case rv.Decision == dispatch.ApplicationChangesRequested && len(rv.Sections) == 0:
+		return rv, fmt.Errorf("sections are required to request changes")
+	case rv.Decision != dispatch.ApplicationChangesRequested && len(rv.Sections) > 0:
+		return rv, fmt.Errorf("sections only apply to %s", dispatch.ApplicationChangesRequested)
+	}
+	return rv, nil
+}
+
+// UpdateApplicationStatus records a reviewer's decision, with its reason and
+// document findings, and tells the driver.
+func (h *Handler) UpdateApplicationStatus(w http.ResponseWriter, r *http.Request) {
+	if h.apps == nil || h.reviews == nil {
+		respondError(w, http.StatusServiceUnavailable, "application store unavailable")
+		return
+	}
+	var payload reviewPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	review, err := payload.review()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	reviewer, _ := identityFromContext(r.Context())
+	review.DriverID = chi.URLParam(r, "driverID")
+	review.ReviewerID = reviewer.ID
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	review, found, err := h.reviews.RecordApplicationReview(ctx, review)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to update status")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "application not found")
+		return
+	}
+	h.notifyApplicationReview(ctx, review)
+	app, ok, err := h.apps.LoadApplicationDetails(ctx, review.DriverID)
+	if err != nil || !ok {
+		respondJSON(w, http.StatusOK, map[string]string{"status": string(review.Decision)})
+		return
+	}
+	respondJSON(w, http.StatusOK, app)
+}
+
+// notifyApplicationReview tells the driver about decisions they must act on or
+// wait for no longer. Delivery is best effort; the review is already stored.
+func (h *Handler) notifyApplicationReview(ctx context.Context, review dispatch.ApplicationReview) {
+	if h.notifier == nil {
+		return
+	}
+	var text string
+	switch review.Decision {
+	case dispatch.ApplicationApproved:
+		text = "Your driver application was approved. You can go online now."
+	case dispatch.ApplicationRejected:
+		text = "Your driver application was rejected: " + review.Reason
+	case dispatch.ApplicationChangesRequested:
+		text = fmt.Sprintf("Please update your driver application (%s): %s", strings.Join(review.Sections, ", "), review.Reason)
+	default:
+		return
+	}
+	if err := h.notifier.Notify(ctx, dispatch.Notification{
+		Key:     "application_review:" + strconv.FormatInt(review.ID, 10),
+		UserID:  review.DriverID,
+		Message: text,
+	}); err != nil {
+		log.Printf("application review %d: notify %s: %v", review.ID, review.DriverID, err)
+	}
+}
+
+// ListApplicationReviews returns the review history of a driver's application.
+// Drivers see decisions and findings but not who reviewed.
+func (h *Handler) ListApplicationReviews(w http.ResponseWriter, r *http.Request) {
+	if h.reviews == nil {
+		respondError(w, http.StatusServiceUnavailable, "application store unavailable")
+		return
+	}
+	enforce := h.auth.store != nil
+	driverID := chi.URLParam(r, "driverID")
+	if !matchIdentityOr(w, r, enforce, driverID, auth.PermApplicationsReadAny) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	reviews, err := h.reviews.ListApplicationReviews(ctx, driverID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load reviews")
+		return
+	}
+	if enforce && !hasPermission(r, auth.PermApplicationsReadAny) {
+		for i := range reviews {
+			reviews[i].ReviewerID = ""
+		}
+	}
+	if reviews == nil {
+		reviews = []dispatch.ApplicationReview{}
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"data": reviews})
+}
+
+// ResubmitApplicationSections lets a driver send again only the sections a
+// reviewer asked to change. All of them must be sent, and the application goes
+// back to review.
+func (h *Handler) ResubmitApplicationSections(w http.ResponseWriter, r *http.Request) {
+	if h.apps == nil || h.reviews == nil {
+		respondError(w, http.StatusServiceUnavailable, "application store unavailable")
+		return
+	}
+	enforce := h.auth.store != nil
+	driverID := chi.URLParam(r, "driverID")
+	if !matchIdentity(w, r, enforce, driverID) {
+		return
+	}
+	var payload applicationSections
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if err := validateSections(payload); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	app, ok, err := h.apps.LoadApplicationDetails(ctx, driverID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load application")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "application not found")
+		return
+	}
+	if app.Status != dispatch.ApplicationChangesRequested {
+		respondError(w, http.StatusConflict, "no changes were requested")
+		return
+	}
+	reviews, err := h.reviews.ListApplicationReviews(ctx, driverID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load reviews")
+		return
+	}
+	var requested []string
+	for _, rv := range reviews {
+		if rv.Decision == dispatch.ApplicationChangesRequested {
+			requested = rv.Sections
+		}
+	}
+	sent := payload.names()
+	if !sameSections(requested, sent) {
+		respondJSON(w, http.StatusUnprocessableEntity, map[string]any{
+			"error":    "send exactly the sections the reviewer asked for",
+			"sections": requested,
+		})
+		return
+	}
+	rule, ok := h.applicationRules(ctx, w, app.LocationCode, app.RulesVersion)
+	if !ok {
+		return
+	}
+	if !h.saveApplicationSections(ctx, w, driverID, payload, app.Vehicle.ID) {
+		return
+	}
+
+	full, ok, err := h.apps.LoadApplicationDetails(ctx, driverID)
+	if err != nil || !ok {
+		respondError(w, http.StatusInternalServerError, "failed to load application")
+		return
+	}
+	if rule != nil {
+		full, err = h.evaluateApplication(ctx, *rule, full, true)
+	} else {
+		err = h.apps.UpdateApplicationStatus(ctx, driverID, dispatch.ApplicationNeedsReview)
+		full.Status = dispatch.ApplicationNeedsReview
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to update status")
+		return
+	}
+	if payload.License != nil {
+		full = h.flagDuplicateLicense(ctx, full)
+	}
+	respondJSON(w, http.StatusOK, full)
+}
+
+// flagDuplicateLicense sends a saved application to a reviewer when its
+// license number is also on another driver's application. The other drivers
+// are not named to the applicant. The submission has already been stored, so
+// failures are logged rather than returned.
+func (h *Handler) flagDuplicateLicense(ctx context.Context, app dispatch.DriverApplication) dispatch.DriverApplication {
+	if h.lookup == nil || h.reviews == nil || app.License.Number == "" || app.Status == dispatch.ApplicationRejected {
+		return app
+	}
+	drivers, err := h.lookup.FindDriversByLicenseNumber(ctx, app.License.Number)
+	if err != nil {
+		log.Printf("application %s: duplicate license check: %v", app.DriverID, err)
+		return app
+	}
+	others := 0
+	for _, id := range drivers {
+		if id != app.DriverID {
+			others++
+		}
+	}
+	if others == 0 {
+		return app
+	}
+	note := fmt.Sprintf("license number is also on %d other driver application(s)", others)
+	if _, _, err := h.reviews.RecordApplicationReview(ctx, dispatch.ApplicationReview{
+		DriverID: app.DriverID,
+		Decision: dispatch.ApplicationNeedsReview,
+		Reason:   note,
+		Findings: []dispatch.DocumentFinding{{Document: dispatch.SectionLicense, Verdict: "mismatch", Note: note}},
+	}); err != nil {
+		log.Printf("application %s: flag duplicate license: %v", app.DriverID, err)
+		return app
+	}
+	app.Status = dispatch.ApplicationNeedsReview
+	return app
+}
+
+func validateSections(s applicationSections) error {
+	if s.License != nil && s.License.Number == "" {
+		return fmt.Errorf("license.number is required")
+	}
+	if s.Vehicle != nil {
+		if err := validateVehicle(*s.Vehicle); err != nil {
+			return err
+		}
+	}
+	if s.Photos != nil {
+		if err := validatePhotos(s.Photos); err != nil {
+			return err
+		}
+	}
+	if s.Liveness != nil {
+		if err := validateLiveness(*s.Liveness); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameSections(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, s := range a {
+		set[s] = true
+	}
+	for _, s := range b {
+		if !set[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// ListApplicationQueue lists applications waiting on reviewers, oldest first.
+// ?status= takes a comma-separated list (default pending,needs_review) and
+// ?minAge= a duration such as 24h.
+func (h *Handler) ListApplicationQueue(w http.ResponseWriter, r *http.Request) {
+	if h.reviews == nil {
+		respondError(w, http.StatusServiceUnavailable, "application store unavailable")
+		return
+	}
+	q := r.URL.Query()
+	statuses := []dispatch.DriverApplicationStatus{dispatch.ApplicationPending, dispatch.ApplicationNeedsReview}
+	if raw := q.Get("status"); raw != "" {
+		statuses = nil
+		for _, s := range strings.Split(raw, ",") {
+			status := dispatch.DriverApplicationStatus(strings.ToLower(strings.TrimSpace(s)))
+			switch status {
+			case dispatch.ApplicationPending, dispatch.ApplicationApproved, dispatch.ApplicationRejected,
+				dispatch.ApplicationNeedsReview, dispatch.ApplicationChangesRequested:
+				statuses = append(statuses, status)
+			default:
+				respondError(w, http.StatusBadRequest, "invalid status")
+				return
+			}
+		}
+	}
+	var minAge time.Duration
+	if raw := q.Get("minAge"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			respondError(w, http.StatusBadRequest, "minAge must be a duration such as 24h")
+			return
+		}
+		minAge = d
+	}
+	limit := parseLimit(q.Get("limit"), 50)
+	offset := parseOffset(q.Get("offset"))
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	items, total, err := h.reviews.ListApplicationQueue(ctx, statuses, minAge, limit, offset)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to list applications")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"data":   items,
+		"limit":  limit,
+		"offset": offset,
+		"total":  total,
+	})
+}
@@ -1,9 +1,12 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -11,26 +14,98 @@ import (
 
 	"turbodriver/internal/auth"
 	"turbodriver/internal/dispatch"
+	"turbodriver/internal/liveness"
 	"turbodriver/internal/storage"
 )
 
 // AttachRoutes wires HTTP routes to handlers.
-func AttachRoutes(r chi.Router, store *dispatch.Store, hub *dispatch.Hub, authStore *auth.InMemoryStore, identityDB *storage.IdentityStore, defaultTTL time.Duration, eventLogger dispatch.EventLogger, rideLister dispatch.RideLister, apps ApplicationStore) {
+func AttachRoutes(r chi.Router, store *dispatch.Store, hub *dispatch.Hub, authStore *auth.InMemoryStore, identityDB *storage.IdentityStore, defaultTTL time.Duration, eventLogger dispatch.EventLogger, rideLister dispatch.RideLister, apps ApplicationStore, limits RateLimitBackend) {
 	signupSecret := os.Getenv("SIGNUP_SECRET")
 	allowSignup := os.Getenv("ALLOW_SIGNUP") == "true"
-	authCfg := newAuthConfig(authStore, identityDB, defaultTTL, signupSecret, allowSignup)
+	var (
+		identities IdentityDB
+		refresh    auth.RefreshStore
+		otpStore   auth.OTPStore    = auth.NewMemoryOTPStore()
+		keyStore   auth.APIKeyStore = auth.NewMemoryAPIKeyStore()
+	)
+	if identityDB != nil {
+		identities = identityDB
+		refresh = identityDB
+		otpStore = identityDB
+		keyStore = identityDB
+	}
+	authCfg := newAuthConfig(authStore, identities, defaultTTL, signupSecret, allowSignup)
+	authCfg.sessions = sessionsFromEnv(refresh)
+	authCfg.keys = auth.NewAPIKeys(keyStore)
+	go authCfg.keys.Run(context.Background(), parseDurationEnv("API_KEY_USAGE_FLUSH", "30s"))
+	notifier := notifierFromEnv()
+	relay := dispatch.NewOutboxRelay(store.Outbox(), outboxSinksFromEnv(hub, store, notifier)...)
+	relay.Retention = parseDurationEnv("OUTBOX_RETENTION", "168h")
+	store.OnOutboxWrite(relay.Wake)
+	go relay.Run(context.Background(), parseDurationEnv("OUTBOX_POLL_INTERVAL", "2s"))
+	messages, _ := apps.(MessageStore)
+	shares, _ := apps.(ShareStore)
+	safety, _ := apps.(SafetyStore)
+	locations, _ := apps.(LocationSettingsStore)
+	privacy, _ := apps.(PrivacyStore)
+	uploads, _ := apps.(UploadStore)
+	rules, _ := apps.(LocationRulesStore)
+	reviews, _ := apps.(ReviewStore)
+	lookup, _ := apps.(PIILookup)
+	livenessChecks, _ := apps.(LivenessStore)
+	verifier, err := liveness.FromSpec(os.Getenv("LIVENESS_VERIFIER"))
+	if err != nil {
+		log.Printf("liveness: %v; captures stay unverified", err)
+	}
+	archive, _ := eventLogger.(ArchivedEventReader)
+	requests, ok := apps.(dispatch.RequestIdempotency)
+	if !ok {
+		requests = dispatch.NewMemoryRequestIdempotency()
+	}
+	idem := idempotency{store: requests, ttl: parseDurationEnv("IDEMPOTENCY_TTL", "24h")}.middleware
+	var otp *auth.OTPService
+	if sms, err := auth.SMSSenderFromSpec(os.Getenv("SMS_SINK")); err != nil {
+		log.Printf("otp: %v; phone login disabled", err)
+	} else {
+		otp = auth.NewOTPService(otpStore, sms,
+			parseDurationEnv("OTP_TTL", "5m"), parseDurationEnv("OTP_RESEND_COOLDOWN", "30s"), parseDurationEnv("OTP_LOCKOUT", "1h"), 5)
+	}
 	handler := &Handler{
 		store:         store,
 		hub:           hub,
 		auth:          authCfg,
 		events:        eventLogger,
+		archive:       archive,
 		db:            rideLister,
 		apps:          apps,
+		messages:      messages,
+		shares:        shares,
+		safety:        safety,
+		locations:     locations,
+		privacy:       privacy,
+		uploads:       uploads,
+		rules:         rules,
+		reviews:       reviews,
+		lookup:        lookup,
+		liveness:      livenessChecks,
+		verifier:      verifier,
+		notifier:      notifier,
+		pinDefault:    os.Getenv("PICKUP_PIN_REQUIRED") == "true",
+		monitor:       dispatch.NewTripMonitor(parseDurationEnv("MONITOR_STOP_AFTER", "5m")),
+		otp:           otp,
+		limiter:       newRateLimiter(limits),
+		relay:         relay,
 		startTime:     time.Now(),
 		staleTTL:      parseDurationEnv("DRIVER_TTL", "5m"),
+		shareTTL:      parseDurationEnv("SHARE_TTL", "4h"),
+		challengeTTL:  parseDurationEnv("LIVENESS_CHALLENGE_TTL", "10m"),
+		acceptances:   newAcceptanceCache(parseDurationEnv("RULES_ACCEPTANCE_TTL", "1m")),
 		matchBuckets:  newBucketCounter(map[float64]int64{1: 0, 3: 0, 10: 0, 30: 0}),
 		acceptBuckets: newBucketCounter(map[float64]int64{1: 0, 3: 0, 10: 0, 30: 0}),
 	}
+	if verifier != nil && livenessChecks != nil && uploads != nil {
+		go handler.runLivenessChecks(context.Background(), parseDurationEnv("LIVENESS_POLL_INTERVAL", "5s"))
+	}
 
 	r.Use(handler.metricsMiddleware)
 	r.Use(middleware.RequestID)
@@ -41,40 +116,98 @@ func AttachRoutes(r chi.Router, store *dispatch.Store, hub *dispatch.Hub, authSt
 		w.Write([]byte("ok"))
 	})
 
-	r.Post("/api/auth/signup", handler.SignupIdentity)
+	// Authenticated groups are limited per identity, the public auth endpoints per client IP.
+	limit := handler.limiter.limit
+	r.Group(func(pr chi.Router) {
+		pr.Use(limit("auth"))
+		if allowSignup {
+			pr.Post("/api/auth/signup", handler.SignupIdentity)
+		}
+		pr.Post("/api/auth/refresh", handler.RefreshSession)
+		pr.Post("/api/auth/otp/start", handler.StartOTP)
+		pr.Post("/api/auth/otp/verify", handler.VerifyOTP)
+	})
 
+	// Every authenticated route declares the permissions it needs; see auth.rolePermissions.
+	can := authCfg.permit
 	r.Group(func(pr chi.Router) {
 		pr.Use(authCfg.middleware)
-		pr.Post("/api/drivers/{driverID}/location", handler.UpdateDriverLocation)
-		pr.Post("/api/rides", handler.RequestRide)
-		pr.Get("/api/rides/{rideID}", handler.GetRide)
-		pr.Get("/api/history/passenger", handler.ListPassengerRides)
-		pr.Get("/api/history/driver", handler.ListDriverRides)
-		pr.Post("/api/rides/{rideID}/accept", handler.AcceptRide)
-		pr.Post("/api/rides/{rideID}/cancel", handler.CancelRide)
-		pr.Post("/api/rides/{rideID}/complete", handler.CompleteRide)
-		pr.Post("/api/drivers/{driverID}/application", handler.SubmitDriverApplication)
-		pr.Get("/api/drivers/{driverID}/application", handler.GetDriverApplication)
-		pr.Post("/api/passengers/{passengerID}/profile", handler.UpsertPassengerProfile)
-		pr.Get("/api/passengers/{passengerID}/profile", handler.GetPassengerProfile)
-		pr.Post("/api/rides/{rideID}/rating", handler.RateRide)
-		pr.Get("/api/drivers/{driverID}/ratings", handler.GetRatingsForDriver)
-		pr.Get("/api/passengers/{passengerID}/ratings", handler.GetRatingsForPassenger)
-		pr.Get("/api/passengers/{passengerID}/summary", handler.GetPassengerSummary)
-		pr.Get("/api/drivers/{driverID}/summary", handler.GetDriverSummary)
+		pr.Use(limit("api"))
+		pr.Use(idem)
+		pr.With(can(auth.PermRidesDrive), limit("heartbeat")).Post("/api/drivers/{driverID}/location", handler.UpdateDriverLocation)
+		pr.With(can(auth.PermRidesRequest), limit("ride_request")).Post("/api/rides", handler.RequestRide)
+		pr.With(can(auth.PermRidesReadOwn, auth.PermRidesReadAny)).Get("/api/rides/{rideID}", handler.GetRide)
+		pr.With(can(auth.PermHistoryReadOwn)).Get("/api/history/passenger", handler.ListPassengerRides)
+		pr.With(can(auth.PermHistoryReadOwn)).Get("/api/history/driver", handler.ListDriverRides)
+		pr.With(can(auth.PermRidesDrive), ifMatch).Post("/api/rides/{rideID}/accept", handler.AcceptRide)
+		pr.With(can(auth.PermRidesDrive), ifMatch).Post("/api/rides/{rideID}/start", handler.StartRide)
+		pr.With(can(auth.PermRidesCancelOwn, auth.PermRidesCancelAny), ifMatch).Post("/api/rides/{rideID}/cancel", handler.CancelRide)
+		pr.With(can(auth.PermRidesDrive), ifMatch).Post("/api/rides/{rideID}/complete", handler.CompleteRide)
+		pr.With(can(auth.PermUploadsWriteOwn)).Post("/api/uploads", handler.CreateUpload)
+		pr.With(can(auth.PermUploadsWriteOwn, auth.PermApplicationsReadAny)).Get("/api/uploads/{uploadID}", handler.GetUpload)
+		pr.With(can(auth.PermUploadsWriteOwn)).Put("/api/uploads/{uploadID}/content", handler.PutUploadContent)
+		pr.With(can(auth.PermUploadsWriteOwn, auth.PermApplicationsReadAny)).Get("/api/uploads/{uploadID}/content", handler.GetUploadContent)
+		pr.With(can(auth.PermUploadsWriteOwn)).Post("/api/uploads/{uploadID}/complete", handler.CompleteUpload)
+		pr.With(can(auth.PermApplicationsSubmit)).Post("/api/drivers/{driverID}/liveness/challenge", handler.CreateLivenessChallenge)
+		pr.With(can(auth.PermApplicationsSubmit)).Post("/api/drivers/{driverID}/application", handler.SubmitDriverApplication)
+		pr.With(can(auth.PermApplicationsSubmit)).Patch("/api/drivers/{driverID}/application", handler.ResubmitApplicationSections)
+		pr.With(can(auth.PermApplicationsSubmit, auth.PermApplicationsReadAny)).Get("/api/drivers/{driverID}/application", handler.GetDriverApplication)
+		pr.With(can(auth.PermApplicationsSubmit, auth.PermApplicationsReadAny)).Get("/api/drivers/{driverID}/application/reviews", handler.ListApplicationReviews)
+		pr.With(can(auth.PermApplicationsSubmit, auth.PermApplicationsReadAny)).Get("/api/drivers/{driverID}/rules", handler.GetRulesAcceptance)
+		pr.With(can(auth.PermApplicationsSubmit)).Post("/api/drivers/{driverID}/rules/accept", handler.AcceptLocationRules)
+		pr.With(can(auth.PermProfilesWriteOwn)).Post("/api/passengers/{passengerID}/profile", handler.UpsertPassengerProfile)
+		pr.With(can(auth.PermProfilesReadOwn, auth.PermProfilesReadAny)).Get("/api/passengers/{passengerID}/profile", handler.GetPassengerProfile)
+		pr.With(can(auth.PermRatingsWrite)).Post("/api/rides/{rideID}/rating", handler.RateRide)
+		pr.With(can(auth.PermProfilesReadOwn, auth.PermProfilesReadAny)).Get("/api/drivers/{driverID}/ratings", handler.GetRatingsForDriver)
+		pr.With(can(auth.PermProfilesReadOwn, auth.PermProfilesReadAny)).Get("/api/passengers/{passengerID}/ratings", handler.GetRatingsForPassenger)
+		pr.With(can(auth.PermProfilesReadOwn, auth.PermProfilesReadAny)).Get("/api/passengers/{passengerID}/summary", handler.GetPassengerSummary)
+		pr.With(can(auth.PermProfilesReadOwn, auth.PermProfilesReadAny)).Get("/api/drivers/{driverID}/summary", handler.GetDriverSummary)
+		pr.With(can(auth.PermChatParticipate)).Post("/api/rides/{rideID}/messages", handler.SendRideMessage)
+		pr.With(can(auth.PermChatParticipate, auth.PermRidesReadAny)).Get("/api/rides/{rideID}/messages", handler.ListRideMessages)
+		pr.With(can(auth.PermChatParticipate)).Post("/api/rides/{rideID}/messages/read", handler.MarkRideMessagesRead)
+		pr.With(can(auth.PermChatParticipate)).Get("/api/chat/quick-replies", handler.ListQuickReplies)
+		pr.With(can(auth.PermSharesManageOwn, auth.PermSharesManageAny)).Post("/api/rides/{rideID}/share", handler.CreateRideShare)
+		pr.With(can(auth.PermSharesManageOwn, auth.PermSharesManageAny)).Get("/api/rides/{rideID}/share", handler.ListRideShares)
+		pr.With(can(auth.PermSharesManageOwn, auth.PermSharesManageAny)).Delete("/api/rides/{rideID}/share/{shareID}", handler.RevokeRideShare)
+		pr.With(can(auth.PermSafetyReport)).Post("/api/rides/{rideID}/sos", handler.RaiseSOS)
+		pr.With(can(auth.PermSafetyReport)).Post("/api/rides/{rideID}/safety-check", handler.RespondSafetyCheck)
+		pr.With(can(auth.PermAccountManageOwn)).Get("/api/me/export", handler.ExportMyData)
+		pr.With(can(auth.PermAccountManageOwn)).Delete("/api/me", handler.DeleteMyAccount)
+		pr.Post("/api/auth/logout", handler.Logout)
 	})
 
 	r.Group(func(pr chi.Router) {
 		pr.Use(authCfg.middleware)
-		pr.Post("/api/auth/register", handler.RegisterIdentity)
-		pr.Get("/api/admin/rides/{rideID}/events", handler.ListRideEvents)
-		pr.Patch("/api/admin/drivers/{driverID}/application", handler.UpdateApplicationStatus)
+		pr.Use(limit("api"))
+		pr.Use(idem)
+		pr.With(can(auth.PermIdentitiesIssue)).Post("/api/auth/register", handler.RegisterIdentity)
+		pr.With(can(auth.PermIdentitiesRevoke)).Post("/api/admin/identities/{identityID}/revoke-tokens", handler.RevokeIdentityTokens)
+		pr.With(can(auth.PermPartnersManage)).Post("/api/admin/partners/{orgID}/keys", handler.CreatePartnerKey)
+		pr.With(can(auth.PermPartnersManage)).Get("/api/admin/partners/{orgID}/keys", handler.ListPartnerKeys)
+		pr.With(can(auth.PermPartnersManage)).Post("/api/admin/partners/keys/{keyID}/revoke", handler.RevokePartnerKey)
+		pr.With(can(auth.PermRideEventsRead)).Get("/api/admin/rides/{rideID}/events", handler.ListRideEvents)
+		pr.With(can(auth.PermApplicationsReadAny)).Get("/api/admin/applications", handler.ListApplicationQueue)
+		pr.With(can(auth.PermProfilesReadAny)).Post("/api/admin/lookup", handler.LookupIdentities)
+		pr.With(can(auth.PermApplicationsReview)).Patch("/api/admin/drivers/{driverID}/application", handler.UpdateApplicationStatus)
+		pr.With(can(auth.PermLocationsManage)).Get("/api/admin/locations/{locationCode}/settings", handler.GetLocationSettings)
+		pr.With(can(auth.PermLocationsManage)).Put("/api/admin/locations/{locationCode}/settings", handler.UpdateLocationSettings)
+		pr.With(can(auth.PermLocationsManage)).Get("/api/admin/locations/{locationCode}/rules", handler.ListLocationRules)
+		pr.With(can(auth.PermLocationsManage)).Post("/api/admin/locations/{locationCode}/rules", handler.CreateLocationRule)
+		pr.With(can(auth.PermLocationsManage)).Get("/api/admin/locations/{locationCode}/rules/{ruleID}", handler.GetLocationRule)
+		pr.With(can(auth.PermLocationsManage)).Put("/api/admin/locations/{locationCode}/rules/{ruleID}", handler.UpdateLocationRule)
+		pr.With(can(auth.PermLocationsManage)).Delete("/api/admin/locations/{locationCode}/rules/{ruleID}", handler.DeleteLocationRule)
+		pr.With(can(auth.PermSafetyRead)).Get("/api/admin/safety/incidents", handler.ListSafetyIncidents)
+		pr.With(can(auth.PermSafetyRead)).Get("/api/admin/safety/incidents/{incidentID}", handler.GetSafetyIncident)
+		pr.With(can(auth.PermSafetyManage)).Post("/api/admin/safety/incidents/{incidentID}/acknowledge", handler.AcknowledgeSafetyIncident)
+		pr.With(can(auth.PermSafetyManage)).Post("/api/admin/safety/incidents/{incidentID}/escalate", handler.EscalateSafetyIncident)
+		pr.With(can(auth.PermSafetyManage)).Post("/api/admin/safety/incidents/{incidentID}/resolve", handler.ResolveSafetyIncident)
 	})
 
 	r.Get("/metrics", handler.Metrics)
 
 	r.Group(func(pr chi.Router) {
 		pr.Use(authCfg.middleware)
+		pr.Use(can(auth.PermAdminConsole))
 		fileServer := http.StripPrefix("/admin", http.FileServer(http.Dir("./static/admin")))
 		pr.Get("/admin/*", func(w http.ResponseWriter, r *http.Request) {
 			fileServer.ServeHTTP(w, r)
@@ -82,6 +215,10 @@ func AttachRoutes(r chi.Router, store *dispatch.Store, hub *dispatch.Hub, authSt
 	})
 
 	r.Get("/ws/rides/{rideID}", handler.RideWebsocket)
+	r.Get("/ws/admin", handler.AdminWebsocket)
+	r.Get("/share/{token}", handler.GetSharedRide)
+	r.Get("/api/locations/{locationCode}/rules", handler.GetCurrentLocationRules)
+	r.Get("/share/{token}/ws", handler.SharedRideWebsocket)
 }
 
 func respondJSON(w http.ResponseWriter, status int, body any) {
@@ -96,6 +233,38 @@ func respondError(w http.ResponseWriter, status int, msg string) {
 	respondJSON(w, status, map[string]string{"error": msg})
 }
 
+// outboxSinksFromEnv lists where committed ride transitions are relayed: the
+// websocket hub always, WEBHOOK_URLS (comma-separated, signed with
+// WEBHOOK_SECRET) and passenger notifications when a notifier is configured.
+func outboxSinksFromEnv(hub *dispatch.Hub, rides *dispatch.Store, notifier dispatch.Notifier) []dispatch.OutboxSink {
+	sinks := []dispatch.OutboxSink{dispatch.HubSink{Hub: hub, Rides: rides}}
+	for _, raw := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		sink, err := dispatch.NewWebhookSink(raw, os.Getenv("WEBHOOK_SECRET"))
+		if err != nil {
+			log.Printf("outbox: skipping webhook: %v", err)
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+	if notifier != nil {
+		sinks = append(sinks, dispatch.NotificationSink{Notifier: notifier})
+	}
+	return sinks
+}
+
+// notifierFromEnv returns the notifier for riders and drivers, or nil when
+// NOTIFICATIONS is unset.
+func notifierFromEnv() dispatch.Notifier {
+	if os.Getenv("NOTIFICATIONS") == "log" {
+		return dispatch.LogNotifier{}
+	}
+	return nil
+}
+
 func parseDurationEnv(key, def string) time.Duration {
 	val := os.Getenv(key)
 	if val == "" {
@@ -0,0 +1,442 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/auth"
+	"turbodriver/internal/dispatch"
+	"turbodriver/internal/eligibility"
+	"turbodriver/internal/storage"
+)
+
+// LocationRulesStore keeps the versioned rules drivers accept per location.
+type LocationRulesStore interface {
+	CreateLocationRule(ctx context.Context, rule dispatch.LocationRule) (dispatch.LocationRule, error)
+	GetLocationRule(ctx context.Context, id int64) (dispatch.LocationRule, bool, error)
+	ListLocationRules(ctx context.Context, locationCode string) ([]dispatch.LocationRule, error)
+	CurrentLocationRule(ctx context.Context, locationCode string) (dispatch.LocationRule, bool, error)
+	UpdateLocationRule(ctx context.Context, rule dispatch.LocationRule) (dispatch.LocationRule, bool, error)
+	DeleteLocationRule(ctx context.Context, id int64) (bool, error)
+	RulesAcceptance(ctx context.Context, driverID string) (dispatch.RulesAcceptance, bool, error)
+	AcceptLocationRules(ctx context.Context, driverID string, ruleID int64) (bool, error)
+	SaveRulesReport(ctx context.Context, driverID string, report dispatch.RulesReport, status dispatch.DriverApplicationStatus) error
+}
+
+// rulesClockSkew tolerates admin clocks slightly behind ours when scheduling.
+const rulesClockSkew = time.Minute
+
+type locationRulePayload struct {
+	Name        string          `json:"name"`
+	Rules       json.RawMessage `json:"rules"`
+	EffectiveAt string          `json:"effectiveAt,omitempty"`
+}
+
+// parse validates the payload; effectiveAt defaults to now and may not be in the past.
+func (p locationRulePayload) parse(now time.Time) (dispatch.LocationRule, error) {
+	var rule dispatch.LocationRule
+	rule.Name = strings.TrimSpace(p.Name)
+	if rule.Name == "" {
+		return rule, errors.New("name is required")
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(p.Rules, &obj); err != nil || obj == nil {
+		return rule, errors.New("rules must be a JSON object")
+	}
+	if _, err := eligibility.Parse(p.Rules); err != nil {
+		return rule, err
+	}
+	rule.Rules = p.Rules
+	rule.EffectiveAt = now
+	if p.EffectiveAt != "" {
+		t, err := time.Parse(time.RFC3339, p.EffectiveAt)
+		if err != nil {
+			return rule, errors.New("effectiveAt must be RFC3339")
+		}
+		if t.Before(now.Add(-rulesClockSkew)) {
+			return rule, errors.New("effectiveAt must not be in the past")
+		}
+		rule.EffectiveAt = t.UTC()
+	}
+	return rule, nil
+}
+
+// locationRule loads the version named in the URL, checking it belongs to the location.
+func (h *Handler) locationRule(w http.ResponseWriter, r *http.Request) (dispatch.LocationRule, bool) {
+	if h.rules == nil {
+		respondError(w, http.StatusServiceUnavailable, "location rules unavailable")
+		return dispatch.LocationRule{}, false
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "ruleID"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "rules version not found")
+		return dispatch.LocationRule{}, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	rule, ok, err := h.rules.GetLocationRule(ctx, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load rules")
+		return dispatch.LocationRule{}, false
+	}
+	if !ok || rule.LocationCode != chi.URLParam(r, "locationCode") {
+		respondError(w, http.StatusNotFound, "rules version not found")
+		return dispatch.LocationRule{}, false
+	}
+	return rule, true
+}
+
+func (h *Handler) ListLocationRules(w http.ResponseWriter, r *http.Request) {
+	if h.rules == nil {
+		respondError(w, http.StatusServiceUnavailable, "location rules unavailable")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	rules, err := h.rules.ListLocationRules(ctx, chi.URLParam(r, "locationCode"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to list rules")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"data": rules})
+}
+
+// CreateLocationRule adds a new rules version. Once it takes effect, drivers
+// must accept it before going online again.
+func (h *Handler) CreateLocationRule(w http.ResponseWriter, r *http.Request) {
+	if h.rules == nil {
+		respondError(w, http.StatusServiceUnavailable, "location rules unavailable")
+		return
+	}
+	var payload locationRulePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	rule, err := payload.parse(time.Now().UTC())
+	if err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	admin, _ := identityFromContext(r.Context())
+	rule.LocationCode = chi.URLParam(r, "locationCode")
+	rule.CreatedBy = admin.ID
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	saved, err := h.rules.CreateLocationRule(ctx, rule)
+	if errors.Is(err, storage.ErrRulesOrder) {
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to save rules")
+		return
+	}
+	respondJSON(w, http.StatusCreated, saved)
+}
+
+func (h *Handler) GetLocationRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.locationRule(w, r)
+	if !ok {
+		return
+	}
+	respondJSON(w, http.StatusOK, rule)
+}
+
+// UpdateLocationRule edits a version that has not taken effect yet; versions in
+// force are immutable, so publish a new version instead.
+func (h *Handler) UpdateLocationRule(w http.ResponseWriter, r *http.Request) {
+	current, ok := h.locationRule(w, r)
+	if !ok {
+		return
+	}
+	var payload locationRulePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	rule, err := payload.parse(time.Now().UTC())
+	if err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	rule.ID = current.ID
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	saved, _, err := h.rules.UpdateLocationRule(ctx, rule)
+	switch {
+	case errors.Is(err, storage.ErrRulesInForce), errors.Is(err, storage.ErrRulesOrder):
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, "failed to save rules")
+		return
+	}
+	respondJSON(w, http.StatusOK, saved)
+}
+
+// DeleteLocationRule withdraws the latest version before it takes effect.
+func (h *Handler) DeleteLocationRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.locationRule(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	_, err := h.rules.DeleteLocationRule(ctx, rule.ID)
+	switch {
+	case errors.Is(err, storage.ErrRulesInForce), errors.Is(err, storage.ErrRulesNotLatest):
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, "failed to delete rules")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCurrentLocationRules is the public view of the rules in force for a
+// location, which drivers read and accept when applying.
+func (h *Handler) GetCurrentLocationRules(w http.ResponseWriter, r *http.Request) {
+	if h.rules == nil {
+		respondError(w, http.StatusServiceUnavailable, "location rules unavailable")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	rule, ok, err := h.rules.CurrentLocationRule(ctx, chi.URLParam(r, "locationCode"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load rules")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "no rules for location")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"id":           rule.ID,
+		"locationCode": rule.LocationCode,
+		"version":      rule.Version,
+		"name":         rule.Name,
+		"rules":        rule.Rules,
+		"effectiveAt":  rule.EffectiveAt,
+	})
+}
+
+// GetRulesAcceptance tells a driver whether they must accept new rules.
+func (h *Handler) GetRulesAcceptance(w http.ResponseWriter, r *http.Request) {
+	if h.rules == nil {
+		respondError(w, http.StatusServiceUnavailable, "location rules unavailable")
+		return
+	}
+	enforce := h.auth.store != nil
+	driverID := chi.URLParam(r, "driverID")
+	if !matchIdentityOr(w, r, enforce, driverID, auth.PermApplicationsReadAny) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	acc, ok, err := h.rules.RulesAcceptance(ctx, driverID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load rules acceptance")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "application not found")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"locationCode":           acc.LocationCode,
+		"acceptedRulesVersionId": acc.AcceptedVersion,
+		"acceptedAt":             acc.AcceptedAt,
+		"currentRulesVersionId":  acc.CurrentVersion,
+		"acceptanceRequired":     !acc.Current(),
+	})
+}
+
+// AcceptLocationRules records the driver accepting the rules in force for their
+// application's location. Only the current version can be accepted.
+func (h *Handler) AcceptLocationRules(w http.ResponseWriter, r *http.Request) {
+	if h.rules == nil {
+		respondError(w, http.StatusServiceUnavailable, "location rules unavailable")
+		return
+	}
+	enforce := h.auth.store != nil
+	driverID := chi.URLParam(r, "driverID")
+	if !matchIdentity(w, r, enforce, driverID) {
+		return
+	}
+	var body struct {
+		RulesVersionID int64 `json:"rulesVersionId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	acc, ok, err := h.rules.RulesAcceptance(ctx, driverID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load rules acceptance")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "application not found")
+		return
+	}
+	if acc.CurrentVersion == nil || *acc.CurrentVersion != body.RulesVersionID {
+		respondJSON(w, http.StatusConflict, map[string]any{
+			"error":                 "rulesVersionId is not the current rules version for this location",
+			"currentRulesVersionId": acc.CurrentVersion,
+		})
+		return
+	}
+	accepted, err := h.rules.AcceptLocationRules(ctx, driverID, body.RulesVersionID)
+	if err != nil || !accepted {
+		respondError(w, http.StatusInternalServerError, "failed to record acceptance")
+		return
+	}
+	now := time.Now().UTC()
+	acc.AcceptedVersion, acc.AcceptedAt = acc.CurrentVersion, &now
+	respondJSON(w, http.StatusOK, acc)
+}
+
+// applicationRules verifies an application references the rules in force for
+// its location, or none when the location has no rules, and returns them.
+func (h *Handler) applicationRules(ctx context.Context, w http.ResponseWriter, locationCode string, versionID *int64) (*dispatch.LocationRule, bool) {
+	if h.rules == nil {
+		return nil, true
+	}
+	current, ok, err := h.rules.CurrentLocationRule(ctx, locationCode)
+	switch {
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, "failed to load rules")
+		return nil, false
+	case ok && (versionID == nil || *versionID != current.ID):
+		respondJSON(w, http.StatusConflict, map[string]any{
+			"error":                 "rulesVersionId must be the current rules version for this location",
+			"currentRulesVersionId": current.ID,
+		})
+		return nil, false
+	case !ok && versionID != nil:
+		respondError(w, http.StatusUnprocessableEntity, "location has no rules to accept")
+		return nil, false
+	case !ok:
+		return nil, true
+	}
+	return &current, true
+}
+
+// evaluateApplication checks a submitted application against its location's
+// rules and moves it to the decision. Rules that no longer parse send it to
+// review rather than failing the submission. Changes a reviewer asked for
+// always go back to review, whatever the checks decide.
+func (h *Handler) evaluateApplication(ctx context.Context, rule dispatch.LocationRule, app dispatch.DriverApplication, afterReview bool) (dispatch.DriverApplication, error) {
+	now := time.Now().UTC()
+	var report dispatch.RulesReport
+	if checks, err := eligibility.Parse(rule.Rules); err != nil {
+		report = eligibility.Unreadable(rule.ID, err, now)
+	} else {
+		report = eligibility.Evaluate(checks, rule.ID, app, now)
+	}
+	status := report.Decision
+	if afterReview {
+		status = dispatch.ApplicationNeedsReview
+	}
+	if err := h.rules.SaveRulesReport(ctx, app.DriverID, report, status); err != nil {
+		return app, err
+	}
+	app.Status = status
+	app.RulesReport = &report
+	return app, nil
+}
+
+// requireCurrentRules keeps a driver offline until they have accepted the rules
+// in force for their application's location. Drivers on a ride are never
+// stopped mid-trip, and drivers without an application are not gated here.
+// Drivers found up to date are not checked again for RULES_ACCEPTANCE_TTL, and
+// a failed check lets the driver through rather than taking the fleet offline
+// with the database.
+func (h *Handler) requireCurrentRules(w http.ResponseWriter, r *http.Request, driverID string) bool {
+	if h.rules == nil {
+		return true
+	}
+	if state, ok := h.store.GetDriver(driverID); ok && state.RideID != "" {
+		return true
+	}
+	if h.acceptances.current(driverID) {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	acc, ok, err := h.rules.RulesAcceptance(ctx, driverID)
+	if err != nil {
+		log.Printf("rules: check acceptance of %s: %v", driverID, err)
+		return true
+	}
+	if !ok || acc.Current() {
+		h.acceptances.remember(driverID)
+		return true
+	}
+	if state, offline, err := h.store.TakeDriverOffline(ctx, driverID); err != nil {
+		log.Printf("rules: take %s offline: %v", driverID, err)
+	} else if offline {
+		h.hub.PublishDriverUpdate(driverID, state)
+	}
+	respondJSON(w, http.StatusConflict, map[string]any{
+		"error":                 "accept the current location rules before going online",
+		"locationCode":          acc.LocationCode,
+		"currentRulesVersionId": acc.CurrentVersion,
+	})
+	return false
+}
+
+// acceptanceCache remembers drivers found to have accepted the current rules,
+// so heartbeats do not each query the database. Only up-to-date drivers are
+// kept, so an acceptance takes effect on the next heartbeat; a new rules
+// version is enforced once the driver's entry expires.
+type acceptanceCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	checked map[string]time.Time
+}
+
+func newAcceptanceCache(ttl time.Duration) *acceptanceCache {
+	return &acceptanceCache{ttl: ttl, checked: make(map[string]time.Time)}
+}
+
+func (c *acceptanceCache) current(driverID string) bool {
+	if c == nil || c.ttl <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at, ok := c.checked[driverID]
+	return ok && time.Since(at) < c.ttl
+}
+
+func (c *acceptanceCache) remember(driverID string) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.checked) > 10000 {
+		for id, at := range c.checked {
+			if now.Sub(at) >= c.ttl {
+				delete(c.checked, id)
+			}
+		}
+	}
+	c.checked[driverID] = now
+}
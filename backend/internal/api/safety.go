@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/auth"
+	"turbodriver/internal/dispatch"
+)
+
+// sosTrackPoints is how many recent driver positions are frozen into an incident.
+const sosTrackPoints = 50
+
+// SafetyStore persists safety incidents raised during rides.
+type SafetyStore interface {
+	CreateSafetyIncident(ctx context.Context, inc dispatch.SafetyIncident) (dispatch.SafetyIncident, error)
+	GetSafetyIncident(ctx context.Context, id int64) (dispatch.SafetyIncident, bool, error)
+	ListSafetyIncidents(ctx context.Context, status dispatch.SafetyIncidentStatus, limit, offset int) ([]dispatch.SafetyIncident, error)
+	CountSafetyIncidents(ctx context.Context, status dispatch.SafetyIncidentStatus) (int, error)
+	TransitionSafetyIncident(ctx context.Context, id int64, from, to dispatch.SafetyIncidentStatus, actorID, note string) (dispatch.SafetyIncident, bool, error)
+}
+
+// RaiseSOS lets the passenger or driver of a ride raise an emergency alert.
+func (h *Handler) RaiseSOS(w http.ResponseWriter, r *http.Request) {
+	if h.safety == nil {
+		respondError(w, http.StatusServiceUnavailable, "safety tooling unavailable")
+		return
+	}
+	enforce := h.auth.store != nil
+	rideID := chi.URLParam(r, "rideID")
+	ride, ok := h.store.GetRide(r.Context(), rideID)
+	if !ok {
+		respondError(w, http.StatusNotFound, "ride not found")
+		return
+	}
+	if !canAccessRide(r, enforce, ride) {
+		respondError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	var body struct {
+		Note      string   `json:"note,omitempty"`
+		Latitude  *float64 `json:"latitude,omitempty"`
+		Longitude *float64 `json:"longitude,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+	}
+
+	id, _ := identityFromContext(r.Context())
+	inc := dispatch.SafetyIncident{
+		RideID:       ride.ID,
+		Kind:         "sos",
+		ReporterID:   id.ID,
+		ReporterRole: id.Role,
+		Status:       dispatch.IncidentOpen,
+		Note:         strings.TrimSpace(body.Note),
+		Snapshot:     h.safetySnapshot(ride),
+	}
+	if body.Latitude != nil && body.Longitude != nil {
+		inc.Snapshot.ReporterLocation = &dispatch.Coordinate{
+			Latitude:  *body.Latitude,
+			Longitude: *body.Longitude,
+			At:        time.Now(),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	saved, err := h.safety.CreateSafetyIncident(ctx, inc)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to record incident")
+		return
+	}
+	h.logRideEvent(r.Context(), ride, "sos_raised", map[string]any{
+		"incidentId": saved.ID,
+		"note":       saved.Note,
+	})
+	h.hub.PublishSafetyIncident(saved)
+	respondJSON(w, http.StatusCreated, saved)
+}
+
+// safetySnapshot captures the ride, latest driver position and recent track.
+// The pickup PIN is left out: snapshots reach the reporter, admins and storage.
+func (h *Handler) safetySnapshot(ride dispatch.Ride) dispatch.SafetySnapshot {
+	snap := dispatch.SafetySnapshot{
+		Ride:  ride.WithoutPIN(),
+		Track: h.store.RecentTrack(ride.ID, sosTrackPoints),
+	}
+	if ride.DriverID != "" {
+		if drv, ok := h.store.GetDriver(ride.DriverID); ok {
+			loc := drv.Location
+			snap.DriverLocation = &loc
+		}
+	}
+	return snap
+}
+
+func (h *Handler) ListSafetyIncidents(w http.ResponseWriter, r *http.Request) {
+	if h.safety == nil {
+		respondError(w, http.StatusServiceUnavailable, "safety tooling unavailable")
+		return
+	}
+	status := dispatch.SafetyIncidentStatus(strings.ToLower(r.URL.Query().Get("status")))
+	limit := parseLimit(r.URL.Query().Get("limit"), 100)
+	offset := parseOffset(r.URL.Query().Get("offset"))
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	incidents, err := h.safety.ListSafetyIncidents(ctx, status, limit, offset)
+	total, _ := h.safety.CountSafetyIncidents(ctx, status)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to fetch incidents")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"data":   incidents,
+		"limit":  limit,
+		"offset": offset,
+		"total":  total,
+	})
+}
+
+func (h *Handler) GetSafetyIncident(w http.ResponseWriter, r *http.Request) {
+	if h.safety == nil {
+		respondError(w, http.StatusServiceUnavailable, "safety tooling unavailable")
+		return
+	}
+	incidentID, err := strconv.ParseInt(chi.URLParam(r, "incidentID"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid incident id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	inc, ok, err := h.safety.GetSafetyIncident(ctx, incidentID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to fetch incident")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "incident not found")
+		return
+	}
+	respondJSON(w, http.StatusOK, inc)
+}
+
+func (h *Handler) AcknowledgeSafetyIncident(w http.ResponseWriter, r *http.Request) {
+	h.transitionSafetyIncident(w, r, dispatch.IncidentAcknowledged)
+}
+
+func (h *Handler) EscalateSafetyIncident(w http.ResponseWriter, r *http.Request) {
+	h.transitionSafetyIncident(w, r, dispatch.IncidentEscalated)
+}
+
+func (h *Handler) ResolveSafetyIncident(w http.ResponseWriter, r *http.Request) {
+	h.transitionSafetyIncident(w, r, dispatch.IncidentResolved)
+}
+
+func (h *Handler) transitionSafetyIncident(w http.ResponseWriter, r *http.Request, next dispatch.SafetyIncidentStatus) {
+	if h.safety == nil {
+		respondError(w, http.StatusServiceUnavailable, "safety tooling unavailable")
+		return
+	}
+	incidentID, err := strconv.ParseInt(chi.URLParam(r, "incidentID"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid incident id")
+		return
+	}
+	var body struct {
+		Note string `json:"note,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	current, ok, err := h.safety.GetSafetyIncident(ctx, incidentID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to fetch incident")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "incident not found")
+		return
+	}
+	if !current.Status.CanTransition(next) {
+		respondError(w, http.StatusConflict, "cannot move incident from "+string(current.Status)+" to "+string(next))
+		return
+	}
+	admin, _ := identityFromContext(r.Context())
+	updated, ok, err := h.safety.TransitionSafetyIncident(ctx, incidentID, current.Status, next, admin.ID, strings.TrimSpace(body.Note))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to update incident")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusConflict, "incident changed concurrently")
+		return
+	}
+	h.logRideEvent(r.Context(), dispatch.Ride{ID: updated.RideID}, "sos_"+string(next), map[string]any{
+		"incidentId": updated.ID,
+		"statusFrom": current.Status,
+		"statusTo":   updated.Status,
+		"note":       strings.TrimSpace(body.Note),
+	})
+	h.hub.PublishSafetyIncident(updated)
+	respondJSON(w, http.StatusOK, updated)
+}
+
+// AdminWebsocket streams real-time safety alerts to admins.
+func (h *Handler) AdminWebsocket(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.auth.authorized(r)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if h.auth.store != nil && !auth.Can(id.Role, auth.PermSafetyRead) {
+		respondError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	h.hub.ServeAdmin(w, r)
+}
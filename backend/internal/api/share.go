@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+const maxShareTTL = 24 * time.Hour
+
+// ShareStore persists trip sharing links.
+type ShareStore interface {
+	CreateRideShare(ctx context.Context, share dispatch.RideShare) (dispatch.RideShare, error)
+	LookupRideShare(ctx context.Context, tokenHash string) (dispatch.RideShare, bool, error)
+	ListRideShares(ctx context.Context, rideID string) ([]dispatch.RideShare, error)
+	RevokeRideShare(ctx context.Context, rideID string, shareID int64) (bool, error)
+}
+
+// shareRide loads the ride and verifies the caller may manage its share links.
+func (h *Handler) shareRide(w http.ResponseWriter, r *http.Request) (dispatch.Ride, bool) {
+	if h.shares == nil {
+		respondError(w, http.StatusServiceUnavailable, "trip sharing unavailable")
+		return dispatch.Ride{}, false
+	}
+	enforce := h.auth.store != nil
+	ride, ok := h.store.GetRide(r.Context(), chi.URLParam(r, "rideID"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "ride not found")
+		return dispatch.Ride{}, false
+	}
+	if !canAccessRide(r, enforce, ride) {
+		respondError(w, http.StatusForbidden, "forbidden")
+		return dispatch.Ride{}, false
+	}
+	return ride, true
+}
+
+// CreateRideShare mints an expiring read-only tracking link for a ride.
+func (h *Handler) CreateRideShare(w http.ResponseWriter, r *http.Request) {
+	ride, ok := h.shareRide(w, r)
+	if !ok {
+		return
+	}
+	if ride.Status.IsTerminal() {
+		respondError(w, http.StatusConflict, "ride already finished")
+		return
+	}
+	var body struct {
+		TTL string `json:"ttl,omitempty"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+	}
+	ttl := h.shareTTL
+	if body.TTL != "" {
+		if parsed, err := time.ParseDuration(body.TTL); err == nil && parsed > 0 {
+			ttl = parsed
+		}
+	}
+	if ttl > maxShareTTL {
+		ttl = maxShareTTL
+	}
+	token := newShareToken()
+	id, _ := identityFromContext(r.Context())
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	share, err := h.shares.CreateRideShare(ctx, dispatch.RideShare{
+		RideID:    ride.ID,
+		CreatedBy: id.ID,
+		TokenHash: hashShareToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to create share")
+		return
+	}
+	share.Token = token
+	h.logRideEvent(r.Context(), ride, "ride_shared", map[string]any{
+		"shareId":   share.ID,
+		"expiresAt": share.ExpiresAt,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, http.StatusCreated, map[string]any{
+		"share": share,
+		"url":   "/share/" + token,
+	})
+}
+
+// ListRideShares returns share links created for a ride (tokens are never returned).
+func (h *Handler) ListRideShares(w http.ResponseWriter, r *http.Request) {
+	ride, ok := h.shareRide(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	shares, err := h.shares.ListRideShares(ctx, ride.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to fetch shares")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"data": shares})
+}
+
+// RevokeRideShare invalidates a share link and disconnects its viewers.
+func (h *Handler) RevokeRideShare(w http.ResponseWriter, r *http.Request) {
+	ride, ok := h.shareRide(w, r)
+	if !ok {
+		return
+	}
+	shareID, err := strconv.ParseInt(chi.URLParam(r, "shareID"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid share id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	revoked, err := h.shares.RevokeRideShare(ctx, ride.ID, shareID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to revoke share")
+		return
+	}
+	if !revoked {
+		respondError(w, http.StatusNotFound, "share not found")
+		return
+	}
+	h.hub.CloseShare(ride.ID, shareID)
+	h.logRideEvent(r.Context(), ride, "ride_share_revoked", map[string]any{
+		"shareId": shareID,
+	})
+	respondJSON(w, http.StatusOK, map[string]any{"revoked": true})
+}
+
+// resolveShare validates a public share token and loads its ride.
+func (h *Handler) resolveShare(w http.ResponseWriter, r *http.Request) (dispatch.RideShare, dispatch.Ride, bool) {
+	if h.shares == nil {
+		respondError(w, http.StatusServiceUnavailable, "trip sharing unavailable")
+		return dispatch.RideShare{}, dispatch.Ride{}, false
+	}
+	token := chi.URLParam(r, "token")
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	share, ok, err := h.shares.LookupRideShare(ctx, hashShareToken(token))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to read share")
+		return dispatch.RideShare{}, dispatch.Ride{}, false
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "share not found")
+		return dispatch.RideShare{}, dispatch.Ride{}, false
+	}
+	if !share.Active(time.Now()) {
+		respondError(w, http.StatusGone, "share expired or revoked")
+		return dispatch.RideShare{}, dispatch.Ride{}, false
+	}
+	ride, ok := h.store.GetRide(r.Context(), share.RideID)
+	if !ok {
+		respondError(w, http.StatusNotFound, "ride not found")
+		return dispatch.RideShare{}, dispatch.Ride{}, false
+	}
+	return share, ride, true
+}
+
+// GetSharedRide is the public, redacted view behind a share link.
+func (h *Handler) GetSharedRide(w http.ResponseWriter, r *http.Request) {
+	share, ride, ok := h.resolveShare(w, r)
+	if !ok {
+		return
+	}
+	view := dispatch.SharedRideView{
+		Status:    ride.Status,
+		Pickup:    ride.Pickup,
+		ExpiresAt: share.ExpiresAt,
+	}
+	if !ride.Status.IsTerminal() && ride.DriverID != "" {
+		if drv, found := h.store.GetDriver(ride.DriverID); found && drv.RideID == ride.ID {
+			loc := drv.Location
+			view.DriverLocation = &loc
+		}
+	}
+	respondJSON(w, http.StatusOK, view)
+}
+
+// SharedRideWebsocket streams redacted status and driver location frames.
+func (h *Handler) SharedRideWebsocket(w http.ResponseWriter, r *http.Request) {
+	share, _, ok := h.resolveShare(w, r)
+	if !ok {
+		return
+	}
+	h.hub.ServeSharedRide(w, r, share)
+}
+
+func newShareToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,508 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"turbodriver/internal/auth"
+	"turbodriver/internal/dispatch"
+	"turbodriver/internal/storage"
+)
+
+// uploadURLTTL is how long a reserved upload waits for its content.
+const uploadURLTTL = 15 * time.Minute
+
+// UploadStore keeps upload records and their content.
+type UploadStore interface {
+	InsertUpload(ctx context.Context, up dispatch.Upload) error
+	GetUpload(ctx context.Context, id string) (dispatch.Upload, bool, error)
+	CompleteUpload(ctx context.Context, up dispatch.Upload) (bool, error)
+	DeleteUpload(ctx context.Context, up dispatch.Upload) error
+	PutUploadObject(ctx context.Context, up dispatch.Upload, body io.Reader) error
+	OpenUploadObject(ctx context.Context, up dispatch.Upload) (io.ReadCloser, error)
+	PresignUpload(ctx context.Context, up dispatch.Upload, ttl time.Duration) (string, bool, error)
+}
+
+// uploadPolicy bounds what may be uploaded for a purpose. minSide and maxSide
+// bound the shorter and longer side of images, in pixels.
+type uploadPolicy struct {
+	types    []string
+	maxBytes int64
+	minSide  int
+	maxSide  int
+}
+
+var (
+	imageTypes    = []string{"image/jpeg", "image/png"}
+	documentTypes = []string{"image/jpeg", "image/png", "application/pdf"}
+)
+
+var uploadPolicies = map[string]uploadPolicy{
+	dispatch.UploadLicenseDocument: {types: documentTypes, maxBytes: 10 << 20, minSide: 600, maxSide: 10000},
+	dispatch.UploadVehicleDocument: {types: documentTypes, maxBytes: 10 << 20, minSide: 600, maxSide: 10000},
+	dispatch.UploadVehicleContract: {types: documentTypes, maxBytes: 10 << 20, minSide: 600, maxSide: 10000},
+	dispatch.UploadVehiclePhoto:    {types: imageTypes, maxBytes: 8 << 20, minSide: 480, maxSide: 10000},
+	dispatch.UploadLivenessCapture: {types: imageTypes, maxBytes: 5 << 20, minSide: 320, maxSide: 4096},
+}
+
+// maxUploadBytes is the largest file any purpose accepts.
+const maxUploadBytes = 10 << 20
+
+var errInvalidUpload = errors.New("invalid upload")
+
+func (p uploadPolicy) allows(contentType string) bool {
+	for _, t := range p.types {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectUpload checks content against a policy and measures it. The sniffed
+// type must be allowed and match declaredType, and the SHA-256 must match
+// declaredSHA; either may be empty to skip the comparison.
+func inspectUpload(policy uploadPolicy, declaredType, declaredSHA string, body []byte) (dispatch.Upload, error) {
+	var up dispatch.Upload
+	if len(body) == 0 {
+		return up, fmt.Errorf("%w: empty file", errInvalidUpload)
+	}
+	if int64(len(body)) > policy.maxBytes {
+		return up, fmt.Errorf("%w: file larger than %d bytes", errInvalidUpload, policy.maxBytes)
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	if !policy.allows(sniffed) {
+		return up, fmt.Errorf("%w: content type %s not allowed (want %s)", errInvalidUpload, sniffed, strings.Join(policy.types, ", "))
+	}
+	if declaredType != "" {
+		if declared, _, err := mime.ParseMediaType(declaredType); err != nil || declared != sniffed {
+			return up, fmt.Errorf("%w: declared content type %q does not match content (%s)", errInvalidUpload, declaredType, sniffed)
+		}
+	}
+	sum := sha256.Sum256(body)
+	up.SHA256 = hex.EncodeToString(sum[:])
+	if declaredSHA != "" && !strings.EqualFold(declaredSHA, up.SHA256) {
+		return up, fmt.Errorf("%w: checksum mismatch", errInvalidUpload)
+	}
+	up.ContentType = sniffed
+	up.Size = int64(len(body))
+	if strings.HasPrefix(sniffed, "image/") {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			return up, fmt.Errorf("%w: unreadable image", errInvalidUpload)
+		}
+		short, long := cfg.Width, cfg.Height
+		if short > long {
+			short, long = long, short
+		}
+		if short < policy.minSide || long > policy.maxSide {
+			return up, fmt.Errorf("%w: image is %dx%d, sides must be between %d and %d pixels",
+				errInvalidUpload, cfg.Width, cfg.Height, policy.minSide, policy.maxSide)
+		}
+		up.Width, up.Height = cfg.Width, cfg.Height
+	}
+	return up, nil
+}
+
+// uploadOwner returns the caller, who owns whatever they upload.
+func (h *Handler) uploadOwner(w http.ResponseWriter, r *http.Request) (dispatch.Identity, bool) {
+	if h.uploads == nil {
+		respondError(w, http.StatusServiceUnavailable, "upload store unavailable")
+		return dispatch.Identity{}, false
+	}
+	id, ok := identityFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return dispatch.Identity{}, false
+	}
+	return id, true
+}
+
+// CreateUpload receives a file as multipart/form-data (fields "purpose",
+// "file" and optionally "sha256"), or reserves a direct upload when sent JSON
+// ({"purpose","contentType","size","sha256"}). Reserved uploads return a URL to
+// PUT the content to, then must be completed with POST .../complete.
+func (h *Handler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	owner, ok := h.uploadOwner(w, r)
+	if !ok {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		h.receiveUpload(w, r, owner)
+		return
+	}
+	h.reserveUpload(w, r, owner)
+}
+
+func (h *Handler) receiveUpload(w http.ResponseWriter, r *http.Request, owner dispatch.Identity) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid multipart upload")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	purpose := r.FormValue("purpose")
+	policy, ok := uploadPolicies[purpose]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "unknown upload purpose")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "file required")
+		return
+	}
+	defer file.Close()
+	body, err := io.ReadAll(io.LimitReader(file, policy.maxBytes+1))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "failed to read file")
+		return
+	}
+	up, err := inspectUpload(policy, header.Header.Get("Content-Type"), r.FormValue("sha256"), body)
+	if err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	id, err := newUploadID()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	now := time.Now().UTC()
+	up.ID = id
+	up.OwnerID = owner.ID
+	up.Purpose = purpose
+	up.Status = dispatch.UploadReady
+	up.ObjectKey = storage.UploadObjectKey(owner.ID, id)
+	up.CreatedAt = now
+	up.CompletedAt = &now
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	if err := h.uploads.PutUploadObject(ctx, up, bytes.NewReader(body)); err != nil {
+		log.Printf("upload %s: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	if err := h.uploads.InsertUpload(ctx, up); err != nil {
+		h.uploads.DeleteUpload(ctx, up)
+		respondError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	respondJSON(w, http.StatusCreated, up)
+}
+
+type reserveUploadPayload struct {
+	Purpose     string `json:"purpose"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+func (h *Handler) reserveUpload(w http.ResponseWriter, r *http.Request, owner dispatch.Identity) {
+	var payload reserveUploadPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	policy, ok := uploadPolicies[payload.Purpose]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "unknown upload purpose")
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(payload.ContentType)
+	if !policy.allows(contentType) {
+		respondError(w, http.StatusUnprocessableEntity, fmt.Sprintf("contentType must be one of %s", strings.Join(policy.types, ", ")))
+		return
+	}
+	if payload.Size <= 0 || payload.Size > policy.maxBytes {
+		respondError(w, http.StatusUnprocessableEntity, fmt.Sprintf("size must be between 1 and %d bytes", policy.maxBytes))
+		return
+	}
+	if sum, err := hex.DecodeString(payload.SHA256); err != nil || len(sum) != sha256.Size {
+		respondError(w, http.StatusUnprocessableEntity, "sha256 must be the hex SHA-256 of the file")
+		return
+	}
+	id, err := newUploadID()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to reserve upload")
+		return
+	}
+	now := time.Now().UTC()
+	expires := now.Add(uploadURLTTL)
+	up := dispatch.Upload{
+		ID:          id,
+		OwnerID:     owner.ID,
+		Purpose:     payload.Purpose,
+		Status:      dispatch.UploadPending,
+		ObjectKey:   storage.UploadObjectKey(owner.ID, id),
+		ContentType: contentType,
+		Size:        payload.Size,
+		SHA256:      strings.ToLower(payload.SHA256),
+		CreatedAt:   now,
+		ExpiresAt:   &expires,
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	uploadURL, presigned, err := h.uploads.PresignUpload(ctx, up, uploadURLTTL)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to reserve upload")
+		return
+	}
+	if !presigned {
+		// Stores without pre-signed URLs take the content through the API.
+		uploadURL = up.ContentURL()
+	}
+	if err := h.uploads.InsertUpload(ctx, up); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to reserve upload")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, http.StatusCreated, map[string]any{
+		"upload":    up,
+		"uploadUrl": uploadURL,
+		"method":    http.MethodPut,
+		"headers":   map[string]string{"Content-Type": contentType},
+		"presigned": presigned,
+		"expiresAt": expires,
+	})
+}
+
+// loadUpload returns the upload named in the URL if the caller owns it or, when
+// reviewers is set, may review driver applications.
+func (h *Handler) loadUpload(w http.ResponseWriter, r *http.Request, reviewers bool) (dispatch.Upload, bool) {
+	if h.uploads == nil {
+		respondError(w, http.StatusServiceUnavailable, "upload store unavailable")
+		return dispatch.Upload{}, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	up, found, err := h.uploads.GetUpload(ctx, chi.URLParam(r, "uploadID"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to load upload")
+		return dispatch.Upload{}, false
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "upload not found")
+		return dispatch.Upload{}, false
+	}
+	id, ok := identityFromContext(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return dispatch.Upload{}, false
+	}
+	if id.ID != up.OwnerID && !(reviewers && auth.Can(id.Role, auth.PermApplicationsReadAny)) {
+		respondError(w, http.StatusForbidden, "forbidden")
+		return dispatch.Upload{}, false
+	}
+	return up, true
+}
+
+// PutUploadContent receives the content of a reserved upload when the blob
+// store cannot hand out pre-signed URLs.
+func (h *Handler) PutUploadContent(w http.ResponseWriter, r *http.Request) {
+	up, ok := h.loadUpload(w, r, false)
+	if !ok {
+		return
+	}
+	if up.Status != dispatch.UploadPending {
+		respondError(w, http.StatusConflict, "upload already completed")
+		return
+	}
+	if up.ExpiresAt != nil && time.Now().After(*up.ExpiresAt) {
+		respondError(w, http.StatusGone, "upload expired")
+		return
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != up.ContentType {
+		respondError(w, http.StatusUnprocessableEntity, "Content-Type must be "+up.ContentType)
+		return
+	}
+	if r.ContentLength != up.Size {
+		respondError(w, http.StatusUnprocessableEntity, "Content-Length must be "+strconv.FormatInt(up.Size, 10))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	body := http.MaxBytesReader(w, r.Body, up.Size)
+	if err := h.uploads.PutUploadObject(ctx, up, body); err != nil {
+		log.Printf("upload %s: %v", up.ID, err)
+		respondError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CompleteUpload checks a reserved upload's content once the client has sent
+// it. Content that fails the checks is discarded and the upload must be
+// started again.
+func (h *Handler) CompleteUpload(w http.ResponseWriter, r *http.Request) {
+	up, ok := h.loadUpload(w, r, false)
+	if !ok {
+		return
+	}
+	if up.Status == dispatch.UploadReady {
+		respondJSON(w, http.StatusOK, up)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	if up.ExpiresAt != nil && time.Now().After(*up.ExpiresAt) {
+		h.uploads.DeleteUpload(ctx, up)
+		respondError(w, http.StatusGone, "upload expired")
+		return
+	}
+	obj, err := h.uploads.OpenUploadObject(ctx, up)
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		respondError(w, http.StatusConflict, "content not uploaded yet")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to read upload")
+		return
+	}
+	policy := uploadPolicies[up.Purpose]
+	body, err := io.ReadAll(io.LimitReader(obj, policy.maxBytes+1))
+	obj.Close()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to read upload")
+		return
+	}
+	measured, err := inspectUpload(policy, up.ContentType, up.SHA256, body)
+	if err == nil && measured.Size != up.Size {
+		err = fmt.Errorf("%w: got %d bytes, declared %d", errInvalidUpload, measured.Size, up.Size)
+	}
+	if err != nil {
+		h.uploads.DeleteUpload(ctx, up)
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	up.Width, up.Height = measured.Width, measured.Height
+	completed, err := h.uploads.CompleteUpload(ctx, up)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to complete upload")
+		return
+	}
+	if !completed {
+		respondError(w, http.StatusConflict, "upload changed concurrently")
+		return
+	}
+	now := time.Now().UTC()
+	up.Status = dispatch.UploadReady
+	up.ExpiresAt = nil
+	up.CompletedAt = &now
+	respondJSON(w, http.StatusOK, up)
+}
+
+// GetUpload returns an upload's metadata to its owner or an application reviewer.
+func (h *Handler) GetUpload(w http.ResponseWriter, r *http.Request) {
+	up, ok := h.loadUpload(w, r, true)
+	if !ok {
+		return
+	}
+	respondJSON(w, http.StatusOK, up)
+}
+
+// GetUploadContent streams a completed upload to its owner or an application reviewer.
+func (h *Handler) GetUploadContent(w http.ResponseWriter, r *http.Request) {
+	up, ok := h.loadUpload(w, r, true)
+	if !ok {
+		return
+	}
+	if up.Status != dispatch.UploadReady {
+		respondError(w, http.StatusConflict, "upload not completed")
+		return
+	}
+	obj, err := h.uploads.OpenUploadObject(r.Context(), up)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to read upload")
+		return
+	}
+	defer obj.Close()
+	w.Header().Set("Content-Type", up.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(up.Size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("ETag", `"`+up.SHA256+`"`)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, obj)
+}
+
+// applicationUpload resolves an upload ID sent with a driver application,
+// checking that the driver owns it, it is complete and it was uploaded for
+// purpose. An empty ID resolves to the zero Upload.
+func (h *Handler) applicationUpload(ctx context.Context, driverID, field, id, purpose string) (dispatch.Upload, error) {
+	if id == "" {
+		return dispatch.Upload{}, nil
+	}
+	if h.uploads == nil {
+		return dispatch.Upload{}, errUploadsUnavailable
+	}
+	up, found, err := h.uploads.GetUpload(ctx, id)
+	if err != nil {
+		return dispatch.Upload{}, err
+	}
+	switch {
+	case !found || up.OwnerID != driverID:
+		return dispatch.Upload{}, fmt.Errorf("%w: %s: upload %q not found", errInvalidUpload, field, id)
+	case up.Status != dispatch.UploadReady:
+		return dispatch.Upload{}, fmt.Errorf("%w: %s: upload %q is not completed", errInvalidUpload, field, id)
+	case up.Purpose != purpose:
+		return dispatch.Upload{}, fmt.Errorf("%w: %s: upload %q is a %s, want %s", errInvalidUpload, field, id, up.Purpose, purpose)
+	}
+	return up, nil
+}
+
+// readUpload loads the completed upload a content URL stored on an
+// application points to.
+func (h *Handler) readUpload(ctx context.Context, contentURL string) (dispatch.Upload, []byte, error) {
+	if h.uploads == nil {
+		return dispatch.Upload{}, nil, errUploadsUnavailable
+	}
+	id, hasPrefix := strings.CutPrefix(contentURL, "/api/uploads/")
+	id, hasSuffix := strings.CutSuffix(id, "/content")
+	if !hasPrefix || !hasSuffix {
+		return dispatch.Upload{}, nil, fmt.Errorf("%w: %q is not an upload", errInvalidUpload, contentURL)
+	}
+	up, found, err := h.uploads.GetUpload(ctx, id)
+	if err != nil {
+		return up, nil, err
+	}
+	if !found || up.Status != dispatch.UploadReady {
+		return up, nil, fmt.Errorf("%w: upload %q not found", errInvalidUpload, id)
+	}
+	obj, err := h.uploads.OpenUploadObject(ctx, up)
+	if err != nil {
+		return up, nil, err
+	}
+	defer obj.Close()
+	body, err := io.ReadAll(io.LimitReader(obj, maxUploadBytes))
+	return up, body, err
+}
+
+var errUploadsUnavailable = errors.New("upload store unavailable")
+
+func newUploadID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "upl_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Partner API keys let hotels and corporate accounts book rides on behalf of
+// guests. Keys look like "tdk_<selector>.<secret>"; like bearer tokens only the
+// selector and a salted hash of the secret are stored.
+const apiKeyPrefix = "tdk_"
+
+var (
+	ErrAPIKeySpec    = errors.New("invalid api key request")
+	ErrAPIKeyInvalid = errors.New("invalid api key")
+)
+
+// APIKey is the stored form of a partner key.
+type APIKey struct {
+	ID     string       `json:"id"`
+	OrgID  string       `json:"orgId"`
+	Name   string       `json:"name"`
+	Scopes []Permission `json:"scopes"`
+	// RatePerMinute caps requests made with the key; 0 falls back to the default API policy.
+	RatePerMinute int        `json:"ratePerMinute"`
+	UsageCount    int64      `json:"usageCount"`
+	LastUsedAt    *time.Time `json:"lastUsedAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+
+	Selector string `json:"-"`
+	Salt     string `json:"-"`
+	Hash     string `json:"-"`
+}
+
+// Allows reports whether the key was granted any of the permissions.
+func (k APIKey) Allows(perms ...Permission) bool {
+	for _, p := range perms {
+		for _, s := range k.Scopes {
+			if s == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Identity is the principal requests made with the key act as: the partner org.
+func (k APIKey) Identity() dispatch.Identity {
+	return dispatch.Identity{ID: k.OrgID, Role: dispatch.RolePartner}
+}
+
+// APIKeyStore persists partner keys.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKey(ctx context.Context, selector string) (APIKey, bool, error)
+	ListAPIKeys(ctx context.Context, orgID string) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) (bool, error)
+	// AddAPIKeyUsage adds n requests to the key's counter and bumps last use.
+	AddAPIKeyUsage(ctx context.Context, id string, n int64, at time.Time) error
+}
+
+// IsAPIKey reports whether the credential is a partner key rather than a bearer token.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// APIKeys issues and authenticates partner keys. Usage is counted in memory and
+// flushed to the store periodically so authentication stays a single read.
+type APIKeys struct {
+	store APIKeyStore
+
+	mu       sync.Mutex
+	pending  map[string]int64
+	lastUsed map[string]time.Time
+}
+
+func NewAPIKeys(store APIKeyStore) *APIKeys {
+	return &APIKeys{store: store, pending: make(map[string]int64), lastUsed: make(map[string]time.Time)}
+}
+
+// Create issues a key for the org; the plaintext is returned once and never stored.
+func (k *APIKeys) Create(ctx context.Context, orgID, name string, scopes []Permission, ratePerMinute int) (APIKey, string, error) {
+	if orgID == "" {
+		return APIKey{}, "", fmt.Errorf("%w: orgId required", ErrAPIKeySpec)
+	}
+	if len(scopes) == 0 {
+		return APIKey{}, "", fmt.Errorf("%w: at least one scope required", ErrAPIKeySpec)
+	}
+	for _, s := range scopes {
+		if !Can(dispatch.RolePartner, s) {
+			return APIKey{}, "", fmt.Errorf("%w: scope %q not grantable to partners", ErrAPIKeySpec, s)
+		}
+	}
+	if ratePerMinute < 0 {
+		return APIKey{}, "", fmt.Errorf("%w: ratePerMinute must not be negative", ErrAPIKeySpec)
+	}
+	token := randomHex(8) + "." + randomHex(24)
+	rec := HashToken(token)
+	key := APIKey{
+		ID:            "key_" + randomHex(8),
+		OrgID:         orgID,
+		Name:          name,
+		Scopes:        scopes,
+		RatePerMinute: ratePerMinute,
+		CreatedAt:     time.Now().UTC(),
+		Selector:      rec.Selector,
+		Salt:          rec.Salt,
+		Hash:          rec.Hash,
+	}
+	if err := k.store.CreateAPIKey(ctx, key); err != nil {
+		return APIKey{}, "", err
+	}
+	return key, apiKeyPrefix + token, nil
+}
+
+// Authenticate verifies a presented key and counts the request against it.
+func (k *APIKeys) Authenticate(ctx context.Context, raw string) (APIKey, error) {
+	if !IsAPIKey(raw) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	selector, secret, ok := strings.Cut(strings.TrimPrefix(raw, apiKeyPrefix), ".")
+	if !ok {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	key, found, err := k.store.GetAPIKey(ctx, selector)
+	if err != nil {
+		return APIKey{}, err
+	}
+	rec := TokenRecord{Salt: key.Salt, Hash: key.Hash}
+	if !found || key.RevokedAt != nil || !rec.Verify(secret) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	k.mu.Lock()
+	k.pending[key.ID]++
+	k.lastUsed[key.ID] = time.Now().UTC()
+	k.mu.Unlock()
+	return key, nil
+}
+
+// List returns the org's keys with unflushed usage folded in.
+func (k *APIKeys) List(ctx context.Context, orgID string) ([]APIKey, error) {
+	keys, err := k.store.ListAPIKeys(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i := range keys {
+		keys[i].UsageCount += k.pending[keys[i].ID]
+		if at, ok := k.lastUsed[keys[i].ID]; ok {
+			keys[i].LastUsedAt = &at
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (k *APIKeys) Revoke(ctx context.Context, id string) (bool, error) {
+	return k.store.RevokeAPIKey(ctx, id)
+}
+
+// Flush writes pending usage counts to the store. Counts that fail to write are
+// kept for the next flush.
+func (k *APIKeys) Flush(ctx context.Context) error {
+	k.mu.Lock()
+	pending, lastUsed := k.pending, k.lastUsed
+	k.pending, k.lastUsed = make(map[string]int64), make(map[string]time.Time)
+	k.mu.Unlock()
+
+	var firstErr error
+	for id, n := range pending {
+		if err := k.store.AddAPIKeyUsage(ctx, id, n, lastUsed[id]); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			k.mu.Lock()
+			k.pending[id] += n
+			if at, ok := k.lastUsed[id]; !ok || at.Before(lastUsed[id]) {
+				k.lastUsed[id] = lastUsed[id]
+			}
+			k.mu.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// Run flushes usage every interval until ctx is done.
+func (k *APIKeys) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := k.Flush(flushCtx); err != nil {
+				log.Printf("apikeys: usage flush failed: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// MemoryAPIKeyStore keeps keys in process; used when Postgres is unavailable.
+type MemoryAPIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]APIKey // by selector
+}
+
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+func (m *MemoryAPIKeyStore) CreateAPIKey(_ context.Context, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key.Selector] = key
+	return nil
+}
+
+func (m *MemoryAPIKeyStore) GetAPIKey(_ context.Context, selector string) (APIKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.keys[selector]
+	return key, ok, nil
+}
+
+func (m *MemoryAPIKeyStore) ListAPIKeys(_ context.Context, orgID string) ([]APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []APIKey
+	for _, key := range m.keys {
+		if key.OrgID == orgID {
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryAPIKeyStore) RevokeAPIKey(_ context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for selector, key := range m.keys {
+		if key.ID == id && key.RevokedAt == nil {
+			now := time.Now().UTC()
+			key.RevokedAt = &now
+			m.keys[selector] = key
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryAPIKeyStore) AddAPIKeyUsage(_ context.Context, id string, n int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for selector, key := range m.keys {
+		if key.ID == id {
+			key.UsageCount += n
+			key.LastUsedAt = &at
+			m.keys[selector] = key
+			return nil
+		}
+	}
+	return nil
+}
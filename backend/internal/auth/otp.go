@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+var (
+	ErrInvalidPhone = errors.New("phone must be in E.164 format, e.g. +15551234567")
+	ErrOTPCooldown  = errors.New("code recently sent, wait before requesting another")
+	ErrOTPInvalid   = errors.New("invalid or expired code")
+	ErrOTPLocked    = errors.New("too many attempts, try again later")
+)
+
+// OTPChallenge is a pending one-time code for a phone and role. Only a salted
+// hash of the code is kept. Attempts count every guess since WindowStartedAt,
+// across resent codes.
+type OTPChallenge struct {
+	Phone           string
+	Role            dispatch.IdentityRole
+	Salt            string
+	Hash            string
+	Attempts        int
+	ExpiresAt       time.Time
+	LastSentAt      time.Time
+	WindowStartedAt time.Time
+}
+
+// OTPStore persists challenges and the phone → identity mapping.
+type OTPStore interface {
+	GetOTPChallenge(ctx context.Context, phone string, role dispatch.IdentityRole) (OTPChallenge, bool, error)
+	SaveOTPChallenge(ctx context.Context, ch OTPChallenge) error
+	// RecordOTPAttempt counts an attempt against the challenge, atomically and
+	// only while fewer than max were made, and returns the challenge as it was
+	// counted. It reports false if there is no challenge or no attempt is left.
+	RecordOTPAttempt(ctx context.Context, phone string, role dispatch.IdentityRole, max int) (OTPChallenge, bool, error)
+	DeleteOTPChallenge(ctx context.Context, phone string, role dispatch.IdentityRole) error
+	PhoneIdentity(ctx context.Context, phone string, role dispatch.IdentityRole) (string, bool, error)
+	// LinkPhoneIdentity maps the phone to identityID unless already mapped, and
+	// returns the identity that ends up linked.
+	LinkPhoneIdentity(ctx context.Context, phone string, role dispatch.IdentityRole, identityID string) (string, error)
+}
+
+// SMSSender delivers text messages to a phone number.
+type SMSSender interface {
+	Send(ctx context.Context, phone, message string) error
+}
+
+// OTPService issues and verifies phone login codes. A phone gets maxAttempts
+// guesses per window, however many codes it is sent; once they are used up it
+// is locked out until the window ends.
+type OTPService struct {
+	store       OTPStore
+	sms         SMSSender
+	codeTTL     time.Duration
+	cooldown    time.Duration
+	window      time.Duration
+	maxAttempts int
+}
+
+func NewOTPService(store OTPStore, sms SMSSender, codeTTL, cooldown, window time.Duration, maxAttempts int) *OTPService {
+	if codeTTL <= 0 {
+		codeTTL = 5 * time.Minute
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	if window <= 0 {
+		window = time.Hour
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	return &OTPService{store: store, sms: sms, codeTTL: codeTTL, cooldown: cooldown, window: window, maxAttempts: maxAttempts}
+}
+
+// Store exposes the phone → identity mapping to callers resolving identities.
+func (s *OTPService) Store() OTPStore {
+	return s.store
+}
+
+// NormalizePhone strips formatting and validates an E.164 number.
+func NormalizePhone(raw string) (string, error) {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(raw) {
+		switch {
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.':
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	phone := b.String()
+	if !strings.HasPrefix(phone, "+") || len(phone) < 9 || len(phone) > 16 {
+		return "", ErrInvalidPhone
+	}
+	return phone, nil
+}
+
+// Start sends a fresh code unless one was sent within the cooldown or the
+// phone is locked out. The returned duration is how long the caller must wait
+// when ErrOTPCooldown or ErrOTPLocked is returned.
+func (s *OTPService) Start(ctx context.Context, phone string, role dispatch.IdentityRole) (time.Duration, error) {
+	now := time.Now()
+	code := newOTPCode()
+	salt := randomHex(16)
+	ch := OTPChallenge{
+		Phone:           phone,
+		Role:            role,
+		Salt:            salt,
+		Hash:            hashSecret(salt, code),
+		ExpiresAt:       now.Add(s.codeTTL),
+		LastSentAt:      now,
+		WindowStartedAt: now,
+	}
+	if existing, ok, err := s.store.GetOTPChallenge(ctx, phone, role); err != nil {
+		return 0, err
+	} else if ok {
+		if end := existing.WindowStartedAt.Add(s.window); now.Before(end) {
+			if existing.Attempts >= s.maxAttempts {
+				return end.Sub(now), ErrOTPLocked
+			}
+			// Guesses at earlier codes still count.
+			ch.Attempts, ch.WindowStartedAt = existing.Attempts, existing.WindowStartedAt
+		}
+		if wait := existing.LastSentAt.Add(s.cooldown).Sub(now); wait > 0 {
+			return wait, ErrOTPCooldown
+		}
+	}
+	if err := s.store.SaveOTPChallenge(ctx, ch); err != nil {
+		return 0, err
+	}
+	msg := fmt.Sprintf("Your TurboDriver code is %s. It expires in %d minutes.", code, int(s.codeTTL.Minutes()))
+	if err := s.sms.Send(ctx, phone, msg); err != nil {
+		// Void the unsent code but keep the count, and allow an immediate retry.
+		ch.ExpiresAt, ch.LastSentAt = now, time.Time{}
+		_ = s.store.SaveOTPChallenge(ctx, ch)
+		return 0, err
+	}
+	return 0, nil
+}
+
+// Verify checks a code. Each guess counts against the attempt limit of the
+// window; once exhausted the challenge stays in place as a lockout until the
+// window ends, and no new code can be requested meanwhile.
+func (s *OTPService) Verify(ctx context.Context, phone string, role dispatch.IdentityRole, code string) error {
+	ch, ok, err := s.store.GetOTPChallenge(ctx, phone, role)
+	if err != nil {
+		return err
+	}
+	if !ok || time.Now().After(ch.ExpiresAt) {
+		return ErrOTPInvalid
+	}
+	if ch.Attempts >= s.maxAttempts {
+		return ErrOTPLocked
+	}
+	// Count the attempt before comparing, so concurrent guesses cannot all
+	// slip in under the limit.
+	ch, ok, err = s.store.RecordOTPAttempt(ctx, phone, role, s.maxAttempts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrOTPLocked
+	}
+	if time.Now().After(ch.ExpiresAt) {
+		return ErrOTPInvalid
+	}
+	if !(TokenRecord{Salt: ch.Salt, Hash: ch.Hash}).Verify(strings.TrimSpace(code)) {
+		if ch.Attempts >= s.maxAttempts {
+			return ErrOTPLocked
+		}
+		return ErrOTPInvalid
+	}
+	return s.store.DeleteOTPChallenge(ctx, phone, role)
+}
+
+func newOTPCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "000000"
+	}
+	return fmt.Sprintf("%06d", n.Int64())
+}
+
+// MemoryOTPStore keeps challenges and phone links in process (dev and tests).
+type MemoryOTPStore struct {
+	mu         sync.Mutex
+	challenges map[string]OTPChallenge
+	phones     map[string]string
+}
+
+func NewMemoryOTPStore() *MemoryOTPStore {
+	return &MemoryOTPStore{
+		challenges: make(map[string]OTPChallenge),
+		phones:     make(map[string]string),
+	}
+}
+
+func otpKey(phone string, role dispatch.IdentityRole) string {
+	return string(role) + "|" + phone
+}
+
+func (m *MemoryOTPStore) GetOTPChallenge(_ context.Context, phone string, role dispatch.IdentityRole) (OTPChallenge, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.challenges[otpKey(phone, role)]
+	return ch, ok, nil
+}
+
+func (m *MemoryOTPStore) SaveOTPChallenge(_ context.Context, ch OTPChallenge) error {
+	m.mu.Lock()
+	m.challenges[otpKey(ch.Phone, ch.Role)] = ch
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryOTPStore) RecordOTPAttempt(_ context.Context, phone string, role dispatch.IdentityRole, max int) (OTPChallenge, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := otpKey(phone, role)
+	ch, ok := m.challenges[key]
+	if !ok || ch.Attempts >= max {
+		return OTPChallenge{}, false, nil
+	}
+	ch.Attempts++
+	m.challenges[key] = ch
+	return ch, true, nil
+}
+
+func (m *MemoryOTPStore) DeleteOTPChallenge(_ context.Context, phone string, role dispatch.IdentityRole) error {
+	m.mu.Lock()
+	delete(m.challenges, otpKey(phone, role))
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryOTPStore) PhoneIdentity(_ context.Context, phone string, role dispatch.IdentityRole) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.phones[otpKey(phone, role)]
+	return id, ok, nil
+}
+
+func (m *MemoryOTPStore) LinkPhoneIdentity(_ context.Context, phone string, role dispatch.IdentityRole, identityID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := otpKey(phone, role)
+	if existing, ok := m.phones[key]; ok {
+		return existing, nil
+	}
+	m.phones[key] = identityID
+	return identityID, nil
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"sort"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Permission names an action, scoped as resource:verb[:scope]. ":own" permissions
+// still require the handler to check that the caller owns the resource.
+type Permission string
+
+const (
+	PermRidesRequest   Permission = "rides:request"
+	PermRidesReadOwn   Permission = "rides:read:own"
+	PermRidesReadAny   Permission = "rides:read:any"
+	PermRidesDrive     Permission = "rides:drive"
+	PermRidesCancelOwn Permission = "rides:cancel:own"
+	PermRidesCancelAny Permission = "rides:cancel:any"
+	PermRideEventsRead Permission = "rides:events:read"
+	PermHistoryReadOwn Permission = "history:read:own"
+
+	PermChatParticipate Permission = "chat:participate"
+	PermSharesManageOwn Permission = "shares:manage:own"
+	PermSharesManageAny Permission = "shares:manage:any"
+	PermSafetyReport    Permission = "safety:report"
+	PermSafetyRead      Permission = "safety:read"
+	PermSafetyManage    Permission = "safety:manage"
+	PermRatingsWrite    Permission = "ratings:write"
+
+	PermApplicationsSubmit  Permission = "applications:submit"
+	PermApplicationsReadAny Permission = "applications:read:any"
+	PermApplicationsReview  Permission = "applications:review"
+	PermProfilesWriteOwn    Permission = "profiles:write:own"
+	PermProfilesReadOwn     Permission = "profiles:read:own"
+	PermProfilesReadAny     Permission = "profiles:read:any"
+	// PermAccountManageOwn covers exporting and erasing the caller's own data.
+	PermAccountManageOwn Permission = "account:manage:own"
+	PermUploadsWriteOwn  Permission = "uploads:write:own"
+
+	PermIdentitiesIssue  Permission = "identities:issue"
+	PermIdentitiesRevoke Permission = "identities:revoke"
+	// PermIdentitiesActAs lets the holder act on behalf of any driver or passenger.
+	PermIdentitiesActAs Permission = "identities:act_as"
+	PermLocationsManage Permission = "locations:manage"
+	PermPartnersManage  Permission = "partners:manage"
+	PermAdminConsole    Permission = "admin:console"
+)
+
+// participantOnly permissions only make sense for the people on a ride or the
+// owner of an account; admins do not inherit them.
+var participantOnly = map[Permission]bool{
+	PermChatParticipate:  true,
+	PermSafetyReport:     true,
+	PermRatingsWrite:     true,
+	PermAccountManageOwn: true,
+	PermUploadsWriteOwn:  true,
+}
+
+// AllPermissions lists every known permission.
+var AllPermissions = []Permission{
+	PermRidesRequest, PermRidesReadOwn, PermRidesReadAny, PermRidesDrive,
+	PermRidesCancelOwn, PermRidesCancelAny, PermRideEventsRead, PermHistoryReadOwn,
+	PermChatParticipate, PermSharesManageOwn, PermSharesManageAny,
+	PermSafetyReport, PermSafetyRead, PermSafetyManage, PermRatingsWrite,
+	PermApplicationsSubmit, PermApplicationsReadAny, PermApplicationsReview,
+	PermProfilesWriteOwn, PermProfilesReadOwn, PermProfilesReadAny, PermAccountManageOwn,
+	PermUploadsWriteOwn,
+	PermIdentitiesIssue, PermIdentitiesRevoke, PermIdentitiesActAs,
+	PermLocationsManage, PermPartnersManage, PermAdminConsole,
+}
+
+// rolePermissions maps every role to the permissions it is granted.
+var rolePermissions = map[dispatch.IdentityRole][]Permission{
+	dispatch.RolePassenger: {
+		PermRidesRequest, PermRidesReadOwn, PermRidesCancelOwn, PermHistoryReadOwn,
+		PermChatParticipate, PermSharesManageOwn, PermSafetyReport, PermRatingsWrite,
+		PermProfilesWriteOwn, PermProfilesReadOwn, PermAccountManageOwn,
+	},
+	dispatch.RoleDriver: {
+		PermRidesReadOwn, PermRidesDrive, PermRidesCancelOwn, PermHistoryReadOwn,
+		PermChatParticipate, PermSafetyReport, PermRatingsWrite,
+		PermApplicationsSubmit, PermProfilesReadOwn, PermAccountManageOwn, PermUploadsWriteOwn,
+	},
+	dispatch.RoleSupportAgent: {
+		PermRidesReadAny, PermRidesCancelAny, PermRideEventsRead,
+		PermSafetyRead, PermSafetyManage, PermProfilesReadAny, PermAdminConsole,
+	},
+	dispatch.RoleOpsManager: {
+		PermRidesReadAny, PermRidesCancelAny, PermRideEventsRead,
+		PermSafetyRead, PermSafetyManage, PermProfilesReadAny,
+		PermApplicationsReadAny, PermApplicationsReview,
+		PermIdentitiesRevoke, PermLocationsManage, PermPartnersManage, PermAdminConsole,
+	},
+	dispatch.RoleReviewer: {
+		PermApplicationsReadAny, PermApplicationsReview, PermProfilesReadAny, PermAdminConsole,
+	},
+	// Partner keys are scoped to a subset of these.
+	dispatch.RolePartner: {
+		PermRidesRequest, PermRidesReadOwn, PermRidesCancelOwn,
+	},
+	dispatch.RoleAdmin: adminPermissions(),
+}
+
+func adminPermissions() []Permission {
+	var perms []Permission
+	for _, p := range AllPermissions {
+		if !participantOnly[p] {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+var grants = buildGrants()
+
+func buildGrants() map[dispatch.IdentityRole]map[Permission]bool {
+	out := make(map[dispatch.IdentityRole]map[Permission]bool, len(rolePermissions))
+	for role, perms := range rolePermissions {
+		set := make(map[Permission]bool, len(perms))
+		for _, p := range perms {
+			set[p] = true
+		}
+		out[role] = set
+	}
+	return out
+}
+
+// Can reports whether the role holds the permission.
+func Can(role dispatch.IdentityRole, perm Permission) bool {
+	return grants[role][perm]
+}
+
+// CanAny reports whether the role holds at least one of the permissions.
+func CanAny(role dispatch.IdentityRole, perms ...Permission) bool {
+	for _, p := range perms {
+		if grants[role][p] {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionsFor returns the role's permissions, sorted.
+func PermissionsFor(role dispatch.IdentityRole) []Permission {
+	perms := append([]Permission(nil), rolePermissions[role]...)
+	sort.Slice(perms, func(i, j int) bool { return perms[i] < perms[j] })
+	return perms
+}
+
+// Roles returns every defined role, sorted.
+func Roles() []dispatch.IdentityRole {
+	roles := make([]dispatch.IdentityRole, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i] < roles[j] })
+	return roles
+}
+
+// ValidRole reports whether the role is defined.
+func ValidRole(role dispatch.IdentityRole) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// SelfService reports whether identities of the role may be created without an admin.
+func SelfService(role dispatch.IdentityRole) bool {
+	return role == dispatch.RolePassenger || role == dispatch.RoleDriver
+}
+
+// StaffOnly reports whether none of the permissions is held by a self-service
+// role, i.e. the route is for staff and must be enforced even in open dev mode.
+func StaffOnly(perms ...Permission) bool {
+	for _, p := range perms {
+		if Can(dispatch.RolePassenger, p) || Can(dispatch.RoleDriver, p) {
+			return false
+		}
+	}
+	return true
+}
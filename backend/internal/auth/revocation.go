@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const revocationChannel = "turbodriver:auth:revocations"
+
+// Revocation identifies one opaque token (by selector), one signed access token
+// (by TokenID, kept on a deny list until Expiry) or all tokens of an identity
+// (signed tokens issued at or before At are rejected).
+type Revocation struct {
+	Selector   string `json:"selector,omitempty"`
+	TokenID    string `json:"tokenId,omitempty"`
+	Expiry     int64  `json:"expiry,omitempty"`
+	IdentityID string `json:"identityId,omitempty"`
+	At         int64  `json:"at,omitempty"`
+}
+
+// RevocationBus fans revocations out to every replica's token cache.
+type RevocationBus interface {
+	Publish(ctx context.Context, rev Revocation) error
+}
+
+// RedisRevocations distributes revocations over Redis pub/sub.
+type RedisRevocations struct {
+	client *redis.Client
+}
+
+func NewRedisRevocations(client *redis.Client) *RedisRevocations {
+	return &RedisRevocations{client: client}
+}
+
+func (r *RedisRevocations) Publish(ctx context.Context, rev Revocation) error {
+	payload, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, revocationChannel, payload).Err()
+}
+
+// Listen applies revocations published by any replica until ctx is done.
+func (r *RedisRevocations) Listen(ctx context.Context, store *InMemoryStore) {
+	sub := r.client.Subscribe(ctx, revocationChannel)
+	defer sub.Close()
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var rev Revocation
+			if err := json.Unmarshal([]byte(msg.Payload), &rev); err != nil {
+				log.Printf("auth: bad revocation payload: %v", err)
+				continue
+			}
+			store.Apply(rev)
+		}
+	}
+}
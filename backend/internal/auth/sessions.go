@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+var (
+	ErrInvalidRefresh = errors.New("invalid refresh token")
+	ErrRefreshReused  = errors.New("refresh token reuse detected")
+)
+
+// RefreshRecord is a stored refresh token. Tokens rotated from one another share
+// a FamilyID so that replaying a used token can revoke the whole chain.
+type RefreshRecord struct {
+	TokenRecord
+	FamilyID  string
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// RefreshStore persists refresh tokens.
+type RefreshStore interface {
+	SaveRefreshToken(ctx context.Context, rec RefreshRecord) error
+	GetRefreshToken(ctx context.Context, selector string) (RefreshRecord, bool, error)
+	// ClaimRefreshToken marks the token used; false means it was already used or revoked.
+	ClaimRefreshToken(ctx context.Context, selector string) (bool, error)
+	RevokeRefreshFamily(ctx context.Context, familyID string) error
+	RevokeRefreshForIdentity(ctx context.Context, identityID string) error
+}
+
+// TokenPair is what a client receives after signing in or refreshing.
+type TokenPair struct {
+	AccessToken      string    `json:"token"`
+	AccessExpiresAt  time.Time `json:"expiresAt"`
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
+
+// Sessions issues short-lived signed access tokens backed by rotating refresh tokens.
+type Sessions struct {
+	keys       *Keyring
+	refresh    RefreshStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func NewSessions(keys *Keyring, refresh RefreshStore, accessTTL, refreshTTL time.Duration) *Sessions {
+	if accessTTL <= 0 {
+		accessTTL = 15 * time.Minute
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = 30 * 24 * time.Hour
+	}
+	return &Sessions{keys: keys, refresh: refresh, accessTTL: accessTTL, refreshTTL: refreshTTL}
+}
+
+// Verify validates a signed access token.
+func (s *Sessions) Verify(token string) (Claims, error) {
+	return s.keys.Verify(token)
+}
+
+// Issue starts a new refresh family for the identity.
+func (s *Sessions) Issue(ctx context.Context, identity dispatch.Identity) (TokenPair, error) {
+	return s.issue(ctx, identity, randomHex(12))
+}
+
+func (s *Sessions) issue(ctx context.Context, identity dispatch.Identity, familyID string) (TokenPair, error) {
+	now := time.Now()
+	pair := TokenPair{
+		AccessExpiresAt:  now.Add(s.accessTTL),
+		RefreshExpiresAt: now.Add(s.refreshTTL),
+	}
+	access, err := s.keys.Sign(Claims{
+		Subject:  identity.ID,
+		Role:     identity.Role,
+		IssuedAt: now.Unix(),
+		Expiry:   pair.AccessExpiresAt.Unix(),
+		ID:       randomHex(8),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, rec := NewToken(identity.ID, identity.Role, &pair.RefreshExpiresAt)
+	if err := s.refresh.SaveRefreshToken(ctx, RefreshRecord{TokenRecord: rec, FamilyID: familyID}); err != nil {
+		return TokenPair{}, err
+	}
+	pair.AccessToken = access
+	pair.RefreshToken = refresh
+	return pair, nil
+}
+
+// Refresh exchanges a refresh token for a new pair. Presenting a token that was
+// already rotated revokes its whole family and returns ErrRefreshReused.
+func (s *Sessions) Refresh(ctx context.Context, token string) (dispatch.Identity, TokenPair, error) {
+	selector, secret := SplitToken(token)
+	rec, ok, err := s.refresh.GetRefreshToken(ctx, selector)
+	if err != nil {
+		return dispatch.Identity{}, TokenPair{}, err
+	}
+	if !ok || !rec.Verify(secret) || rec.RevokedAt != nil || rec.Expired(time.Now()) {
+		return dispatch.Identity{}, TokenPair{}, ErrInvalidRefresh
+	}
+	claimed := false
+	if rec.UsedAt == nil {
+		if claimed, err = s.refresh.ClaimRefreshToken(ctx, selector); err != nil {
+			return dispatch.Identity{}, TokenPair{}, err
+		}
+	}
+	if !claimed {
+		if err := s.refresh.RevokeRefreshFamily(ctx, rec.FamilyID); err != nil {
+			return dispatch.Identity{}, TokenPair{}, err
+		}
+		return dispatch.Identity{}, TokenPair{}, ErrRefreshReused
+	}
+	identity := dispatch.Identity{ID: rec.IdentityID, Role: rec.Role}
+	pair, err := s.issue(ctx, identity, rec.FamilyID)
+	if err != nil {
+		return dispatch.Identity{}, TokenPair{}, err
+	}
+	return identity, pair, nil
+}
+
+// RevokeRefresh ends the refresh family the token belongs to.
+func (s *Sessions) RevokeRefresh(ctx context.Context, token string) error {
+	selector, secret := SplitToken(token)
+	rec, ok, err := s.refresh.GetRefreshToken(ctx, selector)
+	if err != nil || !ok || !rec.Verify(secret) {
+		return err
+	}
+	return s.refresh.RevokeRefreshFamily(ctx, rec.FamilyID)
+}
+
+// RevokeIdentity ends every refresh family of the identity.
+func (s *Sessions) RevokeIdentity(ctx context.Context, identityID string) error {
+	return s.refresh.RevokeRefreshForIdentity(ctx, identityID)
+}
+
+// MemoryRefreshStore keeps refresh tokens in process (dev and tests).
+type MemoryRefreshStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshRecord
+}
+
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{tokens: make(map[string]RefreshRecord)}
+}
+
+func (m *MemoryRefreshStore) SaveRefreshToken(_ context.Context, rec RefreshRecord) error {
+	m.mu.Lock()
+	m.tokens[rec.Selector] = rec
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryRefreshStore) GetRefreshToken(_ context.Context, selector string) (RefreshRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.tokens[selector]
+	return rec, ok, nil
+}
+
+func (m *MemoryRefreshStore) ClaimRefreshToken(_ context.Context, selector string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.tokens[selector]
+	if !ok || rec.UsedAt != nil || rec.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	rec.UsedAt = &now
+	m.tokens[selector] = rec
+	return true, nil
+}
+
+func (m *MemoryRefreshStore) RevokeRefreshFamily(_ context.Context, familyID string) error {
+	m.revokeWhere(func(rec RefreshRecord) bool { return rec.FamilyID == familyID })
+	return nil
+}
+
+func (m *MemoryRefreshStore) RevokeRefreshForIdentity(_ context.Context, identityID string) error {
+	m.revokeWhere(func(rec RefreshRecord) bool { return rec.IdentityID == identityID })
+	return nil
+}
+
+func (m *MemoryRefreshStore) revokeWhere(match func(RefreshRecord) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for selector, rec := range m.tokens {
+		if match(rec) && rec.RevokedAt == nil {
+			rec.RevokedAt = &now
+			m.tokens[selector] = rec
+		}
+	}
+}
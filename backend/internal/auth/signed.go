@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrUnknownKey     = errors.New("unknown signing key")
+	ErrBadSignature   = errors.New("bad token signature")
+	ErrTokenExpired   = errors.New("token expired")
+)
+
+// Keyring holds HMAC-SHA256 signing keys by kid. The active key signs new
+// tokens; every key in the ring still verifies, so keys can be rotated by
+// prepending a new one and dropping the old one after the access TTL.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// ParseKeyring reads "kid:secret,kid:secret"; the first entry is the active key.
+func ParseKeyring(spec string) (*Keyring, error) {
+	ring := &Keyring{keys: make(map[string][]byte)}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kid, secret, ok := strings.Cut(part, ":")
+		if !ok || kid == "" || len(secret) < 32 {
+			return nil, errors.New("signing keys must be kid:secret with secrets of at least 32 bytes")
+		}
+		if ring.active == "" {
+			ring.active = kid
+		}
+		ring.keys[kid] = []byte(secret)
+	}
+	if ring.active == "" {
+		return nil, errors.New("no signing keys configured")
+	}
+	return ring, nil
+}
+
+// Claims carried by a signed access token.
+type Claims struct {
+	Subject  string                `json:"sub"`
+	Role     dispatch.IdentityRole `json:"role"`
+	IssuedAt int64                 `json:"iat"`
+	Expiry   int64                 `json:"exp"`
+	ID       string                `json:"jti"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// IsSignedToken reports whether token looks like a signed access token rather
+// than a legacy opaque token.
+func IsSignedToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Sign issues a compact JWS (HS256) for the claims using the active key.
+func (k *Keyring) Sign(claims Claims) (string, error) {
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT", Kid: k.active})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing := b64(header) + "." + b64(payload)
+	return signing + "." + b64(sign(k.keys[k.active], signing)), nil
+}
+
+// Verify checks the signature and expiry of a signed token without any I/O.
+func (k *Keyring) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformedToken
+	}
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Claims{}, ErrMalformedToken
+	}
+	key, ok := k.keys[header.Kid]
+	if !ok {
+		return Claims{}, ErrUnknownKey
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, sign(key, parts[0]+"."+parts[1])) {
+		return Claims{}, ErrBadSignature
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Subject == "" {
+		return Claims{}, ErrMalformedToken
+	}
+	if time.Now().Unix() >= claims.Expiry {
+		return Claims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// Identity converts verified claims into the request identity.
+func (c Claims) Identity() dispatch.Identity {
+	exp := time.Unix(c.Expiry, 0)
+	return dispatch.Identity{ID: c.Subject, Role: c.Role, ExpiresAt: &exp}
+}
+
+func sign(key []byte, signing string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signing))
+	return mac.Sum(nil)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(seg string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
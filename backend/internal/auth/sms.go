@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsoleSMS logs messages instead of sending them (local development).
+type ConsoleSMS struct{}
+
+func (ConsoleSMS) Send(_ context.Context, phone, message string) error {
+	log.Printf("sms to %s: %s", phone, message)
+	return nil
+}
+
+// FileSMS appends messages to a file so tests and scripts can read codes back.
+type FileSMS struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileSMS(path string) *FileSMS {
+	return &FileSMS{path: path}
+}
+
+func (f *FileSMS) Send(_ context.Context, phone, message string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339), phone, message)
+	return err
+}
+
+// WebhookSMS hands messages to an SMS gateway: it POSTs JSON
+// {"to","message"} to the URL and treats any non-2xx response as a failure.
+// Credentials go in the URL as the gateway expects them.
+type WebhookSMS struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSMS(rawURL string) (*WebhookSMS, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid sms gateway url")
+	}
+	return &WebhookSMS{url: rawURL, client: &http.Client{Timeout: 5 * time.Second}}, nil
+}
+
+func (s *WebhookSMS) Send(ctx context.Context, phone, message string) error {
+	body, err := json.Marshal(map[string]string{"to": phone, "message": message})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sms gateway responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SMSSenderFromSpec builds a sender from SMS_SINK: "console" (or empty),
+// "file:/path", or an http(s) gateway URL. Other specs are an error.
+func SMSSenderFromSpec(spec string) (SMSSender, error) {
+	switch {
+	case spec == "" || spec == "console":
+		return ConsoleSMS{}, nil
+	case strings.HasPrefix(spec, "file:"):
+		if path := strings.TrimPrefix(spec, "file:"); path != "" {
+			return NewFileSMS(path), nil
+		}
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return NewWebhookSMS(spec)
+	}
+	return nil, fmt.Errorf("unknown SMS_SINK %q", spec)
+}
+
+// DeliversSMS reports whether the sender reaches phones; the console and file
+// senders only keep codes where operators can read them.
+func DeliversSMS(sender SMSSender) bool {
+	switch sender.(type) {
+	case ConsoleSMS, *FileSMS:
+		return false
+	}
+	return sender != nil
+}
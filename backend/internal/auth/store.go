@@ -1,80 +1,217 @@
 package auth
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"sync"
 	"time"
 
 	"turbodriver/internal/dispatch"
 )
 
-// InMemoryStore keeps issued tokens mapped to identities.
+// InMemoryStore keeps hashed tokens mapped to identities. Without a database it is
+// the source of truth; with one it acts as a short-lived cache in front of it.
 type InMemoryStore struct {
-    mu    sync.RWMutex
-    users map[string]dispatch.Identity
+	mu       sync.RWMutex
+	tokens   map[string]cachedToken
+	cacheTTL time.Duration
+	bus      RevocationBus
+	// deniedIDs and revokedBefore reject signed access tokens, which are
+	// otherwise verified without any lookup.
+	deniedIDs     map[string]int64
+	revokedBefore map[string]int64
+}
+
+type cachedToken struct {
+	rec        TokenRecord
+	cacheUntil time.Time
 }
 
 func NewInMemoryStore() *InMemoryStore {
-    return &InMemoryStore{
-        users: make(map[string]dispatch.Identity),
-    }
+	return &InMemoryStore{
+		tokens:        make(map[string]cachedToken),
+		deniedIDs:     make(map[string]int64),
+		revokedBefore: make(map[string]int64),
+	}
 }
 
-// Register creates an identity with the given role and returns the token.
-func (s *InMemoryStore) Register(role dispatch.IdentityRole, ttl time.Duration) (dispatch.Identity, error) {
-    if role != dispatch.RoleDriver && role != dispatch.RolePassenger && role != dispatch.RoleAdmin {
-        return dispatch.Identity{}, errors.New("invalid role")
-    }
-    id := fmt.Sprintf("%s_%s", role, randomID())
-    token := randomID()
-
-    identity := dispatch.Identity{
-        ID:    id,
-        Role:  role,
-        Token: token,
-    }
-    if ttl > 0 {
-        expiry := time.Now().Add(ttl)
-        identity.ExpiresAt = &expiry
-    }
+// SetCacheTTL bounds how long a token stays cached before it is re-read from the
+// database, limiting the window in which a missed revocation is honoured.
+func (s *InMemoryStore) SetCacheTTL(ttl time.Duration) {
+	s.mu.Lock()
+	s.cacheTTL = ttl
+	s.mu.Unlock()
+}
 
+// AttachRevocations publishes local revocations so other replicas evict them too.
+func (s *InMemoryStore) AttachRevocations(bus RevocationBus) {
 	s.mu.Lock()
-	s.users[token] = identity
+	s.bus = bus
 	s.mu.Unlock()
-	return identity, nil
+}
+
+// NewIdentity allocates an identity ID for the role without issuing any token.
+func NewIdentity(role dispatch.IdentityRole) (dispatch.Identity, error) {
+	if !ValidRole(role) {
+		return dispatch.Identity{}, errors.New("invalid role")
+	}
+	if role == dispatch.RolePartner {
+		return dispatch.Identity{}, errors.New("partners authenticate with api keys")
+	}
+	return dispatch.Identity{
+		ID:   fmt.Sprintf("%s_%s", role, randomHex(8)),
+		Role: role,
+	}, nil
+}
+
+// Register creates an identity with the given role and returns it with its token.
+func (s *InMemoryStore) Register(role dispatch.IdentityRole, ttl time.Duration) (dispatch.Identity, error) {
+	identity, err := NewIdentity(role)
+	if err != nil {
+		return dispatch.Identity{}, err
+	}
+	return s.IssueToken(identity, ttl), nil
+}
+
+// IssueToken mints an additional opaque token for an existing identity.
+func (s *InMemoryStore) IssueToken(identity dispatch.Identity, ttl time.Duration) dispatch.Identity {
+	identity.ExpiresAt = nil
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl)
+		identity.ExpiresAt = &expiry
+	}
+	token, rec := NewToken(identity.ID, identity.Role, identity.ExpiresAt)
+	identity.Token = token
+
+	s.put(rec)
+	return identity
+}
+
+// Cache remembers a token verified against the database.
+func (s *InMemoryStore) Cache(token string, identity dispatch.Identity) {
+	rec := HashToken(token)
+	rec.IdentityID = identity.ID
+	rec.Role = identity.Role
+	rec.ExpiresAt = identity.ExpiresAt
+	if rec.Expired(time.Now()) {
+		return
+	}
+	s.put(rec)
+}
+
+func (s *InMemoryStore) put(rec TokenRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := cachedToken{rec: rec}
+	if s.cacheTTL > 0 {
+		entry.cacheUntil = time.Now().Add(s.cacheTTL)
+	}
+	s.tokens[rec.Selector] = entry
 }
 
 func (s *InMemoryStore) Lookup(token string) (dispatch.Identity, bool) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
-    u, ok := s.users[token]
-    if !ok {
-        return dispatch.Identity{}, false
-    }
-    if u.ExpiresAt != nil && time.Now().After(*u.ExpiresAt) {
-        return dispatch.Identity{}, false
-    }
-    return u, ok
-}
-
-// Seed allows hydrating identities from persistent storage.
-func (s *InMemoryStore) Seed(identity dispatch.Identity) {
-    if identity.Token == "" {
-        return
-    }
-    if identity.ExpiresAt != nil && time.Now().After(*identity.ExpiresAt) {
-        return
-    }
-    s.mu.Lock()
-    s.users[identity.Token] = identity
-    s.mu.Unlock()
-}
-
-func randomID() string {
-	b := make([]byte, 8)
-	_, _ = rand.Read(b)
-	return hex.EncodeToString(b)
+	selector, secret := SplitToken(token)
+	s.mu.RLock()
+	entry, ok := s.tokens[selector]
+	s.mu.RUnlock()
+	if !ok || !entry.rec.Verify(secret) {
+		return dispatch.Identity{}, false
+	}
+	now := time.Now()
+	if entry.rec.Expired(now) || (!entry.cacheUntil.IsZero() && now.After(entry.cacheUntil)) {
+		s.mu.Lock()
+		delete(s.tokens, selector)
+		s.mu.Unlock()
+		return dispatch.Identity{}, false
+	}
+	return dispatch.Identity{
+		ID:        entry.rec.IdentityID,
+		Role:      entry.rec.Role,
+		ExpiresAt: entry.rec.ExpiresAt,
+	}, true
+}
+
+// Revoke drops a single token and propagates the revocation.
+func (s *InMemoryStore) Revoke(ctx context.Context, token string) bool {
+	selector, _ := SplitToken(token)
+	removed := s.Apply(Revocation{Selector: selector})
+	s.publish(ctx, Revocation{Selector: selector})
+	return removed > 0
+}
+
+// RevokeSigned denies a signed access token until it expires and propagates the revocation.
+func (s *InMemoryStore) RevokeSigned(ctx context.Context, claims Claims) {
+	rev := Revocation{TokenID: claims.ID, Expiry: claims.Expiry}
+	s.Apply(rev)
+	s.publish(ctx, rev)
+}
+
+// SignedRevoked reports whether a verified signed token has been revoked.
+func (s *InMemoryStore) SignedRevoked(claims Claims) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.deniedIDs[claims.ID]; ok {
+		return true
+	}
+	cutoff, ok := s.revokedBefore[claims.Subject]
+	return ok && claims.IssuedAt <= cutoff
+}
+
+// RevokeIdentity drops every token issued to an identity and propagates the revocation.
+func (s *InMemoryStore) RevokeIdentity(ctx context.Context, identityID string) int {
+	rev := Revocation{IdentityID: identityID, At: time.Now().Unix()}
+	removed := s.Apply(rev)
+	s.publish(ctx, rev)
+	return removed
+}
+
+// Apply evicts tokens matching a revocation locally without re-publishing it.
+func (s *InMemoryStore) Apply(rev Revocation) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rev.TokenID != "" {
+		now := time.Now().Unix()
+		for id, exp := range s.deniedIDs {
+			if exp < now {
+				delete(s.deniedIDs, id)
+			}
+		}
+		s.deniedIDs[rev.TokenID] = rev.Expiry
+		return 1
+	}
+	if rev.Selector != "" {
+		if _, ok := s.tokens[rev.Selector]; ok {
+			delete(s.tokens, rev.Selector)
+			return 1
+		}
+		return 0
+	}
+	if rev.IdentityID == "" {
+		return 0
+	}
+	if rev.At > s.revokedBefore[rev.IdentityID] {
+		s.revokedBefore[rev.IdentityID] = rev.At
+	}
+	removed := 0
+	for selector, entry := range s.tokens {
+		if entry.rec.IdentityID == rev.IdentityID {
+			delete(s.tokens, selector)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *InMemoryStore) publish(ctx context.Context, rev Revocation) {
+	s.mu.RLock()
+	bus := s.bus
+	s.mu.RUnlock()
+	if bus == nil {
+		return
+	}
+	if err := bus.Publish(ctx, rev); err != nil {
+		log.Printf("auth: publish revocation failed: %v", err)
+	}
 }
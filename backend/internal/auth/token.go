@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Bearer tokens have the form "<selector>.<secret>". Only the selector (a lookup
+// key) and a salted SHA-256 of the secret are ever stored, so a leaked database
+// or cache dump cannot be replayed as live sessions.
+
+// TokenRecord is the stored, non-reversible form of a bearer token.
+type TokenRecord struct {
+	Selector   string
+	IdentityID string
+	Role       dispatch.IdentityRole
+	Salt       string
+	Hash       string
+	ExpiresAt  *time.Time
+}
+
+// NewToken issues a fresh bearer token for the identity.
+func NewToken(identityID string, role dispatch.IdentityRole, expiresAt *time.Time) (string, TokenRecord) {
+	token := randomHex(8) + "." + randomHex(24)
+	rec := HashToken(token)
+	rec.IdentityID = identityID
+	rec.Role = role
+	rec.ExpiresAt = expiresAt
+	return token, rec
+}
+
+// HashToken derives the stored record for a token with a fresh salt.
+func HashToken(token string) TokenRecord {
+	selector, secret := SplitToken(token)
+	salt := randomHex(16)
+	return TokenRecord{Selector: selector, Salt: salt, Hash: hashSecret(salt, secret)}
+}
+
+// SplitToken returns the selector and secret of a token. Tokens issued before
+// hashing was introduced have no selector; one is derived from the whole token.
+func SplitToken(token string) (string, string) {
+	if selector, secret, ok := strings.Cut(token, "."); ok && selector != "" && secret != "" {
+		return selector, secret
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "legacy_" + hex.EncodeToString(sum[:8]), token
+}
+
+// Verify reports whether secret matches the record in constant time.
+func (r TokenRecord) Verify(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(r.Salt, secret)), []byte(r.Hash)) == 1
+}
+
+// Expired reports whether the token is past its expiry.
+func (r TokenRecord) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && now.After(*r.ExpiresAt)
+}
+
+func hashSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -4,13 +4,16 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type Hub struct {
 	mu         sync.RWMutex
-	rideConns  map[string]map[*websocket.Conn]struct{}
+	rideConns  map[string]map[*websocket.Conn]IdentityRole
+	shareConns map[string]map[*websocket.Conn]shareSub
+	adminConns map[*websocket.Conn]struct{}
 	register   chan subscription
 	unregister chan subscription
 }
@@ -18,11 +21,22 @@ type Hub struct {
 type subscription struct {
 	rideID string
 	conn   *websocket.Conn
+	role   IdentityRole
+	share  *shareSub
+	admin  bool
+}
+
+// shareSub tracks a read-only viewer attached through a trip sharing link.
+type shareSub struct {
+	shareID   int64
+	expiresAt time.Time
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		rideConns:  make(map[string]map[*websocket.Conn]struct{}),
+		rideConns:  make(map[string]map[*websocket.Conn]IdentityRole),
+		shareConns: make(map[string]map[*websocket.Conn]shareSub),
+		adminConns: make(map[*websocket.Conn]struct{}),
 		register:   make(chan subscription),
 		unregister: make(chan subscription),
 	}
@@ -33,26 +47,62 @@ func (h *Hub) Run() {
 		select {
 		case sub := <-h.register:
 			h.mu.Lock()
-			if h.rideConns[sub.rideID] == nil {
-				h.rideConns[sub.rideID] = make(map[*websocket.Conn]struct{})
+			if sub.admin {
+				h.adminConns[sub.conn] = struct{}{}
+			} else if sub.share != nil {
+				if h.shareConns[sub.rideID] == nil {
+					h.shareConns[sub.rideID] = make(map[*websocket.Conn]shareSub)
+				}
+				h.shareConns[sub.rideID][sub.conn] = *sub.share
+			} else {
+				if h.rideConns[sub.rideID] == nil {
+					h.rideConns[sub.rideID] = make(map[*websocket.Conn]IdentityRole)
+				}
+				h.rideConns[sub.rideID][sub.conn] = sub.role
 			}
-			h.rideConns[sub.rideID][sub.conn] = struct{}{}
 			h.mu.Unlock()
 		case sub := <-h.unregister:
 			h.mu.Lock()
+			delete(h.adminConns, sub.conn)
 			if conns, ok := h.rideConns[sub.rideID]; ok {
 				delete(conns, sub.conn)
 				if len(conns) == 0 {
 					delete(h.rideConns, sub.rideID)
 				}
 			}
+			if conns, ok := h.shareConns[sub.rideID]; ok {
+				delete(conns, sub.conn)
+				if len(conns) == 0 {
+					delete(h.shareConns, sub.rideID)
+				}
+			}
 			h.mu.Unlock()
 			sub.conn.Close()
 		}
 	}
 }
 
-func (h *Hub) ServeRide(w http.ResponseWriter, r *http.Request, rideID string) {
+// ServeRide subscribes a ride participant; role decides what each frame reveals
+// (only the passenger receives the pickup PIN).
+func (h *Hub) ServeRide(w http.ResponseWriter, r *http.Request, rideID string, role IdentityRole) {
+	h.serve(w, r, subscription{rideID: rideID, role: role})
+}
+
+// ServeSharedRide streams a redacted view of the ride to a share link viewer
+// until the share expires or is revoked.
+func (h *Hub) ServeSharedRide(w http.ResponseWriter, r *http.Request, share RideShare) {
+	h.serve(w, r, subscription{
+		rideID: share.RideID,
+		share:  &shareSub{shareID: share.ID, expiresAt: share.ExpiresAt},
+	})
+}
+
+// ServeAdmin attaches an admin to the operations channel (safety alerts).
+func (h *Hub) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, subscription{admin: true})
+}
+
+func (h *Hub) serve(w http.ResponseWriter, r *http.Request, sub subscription) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
@@ -61,20 +111,46 @@ func (h *Hub) ServeRide(w http.ResponseWriter, r *http.Request, rideID string) {
 		log.Printf("ws upgrade failed: %v", err)
 		return
 	}
-	h.register <- subscription{rideID: rideID, conn: conn}
+	sub.conn = conn
+	h.register <- sub
 
 	go func() {
 		for {
 			if _, _, err := conn.NextReader(); err != nil {
-				h.unregister <- subscription{rideID: rideID, conn: conn}
+				h.unregister <- sub
 				return
 			}
 		}
 	}()
 }
 
+// CloseShare disconnects every viewer attached through the given share.
+func (h *Hub) CloseShare(rideID string, shareID int64) {
+	h.mu.RLock()
+	var stale []*websocket.Conn
+	for conn, sub := range h.shareConns[rideID] {
+		if sub.shareID == shareID {
+			stale = append(stale, conn)
+		}
+	}
+	h.mu.RUnlock()
+	for _, conn := range stale {
+		h.unregister <- subscription{rideID: rideID, conn: conn}
+	}
+}
+
 func (h *Hub) PublishRideUpdate(ride Ride) {
-	h.broadcast(ride.ID, ride)
+	redacted := ride.WithoutPIN()
+	h.broadcastFor(ride.ID, func(role IdentityRole) any {
+		if role == RolePassenger {
+			return ride
+		}
+		return redacted
+	})
+	h.broadcastShared(ride.ID, map[string]any{
+		"type":   "ride_status",
+		"status": ride.Status,
+	})
 }
 
 func (h *Hub) PublishDriverUpdate(driverID string, state DriverState) {
@@ -85,13 +161,96 @@ func (h *Hub) PublishDriverUpdate(driverID string, state DriverState) {
 		"type":   "driver_location",
 		"driver": state,
 	})
+	h.broadcastShared(state.RideID, map[string]any{
+		"type":     "driver_location",
+		"location": state.Location,
+	})
+}
+
+func (h *Hub) PublishRideMessage(msg RideMessage) {
+	h.broadcast(msg.RideID, map[string]any{
+		"type":    "ride_message",
+		"message": msg,
+	})
+}
+
+func (h *Hub) PublishMessagesRead(rideID, readerID string, upTo int64) {
+	h.broadcast(rideID, map[string]any{
+		"type":     "messages_read",
+		"readerId": readerID,
+		"upTo":     upTo,
+	})
+}
+
+// PublishSafetyCheck asks the passenger whether they are OK after a trip alert.
+func (h *Hub) PublishSafetyCheck(alert TripAlert, incidentID int64) {
+	frame := map[string]any{
+		"type":       "safety_check",
+		"prompt":     "Are you OK?",
+		"alert":      alert,
+		"incidentId": incidentID,
+	}
+	h.broadcastFor(alert.RideID, func(role IdentityRole) any {
+		if role != RolePassenger {
+			return nil
+		}
+		return frame
+	})
+}
+
+// PublishAdmin sends a frame to every connected admin.
+func (h *Hub) PublishAdmin(payload any) {
+	h.mu.RLock()
+	conns := make([]*websocket.Conn, 0, len(h.adminConns))
+	for conn := range h.adminConns {
+		conns = append(conns, conn)
+	}
+	h.mu.RUnlock()
+	for _, conn := range conns {
+		if err := conn.WriteJSON(payload); err != nil {
+			h.unregister <- subscription{admin: true, conn: conn}
+		}
+	}
+}
+
+func (h *Hub) PublishSafetyIncident(inc SafetyIncident) {
+	h.PublishAdmin(map[string]any{
+		"type":     "safety_incident",
+		"incident": inc,
+	})
 }
 
 func (h *Hub) broadcast(rideID string, payload any) {
+	h.broadcastFor(rideID, func(IdentityRole) any { return payload })
+}
+
+// broadcastFor renders the frame per subscriber role before sending.
+func (h *Hub) broadcastFor(rideID string, render func(role IdentityRole) any) {
 	h.mu.RLock()
 	conns := h.rideConns[rideID]
 	h.mu.RUnlock()
-	for conn := range conns {
+	for conn, role := range conns {
+		frame := render(role)
+		if frame == nil {
+			continue
+		}
+		if err := conn.WriteJSON(frame); err != nil {
+			h.unregister <- subscription{rideID: rideID, conn: conn}
+		}
+	}
+}
+
+// broadcastShared sends redacted frames to share viewers, dropping expired ones.
+func (h *Hub) broadcastShared(rideID string, payload any) {
+	h.mu.RLock()
+	conns := h.shareConns[rideID]
+	h.mu.RUnlock()
+	now := time.Now()
+	for conn, sub := range conns {
+		if now.After(sub.expiresAt) {
+			h.unregister <- subscription{rideID: rideID, conn: conn}
+			continue
+		}
 		if err := conn.WriteJSON(payload); err != nil {
 			h.unregister <- subscription{rideID: rideID, conn: conn}
 		}
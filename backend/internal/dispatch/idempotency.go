@@ -1,6 +1,7 @@
 package dispatch
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -11,9 +12,9 @@ type idemEntry struct {
 }
 
 type idemCache struct {
-	mu     sync.Mutex
-	byKey  map[string]idemEntry
-	ttl    time.Duration
+	mu    sync.Mutex
+	byKey map[string]idemEntry
+	ttl   time.Duration
 }
 
 func newIdemCache() *idemCache {
@@ -57,3 +58,97 @@ func (c *idemCache) Lookup(key string) (string, bool) {
 	}
 	return entry.rideID, true
 }
+
+// IdempotentResponse is a stored HTTP response, replayed when a request is
+// retried with the same Idempotency-Key.
+type IdempotentResponse struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body"`
+}
+
+type IdempotencyOutcome int
+
+const (
+	// IdempotencyStarted means the caller holds the key and must complete or release it.
+	IdempotencyStarted IdempotencyOutcome = iota
+	// IdempotencyReplay means a response is stored for the key.
+	IdempotencyReplay
+	// IdempotencyMismatch means the key was used for a different request.
+	IdempotencyMismatch
+	// IdempotencyInFlight means another request with the key is still running.
+	IdempotencyInFlight
+)
+
+// RequestIdempotency backs the Idempotency-Key header. Keys are claimed with a
+// lock that lapses after lock, so a crashed request does not hold its key forever.
+// CompleteRequest and ReleaseRequest only touch a claim that is still in flight
+// for fingerprint; CompleteRequest reports false if the claim was lost.
+type RequestIdempotency interface {
+	BeginRequest(ctx context.Context, key, fingerprint string, lock time.Duration) (IdempotencyOutcome, IdempotentResponse, error)
+	CompleteRequest(ctx context.Context, key, fingerprint string, resp IdempotentResponse, ttl time.Duration) (bool, error)
+	ReleaseRequest(ctx context.Context, key, fingerprint string) error
+}
+
+type requestIdemEntry struct {
+	fingerprint string
+	resp        *IdempotentResponse
+	expiry      time.Time
+}
+
+// MemoryRequestIdempotency keeps request keys in process.
+type MemoryRequestIdempotency struct {
+	mu    sync.Mutex
+	byKey map[string]requestIdemEntry
+}
+
+func NewMemoryRequestIdempotency() *MemoryRequestIdempotency {
+	return &MemoryRequestIdempotency{byKey: make(map[string]requestIdemEntry)}
+}
+
+func (m *MemoryRequestIdempotency) BeginRequest(_ context.Context, key, fingerprint string, lock time.Duration) (IdempotencyOutcome, IdempotentResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	entry, ok := m.byKey[key]
+	if !ok || now.After(entry.expiry) {
+		if len(m.byKey) > 10000 {
+			for k, e := range m.byKey {
+				if now.After(e.expiry) {
+					delete(m.byKey, k)
+				}
+			}
+		}
+		m.byKey[key] = requestIdemEntry{fingerprint: fingerprint, expiry: now.Add(lock)}
+		return IdempotencyStarted, IdempotentResponse{}, nil
+	}
+	switch {
+	case entry.fingerprint != fingerprint:
+		return IdempotencyMismatch, IdempotentResponse{}, nil
+	case entry.resp == nil:
+		return IdempotencyInFlight, IdempotentResponse{}, nil
+	}
+	return IdempotencyReplay, *entry.resp, nil
+}
+
+func (m *MemoryRequestIdempotency) CompleteRequest(_ context.Context, key, fingerprint string, resp IdempotentResponse, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.byKey[key]
+	if !ok || entry.fingerprint != fingerprint || entry.resp != nil {
+		return false, nil
+	}
+	entry.resp = &resp
+	entry.expiry = time.Now().Add(ttl)
+	m.byKey[key] = entry
+	return true, nil
+}
+
+func (m *MemoryRequestIdempotency) ReleaseRequest(_ context.Context, key, fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.byKey[key]; ok && entry.fingerprint == fingerprint && entry.resp == nil {
+		delete(m.byKey, key)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package dispatch
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Trip alert kinds raised by the TripMonitor.
+const (
+	AlertRouteDeviation = "route_deviation"
+	AlertProlongedStop  = "prolonged_stop"
+)
+
+// TripAlert describes an anomaly detected on a ride in progress.
+type TripAlert struct {
+	RideID   string     `json:"rideId"`
+	Kind     string     `json:"kind"`
+	Location Coordinate `json:"location"`
+	// DeviationKM is the distance from the expected corridor (route_deviation).
+	DeviationKM float64 `json:"deviationKm,omitempty"`
+	// StoppedFor is how long the driver has not moved (prolonged_stop).
+	StoppedFor time.Duration `json:"stoppedForNs,omitempty"`
+	DetectedAt time.Time     `json:"detectedAt"`
+}
+
+// TripMonitor compares live driver tracks against a straight-line corridor from
+// pickup to dropoff and flags large deviations and long unexpected stops.
+type TripMonitor struct {
+	// CorridorKM is the minimum corridor half-width; long trips widen it to
+	// CorridorRatio of the pickup→dropoff distance.
+	CorridorKM    float64
+	CorridorRatio float64
+	// StopRadiusKM and StopAfter define a prolonged stop: every point in the
+	// trailing window stays within StopRadiusKM for at least StopAfter.
+	StopRadiusKM float64
+	StopAfter    time.Duration
+	// Cooldown suppresses repeated alerts of the same kind for a ride.
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	lastAlert map[string]map[string]time.Time
+}
+
+func NewTripMonitor(stopAfter time.Duration) *TripMonitor {
+	if stopAfter <= 0 {
+		stopAfter = 5 * time.Minute
+	}
+	return &TripMonitor{
+		CorridorKM:    1.5,
+		CorridorRatio: 0.25,
+		StopRadiusKM:  0.05,
+		StopAfter:     stopAfter,
+		Cooldown:      10 * time.Minute,
+		lastAlert:     make(map[string]map[string]time.Time),
+	}
+}
+
+// Evaluate inspects the ride's track and returns any new alerts.
+func (m *TripMonitor) Evaluate(ride Ride, track []Coordinate) []TripAlert {
+	if ride.Status != RideEnRoute || len(track) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var alerts []TripAlert
+	if alert, ok := m.checkDeviation(ride, track); ok && m.allow(ride.ID, alert.Kind, now) {
+		alert.DetectedAt = now
+		alerts = append(alerts, alert)
+	}
+	if alert, ok := m.checkStop(ride, track); ok && m.allow(ride.ID, alert.Kind, now) {
+		alert.DetectedAt = now
+		alerts = append(alerts, alert)
+	}
+	return alerts
+}
+
+// Forget drops cooldown state for a finished ride.
+func (m *TripMonitor) Forget(rideID string) {
+	m.mu.Lock()
+	delete(m.lastAlert, rideID)
+	m.mu.Unlock()
+}
+
+func (m *TripMonitor) allow(rideID, kind string, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byKind := m.lastAlert[rideID]
+	if byKind == nil {
+		byKind = make(map[string]time.Time)
+		m.lastAlert[rideID] = byKind
+	}
+	if last, ok := byKind[kind]; ok && now.Sub(last) < m.Cooldown {
+		return false
+	}
+	byKind[kind] = now
+	return true
+}
+
+// checkDeviation flags the ride when the two latest points both fall outside the corridor.
+func (m *TripMonitor) checkDeviation(ride Ride, track []Coordinate) (TripAlert, bool) {
+	if ride.Dropoff == nil || len(track) < 2 {
+		return TripAlert{}, false
+	}
+	corridor := math.Max(m.CorridorKM, m.CorridorRatio*haversineKM(ride.Pickup, *ride.Dropoff))
+	latest := track[len(track)-1]
+	prev := track[len(track)-2]
+	dev := distanceToSegmentKM(latest, ride.Pickup, *ride.Dropoff)
+	if dev <= corridor || distanceToSegmentKM(prev, ride.Pickup, *ride.Dropoff) <= corridor {
+		return TripAlert{}, false
+	}
+	return TripAlert{RideID: ride.ID, Kind: AlertRouteDeviation, Location: latest, DeviationKM: dev}, true
+}
+
+// checkStop flags the ride when the driver has been stationary away from the
+// pickup and dropoff points for longer than StopAfter.
+func (m *TripMonitor) checkStop(ride Ride, track []Coordinate) (TripAlert, bool) {
+	latest := track[len(track)-1]
+	since := latest.At
+	for i := len(track) - 2; i >= 0; i-- {
+		if haversineKM(track[i], latest) > m.StopRadiusKM {
+			break
+		}
+		since = track[i].At
+	}
+	stopped := latest.At.Sub(since)
+	if stopped < m.StopAfter {
+		return TripAlert{}, false
+	}
+	expectedStop := 4 * m.StopRadiusKM
+	if haversineKM(latest, ride.Pickup) <= expectedStop {
+		return TripAlert{}, false
+	}
+	if ride.Dropoff != nil && haversineKM(latest, *ride.Dropoff) <= expectedStop {
+		return TripAlert{}, false
+	}
+	return TripAlert{RideID: ride.ID, Kind: AlertProlongedStop, Location: latest, StoppedFor: stopped}, true
+}
+
+// distanceToSegmentKM approximates the cross-track distance from p to segment a→b
+// using an equirectangular projection, which is accurate at city scale.
+func distanceToSegmentKM(p, a, b Coordinate) float64 {
+	const earthRadiusKM = 6371
+	refLat := toRadians((a.Latitude + b.Latitude) / 2)
+	project := func(c Coordinate) (float64, float64) {
+		return toRadians(c.Longitude) * math.Cos(refLat) * earthRadiusKM, toRadians(c.Latitude) * earthRadiusKM
+	}
+	px, py := project(p)
+	ax, ay := project(a)
+	bx, by := project(b)
+	dx, dy := bx-ax, by-ay
+	lenSq := dx*dx + dy*dy
+	t := 0.0
+	if lenSq > 0 {
+		t = ((px-ax)*dx + (py-ay)*dy) / lenSq
+		t = math.Max(0, math.Min(1, t))
+	}
+	cx, cy := ax+t*dx, ay+t*dy
+	return math.Hypot(px-cx, py-cy)
+}
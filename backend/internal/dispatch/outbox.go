@@ -0,0 +1,312 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ride transitions are written to an outbox in the same transaction as the ride
+// row and its event. A relay then delivers each message to every sink (hub,
+// webhooks, notifications) at least once; sinks get the message's DedupeKey so
+// receivers can drop redeliveries.
+
+// OutboxMessage is a committed ride transition awaiting delivery.
+type OutboxMessage struct {
+	ID        int64           `json:"-"`
+	DedupeKey string          `json:"id"`
+	RideID    string          `json:"rideId"`
+	EventType string          `json:"type"`
+	Ride      Ride            `json:"ride"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	// Attempts counts earlier delivery rounds; DeliveredSinks lists sinks that
+	// already accepted the message and are skipped on retry.
+	Attempts       int      `json:"-"`
+	DeliveredSinks []string `json:"-"`
+}
+
+// OutboxStore hands out pending messages to the relay.
+type OutboxStore interface {
+	// ClaimOutbox leases up to limit due messages so concurrent relays skip them
+	// until the lease runs out.
+	ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error)
+	MarkOutboxDelivered(ctx context.Context, id int64) error
+	MarkOutboxFailed(ctx context.Context, id int64, deliveredSinks []string, retryAt time.Time, reason string) error
+}
+
+// OutboxPruner is implemented by outbox stores that keep delivered messages.
+type OutboxPruner interface {
+	PruneOutbox(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// OutboxSink receives relayed messages. Deliver must be safe to repeat.
+type OutboxSink interface {
+	Name() string
+	Deliver(ctx context.Context, msg OutboxMessage) error
+}
+
+const (
+	outboxBatch      = 100
+	outboxLease      = 30 * time.Second
+	outboxMaxBackoff = 10 * time.Minute
+	outboxPruneEvery = time.Hour
+)
+
+// OutboxRelay polls the outbox and fans messages out to its sinks.
+type OutboxRelay struct {
+	store OutboxStore
+	sinks []OutboxSink
+	wake  chan struct{}
+	// Retention is how long delivered messages are kept; zero keeps them.
+	Retention time.Duration
+
+	delivered int64
+	failures  map[string]*int64
+}
+
+func NewOutboxRelay(store OutboxStore, sinks ...OutboxSink) *OutboxRelay {
+	failures := make(map[string]*int64, len(sinks))
+	for _, sink := range sinks {
+		failures[sink.Name()] = new(int64)
+	}
+	return &OutboxRelay{store: store, sinks: sinks, wake: make(chan struct{}, 1), failures: failures}
+}
+
+// Wake asks the relay to poll now instead of waiting for the next tick.
+func (r *OutboxRelay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays messages every interval, or sooner when woken, until ctx is done.
+func (r *OutboxRelay) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		if time.Since(lastPrune) >= outboxPruneEvery {
+			r.prune(ctx)
+			lastPrune = time.Now()
+		}
+		for {
+			n, err := r.RelayOnce(ctx)
+			if err != nil {
+				log.Printf("outbox: relay failed: %v", err)
+			}
+			if err != nil || n < outboxBatch {
+				break
+			}
+		}
+	}
+}
+
+// prune deletes messages delivered more than Retention ago.
+func (r *OutboxRelay) prune(ctx context.Context) {
+	pruner, ok := r.store.(OutboxPruner)
+	if !ok || r.Retention <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	n, err := pruner.PruneOutbox(ctx, time.Now().Add(-r.Retention))
+	if err != nil {
+		log.Printf("outbox: prune failed: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("outbox: pruned %d delivered messages", n)
+	}
+}
+
+// RelayOnce delivers one batch of due messages and returns how many were claimed.
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	claimCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	msgs, err := r.store.ClaimOutbox(claimCtx, outboxBatch, outboxLease)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range msgs {
+		r.deliver(ctx, msg)
+	}
+	return len(msgs), nil
+}
+
+func (r *OutboxRelay) deliver(ctx context.Context, msg OutboxMessage) {
+	done := append([]string(nil), msg.DeliveredSinks...)
+	var errs []string
+	for _, sink := range r.sinks {
+		if containsString(done, sink.Name()) {
+			continue
+		}
+		sinkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := sink.Deliver(sinkCtx, msg)
+		cancel()
+		if err != nil {
+			atomic.AddInt64(r.failures[sink.Name()], 1)
+			errs = append(errs, sink.Name()+": "+err.Error())
+			continue
+		}
+		done = append(done, sink.Name())
+	}
+
+	markCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if len(errs) == 0 {
+		if err := r.store.MarkOutboxDelivered(markCtx, msg.ID); err != nil {
+			// The lease expires and the message is redelivered; sinks dedupe it.
+			log.Printf("outbox: mark %s delivered: %v", msg.DedupeKey, err)
+			return
+		}
+		atomic.AddInt64(&r.delivered, 1)
+		return
+	}
+	retryAt := time.Now().Add(outboxBackoff(msg.Attempts + 1))
+	if err := r.store.MarkOutboxFailed(markCtx, msg.ID, done, retryAt, strings.Join(errs, "; ")); err != nil {
+		log.Printf("outbox: mark %s failed: %v", msg.DedupeKey, err)
+	}
+}
+
+// outboxBackoff doubles from one second per attempt up to outboxMaxBackoff.
+func outboxBackoff(attempt int) time.Duration {
+	if attempt > 10 {
+		return outboxMaxBackoff
+	}
+	d := time.Second << (attempt - 1)
+	if d > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return d
+}
+
+// WriteMetrics prints relay counters in Prometheus text format.
+func (r *OutboxRelay) WriteMetrics(w io.Writer) {
+	fmt.Fprintf(w, "turbodriver_outbox_delivered_total %d\n", atomic.LoadInt64(&r.delivered))
+	names := make([]string, 0, len(r.failures))
+	for name := range r.failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "turbodriver_outbox_sink_failures_total{sink=%q} %d\n", name, atomic.LoadInt64(r.failures[name]))
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryOutbox backs the relay when rides are not persisted to Postgres.
+type MemoryOutbox struct {
+	mu      sync.Mutex
+	nextID  int64
+	pending []memoryOutboxEntry
+}
+
+type memoryOutboxEntry struct {
+	msg   OutboxMessage
+	dueAt time.Time
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// Append queues a message, assigning its ID and dedupe key.
+func (m *MemoryOutbox) Append(msg OutboxMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	msg.ID = m.nextID
+	msg.DedupeKey = fmt.Sprintf("mem_%d_%d", msg.CreatedAt.UnixNano(), msg.ID)
+	m.pending = append(m.pending, memoryOutboxEntry{msg: msg, dueAt: msg.CreatedAt})
+}
+
+func (m *MemoryOutbox) ClaimOutbox(_ context.Context, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var out []OutboxMessage
+	for i := range m.pending {
+		if len(out) == limit {
+			break
+		}
+		entry := &m.pending[i]
+		if entry.dueAt.After(now) {
+			continue
+		}
+		entry.dueAt = now.Add(lease)
+		out = append(out, entry.msg)
+	}
+	return out, nil
+}
+
+func (m *MemoryOutbox) MarkOutboxDelivered(_ context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.pending[:0]
+	for _, entry := range m.pending {
+		if entry.msg.ID != id {
+			kept = append(kept, entry)
+		}
+	}
+	m.pending = kept
+	return nil
+}
+
+func (m *MemoryOutbox) MarkOutboxFailed(_ context.Context, id int64, deliveredSinks []string, retryAt time.Time, _ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.pending {
+		if m.pending[i].msg.ID == id {
+			m.pending[i].msg.Attempts++
+			m.pending[i].msg.DeliveredSinks = deliveredSinks
+			m.pending[i].dueAt = retryAt
+		}
+	}
+	return nil
+}
+
+// HubSink pushes ride updates to websocket subscribers.
+type HubSink struct {
+	Hub   *Hub
+	Rides *Store
+}
+
+func (HubSink) Name() string { return "hub" }
+
+func (s HubSink) Deliver(ctx context.Context, msg OutboxMessage) error {
+	// Messages carry no PIN; the passenger's sockets get it from the ride
+	// while it is still at that version.
+	if s.Rides != nil {
+		if current, ok := s.Rides.GetRide(ctx, msg.RideID); ok && current.Version == msg.Ride.Version {
+			msg.Ride.PickupPIN = current.PickupPIN
+		}
+	}
+	s.Hub.PublishRideUpdate(msg.Ride)
+	return nil
+}
@@ -0,0 +1,204 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A ride's event log is the record of what happened to it. ProjectRide folds the
+// log back into the ride so the rides table can be checked against it and
+// repaired after incidents.
+//
+// Transitions carry statusFrom/statusTo; one is applied only when statusFrom
+// matches the projected status, which also skips the duplicate transition events
+// older builds logged from both the store and the handler. The pickup PIN is a
+// secret and never enters the log, so projections leave it empty.
+
+// TimelineEntry is one event in a ride's history.
+type TimelineEntry struct {
+	Type      string     `json:"type"`
+	Status    RideStatus `json:"status"`
+	Applied   bool       `json:"applied"`
+	ActorID   string     `json:"actorId,omitempty"`
+	ActorRole string     `json:"actorRole,omitempty"`
+	At        time.Time  `json:"at"`
+}
+
+// RideProjection is a ride rebuilt from its events.
+type RideProjection struct {
+	Ride     Ride            `json:"ride"`
+	Timeline []TimelineEntry `json:"timeline"`
+	// Partial is set when the creation event predates recording pickup, dropoff,
+	// location and creation time; those fields are then unknown.
+	Partial bool `json:"partial"`
+}
+
+var ErrNoCreationEvent = errors.New("event log has no ride creation event")
+
+// rideEventPayload is the union of fields ride events record.
+type rideEventPayload struct {
+	StatusFrom   RideStatus  `json:"statusFrom"`
+	StatusTo     RideStatus  `json:"statusTo"`
+	PassengerID  string      `json:"passengerId"`
+	DriverID     string      `json:"driverId"`
+	BookedBy     string      `json:"bookedBy"`
+	NewDriver    *string     `json:"newDriver"`
+	Pickup       *Coordinate `json:"pickup"`
+	Dropoff      *Coordinate `json:"dropoff"`
+	LocationCode string      `json:"locationCode"`
+	CreatedAt    *time.Time  `json:"createdAt"`
+}
+
+// ProjectRide folds a ride's events, oldest first, into its current state.
+func ProjectRide(events []RideEvent) (RideProjection, error) {
+	var (
+		proj    RideProjection
+		created bool
+	)
+	for _, evt := range events {
+		var p rideEventPayload
+		if len(evt.Payload) > 0 {
+			if err := json.Unmarshal(evt.Payload, &p); err != nil {
+				return RideProjection{}, fmt.Errorf("event %s on %s: %w", evt.Type, evt.CreatedAt.Format(time.RFC3339), err)
+			}
+		}
+		applied := false
+		switch {
+		case !created && isCreationEvent(evt.Type, p):
+			proj.Ride = Ride{
+				ID:           evt.RideID,
+				PassengerID:  p.PassengerID,
+				DriverID:     p.DriverID,
+				BookedBy:     p.BookedBy,
+				Status:       p.StatusTo,
+				LocationCode: p.LocationCode,
+				Dropoff:      p.Dropoff,
+				CreatedAt:    evt.CreatedAt,
+				Version:      1,
+			}
+			if proj.Ride.Status == "" {
+				proj.Ride.Status = RideAssigned
+			}
+			if p.Pickup != nil && p.CreatedAt != nil {
+				proj.Ride.Pickup = *p.Pickup
+				proj.Ride.CreatedAt = *p.CreatedAt
+			} else {
+				proj.Partial = true
+			}
+			created, applied = true, true
+		case created && p.StatusTo != "" && p.StatusFrom == proj.Ride.Status,
+			// Reassignments logged before transitions recorded statusFrom.
+			created && p.StatusTo != "" && p.StatusFrom == "" && evt.Type == "ride_reassigned":
+			proj.apply(evt.Type, p)
+			applied = true
+		case created && evt.Type == "pickup_pin_reissued":
+			// A new PIN changes the ride but not its status.
+			proj.Ride.Version++
+			applied = true
+		}
+		proj.Timeline = append(proj.Timeline, TimelineEntry{
+			Type:      evt.Type,
+			Status:    proj.Ride.Status,
+			Applied:   applied,
+			ActorID:   evt.ActorID,
+			ActorRole: evt.ActorRole,
+			At:        evt.CreatedAt,
+		})
+	}
+	if !created {
+		return proj, ErrNoCreationEvent
+	}
+	return proj, nil
+}
+
+// isCreationEvent matches the store's creation event and the ride_requested
+// event older builds logged from the handler.
+func isCreationEvent(typ string, p rideEventPayload) bool {
+	return (typ == "ride_assigned" && p.StatusFrom == "") || typ == "ride_requested"
+}
+
+func (proj *RideProjection) apply(typ string, p rideEventPayload) {
+	switch typ {
+	case "ride_reassigned":
+		if p.NewDriver != nil {
+			proj.Ride.DriverID = *p.NewDriver
+		}
+	case "ride_accepted", "ride_started":
+		if p.DriverID != "" {
+			proj.Ride.DriverID = p.DriverID
+		}
+	}
+	proj.Ride.Status = p.StatusTo
+	proj.Ride.Version++
+}
+
+// RideDrift lists fields where a stored ride disagrees with its projection.
+// Fields a partial projection does not know are not compared, nor is the PIN.
+func RideDrift(stored Ride, proj RideProjection) []string {
+	want := proj.Ride
+	var diffs []string
+	diff := func(field string, got, expected any) {
+		diffs = append(diffs, fmt.Sprintf("%s: table=%v events=%v", field, got, expected))
+	}
+	if stored.PassengerID != want.PassengerID {
+		diff("passengerId", stored.PassengerID, want.PassengerID)
+	}
+	if stored.DriverID != want.DriverID {
+		diff("driverId", stored.DriverID, want.DriverID)
+	}
+	if stored.Status != want.Status {
+		diff("status", stored.Status, want.Status)
+	}
+	if stored.BookedBy != want.BookedBy {
+		diff("bookedBy", stored.BookedBy, want.BookedBy)
+	}
+	if stored.Version != want.Version {
+		diff("version", stored.Version, want.Version)
+	}
+	if proj.Partial {
+		return diffs
+	}
+	if stored.LocationCode != want.LocationCode {
+		diff("locationCode", stored.LocationCode, want.LocationCode)
+	}
+	if got, expected := coordString(&stored.Pickup), coordString(&want.Pickup); got != expected {
+		diff("pickup", got, expected)
+	}
+	if got, expected := coordString(stored.Dropoff), coordString(want.Dropoff); got != expected {
+		diff("dropoff", got, expected)
+	}
+	// Postgres keeps microseconds.
+	if !stored.CreatedAt.Truncate(time.Microsecond).Equal(want.CreatedAt.Truncate(time.Microsecond)) {
+		diff("createdAt", stored.CreatedAt.UTC().Format(time.RFC3339Nano), want.CreatedAt.UTC().Format(time.RFC3339Nano))
+	}
+	return diffs
+}
+
+func coordString(c *Coordinate) string {
+	if c == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%v,%v", c.Latitude, c.Longitude)
+}
+
+// Repaired returns the stored ride corrected to match the projection, keeping
+// what the event log does not know (the PIN, and creation details for partial
+// projections).
+func (proj RideProjection) Repaired(stored Ride, found bool) (Ride, error) {
+	if !found && proj.Partial {
+		return Ride{}, errors.New("ride missing from table and its creation details are not in the event log")
+	}
+	out := proj.Ride
+	if found {
+		out.PickupPIN = stored.PickupPIN
+		if proj.Partial {
+			out.Pickup = stored.Pickup
+			out.Dropoff = stored.Dropoff
+			out.LocationCode = stored.LocationCode
+			out.CreatedAt = stored.CreatedAt
+		}
+	}
+	return out, nil
+}
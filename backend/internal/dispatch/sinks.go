@@ -0,0 +1,135 @@
+package dispatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WebhookSink POSTs ride transitions to a partner or internal endpoint. The
+// X-TurboDriver-Delivery header carries the dedupe key; when a secret is set the
+// body is signed with HMAC-SHA256 in X-TurboDriver-Signature.
+type WebhookSink struct {
+	url    string
+	name   string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookSink(rawURL, secret string) (*WebhookSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q", rawURL)
+	}
+	return &WebhookSink{
+		url: rawURL,
+		// Named by host and path so query-string credentials stay out of metrics.
+		name:   "webhook:" + u.Host + u.Path,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+func (s *WebhookSink) Name() string { return s.name }
+
+func (s *WebhookSink) Deliver(ctx context.Context, msg OutboxMessage) error {
+	msg.Ride = msg.Ride.WithoutPIN()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-TurboDriver-Delivery", msg.DedupeKey)
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set("X-TurboDriver-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Notification is a message for a rider or driver. RideID is empty for
+// messages not about a ride. Key is stable across redeliveries so
+// providers can suppress duplicates.
+type Notification struct {
+	Key     string
+	UserID  string
+	RideID  string
+	Message string
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// LogNotifier writes notifications to the log (local development).
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(_ context.Context, n Notification) error {
+	if n.RideID == "" {
+		log.Printf("notify %s: %s", n.UserID, n.Message)
+		return nil
+	}
+	log.Printf("notify %s (ride %s): %s", n.UserID, n.RideID, n.Message)
+	return nil
+}
+
+// NotificationSink tells passengers about transitions they care about.
+type NotificationSink struct {
+	Notifier Notifier
+}
+
+func (NotificationSink) Name() string { return "notifications" }
+
+func (s NotificationSink) Deliver(ctx context.Context, msg OutboxMessage) error {
+	text := passengerNotice(msg)
+	if text == "" || msg.Ride.PassengerID == "" {
+		return nil
+	}
+	return s.Notifier.Notify(ctx, Notification{
+		Key:     msg.DedupeKey,
+		UserID:  msg.Ride.PassengerID,
+		RideID:  msg.RideID,
+		Message: text,
+	})
+}
+
+func passengerNotice(msg OutboxMessage) string {
+	switch msg.EventType {
+	case "ride_accepted":
+		return "Your driver is on the way."
+	case "ride_started":
+		return "Your trip has started."
+	case "ride_completed":
+		return "You have arrived. Thanks for riding with TurboDriver."
+	case "ride_cancelled":
+		return "Your ride was cancelled."
+	case "pickup_pin_reissued":
+		return "Your driver entered a wrong pickup PIN too many times. Check the app for your new PIN and only share it in person."
+	case "ride_reassigned":
+		if msg.Ride.Status == RideRequested {
+			return "Your driver did not respond; we are looking for another one."
+		}
+	}
+	return ""
+}
@@ -2,10 +2,12 @@ package dispatch
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,18 +15,50 @@ import (
 
 // Persistence allows persisting and retrieving driver/ride state.
 type Persistence interface {
-	SaveDriver(DriverState) error
-	SaveRide(Ride) error
-	UpdateRideStatus(id string, status RideStatus) error
-	SetDriverRide(driverID, rideID, status string, available bool) error
-	GetRide(string) (Ride, bool, error)
+	SaveDriver(ctx context.Context, driver DriverState) error
+	SaveRide(ctx context.Context, ride Ride) error
+	UpdateRideStatus(ctx context.Context, id string, status RideStatus) error
+	SetDriverRide(ctx context.Context, driverID, rideID, status string, available bool) error
+	GetRide(ctx context.Context, id string) (Ride, bool, error)
+}
+
+// Pickup PIN verification limits: every maxPINAttempts wrong guesses the ride
+// gets a new PIN, which only the passenger sees; after maxPINFailures in total
+// the ride can no longer be started and has to be cancelled.
+const (
+	maxPINAttempts = 5
+	maxPINFailures = 15
+)
+
+var (
+	ErrPINMismatch = errors.New("invalid pickup pin")
+	ErrPINReissued = errors.New("too many invalid pin attempts, ask the passenger for their new pin")
+	ErrPINLocked   = errors.New("too many invalid pin attempts, the ride can no longer be started")
+	// ErrPersistence wraps failed database writes; the in-memory state is left
+	// as it was before the call.
+	ErrPersistence = errors.New("failed to persist change")
+	// ErrVersionConflict means the ride changed since the caller last saw it.
+	ErrVersionConflict = errors.New("ride was modified concurrently")
+)
+
+// ConflictError reports a version conflict along with the ride's current state.
+type ConflictError struct {
+	Current Ride
 }
 
+func (e *ConflictError) Error() string { return ErrVersionConflict.Error() }
+
+func (e *ConflictError) Unwrap() error { return ErrVersionConflict }
+
+// maxTrackPoints bounds the in-memory breadcrumb trail kept per active ride.
+const maxTrackPoints = 500
+
 // Store keeps a minimal in-memory view of drivers and rides, with optional persistence.
 type Store struct {
 	mu          sync.RWMutex
 	drivers     map[string]DriverState
 	rides       map[string]Ride
+	tracks      map[string][]Coordinate
 	persistence Persistence
 	geo         GeoLocator
 	tx          RideTransaction
@@ -35,6 +69,10 @@ type Store struct {
 	idemDB      IdempotencyStore
 	dbPing      func(context.Context) error
 	redisPing   func(context.Context) error
+	memOutbox   *MemoryOutbox
+	outboxWake  func()
+	// persistFailures counts failed persistence operations (see PersistFailures).
+	persistFailures int64
 }
 
 func NewStore() *Store {
@@ -56,10 +94,12 @@ func NewStoreWithDeps(p Persistence, g GeoLocator) *Store {
 	return &Store{
 		drivers:     make(map[string]DriverState),
 		rides:       make(map[string]Ride),
+		tracks:      make(map[string][]Coordinate),
 		persistence: p,
 		geo:         g,
 		tx:          toRideTx(p),
 		idemCache:   newIdemCache(),
+		memOutbox:   NewMemoryOutbox(),
 	}
 }
 
@@ -85,7 +125,9 @@ func (s *Store) AttachHealth(db func(context.Context) error, redis func(context.
 }
 
 // UpdateDriverLocation sets the latest known driver position and marks them available.
-func (s *Store) UpdateDriverLocation(id string, loc Coordinate) (DriverState, error) {
+// The in-memory position is kept even if persisting it fails, since matching
+// depends on it; the error is still returned.
+func (s *Store) UpdateDriverLocation(ctx context.Context, id string, loc Coordinate) (DriverState, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -105,24 +147,51 @@ func (s *Store) UpdateDriverLocation(id string, loc Coordinate) (DriverState, er
 		}
 	}
 	s.drivers[id] = state
-	if s.persistence != nil {
-		if err := s.persistence.SaveDriver(state); err != nil {
-			return state, err
-		}
+	if state.RideID != "" {
+		s.appendTrackLocked(state.RideID, loc)
 	}
 	if s.geo != nil {
 		_ = s.geo.Add(id, loc.Latitude, loc.Longitude)
 	}
+	if s.persistence != nil {
+		if err := s.persistence.SaveDriver(ctx, state); err != nil {
+			return state, s.persistFailed(err)
+		}
+	}
 	return state, nil
 }
 
+// TakeDriverOffline stops matching a driver until their next location update.
+// Drivers on a ride are left alone. It reports false if the driver was not
+// online.
+func (s *Store) TakeDriverOffline(ctx context.Context, id string) (DriverState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.drivers[id]
+	if !ok || state.RideID != "" || !state.Available {
+		return state, false, nil
+	}
+	state.Available = false
+	state.Status = "offline"
+	s.drivers[id] = state
+	if s.geo != nil {
+		_ = s.geo.Remove(id)
+	}
+	if s.persistence != nil {
+		if err := s.persistence.SaveDriver(ctx, state); err != nil {
+			return state, true, s.persistFailed(err)
+		}
+	}
+	return state, true, nil
+}
+
 // CreateRide creates a ride and assigns the nearest available driver within a fixed radius.
-func (s *Store) CreateRide(passengerID string, pickup Coordinate, idemKey string) (Ride, error) {
+func (s *Store) CreateRide(ctx context.Context, passengerID, bookedBy string, pickup Coordinate, dropoff *Coordinate, locationCode, idemKey string) (Ride, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if idemKey != "" {
-		if ride, ok := s.lookupRideByKeyLocked(idemKey); ok {
+		if ride, ok := s.lookupRideByKeyLocked(ctx, idemKey); ok {
 			return ride, nil
 		}
 	}
@@ -134,12 +203,16 @@ func (s *Store) CreateRide(passengerID string, pickup Coordinate, idemKey string
 
 	now := time.Now()
 	ride := Ride{
-		ID:          fmt.Sprintf("ride_%d", now.UnixNano()),
-		PassengerID: passengerID,
-		DriverID:    nearestID,
-		Status:      RideAssigned,
-		Pickup:      pickup,
-		CreatedAt:   now,
+		ID:           fmt.Sprintf("ride_%d", now.UnixNano()),
+		PassengerID:  passengerID,
+		DriverID:     nearestID,
+		Status:       RideAssigned,
+		Pickup:       pickup,
+		Dropoff:      dropoff,
+		LocationCode: locationCode,
+		BookedBy:     bookedBy,
+		CreatedAt:    now,
+		Version:      1,
 	}
 
 	driver := s.drivers[nearestID]
@@ -147,177 +220,320 @@ func (s *Store) CreateRide(passengerID string, pickup Coordinate, idemKey string
 	driver.Status = "assigned"
 	driver.Available = false
 
+	if err := s.persistRideAndDriverTx(ctx, ride, "ride_assigned", map[string]any{
+		"statusTo":     ride.Status,
+		"passengerId":  ride.PassengerID,
+		"driverId":     driver.ID,
+		"bookedBy":     ride.BookedBy,
+		"distKm":       dist,
+		"pickup":       ride.Pickup,
+		"dropoff":      ride.Dropoff,
+		"locationCode": ride.LocationCode,
+		"createdAt":    ride.CreatedAt,
+	}, driver); err != nil {
+		return Ride{}, err
+	}
 	s.drivers[nearestID] = driver
 	s.rides[ride.ID] = ride
 
-	s.persistRideAndDriverTx(ride, driver, "ride_assigned", map[string]any{
-		"statusTo": ride.Status,
-		"driverId": driver.ID,
-		"distKm":   dist,
-	})
 	s.idemCache.Remember(idemKey, ride.ID)
 	if s.idemDB != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 		defer cancel()
-		_ = s.idemDB.Remember(ctx, idemKey, ride.ID)
+		if err := s.idemDB.Remember(ctx, idemKey, ride.ID); err != nil {
+			atomic.AddInt64(&s.persistFailures, 1)
+		}
 	}
-
-	_ = dist // retained for future logging/metrics
 	return ride, nil
 }
 
 // LookupIdempotent returns a ride if the idempotency key was seen.
-func (s *Store) LookupIdempotent(key string) (Ride, bool) {
+func (s *Store) LookupIdempotent(ctx context.Context, key string) (Ride, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.lookupRideByKeyLocked(key)
+	return s.lookupRideByKeyLocked(ctx, key)
 }
 
-func (s *Store) lookupRideByKeyLocked(key string) (Ride, bool) {
+func (s *Store) lookupRideByKeyLocked(ctx context.Context, key string) (Ride, bool) {
 	if key == "" {
 		return Ride{}, false
 	}
 	if id, ok := s.idemCache.Lookup(key); ok {
-		return s.GetRide(id)
+		return s.getRideLocked(ctx, id)
 	}
 	if s.idemDB != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 		defer cancel()
 		if id, ok, err := s.idemDB.Lookup(ctx, key); err == nil && ok {
-			return s.GetRide(id)
+			return s.getRideLocked(ctx, id)
 		}
 	}
 	return Ride{}, false
 }
 
-func (s *Store) GetRide(id string) (Ride, bool) {
+// GetRide returns the ride from memory, falling back to persistence.
+func (s *Store) GetRide(ctx context.Context, id string) (Ride, bool) {
 	s.mu.RLock()
 	ride, ok := s.rides[id]
 	s.mu.RUnlock()
 	if ok {
 		return ride, true
 	}
-	if s.persistence != nil {
-		dbRide, found, err := s.persistence.GetRide(id)
-		if err == nil && found {
-			s.mu.Lock()
-			s.rides[id] = dbRide
-			s.mu.Unlock()
-			return dbRide, true
-		}
+	dbRide, found := s.loadRide(ctx, id)
+	if !found {
+		return Ride{}, false
 	}
-	return Ride{}, false
+	s.mu.Lock()
+	s.rides[id] = dbRide
+	s.mu.Unlock()
+	return dbRide, true
+}
+
+// getRideLocked is GetRide for callers already holding s.mu.
+func (s *Store) getRideLocked(ctx context.Context, id string) (Ride, bool) {
+	if ride, ok := s.rides[id]; ok {
+		return ride, true
+	}
+	dbRide, found := s.loadRide(ctx, id)
+	if found {
+		s.rides[id] = dbRide
+	}
+	return dbRide, found
+}
+
+func (s *Store) loadRide(ctx context.Context, id string) (Ride, bool) {
+	if s.persistence == nil {
+		return Ride{}, false
+	}
+	ride, found, err := s.persistence.GetRide(ctx, id)
+	if err != nil {
+		atomic.AddInt64(&s.persistFailures, 1)
+		return Ride{}, false
+	}
+	return ride, found
+}
+
+// GetDriver returns the latest in-memory state for a driver.
+func (s *Store) GetDriver(id string) (DriverState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	drv, ok := s.drivers[id]
+	return drv, ok
+}
+
+// RecentTrack returns up to n of the latest driver positions recorded for a ride (n<=0 returns all).
+func (s *Store) RecentTrack(rideID string, n int) []Coordinate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	track := s.tracks[rideID]
+	if n > 0 && len(track) > n {
+		track = track[len(track)-n:]
+	}
+	out := make([]Coordinate, len(track))
+	copy(out, track)
+	return out
+}
+
+func (s *Store) appendTrackLocked(rideID string, loc Coordinate) {
+	track := append(s.tracks[rideID], loc)
+	if len(track) > maxTrackPoints {
+		track = track[len(track)-maxTrackPoints:]
+	}
+	s.tracks[rideID] = track
 }
 
 // AcceptRide transitions a ride to accepted and marks the driver as busy.
-func (s *Store) AcceptRide(rideID, driverID string) (Ride, RideStatus, error) {
+func (s *Store) AcceptRide(ctx context.Context, rideID, driverID string) (Ride, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	ride, ok := s.rides[rideID]
 	if !ok {
-		return Ride{}, "", errors.New("ride not found")
+		return Ride{}, errors.New("ride not found")
 	}
 	if ride.DriverID != driverID {
-		return Ride{}, "", errors.New("driver mismatch")
+		return Ride{}, errors.New("driver mismatch")
+	}
+	if !versionExpected(ctx, ride.Version) {
+		return Ride{}, &ConflictError{Current: ride}
 	}
 	if ride.Status != RideAssigned {
-		return Ride{}, "", errors.New("ride not in assignable state")
+		return Ride{}, errors.New("ride not in assignable state")
 	}
 
 	prev := ride.Status
 	ride.Status = RideAccepted
-	s.rides[rideID] = ride
+	ride.Version++
+	ride.PickupPIN = newPickupPIN()
 
 	driver := s.drivers[driverID]
 	driver.Status = "accepted"
 	driver.Available = false
 	driver.RideID = ride.ID
-	s.drivers[driverID] = driver
 
-	s.persistRideAndDriverTx(ride, driver, "ride_accepted", map[string]any{
+	if err := s.persistRideAndDriverTx(ctx, ride, "ride_accepted", map[string]any{
+		"driverId":   driverID,
 		"statusFrom": prev,
 		"statusTo":   ride.Status,
-	})
-	return ride, prev, nil
+	}, driver); err != nil {
+		return Ride{}, err
+	}
+	s.rides[rideID] = ride
+	s.drivers[driverID] = driver
+	return ride, nil
 }
 
-// CancelRide cancels a ride and frees the driver.
-func (s *Store) CancelRide(rideID string) (Ride, RideStatus, error) {
+// StartRide moves an accepted ride to en_route once the driver has picked up the
+// passenger. When requirePIN is set the driver must present the ride's pickup PIN;
+// wrong attempts replace the PIN and eventually lock the ride (see maxPINFailures).
+func (s *Store) StartRide(ctx context.Context, rideID, driverID, pin string, requirePIN bool) (Ride, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	ride, ok := s.rides[rideID]
 	if !ok {
-		return Ride{}, "", errors.New("ride not found")
+		return Ride{}, errors.New("ride not found")
+	}
+	if ride.DriverID != driverID {
+		return Ride{}, errors.New("driver mismatch")
 	}
-	if ride.Status == RideCancelled || ride.Status == RideComplete {
-		return Ride{}, "", errors.New("ride already finished")
+	if !versionExpected(ctx, ride.Version) {
+		return Ride{}, &ConflictError{Current: ride}
+	}
+	if ride.Status != RideAccepted {
+		return Ride{}, errors.New("ride not in startable state")
+	}
+	if requirePIN {
+		if ride.PINFailures >= maxPINFailures {
+			return Ride{}, ErrPINLocked
+		}
+		if ride.PickupPIN == "" || pin != ride.PickupPIN {
+			return Ride{}, s.pinFailedLocked(ctx, ride)
+		}
 	}
 
 	prev := ride.Status
-	ride.Status = RideCancelled
+	ride.Status = RideEnRoute
+	ride.Version++
+
+	driver := s.drivers[driverID]
+	driver.Status = "on_ride"
+	driver.Available = false
+	driver.RideID = ride.ID
+
+	if err := s.persistRideAndDriverTx(ctx, ride, "ride_started", map[string]any{
+		"driverId":    driverID,
+		"statusFrom":  prev,
+		"statusTo":    ride.Status,
+		"pinVerified": requirePIN,
+	}, driver); err != nil {
+		return Ride{}, err
+	}
 	s.rides[rideID] = ride
+	s.drivers[driverID] = driver
+	return ride, nil
+}
 
-	if ride.DriverID != "" {
-		driver := s.drivers[ride.DriverID]
-		driver.Status = "idle"
-		driver.Available = true
-		driver.RideID = ""
-		s.drivers[driver.ID] = driver
-		s.persistRideAndDriverTx(ride, driver, "ride_cancelled", map[string]any{
-			"statusFrom": prev,
-			"statusTo":   ride.Status,
-		})
-	} else {
-		s.persistRideAndDriverTx(ride, DriverState{}, "ride_cancelled", map[string]any{
-			"statusFrom": prev,
-			"statusTo":   ride.Status,
-		})
+// PINFailureRecorder counts wrong pickup PINs durably, so the limits hold
+// across replicas and restarts.
+type PINFailureRecorder interface {
+	RecordPINFailure(ctx context.Context, rideID string) (int, error)
+}
+
+// pinFailedLocked records a wrong PIN and returns the error for the driver.
+// Each maxPINAttempts failures the PIN is replaced, so guessing has to start
+// over and the driver has to ask the passenger again. Callers hold s.mu.
+func (s *Store) pinFailedLocked(ctx context.Context, ride Ride) error {
+	failures := ride.PINFailures + 1
+	if rec, ok := s.persistence.(PINFailureRecorder); ok {
+		n, err := rec.RecordPINFailure(ctx, ride.ID)
+		if err != nil {
+			return s.persistFailed(err)
+		}
+		failures = n
+	}
+	ride.PINFailures = failures
+	switch {
+	case failures >= maxPINFailures:
+		s.rides[ride.ID] = ride
+		return ErrPINLocked
+	case failures%maxPINAttempts != 0:
+		s.rides[ride.ID] = ride
+		return ErrPINMismatch
+	}
+	ride.PickupPIN = newPickupPIN()
+	ride.Version++
+	if err := s.persistRideAndDriverTx(ctx, ride, "pickup_pin_reissued", map[string]any{
+		"driverId": ride.DriverID,
+		"failures": failures,
+	}); err != nil {
+		return err
 	}
+	s.rides[ride.ID] = ride
+	return ErrPINReissued
+}
 
-	return ride, prev, nil
+// CancelRide cancels a ride and frees the driver.
+func (s *Store) CancelRide(ctx context.Context, rideID string) (Ride, error) {
+	return s.finishRide(ctx, rideID, RideCancelled, "ride_cancelled")
 }
 
 // CompleteRide marks a ride complete and frees the driver.
-func (s *Store) CompleteRide(rideID string) (Ride, RideStatus, error) {
+func (s *Store) CompleteRide(ctx context.Context, rideID string) (Ride, error) {
+	return s.finishRide(ctx, rideID, RideComplete, "ride_completed")
+}
+
+func (s *Store) finishRide(ctx context.Context, rideID string, status RideStatus, evt string) (Ride, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	ride, ok := s.rides[rideID]
 	if !ok {
-		return Ride{}, "", errors.New("ride not found")
+		return Ride{}, errors.New("ride not found")
+	}
+	if !versionExpected(ctx, ride.Version) {
+		return Ride{}, &ConflictError{Current: ride}
 	}
-	if ride.Status != RideAccepted && ride.Status != RideEnRoute {
-		return Ride{}, "", errors.New("ride not in progress")
+	switch status {
+	case RideCancelled:
+		if ride.Status == RideCancelled || ride.Status == RideComplete {
+			return Ride{}, errors.New("ride already finished")
+		}
+	case RideComplete:
+		if ride.Status != RideAccepted && ride.Status != RideEnRoute {
+			return Ride{}, errors.New("ride not in progress")
+		}
 	}
 
 	prev := ride.Status
-	ride.Status = RideComplete
-	s.rides[rideID] = ride
+	ride.Status = status
+	ride.Version++
 
+	var driver DriverState
 	if ride.DriverID != "" {
-		driver := s.drivers[ride.DriverID]
+		driver = s.drivers[ride.DriverID]
+		driver.ID = ride.DriverID
 		driver.Status = "idle"
 		driver.Available = true
 		driver.RideID = ""
+	}
+	if err := s.persistRideAndDriverTx(ctx, ride, evt, map[string]any{
+		"driverId":   ride.DriverID,
+		"statusFrom": prev,
+		"statusTo":   ride.Status,
+	}, driver); err != nil {
+		return Ride{}, err
+	}
+	s.rides[rideID] = ride
+	if driver.ID != "" {
 		s.drivers[driver.ID] = driver
-		s.persistRideAndDriverTx(ride, driver, "ride_completed", map[string]any{
-			"statusFrom": prev,
-			"statusTo":   ride.Status,
-		})
-	} else {
-		s.persistRideAndDriverTx(ride, DriverState{}, "ride_completed", map[string]any{
-			"statusFrom": prev,
-			"statusTo":   ride.Status,
-		})
 	}
-
-	return ride, prev, nil
+	delete(s.tracks, rideID)
+	return ride, nil
 }
 
 // UpdateRideStatus allows direct status updates used by persistence or admin overrides.
-func (s *Store) UpdateRideStatus(rideID string, status RideStatus) (Ride, error) {
+func (s *Store) UpdateRideStatus(ctx context.Context, rideID string, status RideStatus) (Ride, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -325,49 +541,127 @@ func (s *Store) UpdateRideStatus(rideID string, status RideStatus) (Ride, error)
 	if !ok {
 		return Ride{}, errors.New("ride not found")
 	}
+	if !versionExpected(ctx, ride.Version) {
+		return Ride{}, &ConflictError{Current: ride}
+	}
 	ride.Status = status
+	ride.Version++
+	if err := s.persistRideAndDrivers(ctx, ride); err != nil {
+		return Ride{}, err
+	}
 	s.rides[rideID] = ride
-	s.persistRideAndDriver(ride, DriverState{})
 	return ride, nil
 }
 
-func (s *Store) persistRideAndDriver(ride Ride, driver DriverState) {
+// PersistFailures counts persistence operations that returned an error.
+func (s *Store) PersistFailures() int64 {
+	return atomic.LoadInt64(&s.persistFailures)
+}
+
+func (s *Store) persistFailed(err error) error {
+	atomic.AddInt64(&s.persistFailures, 1)
+	return fmt.Errorf("%w: %v", ErrPersistence, err)
+}
+
+// persistRideAndDrivers writes the ride and any driver changes without an event.
+func (s *Store) persistRideAndDrivers(ctx context.Context, ride Ride, drivers ...DriverState) error {
 	if s.persistence == nil {
-		return
+		return nil
 	}
-	_ = s.persistence.UpdateRideStatus(ride.ID, ride.Status)
-	if driver.ID != "" {
-		_ = s.persistence.SetDriverRide(driver.ID, driver.RideID, driver.Status, driver.Available)
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := s.persistence.SaveRide(ctx, ride); err != nil {
+		return s.persistFailed(err)
 	}
+	for _, driver := range drivers {
+		if err := s.persistence.SetDriverRide(ctx, driver.ID, driver.RideID, driver.Status, driver.Available); err != nil {
+			return s.persistFailed(err)
+		}
+	}
+	return nil
 }
 
-func (s *Store) persistRideAndDriverTx(ride Ride, driver DriverState, evt string, payload map[string]any) {
-	if s.tx != nil {
-		body, _ := json.Marshal(payload)
-		var drv *DriverState
-		if driver.ID != "" {
-			drv = &driver
+// persistRideAndDriverTx writes a ride transition together with its event and
+// outbox message. The caller applies the change in memory only once this
+// succeeds; drivers with an empty ID are skipped.
+func (s *Store) persistRideAndDriverTx(ctx context.Context, ride Ride, evt string, payload map[string]any, drivers ...DriverState) error {
+	changed := drivers[:0:0]
+	for _, d := range drivers {
+		if d.ID != "" {
+			changed = append(changed, d)
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-		if evt == "ride_assigned" && payload["statusFrom"] == nil {
-			_ = s.tx.CreateRideWithEvent(ctx, ride, RideEvent{
-				RideID:    ride.ID,
-				Type:      evt,
-				Payload:   body,
-				CreatedAt: time.Now(),
-			}, driver)
-			return
+	}
+	body, _ := json.Marshal(payload)
+	event := RideEvent{
+		RideID:    ride.ID,
+		Type:      evt,
+		Payload:   body,
+		CreatedAt: time.Now(),
+	}
+	if actor, ok := ActorFromContext(ctx); ok {
+		event.ActorID = actor.ID
+		event.ActorRole = string(actor.Role)
+	}
+
+	if s.tx == nil {
+		if err := s.persistRideAndDrivers(ctx, ride, changed...); err != nil {
+			return err
 		}
-		_ = s.tx.UpdateRideWithEvent(ctx, ride, RideEvent{
+		s.memOutbox.Append(OutboxMessage{
 			RideID:    ride.ID,
-			Type:      evt,
+			EventType: evt,
+			Ride:      ride.WithoutPIN(),
 			Payload:   body,
-			CreatedAt: time.Now(),
-		}, drv)
-		return
+			CreatedAt: event.CreatedAt,
+		})
+		s.wakeOutbox()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var err error
+	if evt == "ride_assigned" && payload["statusFrom"] == nil {
+		err = s.tx.CreateRideWithEvent(ctx, ride, event, changed[0])
+	} else {
+		err = s.tx.UpdateRideWithEvent(ctx, ride, event, changed...)
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		// Another replica moved the ride on; adopt its state so the caller can retry.
+		if current, found := s.loadRide(ctx, ride.ID); found {
+			s.rides[ride.ID] = current
+			return &ConflictError{Current: current}
+		}
+		return s.persistFailed(err)
+	}
+	if err != nil {
+		return s.persistFailed(err)
+	}
+	s.wakeOutbox()
+	return nil
+}
+
+// Outbox returns where committed ride transitions wait for the relay: the
+// database when rides are persisted transactionally, otherwise memory.
+func (s *Store) Outbox() OutboxStore {
+	if ob, ok := s.tx.(OutboxStore); ok {
+		return ob
+	}
+	return s.memOutbox
+}
+
+// OnOutboxWrite registers a callback run after each committed transition,
+// typically OutboxRelay.Wake.
+func (s *Store) OnOutboxWrite(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outboxWake = fn
+}
+
+func (s *Store) wakeOutbox() {
+	if s.outboxWake != nil {
+		s.outboxWake()
 	}
-	s.persistRideAndDriver(ride, driver)
 }
 
 // PruneStaleDrivers removes drivers whose heartbeats are older than ttl.
@@ -441,6 +735,50 @@ func (s *Store) DriverIsFresh(driverID string, ttl time.Duration) bool {
 	return time.Since(drv.UpdatedAt) <= ttl
 }
 
+// ActiveRideFor returns an unfinished ride the identity is on, as passenger or driver.
+func (s *Store) ActiveRideFor(id string) (Ride, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ride := range s.rides {
+		if ride.Status == RideComplete || ride.Status == RideCancelled {
+			continue
+		}
+		if ride.PassengerID == id || ride.DriverID == id {
+			return ride, true
+		}
+	}
+	return Ride{}, false
+}
+
+// ForgetIdentity drops an erased identity from memory: its driver state,
+// location and ride tracks go, and rides it took part in name the pseudonym.
+func (s *Store) ForgetIdentity(id, pseudonym string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.drivers[id]; ok {
+		delete(s.drivers, id)
+		if s.geo != nil {
+			_ = s.geo.Remove(id)
+		}
+	}
+	for rideID, ride := range s.rides {
+		changed := false
+		if ride.PassengerID == id {
+			ride.PassengerID = pseudonym
+			ride.PickupPIN = ""
+			changed = true
+		}
+		if ride.DriverID == id {
+			ride.DriverID = pseudonym
+			delete(s.tracks, rideID)
+			changed = true
+		}
+		if changed {
+			s.rides[rideID] = ride
+		}
+	}
+}
+
 // HealthCheck checks db/redis ping if configured.
 func (s *Store) HealthCheck(ctx context.Context) error {
 	if s.dbPing != nil {
@@ -457,7 +795,7 @@ func (s *Store) HealthCheck(ctx context.Context) error {
 }
 
 // ReassignIfUnaccepted frees the current driver and attempts to reassign if still unaccepted.
-func (s *Store) ReassignIfUnaccepted(rideID, expectedDriverID string) (Ride, bool, error) {
+func (s *Store) ReassignIfUnaccepted(ctx context.Context, rideID, expectedDriverID string) (Ride, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -470,34 +808,42 @@ func (s *Store) ReassignIfUnaccepted(rideID, expectedDriverID string) (Ride, boo
 	}
 
 	// free prior driver
+	var changed []DriverState
 	if driver, ok := s.drivers[expectedDriverID]; ok {
 		driver.Status = "idle"
 		driver.Available = true
 		driver.RideID = ""
-		s.drivers[driver.ID] = driver
-		s.persistRideAndDriver(ride, driver)
+		changed = append(changed, driver)
 	}
 
+	ride.Version++
 	exclude := map[string]struct{}{expectedDriverID: {}}
 	nextID, _ := s.findNearestDriverLockedExcluding(ride.Pickup, 3, exclude)
 	if nextID == "" {
 		ride.Status = RideRequested
 		ride.DriverID = ""
-		s.rides[rideID] = ride
-		s.persistRideAndDriver(ride, DriverState{})
-		return ride, true, nil
+	} else {
+		ride.DriverID = nextID
+		ride.Status = RideAssigned
+		driver := s.drivers[nextID]
+		driver.RideID = ride.ID
+		driver.Status = "assigned"
+		driver.Available = false
+		changed = append(changed, driver)
+	}
+
+	if err := s.persistRideAndDriverTx(ctx, ride, "ride_reassigned", map[string]any{
+		"previousDriver": expectedDriverID,
+		"newDriver":      ride.DriverID,
+		"statusFrom":     RideAssigned,
+		"statusTo":       ride.Status,
+	}, changed...); err != nil {
+		return Ride{}, false, err
 	}
-
-	ride.DriverID = nextID
-	ride.Status = RideAssigned
 	s.rides[rideID] = ride
-
-	driver := s.drivers[nextID]
-	driver.RideID = ride.ID
-	driver.Status = "assigned"
-	driver.Available = false
-	s.drivers[nextID] = driver
-	s.persistRideAndDriver(ride, driver)
+	for _, driver := range changed {
+		s.drivers[driver.ID] = driver
+	}
 	return ride, true, nil
 }
 
@@ -536,6 +882,14 @@ func (s *Store) findNearestDriverLockedExcluding(target Coordinate, radiusKM flo
 	return bestID, bestDist
 }
 
+func newPickupPIN() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return fmt.Sprintf("%04d", time.Now().UnixNano()%10000)
+	}
+	return fmt.Sprintf("%04d", n.Int64())
+}
+
 func haversineKM(a, b Coordinate) float64 {
 	const earthRadiusKM = 6371
 	lat1 := toRadians(a.Latitude)
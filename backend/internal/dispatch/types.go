@@ -2,6 +2,7 @@ package dispatch
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 )
 
@@ -16,6 +17,11 @@ const (
 	RideCancelled RideStatus = "cancelled"
 )
 
+// IsTerminal reports whether no further transitions are allowed.
+func (s RideStatus) IsTerminal() bool {
+	return s == RideComplete || s == RideCancelled
+}
+
 type Coordinate struct {
 	Latitude  float64   `json:"latitude"`
 	Longitude float64   `json:"longitude"`
@@ -39,6 +45,14 @@ const (
 	RolePassenger IdentityRole = "passenger"
 	RoleDriver    IdentityRole = "driver"
 	RoleAdmin     IdentityRole = "admin"
+
+	// Staff roles with narrower permissions than admin.
+	RoleSupportAgent IdentityRole = "support_agent"
+	RoleOpsManager   IdentityRole = "ops_manager"
+	RoleReviewer     IdentityRole = "reviewer"
+
+	// RolePartner is the principal behind a partner API key; the identity ID is the org.
+	RolePartner IdentityRole = "partner"
 )
 
 type Identity struct {
@@ -50,12 +64,63 @@ type Identity struct {
 }
 
 type Ride struct {
-	ID          string     `json:"id"`
-	PassengerID string     `json:"passengerId"`
-	DriverID    string     `json:"driverId,omitempty"`
-	Status      RideStatus `json:"status"`
-	Pickup      Coordinate `json:"pickup"`
-	CreatedAt   time.Time  `json:"createdAt"`
+	ID           string      `json:"id"`
+	PassengerID  string      `json:"passengerId"`
+	DriverID     string      `json:"driverId,omitempty"`
+	Status       RideStatus  `json:"status"`
+	Pickup       Coordinate  `json:"pickup"`
+	Dropoff      *Coordinate `json:"dropoff,omitempty"`
+	LocationCode string      `json:"locationCode,omitempty"`
+	// BookedBy is the partner org that booked the ride for the passenger, if any.
+	BookedBy string `json:"bookedBy,omitempty"`
+	// PickupPIN is issued at acceptance and must only be shown to the passenger.
+	PickupPIN string `json:"pickupPin,omitempty"`
+	// PINFailures counts wrong pickup PINs entered for the ride.
+	PINFailures int       `json:"-"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Version starts at 1 and increments on every transition.
+	Version int `json:"version"`
+}
+
+// WithoutPIN returns a copy of the ride safe to show to anyone but the passenger.
+func (r Ride) WithoutPIN() Ride {
+	r.PickupPIN = ""
+	return r
+}
+
+type actorCtxKey struct{}
+
+// ContextWithActor records who is acting so persisted ride events can name them.
+func ContextWithActor(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, actorCtxKey{}, id)
+}
+
+// ActorFromContext returns the identity set by ContextWithActor.
+func ActorFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(actorCtxKey{}).(Identity)
+	return id, ok
+}
+
+type expectedVersionCtxKey struct{}
+
+// ContextWithExpectedVersions makes ride transitions fail with a ConflictError
+// unless the ride is at one of the versions (an If-Match precondition).
+func ContextWithExpectedVersions(ctx context.Context, versions []int) context.Context {
+	return context.WithValue(ctx, expectedVersionCtxKey{}, versions)
+}
+
+// versionExpected reports whether the context's precondition, if any, allows v.
+func versionExpected(ctx context.Context, v int) bool {
+	versions, ok := ctx.Value(expectedVersionCtxKey{}).([]int)
+	if !ok {
+		return true
+	}
+	for _, want := range versions {
+		if want == v {
+			return true
+		}
+	}
+	return false
 }
 
 type RideEvent struct {
@@ -65,6 +130,8 @@ type RideEvent struct {
 	ActorID   string    `json:"actorId,omitempty"`
 	ActorRole string    `json:"actorRole,omitempty"`
 	CreatedAt time.Time `json:"createdAt"`
+	// Archived marks events read back from an archive export.
+	Archived bool `json:"archived,omitempty"`
 }
 
 type EventLogger interface {
@@ -73,9 +140,10 @@ type EventLogger interface {
 	CountRideEvents(ctx context.Context, rideID string) (int, error)
 }
 
+// RideTransaction writes a ride change, its event and its outbox message atomically.
 type RideTransaction interface {
 	CreateRideWithEvent(ctx context.Context, ride Ride, event RideEvent, driver DriverState) error
-	UpdateRideWithEvent(ctx context.Context, ride Ride, event RideEvent, driver *DriverState) error
+	UpdateRideWithEvent(ctx context.Context, ride Ride, event RideEvent, drivers ...DriverState) error
 }
 
 type IdempotencyStore interface {
@@ -100,29 +168,127 @@ const (
 	ApplicationApproved    DriverApplicationStatus = "approved"
 	ApplicationRejected    DriverApplicationStatus = "rejected"
 	ApplicationNeedsReview DriverApplicationStatus = "needs_review"
+	// ApplicationChangesRequested waits for the driver to resubmit the
+	// sections named in the latest review.
+	ApplicationChangesRequested DriverApplicationStatus = "changes_requested"
 )
 
+// LocationRule is one version of the rules drivers in a location accept. The
+// current version is the latest one whose EffectiveAt has passed.
 type LocationRule struct {
-	ID           int64     `json:"id"`
-	LocationCode string    `json:"locationCode"`
-	Name         string    `json:"name"`
-	Rules        []byte    `json:"rules"` // JSON blob
-	EffectiveAt  time.Time `json:"effectiveAt"`
-	CreatedAt    time.Time `json:"createdAt"`
+	ID           int64           `json:"id"`
+	LocationCode string          `json:"locationCode"`
+	Version      int             `json:"version"` // 1, 2, ... per location
+	Name         string          `json:"name"`
+	Rules        json.RawMessage `json:"rules"`
+	EffectiveAt  time.Time       `json:"effectiveAt"`
+	CreatedBy    string          `json:"createdBy,omitempty"`
+	CreatedAt    time.Time       `json:"createdAt"`
+}
+
+// InForce reports whether the version has taken effect at t.
+func (r LocationRule) InForce(t time.Time) bool {
+	return !r.EffectiveAt.After(t)
+}
+
+// RulesAcceptance compares the rules version a driver accepted with the one
+// now in force for their application's location.
+type RulesAcceptance struct {
+	LocationCode    string     `json:"locationCode"`
+	AcceptedVersion *int64     `json:"acceptedRulesVersionId,omitempty"`
+	AcceptedAt      *time.Time `json:"acceptedAt,omitempty"`
+	CurrentVersion  *int64     `json:"currentRulesVersionId,omitempty"`
+}
+
+// Current reports whether the driver has accepted the rules in force; a
+// location without rules needs no acceptance.
+func (a RulesAcceptance) Current() bool {
+	if a.CurrentVersion == nil {
+		return true
+	}
+	return a.AcceptedVersion != nil && *a.AcceptedVersion == *a.CurrentVersion
 }
 
 type DriverApplication struct {
-	ID           int64                   `json:"id"`
-	DriverID     string                  `json:"driverId"`
-	LocationCode string                  `json:"locationCode"`
-	RulesVersion *int64                  `json:"rulesVersion,omitempty"`
-	Status       DriverApplicationStatus `json:"status"`
-	License      DriverLicense           `json:"license"`
-	Vehicle      DriverVehicle           `json:"vehicle"`
-	Photos       []VehiclePhoto          `json:"photos,omitempty"`
-	Liveness     DriverLiveness          `json:"liveness"`
-	CreatedAt    time.Time               `json:"createdAt"`
-	UpdatedAt    time.Time               `json:"updatedAt"`
+	ID              int64                   `json:"id"`
+	DriverID        string                  `json:"driverId"`
+	LocationCode    string                  `json:"locationCode"`
+	RulesVersion    *int64                  `json:"rulesVersion,omitempty"`
+	RulesAcceptedAt *time.Time              `json:"rulesAcceptedAt,omitempty"` // when RulesVersion was accepted
+	RulesReport     *RulesReport            `json:"rulesReport,omitempty"`
+	Status          DriverApplicationStatus `json:"status"`
+	License         DriverLicense           `json:"license"`
+	Vehicle         DriverVehicle           `json:"vehicle"`
+	Photos          []VehiclePhoto          `json:"photos,omitempty"`
+	Liveness        DriverLiveness          `json:"liveness"`
+	CreatedAt       time.Time               `json:"createdAt"`
+	UpdatedAt       time.Time               `json:"updatedAt"`
+}
+
+// Sections of a driver application a reviewer can send back for changes.
+const (
+	SectionLicense  = "license"
+	SectionVehicle  = "vehicle"
+	SectionPhotos   = "photos"
+	SectionLiveness = "liveness"
+)
+
+// ApplicationReview is one reviewer decision on a driver application.
+// Sections lists what the driver must resubmit when changes are requested.
+type ApplicationReview struct {
+	ID            int64                   `json:"id"`
+	ApplicationID int64                   `json:"applicationId"`
+	DriverID      string                  `json:"driverId"`
+	ReviewerID    string                  `json:"reviewerId,omitempty"`
+	Decision      DriverApplicationStatus `json:"decision"`
+	Reason        string                  `json:"reason,omitempty"`
+	Findings      []DocumentFinding       `json:"findings"`
+	Sections      []string                `json:"sections,omitempty"`
+	CreatedAt     time.Time               `json:"createdAt"`
+}
+
+// DocumentFinding is a reviewer's verdict on one document, e.g. the
+// "license_document" or "vehicle_photo:front".
+type DocumentFinding struct {
+	Document string `json:"document"`
+	Verdict  string `json:"verdict"` // accepted | rejected | unreadable | expired | mismatch
+	Note     string `json:"note,omitempty"`
+}
+
+// ApplicationQueueItem is a driver application waiting on reviewers.
+type ApplicationQueueItem struct {
+	ApplicationID  int64                   `json:"applicationId"`
+	DriverID       string                  `json:"driverId"`
+	LocationCode   string                  `json:"locationCode"`
+	Status         DriverApplicationStatus `json:"status"`
+	RulesDecision  DriverApplicationStatus `json:"rulesDecision,omitempty"`
+	Reviews        int                     `json:"reviews"`
+	SubmittedAt    time.Time               `json:"submittedAt"`
+	UpdatedAt      time.Time               `json:"updatedAt"`
+	WaitingSeconds int64                   `json:"waitingSeconds"` // since UpdatedAt
+}
+
+// Results of a single rule check.
+const (
+	RulePass    = "pass"
+	RuleFail    = "fail"
+	RuleUnknown = "unknown" // the application lacks the data to decide
+)
+
+// RulesReport is the outcome of evaluating an application against its
+// location's rules; see package eligibility.
+type RulesReport struct {
+	RulesVersion int64                   `json:"rulesVersionId"`
+	Decision     DriverApplicationStatus `json:"decision"`
+	Results      []RuleResult            `json:"results"`
+	EvaluatedAt  time.Time               `json:"evaluatedAt"`
+}
+
+type RuleResult struct {
+	Check  string `json:"check"`
+	Result string `json:"result"`           // pass | fail | unknown
+	OnFail string `json:"onFail,omitempty"` // reject | review
+	Detail string `json:"detail,omitempty"`
 }
 
 type DriverLicense struct {
@@ -131,6 +297,7 @@ type DriverLicense struct {
 	Number      string     `json:"number"`
 	Country     string     `json:"country,omitempty"`
 	Region      string     `json:"region,omitempty"`
+	IssuedAt    *time.Time `json:"issuedAt,omitempty"`
 	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
 	Remunerated bool       `json:"remunerated"`
 	DocumentURL string     `json:"documentUrl,omitempty"`
@@ -144,6 +311,7 @@ type DriverVehicle struct {
 	DriverID        string     `json:"driverId"`
 	Type            string     `json:"type"` // car | motorcycle | bus
 	PlateNumber     string     `json:"plateNumber,omitempty"`
+	Year            int        `json:"year,omitempty"` // model year
 	DocumentNumber  string     `json:"documentNumber,omitempty"`
 	DocumentURL     string     `json:"documentUrl,omitempty"`
 	DocumentExpires *time.Time `json:"documentExpiresAt,omitempty"`
@@ -163,13 +331,94 @@ type VehiclePhoto struct {
 }
 
 type DriverLiveness struct {
-	ID                int64      `json:"id"`
-	DriverID          string     `json:"driverId"`
-	ChallengeSequence []string   `json:"challengeSequence"`
-	Captures          []byte     `json:"captures"` // JSON map direction -> photo URL
-	Verified          bool       `json:"verified"`
-	VerifiedAt        *time.Time `json:"verifiedAt,omitempty"`
-	CreatedAt         time.Time  `json:"createdAt"`
+	ID                int64           `json:"id"`
+	DriverID          string          `json:"driverId"`
+	ChallengeID       string          `json:"challengeId,omitempty"`
+	ChallengeSequence []string        `json:"challengeSequence"`
+	Captures          []byte          `json:"captures"` // JSON map direction -> photo URL
+	Status            string          `json:"status"`   // pending | verified | failed | error
+	Result            *LivenessResult `json:"result,omitempty"`
+	Attempts          int             `json:"-"`
+	Verified          bool            `json:"verified"`
+	VerifiedAt        *time.Time      `json:"verifiedAt,omitempty"`
+	CreatedAt         time.Time       `json:"createdAt"`
+}
+
+// Liveness verification states. Error means the verifier kept failing and a
+// reviewer has to look at the captures.
+const (
+	LivenessPending  = "pending"
+	LivenessVerified = "verified"
+	LivenessFailed   = "failed"
+	LivenessError    = "error"
+)
+
+// LivenessResult is a verifier's verdict on a driver's captures: Live when they
+// show a live person following the challenge, FaceMatch when that person is
+// the one on the license document.
+type LivenessResult struct {
+	Provider  string    `json:"provider"`
+	Live      bool      `json:"live"`
+	FaceMatch bool      `json:"faceMatch"`
+	Score     float64   `json:"score"`
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Passed reports whether the captures are verified.
+func (r LivenessResult) Passed() bool { return r.Live && r.FaceMatch }
+
+// LivenessChallenge is the head-turn order a driver is asked to capture. It is
+// issued by the server and used by at most one submission.
+type LivenessChallenge struct {
+	ID        string     `json:"id"`
+	DriverID  string     `json:"driverId"`
+	Sequence  []string   `json:"sequence"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+}
+
+// Uploads
+
+type UploadStatus string
+
+const (
+	UploadPending UploadStatus = "pending"
+	UploadReady   UploadStatus = "ready"
+)
+
+// Upload purposes; each has its own allowed types, size and dimensions.
+const (
+	UploadLicenseDocument = "license_document"
+	UploadVehicleDocument = "vehicle_document"
+	UploadVehicleContract = "vehicle_contract"
+	UploadVehiclePhoto    = "vehicle_photo"
+	UploadLivenessCapture = "liveness_capture"
+)
+
+// Upload is a file received for a driver application. Width and Height are
+// set for images.
+type Upload struct {
+	ID          string       `json:"id"`
+	OwnerID     string       `json:"ownerId"`
+	Purpose     string       `json:"purpose"`
+	Status      UploadStatus `json:"status"`
+	ObjectKey   string       `json:"-"`
+	ContentType string       `json:"contentType"`
+	Size        int64        `json:"size"`
+	SHA256      string       `json:"sha256"`
+	Width       int          `json:"width,omitempty"`
+	Height      int          `json:"height,omitempty"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	ExpiresAt   *time.Time   `json:"expiresAt,omitempty"`
+	CompletedAt *time.Time   `json:"completedAt,omitempty"`
+}
+
+// ContentURL is where the upload's content is served; applications store it
+// in place of client-supplied document URLs.
+func (u Upload) ContentURL() string {
+	return "/api/uploads/" + u.ID + "/content"
 }
 
 // Passenger profile
@@ -194,3 +443,191 @@ type Rating struct {
 	RequiresAttention bool         `json:"requiresAttention"`
 	CreatedAt         time.Time    `json:"createdAt"`
 }
+
+// In-ride chat
+
+type RideMessage struct {
+	ID         int64        `json:"id"`
+	RideID     string       `json:"rideId"`
+	SenderID   string       `json:"senderId"`
+	SenderRole IdentityRole `json:"senderRole"`
+	Body       string       `json:"body"`
+	QuickReply string       `json:"quickReply,omitempty"` // canned reply key when used
+	ReadAt     *time.Time   `json:"readAt,omitempty"`
+	CreatedAt  time.Time    `json:"createdAt"`
+}
+
+type QuickReply struct {
+	Key  string `json:"key"`
+	Body string `json:"body"`
+}
+
+// QuickReplies lists canned chat messages offered to each role.
+var QuickReplies = map[IdentityRole][]QuickReply{
+	RoleDriver: {
+		{Key: "on_my_way", Body: "I'm on my way."},
+		{Key: "arrived", Body: "I've arrived at the pickup point."},
+		{Key: "traffic", Body: "Running a few minutes late due to traffic."},
+		{Key: "cant_find", Body: "I can't find you. Can you share a landmark?"},
+	},
+	RolePassenger: {
+		{Key: "coming", Body: "I'm coming out now."},
+		{Key: "wait", Body: "Please wait, I'll be there in 2 minutes."},
+		{Key: "here", Body: "I'm at the pickup point."},
+		{Key: "call_me", Body: "Please call me when you arrive."},
+	},
+}
+
+// LookupQuickReply returns the canned reply for role and key.
+func LookupQuickReply(role IdentityRole, key string) (QuickReply, bool) {
+	for _, qr := range QuickReplies[role] {
+		if qr.Key == key {
+			return qr, true
+		}
+	}
+	return QuickReply{}, false
+}
+
+// Trip sharing
+
+// RideShare is a read-only, expiring link to a single ride's live status.
+type RideShare struct {
+	ID        int64      `json:"id"`
+	RideID    string     `json:"rideId"`
+	CreatedBy string     `json:"createdBy"`
+	Token     string     `json:"token,omitempty"` // only returned when minted
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Active reports whether the share can still be used at the given time.
+func (s RideShare) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// SharedRideView is the redacted ride snapshot exposed to share link viewers.
+type SharedRideView struct {
+	Status         RideStatus  `json:"status"`
+	Pickup         Coordinate  `json:"pickup"`
+	DriverLocation *Coordinate `json:"driverLocation,omitempty"`
+	ExpiresAt      time.Time   `json:"expiresAt"`
+}
+
+// Safety incidents
+
+type SafetyIncidentStatus string
+
+const (
+	IncidentOpen         SafetyIncidentStatus = "open"
+	IncidentAcknowledged SafetyIncidentStatus = "acknowledged"
+	IncidentEscalated    SafetyIncidentStatus = "escalated"
+	IncidentResolved     SafetyIncidentStatus = "resolved"
+)
+
+// CanTransition reports whether an incident may move from s to next.
+func (s SafetyIncidentStatus) CanTransition(next SafetyIncidentStatus) bool {
+	switch next {
+	case IncidentAcknowledged:
+		return s == IncidentOpen
+	case IncidentEscalated:
+		return s == IncidentOpen || s == IncidentAcknowledged
+	case IncidentResolved:
+		return s != IncidentResolved
+	}
+	return false
+}
+
+// SafetySnapshot freezes ride context at the moment an incident was raised.
+type SafetySnapshot struct {
+	Ride             Ride         `json:"ride"`
+	DriverLocation   *Coordinate  `json:"driverLocation,omitempty"`
+	ReporterLocation *Coordinate  `json:"reporterLocation,omitempty"`
+	Track            []Coordinate `json:"track,omitempty"`
+}
+
+type SafetyIncident struct {
+	ID             int64                `json:"id"`
+	RideID         string               `json:"rideId"`
+	Kind           string               `json:"kind"` // sos
+	ReporterID     string               `json:"reporterId,omitempty"`
+	ReporterRole   IdentityRole         `json:"reporterRole,omitempty"`
+	Status         SafetyIncidentStatus `json:"status"`
+	Note           string               `json:"note,omitempty"`
+	Snapshot       SafetySnapshot       `json:"snapshot"`
+	AcknowledgedBy string               `json:"acknowledgedBy,omitempty"`
+	AcknowledgedAt *time.Time           `json:"acknowledgedAt,omitempty"`
+	EscalatedBy    string               `json:"escalatedBy,omitempty"`
+	EscalatedAt    *time.Time           `json:"escalatedAt,omitempty"`
+	ResolvedBy     string               `json:"resolvedBy,omitempty"`
+	ResolvedAt     *time.Time           `json:"resolvedAt,omitempty"`
+	Resolution     string               `json:"resolution,omitempty"`
+	CreatedAt      time.Time            `json:"createdAt"`
+	UpdatedAt      time.Time            `json:"updatedAt"`
+}
+
+// LocationSettings holds per-location feature switches managed by admins.
+type LocationSettings struct {
+	LocationCode      string    `json:"locationCode"`
+	PickupPINRequired bool      `json:"pickupPinRequired"`
+	UpdatedBy         string    `json:"updatedBy,omitempty"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// Data subject requests
+
+const (
+	ComplianceExport  = "export"
+	ComplianceErasure = "erasure"
+)
+
+// ComplianceEvent is one step of a data subject request, kept in the
+// compliance audit log after the subject itself is erased.
+type ComplianceEvent struct {
+	ID          int64          `json:"id"`
+	RequestID   string         `json:"requestId"`
+	SubjectID   string         `json:"subjectId"`
+	SubjectRole IdentityRole   `json:"subjectRole"`
+	Request     string         `json:"request"` // export | erasure
+	Step        string         `json:"step"`
+	Detail      map[string]any `json:"detail,omitempty"`
+	ActorID     string         `json:"actorId,omitempty"`
+	CreatedAt   time.Time      `json:"createdAt"`
+}
+
+// DataExport is what is held about an identity, as handed to the subject.
+type DataExport struct {
+	Identity    ExportedIdentity    `json:"identity"`
+	Profile     *PassengerProfile   `json:"profile,omitempty"`
+	Application *DriverApplication  `json:"application,omitempty"`
+	Reviews     []ApplicationReview `json:"applicationReviews,omitempty"`
+	Rides       []Ride              `json:"rides"`
+	Ratings     []Rating            `json:"ratings"`
+	Messages    []RideMessage       `json:"messages"`
+	TrackPoints []TrackPoint        `json:"trackPoints"`
+	Uploads     []Upload            `json:"uploads"`
+}
+
+type ExportedIdentity struct {
+	ID        string       `json:"id"`
+	Role      IdentityRole `json:"role"`
+	Phones    []string     `json:"phones,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	ExpiresAt *time.Time   `json:"expiresAt,omitempty"`
+}
+
+// TrackPoint is a recorded position with where it was kept: "last_known" for
+// the driver's latest heartbeat, "ride" for a live ride's track and
+// "safety_incident" for the track captured with an incident.
+type TrackPoint struct {
+	RideID string `json:"rideId,omitempty"`
+	Source string `json:"source"`
+	Coordinate
+}
+
+// ErasureStep reports the rows one step of an erasure touched.
+type ErasureStep struct {
+	Step string `json:"step"`
+	Rows int64  `json:"rows"`
+}
@@ -0,0 +1,217 @@
+// Package eligibility evaluates driver applications against the rules of their
+// location.
+//
+// Rules live in location_rules.rules as a list of checks:
+//
+//	{"checks": [
+//	  {"check": "min_license_age", "years": 2, "onFail": "reject"},
+//	  {"check": "vehicle_types", "allowed": ["car", "motorcycle"]},
+//	  {"check": "max_vehicle_age", "years": 10},
+//	  {"check": "remunerated_license"},
+//	  {"check": "contract_for_rented"},
+//	  {"check": "liveness_verified"}
+//	]}
+//
+// A failed check sends the application to review unless it says
+// "onFail": "reject". Checks the application has no data for (say, a license
+// without an issue date) always go to review. Other keys in the rules object
+// are ignored, so locations can keep text for drivers next to the checks.
+package eligibility
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Checks a location may use.
+const (
+	// MinLicenseAge: the license was issued at least "years" ago.
+	MinLicenseAge = "min_license_age"
+	// LicenseNotExpired: the license has not expired.
+	LicenseNotExpired = "license_not_expired"
+	// RemuneratedLicense: the license permits paid driving.
+	RemuneratedLicense = "remunerated_license"
+	// VehicleTypes: the vehicle type is one of "allowed".
+	VehicleTypes = "vehicle_types"
+	// MaxVehicleAge: the vehicle's model year is at most "years" old.
+	MaxVehicleAge = "max_vehicle_age"
+	// VehicleDocumentNotExpired: the vehicle document has not expired.
+	VehicleDocumentNotExpired = "vehicle_document_not_expired"
+	// ContractForRented: rented or lent vehicles come with an unexpired contract.
+	ContractForRented = "contract_for_rented"
+	// LivenessVerified: the liveness captures passed verification. Unknown
+	// until the verifier has run; the application is evaluated again then.
+	LivenessVerified = "liveness_verified"
+)
+
+// What happens to an application when a check fails.
+const (
+	OnFailReject = "reject"
+	OnFailReview = "review"
+)
+
+// Check is one rule. Years and Allowed are only read by the checks that use them.
+type Check struct {
+	Check   string   `json:"check"`
+	Years   int      `json:"years,omitempty"`
+	Allowed []string `json:"allowed,omitempty"`
+	OnFail  string   `json:"onFail,omitempty"`
+}
+
+// Rules are the checks of one location rules version.
+type Rules struct {
+	Checks []Check `json:"checks"`
+}
+
+// Parse reads and validates a location_rules.rules document.
+func Parse(raw json.RawMessage) (Rules, error) {
+	var rules Rules
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return Rules{}, fmt.Errorf("rules: %w", err)
+	}
+	for i, c := range rules.Checks {
+		if err := c.validate(); err != nil {
+			return Rules{}, fmt.Errorf("rules: checks[%d]: %w", i, err)
+		}
+		if rules.Checks[i].OnFail == "" {
+			rules.Checks[i].OnFail = OnFailReview
+		}
+	}
+	return rules, nil
+}
+
+func (c Check) validate() error {
+	switch c.OnFail {
+	case "", OnFailReject, OnFailReview:
+	default:
+		return fmt.Errorf("onFail must be %s or %s", OnFailReject, OnFailReview)
+	}
+	switch c.Check {
+	case MinLicenseAge, MaxVehicleAge:
+		if c.Years <= 0 {
+			return fmt.Errorf("%s: years must be positive", c.Check)
+		}
+	case VehicleTypes:
+		if len(c.Allowed) == 0 {
+			return fmt.Errorf("%s: allowed must list vehicle types", c.Check)
+		}
+	case LicenseNotExpired, RemuneratedLicense, VehicleDocumentNotExpired, ContractForRented, LivenessVerified:
+	case "":
+		return errors.New("check is required")
+	default:
+		return fmt.Errorf("unknown check %q", c.Check)
+	}
+	return nil
+}
+
+// Evaluate runs every check against the application and decides its status:
+// rejected if a rejecting check failed, needs_review if any other check did
+// not pass (or there are no checks), approved otherwise.
+func Evaluate(rules Rules, version int64, app dispatch.DriverApplication, now time.Time) dispatch.RulesReport {
+	report := dispatch.RulesReport{
+		RulesVersion: version,
+		Decision:     dispatch.ApplicationApproved,
+		EvaluatedAt:  now,
+	}
+	if len(rules.Checks) == 0 {
+		report.Decision = dispatch.ApplicationNeedsReview
+	}
+	for _, c := range rules.Checks {
+		result, detail := c.run(app, now)
+		report.Results = append(report.Results, dispatch.RuleResult{
+			Check:  c.Check,
+			Result: result,
+			OnFail: c.OnFail,
+			Detail: detail,
+		})
+		switch {
+		case result == dispatch.RuleFail && c.OnFail == OnFailReject:
+			report.Decision = dispatch.ApplicationRejected
+		case result != dispatch.RulePass && report.Decision == dispatch.ApplicationApproved:
+			report.Decision = dispatch.ApplicationNeedsReview
+		}
+	}
+	return report
+}
+
+// Unreadable reports rules that no longer parse, so the application goes to review.
+func Unreadable(version int64, err error, now time.Time) dispatch.RulesReport {
+	return dispatch.RulesReport{
+		RulesVersion: version,
+		Decision:     dispatch.ApplicationNeedsReview,
+		Results:      []dispatch.RuleResult{{Check: "rules", Result: dispatch.RuleUnknown, Detail: err.Error()}},
+		EvaluatedAt:  now,
+	}
+}
+
+func (c Check) run(app dispatch.DriverApplication, now time.Time) (string, string) {
+	lic, veh := app.License, app.Vehicle
+	switch c.Check {
+	case MinLicenseAge:
+		if lic.IssuedAt == nil {
+			return dispatch.RuleUnknown, "license issue date missing"
+		}
+		if lic.IssuedAt.After(now.AddDate(-c.Years, 0, 0)) {
+			return dispatch.RuleFail, fmt.Sprintf("license issued %s, less than %d years ago", lic.IssuedAt.Format("2006-01-02"), c.Years)
+		}
+	case LicenseNotExpired:
+		if lic.ExpiresAt == nil {
+			return dispatch.RuleUnknown, "license expiry date missing"
+		}
+		if !lic.ExpiresAt.After(now) {
+			return dispatch.RuleFail, "license expired " + lic.ExpiresAt.Format("2006-01-02")
+		}
+	case RemuneratedLicense:
+		if !lic.Remunerated {
+			return dispatch.RuleFail, "license does not permit paid driving"
+		}
+	case VehicleTypes:
+		for _, t := range c.Allowed {
+			if strings.EqualFold(t, veh.Type) {
+				return dispatch.RulePass, ""
+			}
+		}
+		return dispatch.RuleFail, fmt.Sprintf("vehicle type %q not allowed (allowed: %s)", veh.Type, strings.Join(c.Allowed, ", "))
+	case MaxVehicleAge:
+		if veh.Year == 0 {
+			return dispatch.RuleUnknown, "vehicle model year missing"
+		}
+		if age := now.Year() - veh.Year; age > c.Years {
+			return dispatch.RuleFail, fmt.Sprintf("vehicle is %d years old, more than %d", age, c.Years)
+		}
+	case VehicleDocumentNotExpired:
+		if veh.DocumentExpires == nil {
+			return dispatch.RuleUnknown, "vehicle document expiry date missing"
+		}
+		if !veh.DocumentExpires.After(now) {
+			return dispatch.RuleFail, "vehicle document expired " + veh.DocumentExpires.Format("2006-01-02")
+		}
+	case ContractForRented:
+		if veh.Ownership != "renting" && veh.Ownership != "lent" {
+			return dispatch.RulePass, "vehicle is owned"
+		}
+		if veh.ContractURL == "" {
+			return dispatch.RuleFail, "no contract for " + veh.Ownership + " vehicle"
+		}
+		if veh.ContractExpires != nil && !veh.ContractExpires.After(now) {
+			return dispatch.RuleFail, "contract expired " + veh.ContractExpires.Format("2006-01-02")
+		}
+	case LivenessVerified:
+		liv := app.Liveness
+		switch {
+		case liv.Verified:
+		case liv.Status == dispatch.LivenessFailed && liv.Result != nil:
+			return dispatch.RuleFail, "liveness not verified: " + liv.Result.Reason
+		case liv.Status == dispatch.LivenessError:
+			return dispatch.RuleUnknown, "liveness could not be verified"
+		default:
+			return dispatch.RuleUnknown, "liveness verification pending"
+		}
+	}
+	return dispatch.RulePass, ""
+}
@@ -0,0 +1,144 @@
+package eligibility
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+var now = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func ago(years int) *time.Time {
+	t := now.AddDate(-years, 0, 0)
+	return &t
+}
+
+func goodApplication() dispatch.DriverApplication {
+	return dispatch.DriverApplication{
+		DriverID: "drv_1",
+		License:  dispatch.DriverLicense{Number: "L-1", IssuedAt: ago(5), ExpiresAt: ago(-3), Remunerated: true},
+		Vehicle:  dispatch.DriverVehicle{Type: "car", Year: 2022, DocumentExpires: ago(-1), Ownership: "owns"},
+		Liveness: dispatch.DriverLiveness{Status: dispatch.LivenessVerified, Verified: true},
+	}
+}
+
+func mustParse(t *testing.T, raw string) Rules {
+	t.Helper()
+	rules, err := Parse(json.RawMessage(raw))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return rules
+}
+
+func TestEvaluate(t *testing.T) {
+	const all = `{"checks": [
+		{"check": "min_license_age", "years": 2, "onFail": "reject"},
+		{"check": "license_not_expired"},
+		{"check": "remunerated_license"},
+		{"check": "vehicle_types", "allowed": ["car", "motorcycle"]},
+		{"check": "max_vehicle_age", "years": 10},
+		{"check": "vehicle_document_not_expired"},
+		{"check": "contract_for_rented"},
+		{"check": "liveness_verified"}
+	]}`
+	tests := []struct {
+		name string
+		edit func(*dispatch.DriverApplication)
+		want dispatch.DriverApplicationStatus
+	}{
+		{name: "approved", edit: func(*dispatch.DriverApplication) {}, want: dispatch.ApplicationApproved},
+		{
+			name: "rejecting check fails",
+			edit: func(a *dispatch.DriverApplication) { a.License.IssuedAt = ago(1) },
+			want: dispatch.ApplicationRejected,
+		},
+		{
+			name: "reviewing check fails",
+			edit: func(a *dispatch.DriverApplication) { a.Vehicle.Type = "bus" },
+			want: dispatch.ApplicationNeedsReview,
+		},
+		{
+			name: "missing data",
+			edit: func(a *dispatch.DriverApplication) { a.Vehicle.Year = 0 },
+			want: dispatch.ApplicationNeedsReview,
+		},
+		{
+			name: "rented without contract",
+			edit: func(a *dispatch.DriverApplication) { a.Vehicle.Ownership = "renting" },
+			want: dispatch.ApplicationNeedsReview,
+		},
+		{
+			name: "liveness pending",
+			edit: func(a *dispatch.DriverApplication) {
+				a.Liveness = dispatch.DriverLiveness{Status: dispatch.LivenessPending}
+			},
+			want: dispatch.ApplicationNeedsReview,
+		},
+	}
+	rules := mustParse(t, all)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := goodApplication()
+			tt.edit(&app)
+			report := Evaluate(rules, 7, app, now)
+			if report.Decision != tt.want {
+				t.Fatalf("decision %s, want %s: %+v", report.Decision, tt.want, report.Results)
+			}
+			if report.RulesVersion != 7 || len(report.Results) != len(rules.Checks) {
+				t.Fatalf("report for version %d has %d results, want version 7 with %d", report.RulesVersion, len(report.Results), len(rules.Checks))
+			}
+		})
+	}
+}
+
+func TestEvaluateNoChecks(t *testing.T) {
+	report := Evaluate(mustParse(t, `{"checks": []}`), 1, goodApplication(), now)
+	if report.Decision != dispatch.ApplicationNeedsReview {
+		t.Fatalf("decision %s, want %s", report.Decision, dispatch.ApplicationNeedsReview)
+	}
+}
+
+func TestEvaluateLiveness(t *testing.T) {
+	rules := mustParse(t, `{"checks": [{"check": "liveness_verified"}]}`)
+	tests := []struct {
+		name string
+		liv  dispatch.DriverLiveness
+		want string
+	}{
+		{name: "verified", liv: dispatch.DriverLiveness{Status: dispatch.LivenessVerified, Verified: true}, want: dispatch.RulePass},
+		{
+			name: "failed",
+			liv:  dispatch.DriverLiveness{Status: dispatch.LivenessFailed, Result: &dispatch.LivenessResult{Reason: "no capture for up"}},
+			want: dispatch.RuleFail,
+		},
+		{name: "error", liv: dispatch.DriverLiveness{Status: dispatch.LivenessError}, want: dispatch.RuleUnknown},
+		{name: "pending", liv: dispatch.DriverLiveness{Status: dispatch.LivenessPending}, want: dispatch.RuleUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := goodApplication()
+			app.Liveness = tt.liv
+			report := Evaluate(rules, 1, app, now)
+			if got := report.Results[0].Result; got != tt.want {
+				t.Fatalf("result %s, want %s (%s)", got, tt.want, report.Results[0].Detail)
+			}
+		})
+	}
+}
+
+func TestParseRejectsInvalidChecks(t *testing.T) {
+	for _, raw := range []string{
+		`{"checks": [{"check": "min_license_age"}]}`,
+		`{"checks": [{"check": "vehicle_types"}]}`,
+		`{"checks": [{"check": "license_not_expired", "onFail": "ignore"}]}`,
+		`{"checks": [{"check": "shoe_size"}]}`,
+		`{"checks": [{}]}`,
+	} {
+		if _, err := Parse(json.RawMessage(raw)); err == nil {
+			t.Errorf("Parse(%s) accepted invalid rules", raw)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package liveness verifies the head-turn captures drivers send with their
+// application: that they show a live person following the server-issued
+// challenge, and that the person is the one on the license document.
+//
+// Providers implement Verifier. LIVENESS_VERIFIER selects one; "fake" is a
+// deterministic stand-in for development and tests.
+package liveness
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Directions are the head turns a challenge is made of.
+var Directions = []string{"up", "down", "left", "right"}
+
+// Image is the content of an upload.
+type Image struct {
+	UploadID    string
+	ContentType string
+	SHA256      string
+	Data        []byte
+}
+
+// Request is one driver's captures. Captures are keyed by direction; Reference
+// is the license document, or nil if the application has none.
+type Request struct {
+	DriverID  string
+	Sequence  []string
+	Captures  map[string]Image
+	Reference *Image
+}
+
+// Verifier checks a driver's captures. Errors are for provider failures and
+// are retried; a negative verdict is a result, not an error.
+type Verifier interface {
+	Name() string
+	Verify(ctx context.Context, req Request) (dispatch.LivenessResult, error)
+}
+
+// FromSpec builds a verifier from LIVENESS_VERIFIER. An empty spec means no
+// verification: captures stay pending for reviewers.
+func FromSpec(spec string) (Verifier, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case "fake":
+		return Fake{}, nil
+	default:
+		return nil, fmt.Errorf("liveness: unknown verifier %q", spec)
+	}
+}
+
+// Fake passes captures that cover every direction of the challenge with a
+// different image each and come with a license document to match against.
+// It never looks at the pixels, so the same request always gets the same
+// result.
+type Fake struct{}
+
+func (Fake) Name() string { return "fake" }
+
+func (Fake) Verify(_ context.Context, req Request) (dispatch.LivenessResult, error) {
+	result := dispatch.LivenessResult{Provider: "fake", Live: true, FaceMatch: true}
+	seen := map[string]string{}
+	var problems []string
+	for _, dir := range req.Sequence {
+		img, ok := req.Captures[dir]
+		if !ok || len(img.Data) == 0 {
+			result.Live = false
+			problems = append(problems, "no capture for "+dir)
+			continue
+		}
+		if other, dup := seen[img.SHA256]; dup {
+			result.Live = false
+			problems = append(problems, fmt.Sprintf("captures for %s and %s are the same image", other, dir))
+			continue
+		}
+		seen[img.SHA256] = dir
+	}
+	if req.Reference == nil || len(req.Reference.Data) == 0 {
+		result.FaceMatch = false
+		problems = append(problems, "no license document to match the face against")
+	}
+	if result.Passed() {
+		result.Score = 1
+	}
+	result.Reason = strings.Join(problems, "; ")
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package liveness
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func image(sum string) Image {
+	return Image{UploadID: "up_" + sum, ContentType: "image/jpeg", SHA256: sum, Data: []byte(sum)}
+}
+
+func fullRequest() Request {
+	return Request{
+		DriverID: "drv_1",
+		Sequence: []string{"left", "up", "right", "down"},
+		Captures: map[string]Image{
+			"left":  image("a"),
+			"up":    image("b"),
+			"right": image("c"),
+			"down":  image("d"),
+		},
+		Reference: &Image{UploadID: "up_lic", SHA256: "lic", Data: []byte("lic")},
+	}
+}
+
+func TestFakeVerify(t *testing.T) {
+	tests := []struct {
+		name          string
+		edit          func(*Request)
+		live, match   bool
+		reasonContain string
+	}{
+		{name: "passes", edit: func(*Request) {}, live: true, match: true},
+		{
+			name:          "missing direction",
+			edit:          func(r *Request) { delete(r.Captures, "right") },
+			match:         true,
+			reasonContain: "no capture for right",
+		},
+		{
+			name:          "empty capture",
+			edit:          func(r *Request) { r.Captures["up"] = Image{SHA256: "e"} },
+			match:         true,
+			reasonContain: "no capture for up",
+		},
+		{
+			name:          "duplicate images",
+			edit:          func(r *Request) { r.Captures["down"] = image("a") },
+			match:         true,
+			reasonContain: "captures for left and down are the same image",
+		},
+		{
+			name:          "missing reference",
+			edit:          func(r *Request) { r.Reference = nil },
+			live:          true,
+			reasonContain: "no license document",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fullRequest()
+			tt.edit(&req)
+			got, err := Fake{}.Verify(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if got.Live != tt.live || got.FaceMatch != tt.match {
+				t.Fatalf("live=%v faceMatch=%v, want live=%v faceMatch=%v (%s)", got.Live, got.FaceMatch, tt.live, tt.match, got.Reason)
+			}
+			if passed := tt.live && tt.match; got.Passed() != passed || (got.Score == 1) != passed {
+				t.Fatalf("passed=%v score=%v, want passed=%v", got.Passed(), got.Score, passed)
+			}
+			if tt.reasonContain == "" && got.Reason != "" {
+				t.Fatalf("reason %q, want none", got.Reason)
+			}
+			if !strings.Contains(got.Reason, tt.reasonContain) {
+				t.Fatalf("reason %q does not mention %q", got.Reason, tt.reasonContain)
+			}
+		})
+	}
+}
+
+func TestFromSpec(t *testing.T) {
+	if v, err := FromSpec(""); v != nil || err != nil {
+		t.Fatalf(`FromSpec("") = %v, %v; want nil, nil`, v, err)
+	}
+	if v, err := FromSpec("fake"); err != nil || v.Name() != "fake" {
+		t.Fatalf(`FromSpec("fake") = %v, %v`, v, err)
+	}
+	if _, err := FromSpec("acme"); err == nil {
+		t.Fatal(`FromSpec("acme") accepted an unknown verifier`)
+	}
+}
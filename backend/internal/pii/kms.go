@@ -0,0 +1,190 @@
+package pii
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// KMS wraps and unwraps data keys with master keys it never hands out.
+// Implementations for hosted key services only need these three calls.
+type KMS interface {
+	// CurrentKeyID names the master key new data keys are wrapped with.
+	CurrentKeyID() string
+	Wrap(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// KeyFile is the on-disk format of a LocalKMS: base64 AES-256 master keys by
+// ID, the one new data keys use, and the blind index key.
+type KeyFile struct {
+	Current    string            `json:"current"`
+	MasterKeys map[string]string `json:"masterKeys"`
+	IndexKey   string            `json:"indexKey"`
+}
+
+// LocalKMS keeps master keys in a JSON file. It is meant for development and
+// single-host installs; production should use a hosted KMS.
+type LocalKMS struct {
+	current string
+	keys    map[string][]byte
+}
+
+// LoadKeyFile reads a key file, returning the KMS and the blind index key.
+func LoadKeyFile(path string) (*LocalKMS, []byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var kf KeyFile
+	if err := json.Unmarshal(raw, &kf); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	kms := &LocalKMS{current: kf.Current, keys: map[string][]byte{}}
+	for id, enc := range kf.MasterKeys {
+		key, err := decodeKey(enc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: master key %s: %w", path, id, err)
+		}
+		if id == "" || strings.Contains(id, ":") {
+			return nil, nil, fmt.Errorf("%s: master key id %q must be non-empty without ':'", path, id)
+		}
+		kms.keys[id] = key
+	}
+	if _, ok := kms.keys[kf.Current]; !ok {
+		return nil, nil, fmt.Errorf("%s: current key %q not in masterKeys", path, kf.Current)
+	}
+	indexKey, err := decodeKey(kf.IndexKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: index key: %w", path, err)
+	}
+	return kms, indexKey, nil
+}
+
+// RotateKeyFile adds a new master key to a key file and makes it current,
+// creating the file (and its index key) if missing. It returns the new key ID.
+// Existing values keep working; re-encrypt them to retire the old keys.
+func RotateKeyFile(path string, now time.Time) (string, error) {
+	var kf KeyFile
+	raw, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		index, err := randomKey()
+		if err != nil {
+			return "", err
+		}
+		kf = KeyFile{MasterKeys: map[string]string{}, IndexKey: index}
+	case err != nil:
+		return "", err
+	default:
+		if err := json.Unmarshal(raw, &kf); err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	id := "k" + now.UTC().Format("20060102T150405")
+	if _, exists := kf.MasterKeys[id]; exists {
+		return "", fmt.Errorf("master key %s already exists", id)
+	}
+	key, err := randomKey()
+	if err != nil {
+		return "", err
+	}
+	kf.MasterKeys[id] = key
+	kf.Current = id
+	out, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0o600); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp, path)
+}
+
+func (k *LocalKMS) CurrentKeyID() string {
+	return k.current
+}
+
+func (k *LocalKMS) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(k.keys[k.current], dataKey, []byte(k.current))
+	return k.current, wrapped, err
+}
+
+func (k *LocalKMS) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	return open(key, wrapped, []byte(keyID))
+}
+
+func randomKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeKey(enc string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("want 32 bytes")
+	}
+	return key, nil
+}
+
+// seal encrypts with AES-256-GCM, returning nonce||ciphertext.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadEncryptor builds an Encryptor backed by the LocalKMS key file at path.
+func LoadEncryptor(path string) (*Encryptor, error) {
+	kms, indexKey, err := LoadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptor(kms, indexKey), nil
+}
@@ -0,0 +1,198 @@
+// Package pii encrypts personal data before it is stored.
+//
+// Values are sealed with AES-256-GCM under a data key; the data key is wrapped
+// by a KMS master key and stored next to the value:
+//
+//	enc:v1:<master key id>:<base64 wrapped data key>:<base64 nonce+ciphertext>
+//
+// Each value is bound to its column, so ciphertext copied into another column
+// fails to open. Values without the prefix are legacy plaintext and read as-is
+// until the re-encryption job seals them. Columns that must be looked up by
+// value also store a blind index: a keyed HMAC of the normalized value.
+package pii
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const prefix = "enc:v1:"
+
+// Data keys are reused for a while to keep KMS calls off the request path.
+const (
+	dataKeyMaxAge  = time.Hour
+	dataKeyMaxUses = 100_000
+	unwrapCacheMax = 1024
+)
+
+var ErrNoKeys = errors.New("value is encrypted but no PII keys are configured")
+
+// Encryptor seals and opens column values. A nil Encryptor stores plaintext
+// and fails to open encrypted values.
+type Encryptor struct {
+	kms      KMS
+	indexKey []byte
+
+	mu        sync.Mutex
+	dataKey   *dataKey
+	unwrapped map[string][]byte
+}
+
+type dataKey struct {
+	keyID   string
+	plain   []byte
+	wrapped []byte
+	created time.Time
+	uses    int
+}
+
+func NewEncryptor(kms KMS, indexKey []byte) *Encryptor {
+	return &Encryptor{kms: kms, indexKey: indexKey, unwrapped: map[string][]byte{}}
+}
+
+// IsEncrypted reports whether a stored value is sealed.
+func IsEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, prefix)
+}
+
+// Encrypt seals a value for column ("table.column"). Empty values stay empty.
+func (e *Encryptor) Encrypt(ctx context.Context, column, value string) (string, error) {
+	if e == nil || value == "" {
+		return value, nil
+	}
+	dk, err := e.currentDataKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dk.plain, []byte(value), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return prefix + dk.keyID + ":" + base64.StdEncoding.EncodeToString(dk.wrapped) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a stored value of column; plaintext values are returned as-is.
+func (e *Encryptor) Decrypt(ctx context.Context, column, stored string) (string, error) {
+	if !IsEncrypted(stored) {
+		return stored, nil
+	}
+	if e == nil {
+		return "", ErrNoKeys
+	}
+	keyID, wrapped, sealed, err := parse(stored)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", column, err)
+	}
+	plainKey, err := e.unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", column, err)
+	}
+	value, err := open(plainKey, sealed, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", column, err)
+	}
+	return string(value), nil
+}
+
+// NeedsRotation reports whether a stored value is plaintext or sealed under a
+// master key other than the current one.
+func (e *Encryptor) NeedsRotation(stored string) bool {
+	if e == nil || stored == "" {
+		return false
+	}
+	if !IsEncrypted(stored) {
+		return true
+	}
+	keyID, _, _, err := parse(stored)
+	return err != nil || keyID != e.kms.CurrentKeyID()
+}
+
+// BlindIndex returns a deterministic digest for equality lookups on column, or
+// nil for an empty value or a nil Encryptor. Values are compared ignoring
+// case, spaces, dots and dashes.
+func (e *Encryptor) BlindIndex(column, value string) *string {
+	value = normalize(value)
+	if e == nil || value == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, e.indexKey)
+	mac.Write([]byte(column))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	idx := hex.EncodeToString(mac.Sum(nil)[:16])
+	return &idx
+}
+
+func normalize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '\t':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(value)))
+}
+
+func parse(stored string) (keyID string, wrapped, sealed []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(stored, prefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("malformed encrypted value")
+	}
+	if wrapped, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return "", nil, nil, errors.New("malformed encrypted value")
+	}
+	if sealed, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, errors.New("malformed encrypted value")
+	}
+	return parts[0], wrapped, sealed, nil
+}
+
+func (e *Encryptor) currentDataKey(ctx context.Context) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dk := e.dataKey
+	if dk != nil && dk.keyID == e.kms.CurrentKeyID() && dk.uses < dataKeyMaxUses && time.Since(dk.created) < dataKeyMaxAge {
+		dk.uses++
+		return dk, nil
+	}
+	plain := make([]byte, 32)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := e.kms.Wrap(ctx, plain)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	e.dataKey = &dataKey{keyID: keyID, plain: plain, wrapped: wrapped, created: time.Now(), uses: 1}
+	return e.dataKey, nil
+}
+
+func (e *Encryptor) unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	cacheKey := keyID + ":" + string(wrapped)
+	e.mu.Lock()
+	plain, ok := e.unwrapped[cacheKey]
+	e.mu.Unlock()
+	if ok {
+		return plain, nil
+	}
+	plain, err := e.kms.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	if len(e.unwrapped) >= unwrapCacheMax {
+		e.unwrapped = map[string][]byte{}
+	}
+	e.unwrapped[cacheKey] = plain
+	e.mu.Unlock()
+	return plain, nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/auth"
+)
+
+const apiKeyColumns = `id, org_id, name, selector, salt, hash, scopes, rate_per_minute, usage_count, last_used_at, created_at, revoked_at`
+
+func (s *IdentityStore) CreateAPIKey(ctx context.Context, key auth.APIKey) error {
+	scopes := make([]string, len(key.Scopes))
+	for i, p := range key.Scopes {
+		scopes[i] = string(p)
+	}
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO partner_api_keys (id, org_id, name, selector, salt, hash, scopes, rate_per_minute, created_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+`, key.ID, key.OrgID, key.Name, key.Selector, key.Salt, key.Hash, scopes, key.RatePerMinute, key.CreatedAt)
+	return err
+}
+
+func (s *IdentityStore) GetAPIKey(ctx context.Context, selector string) (auth.APIKey, bool, error) {
+	key, err := scanAPIKey(s.pool.QueryRow(ctx, `SELECT `+apiKeyColumns+` FROM partner_api_keys WHERE selector = $1`, selector))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return auth.APIKey{}, false, nil
+		}
+		return auth.APIKey{}, false, err
+	}
+	return key, true, nil
+}
+
+func (s *IdentityStore) ListAPIKeys(ctx context.Context, orgID string) ([]auth.APIKey, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+apiKeyColumns+` FROM partner_api_keys WHERE org_id = $1 ORDER BY created_at`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []auth.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, key)
+	}
+	return out, rows.Err()
+}
+
+func (s *IdentityStore) RevokeAPIKey(ctx context.Context, id string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE partner_api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *IdentityStore) AddAPIKeyUsage(ctx context.Context, id string, n int64, at time.Time) error {
+	_, err := s.pool.Exec(ctx, `
+UPDATE partner_api_keys
+SET usage_count = usage_count + $2, last_used_at = GREATEST(COALESCE(last_used_at, $3), $3)
+WHERE id = $1
+`, id, n, at)
+	return err
+}
+
+func scanAPIKey(row pgx.Row) (auth.APIKey, error) {
+	var (
+		key    auth.APIKey
+		scopes []string
+	)
+	if err := row.Scan(&key.ID, &key.OrgID, &key.Name, &key.Selector, &key.Salt, &key.Hash, &scopes, &key.RatePerMinute, &key.UsageCount, &key.LastUsedAt, &key.CreatedAt, &key.RevokedAt); err != nil {
+		return auth.APIKey{}, err
+	}
+	for _, s := range scopes {
+		key.Scopes = append(key.Scopes, auth.Permission(s))
+	}
+	return key, nil
+}
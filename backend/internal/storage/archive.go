@@ -0,0 +1,443 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"turbodriver/internal/dispatch"
+)
+
+// Old ride_events are archived by month. Once a whole partition is past the
+// longest retention it is exported to the blob store as gzipped JSONL and
+// dropped; event types with shorter retention are exported and deleted from
+// partitions that are still kept. Every export is recorded in event_archives,
+// with the rides it holds in event_archive_rides, so timelines stay findable.
+
+// RetentionPolicy says how long ride events are kept, by event type.
+type RetentionPolicy struct {
+	Default time.Duration
+	ByType  map[string]time.Duration
+}
+
+// ParseRetention reads a policy like "400d,ride_message=90d,sos_raised=1825d":
+// the bare duration is the default, the rest override it per event type.
+// Durations take a d suffix for days or anything time.ParseDuration accepts.
+func ParseRetention(spec string) (RetentionPolicy, error) {
+	policy := RetentionPolicy{ByType: map[string]time.Duration{}}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		typ, raw, hasType := strings.Cut(part, "=")
+		if !hasType {
+			raw, typ = typ, ""
+		}
+		d, err := parseRetentionDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return RetentionPolicy{}, fmt.Errorf("retention %q: %w", part, err)
+		}
+		if hasType {
+			policy.ByType[strings.TrimSpace(typ)] = d
+		} else {
+			policy.Default = d
+		}
+	}
+	if policy.Default <= 0 {
+		return RetentionPolicy{}, errors.New("retention needs a positive default duration")
+	}
+	return policy, nil
+}
+
+func parseRetentionDuration(raw string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(raw, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.New("want a positive number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("want a positive duration")
+	}
+	return d, nil
+}
+
+// For returns how long events of a type are kept.
+func (p RetentionPolicy) For(eventType string) time.Duration {
+	if d, ok := p.ByType[eventType]; ok {
+		return d
+	}
+	return p.Default
+}
+
+// Longest is the retention after which a whole partition can go.
+func (p RetentionPolicy) Longest() time.Duration {
+	longest := p.Default
+	for _, d := range p.ByType {
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// ArchiveResult describes one export.
+type ArchiveResult struct {
+	Partition string
+	// EventTypes lists the types exported from a kept partition; empty when
+	// the whole partition was archived and dropped.
+	EventTypes []string
+	// OtherTypes is set when every type without its own retention was included.
+	OtherTypes bool
+	Rows       int64
+	Key        string
+	Dropped    bool
+}
+
+// Archiver exports and removes ride events past retention.
+type Archiver struct {
+	pool   *pgxpool.Pool
+	blobs  BlobStore
+	policy RetentionPolicy
+	// DryRun reports what would be archived without exporting or deleting.
+	DryRun bool
+}
+
+func NewArchiver(pool *pgxpool.Pool, blobs BlobStore, policy RetentionPolicy) *Archiver {
+	return &Archiver{pool: pool, blobs: blobs, policy: policy}
+}
+
+// Run archives everything past retention as of now. Rows in ride_events_default
+// are left alone; they belong to months whose partition is missing and are
+// moved into it by EnsurePartitions.
+func (a *Archiver) Run(ctx context.Context, now time.Time) ([]ArchiveResult, error) {
+	parts, err := listPartitions(ctx, a.pool, "ride_events")
+	if err != nil {
+		return nil, err
+	}
+	var results []ArchiveResult
+	for _, part := range parts {
+		if !part.To.After(now.Add(-a.policy.Longest())) {
+			res, err := a.archivePartition(ctx, part, now)
+			if err != nil {
+				return results, fmt.Errorf("archive %s: %w", part.Name, err)
+			}
+			results = append(results, res)
+			continue
+		}
+		filter, ok := a.expiredTypes(part, now)
+		if !ok {
+			continue
+		}
+		res, err := a.archiveTypes(ctx, part, filter, now)
+		if err != nil {
+			return results, fmt.Errorf("archive %s: %w", part.Name, err)
+		}
+		if res.Rows > 0 {
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+// typeFilter selects the event types of a kept partition that are past
+// retention: the listed types, or when other is set every type except keep.
+type typeFilter struct {
+	listed []string
+	other  bool
+	keep   []string
+}
+
+func (a *Archiver) expiredTypes(part Partition, now time.Time) (typeFilter, bool) {
+	expired := func(d time.Duration) bool { return !part.To.After(now.Add(-d)) }
+	var f typeFilter
+	f.other = expired(a.policy.Default)
+	for typ, d := range a.policy.ByType {
+		switch {
+		case expired(d) && !f.other:
+			f.listed = append(f.listed, typ)
+		case !expired(d) && f.other:
+			f.keep = append(f.keep, typ)
+		}
+	}
+	sort.Strings(f.listed)
+	sort.Strings(f.keep)
+	return f, f.other || len(f.listed) > 0
+}
+
+func (f typeFilter) sql() (string, []string) {
+	if f.other {
+		return "event_type <> ALL($1)", f.keep
+	}
+	return "event_type = ANY($1)", f.listed
+}
+
+func (a *Archiver) archivePartition(ctx context.Context, part Partition, now time.Time) (ArchiveResult, error) {
+	res := ArchiveResult{Partition: part.Name, Dropped: true, Key: archiveKey(part, "all", now)}
+	table := pgx.Identifier{part.Name}.Sanitize()
+	if a.DryRun {
+		err := a.pool.QueryRow(ctx, `SELECT COUNT(*) FROM `+table).Scan(&res.Rows)
+		return res, err
+	}
+	tx, err := a.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+	exp, err := a.export(ctx, tx, res.Key, `SELECT id, ride_id, event_type, payload, COALESCE(actor_id, ''), COALESCE(actor_role, ''), created_at FROM `+table+` ORDER BY id`)
+	if err != nil {
+		return res, err
+	}
+	res.Rows = exp.rows
+	if err := recordArchive(ctx, tx, part, true, nil, res.Key, exp); err != nil {
+		return res, err
+	}
+	// Detaching locks ride_events; don't queue behind long transactions.
+	if _, err := tx.Exec(ctx, `SET LOCAL lock_timeout = '10s'`); err != nil {
+		return res, err
+	}
+	if _, err := tx.Exec(ctx, `ALTER TABLE ride_events DETACH PARTITION `+table); err != nil {
+		return res, err
+	}
+	if _, err := tx.Exec(ctx, `DROP TABLE `+table); err != nil {
+		return res, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+func (a *Archiver) archiveTypes(ctx context.Context, part Partition, f typeFilter, now time.Time) (ArchiveResult, error) {
+	res := ArchiveResult{Partition: part.Name, EventTypes: f.listed, OtherTypes: f.other, Key: archiveKey(part, "expired", now)}
+	table := pgx.Identifier{part.Name}.Sanitize()
+	where, types := f.sql()
+	if types == nil {
+		types = []string{}
+	}
+	if a.DryRun {
+		err := a.pool.QueryRow(ctx, `SELECT COUNT(*) FROM `+table+` WHERE `+where, types).Scan(&res.Rows)
+		return res, err
+	}
+	tx, err := a.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+	var count int64
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM `+table+` WHERE `+where, types).Scan(&count); err != nil {
+		return res, err
+	}
+	if count == 0 {
+		return res, nil
+	}
+	exp, err := a.export(ctx, tx, res.Key, `SELECT id, ride_id, event_type, payload, COALESCE(actor_id, ''), COALESCE(actor_role, ''), created_at FROM `+table+` WHERE `+where+` ORDER BY id`, types)
+	if err != nil {
+		return res, err
+	}
+	res.Rows = exp.rows
+	var recorded []string
+	if !f.other {
+		recorded = f.listed
+	}
+	if err := recordArchive(ctx, tx, part, false, recorded, res.Key, exp); err != nil {
+		return res, err
+	}
+	// Only delete what was exported; the snapshot hides later inserts.
+	if _, err := tx.Exec(ctx, `DELETE FROM `+table+` WHERE `+where+` AND id <= $2`, types, exp.maxID); err != nil {
+		return res, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+func archiveKey(part Partition, scope string, now time.Time) string {
+	return fmt.Sprintf("%s/%s/%s-%s.jsonl.gz", part.Table, part.From.Format("2006-01"), scope, now.UTC().Format("20060102T150405Z"))
+}
+
+// archivedRideEvent is one line of an archive.
+type archivedRideEvent struct {
+	ID        int64           `json:"id"`
+	RideID    string          `json:"rideId"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	ActorID   string          `json:"actorId,omitempty"`
+	ActorRole string          `json:"actorRole,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+type exportStats struct {
+	rows    int64
+	maxID   int64
+	rideIDs map[string]struct{}
+}
+
+// export writes the query's rows to a temporary gzipped JSONL file and uploads
+// it under key.
+func (a *Archiver) export(ctx context.Context, tx pgx.Tx, key, query string, args ...any) (exportStats, error) {
+	stats := exportStats{rideIDs: map[string]struct{}{}}
+	tmp, err := os.CreateTemp("", "ride-events-*.jsonl.gz")
+	if err != nil {
+		return stats, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return stats, err
+	}
+	for rows.Next() {
+		var evt archivedRideEvent
+		if err := rows.Scan(&evt.ID, &evt.RideID, &evt.Type, &evt.Payload, &evt.ActorID, &evt.ActorRole, &evt.CreatedAt); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		if err := enc.Encode(evt); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		stats.rows++
+		if evt.ID > stats.maxID {
+			stats.maxID = evt.ID
+		}
+		stats.rideIDs[evt.RideID] = struct{}{}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+	if err := gz.Close(); err != nil {
+		return stats, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return stats, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return stats, err
+	}
+	return stats, a.blobs.Put(ctx, key, "application/gzip", tmp, size)
+}
+
+func recordArchive(ctx context.Context, tx pgx.Tx, part Partition, whole bool, eventTypes []string, key string, exp exportStats) error {
+	var id int64
+	if err := tx.QueryRow(ctx, `
+INSERT INTO event_archives (table_name, partition_name, period_start, period_end, whole_partition, event_types, object_key, row_count)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+RETURNING id
+`, part.Table, part.Name, part.From, part.To, whole, eventTypes, key, exp.rows).Scan(&id); err != nil {
+		return err
+	}
+	rideIDs := make([]string, 0, len(exp.rideIDs))
+	for rideID := range exp.rideIDs {
+		rideIDs = append(rideIDs, rideID)
+	}
+	_, err := tx.Exec(ctx, `
+INSERT INTO event_archive_rides (ride_id, archive_id)
+SELECT unnest($2::text[]), $1
+`, id, rideIDs)
+	return err
+}
+
+// AttachArchive lets ride event queries read archived events from blobs.
+func (p *Postgres) AttachArchive(blobs BlobStore) {
+	p.archive = blobs
+}
+
+// ListArchivedRideEvents returns a ride's events that were moved to archives,
+// oldest first. Without an attached archive store it returns none.
+func (p *Postgres) ListArchivedRideEvents(ctx context.Context, rideID string) ([]dispatch.RideEvent, error) {
+	if p.archive == nil {
+		return nil, nil
+	}
+	rows, err := p.pool.Query(ctx, `
+SELECT a.object_key
+FROM event_archive_rides r
+JOIN event_archives a ON a.id = r.archive_id
+WHERE r.ride_id = $1
+ORDER BY a.period_start, a.id
+`, rideID)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var out []dispatch.RideEvent
+	for _, key := range keys {
+		events, err := p.readArchive(ctx, key, rideID)
+		if err != nil {
+			return nil, fmt.Errorf("archive %s: %w", key, err)
+		}
+		out = append(out, events...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (p *Postgres) readArchive(ctx context.Context, key, rideID string) ([]dispatch.RideEvent, error) {
+	body, err := p.archive.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	needle := []byte(rideID)
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	var out []dispatch.RideEvent
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.Contains(line, needle) {
+			continue
+		}
+		var evt archivedRideEvent
+		if err := json.Unmarshal(line, &evt); err != nil {
+			return nil, err
+		}
+		if evt.RideID != rideID {
+			continue
+		}
+		out = append(out, dispatch.RideEvent{
+			RideID:    evt.RideID,
+			Type:      evt.Type,
+			Payload:   evt.Payload,
+			ActorID:   evt.ActorID,
+			ActorRole: evt.ActorRole,
+			CreatedAt: evt.CreatedAt,
+			Archived:  true,
+		})
+	}
+	return out, scanner.Err()
+}
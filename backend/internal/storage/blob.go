@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps opaque objects (event archives, uploads) by slash-separated key.
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes an object; deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// BlobPresigner is implemented by stores clients can upload to directly.
+type BlobPresigner interface {
+	// PresignPut returns a URL that accepts one PUT of key with the content
+	// type until ttl passes.
+	PresignPut(key, contentType string, ttl time.Duration) (string, error)
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStoreFromSpec builds a store from a spec: a directory path (or
+// file:///dir) for local disk, or s3://bucket/prefix for S3-compatible storage
+// configured by S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY.
+func BlobStoreFromSpec(spec string) (BlobStore, error) {
+	switch {
+	case spec == "":
+		return nil, errors.New("empty blob store spec")
+	case strings.HasPrefix(spec, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(spec, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("blob store %q: missing bucket", spec)
+		}
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		return NewS3BlobStore(endpoint, region, bucket, prefix, os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY")), nil
+	default:
+		return NewLocalBlobStore(strings.TrimPrefix(spec, "file://")), nil
+	}
+}
+
+// cleanBlobKey rejects keys that would escape the store's root.
+func cleanBlobKey(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if clean == "" || clean != key {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return clean, nil
+}
+
+// LocalBlobStore keeps blobs as files under a directory.
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) *LocalBlobStore {
+	return &LocalBlobStore{root: root}
+}
+
+func (l *LocalBlobStore) Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(l.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return err
+	}
+	// Write beside the destination and rename so readers never see a partial blob.
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (l *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(l.root, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (l *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(l.root, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
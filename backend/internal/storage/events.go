@@ -3,8 +3,11 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+
 	"turbodriver/internal/dispatch"
 )
 
@@ -70,10 +73,10 @@ func (p *Postgres) CreateRideWithEvent(ctx context.Context, ride dispatch.Ride,
 	defer tx.Rollback(ctx)
 
 	if _, err := tx.Exec(ctx, `
-INSERT INTO rides (id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at)
-VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
-ON CONFLICT (id) DO UPDATE SET driver_id = EXCLUDED.driver_id, status = EXCLUDED.status
-`, ride.ID, ride.PassengerID, ride.DriverID, ride.Status, ride.Pickup.Latitude, ride.Pickup.Longitude, ride.Pickup.Accuracy, ride.Pickup.At, ride.CreatedAt); err != nil {
+INSERT INTO rides (id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at, location_code, pickup_pin, dropoff_lat, dropoff_long, booked_by, version)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
+ON CONFLICT (id) DO UPDATE SET driver_id = EXCLUDED.driver_id, status = EXCLUDED.status, pickup_pin = EXCLUDED.pickup_pin, version = EXCLUDED.version
+`, ride.ID, ride.PassengerID, ride.DriverID, ride.Status, ride.Pickup.Latitude, ride.Pickup.Longitude, ride.Pickup.Accuracy, ride.Pickup.At, ride.CreatedAt, ride.LocationCode, ride.PickupPIN, dropoffLat(ride), dropoffLong(ride), nullIfEmpty(ride.BookedBy), ride.Version); err != nil {
 		return err
 	}
 	if driver.ID != "" {
@@ -83,39 +86,63 @@ UPDATE drivers SET ride_id=$2, status=$3, available=$4 WHERE id=$1
 			return err
 		}
 	}
-	if _, err := tx.Exec(ctx, `
-INSERT INTO ride_events (ride_id, event_type, payload, actor_id, actor_role, created_at)
-VALUES ($1,$2,$3,$4,$5,COALESCE($6,NOW()))
-`, event.RideID, event.Type, event.Payload, event.ActorID, event.ActorRole, event.CreatedAt); err != nil {
+	if err := insertEventWithOutbox(ctx, tx, ride, event); err != nil {
 		return err
 	}
 	return tx.Commit(ctx)
 }
 
-func (p *Postgres) UpdateRideWithEvent(ctx context.Context, ride dispatch.Ride, event dispatch.RideEvent, driver *dispatch.DriverState) error {
+func (p *Postgres) UpdateRideWithEvent(ctx context.Context, ride dispatch.Ride, event dispatch.RideEvent, drivers ...dispatch.DriverState) error {
 	tx, err := p.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
 
-	if _, err := tx.Exec(ctx, `
-UPDATE rides SET driver_id=$2, status=$3 WHERE id=$1
-`, ride.ID, ride.DriverID, ride.Status); err != nil {
+	// The ride carries its new version; the update only applies on top of the
+	// version it was derived from.
+	tag, err := tx.Exec(ctx, `
+UPDATE rides SET driver_id=$2, status=$3, pickup_pin=$4, version=$5 WHERE id=$1 AND version=$5-1
+`, ride.ID, ride.DriverID, ride.Status, ride.PickupPIN, ride.Version)
+	if err != nil {
 		return err
 	}
-	if driver != nil {
+	if tag.RowsAffected() == 0 {
+		return dispatch.ErrVersionConflict
+	}
+	for _, driver := range drivers {
 		if _, err := tx.Exec(ctx, `
 UPDATE drivers SET ride_id=$2, status=$3, available=$4 WHERE id=$1
 `, driver.ID, driver.RideID, driver.Status, driver.Available); err != nil {
 			return err
 		}
 	}
-	if _, err := tx.Exec(ctx, `
+	if err := insertEventWithOutbox(ctx, tx, ride, event); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// insertEventWithOutbox records the event and queues it for the outbox relay
+// inside the caller's transaction. The dedupe key derives from the event ID so
+// every delivery of the same transition carries the same key. The queued ride
+// has no pickup PIN; the hub sink adds it back for the passenger.
+func insertEventWithOutbox(ctx context.Context, tx pgx.Tx, ride dispatch.Ride, event dispatch.RideEvent) error {
+	var eventID int64
+	if err := tx.QueryRow(ctx, `
 INSERT INTO ride_events (ride_id, event_type, payload, actor_id, actor_role, created_at)
 VALUES ($1,$2,$3,$4,$5,COALESCE($6,NOW()))
-`, event.RideID, event.Type, event.Payload, event.ActorID, event.ActorRole, event.CreatedAt); err != nil {
+RETURNING id
+`, event.RideID, event.Type, event.Payload, event.ActorID, event.ActorRole, event.CreatedAt).Scan(&eventID); err != nil {
 		return err
 	}
-	return tx.Commit(ctx)
+	snapshot, err := json.Marshal(ride.WithoutPIN())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+INSERT INTO outbox (dedupe_key, ride_id, event_type, ride, payload, created_at)
+VALUES ($1,$2,$3,$4,$5,COALESCE($6,NOW()))
+`, fmt.Sprintf("ride_event_%d", eventID), event.RideID, event.Type, snapshot, event.Payload, event.CreatedAt)
+	return err
 }
@@ -2,9 +2,13 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"turbodriver/internal/dispatch"
 )
 
 // IdempotencyStore persists idempotency keys with TTL.
@@ -24,18 +28,6 @@ func (s *IdempotencyStore) TTL() time.Duration {
 	return s.ttl
 }
 
-func (s *IdempotencyStore) EnsureSchema(ctx context.Context) error {
-	_, err := s.pool.Exec(ctx, `
-CREATE TABLE IF NOT EXISTS idempotency_keys (
-	key TEXT PRIMARY KEY,
-	ride_id TEXT NOT NULL,
-	expires_at TIMESTAMPTZ NOT NULL
-);
-CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys(expires_at);
-`)
-	return err
-}
-
 func (s *IdempotencyStore) Remember(ctx context.Context, key, rideID string) error {
 	if key == "" || rideID == "" {
 		return nil
@@ -56,7 +48,7 @@ func (s *IdempotencyStore) Lookup(ctx context.Context, key string) (string, bool
 	var rideID string
 	var expires time.Time
 	err := s.pool.QueryRow(ctx, `
-SELECT ride_id, expires_at FROM idempotency_keys WHERE key = $1
+SELECT ride_id, expires_at FROM idempotency_keys WHERE key = $1 AND ride_id IS NOT NULL
 `, key).Scan(&rideID, &expires)
 	if err != nil {
 		if err.Error() == "no rows in result set" {
@@ -69,3 +61,69 @@ SELECT ride_id, expires_at FROM idempotency_keys WHERE key = $1
 	}
 	return rideID, true, nil
 }
+
+// Idempotency-Key requests share idempotency_keys with ride keys. A row without
+// a status_code is a request in flight whose lock ends at expires_at; expired
+// rows are reclaimed by the next request with the key.
+
+func (p *Postgres) BeginRequest(ctx context.Context, key, fingerprint string, lock time.Duration) (dispatch.IdempotencyOutcome, dispatch.IdempotentResponse, error) {
+	tag, err := p.pool.Exec(ctx, `
+INSERT INTO idempotency_keys (key, fingerprint, expires_at)
+VALUES ($1, $2, NOW() + make_interval(secs => $3))
+ON CONFLICT (key) DO UPDATE SET
+	fingerprint = EXCLUDED.fingerprint,
+	expires_at = EXCLUDED.expires_at,
+	ride_id = NULL,
+	status_code = NULL,
+	response_headers = NULL,
+	response_body = NULL
+WHERE idempotency_keys.expires_at < NOW()
+`, key, fingerprint, lock.Seconds())
+	if err != nil {
+		return 0, dispatch.IdempotentResponse{}, err
+	}
+	if tag.RowsAffected() == 1 {
+		return dispatch.IdempotencyStarted, dispatch.IdempotentResponse{}, nil
+	}
+
+	var (
+		storedPrint *string
+		status      *int
+		headers     map[string]string
+		body        []byte
+	)
+	err = p.pool.QueryRow(ctx, `
+SELECT fingerprint, status_code, response_headers, response_body FROM idempotency_keys WHERE key = $1
+`, key).Scan(&storedPrint, &status, &headers, &body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Released between the insert and the read; the retry will claim it.
+		return dispatch.IdempotencyInFlight, dispatch.IdempotentResponse{}, nil
+	}
+	if err != nil {
+		return 0, dispatch.IdempotentResponse{}, err
+	}
+	switch {
+	case derefString(storedPrint) != fingerprint:
+		return dispatch.IdempotencyMismatch, dispatch.IdempotentResponse{}, nil
+	case status == nil:
+		return dispatch.IdempotencyInFlight, dispatch.IdempotentResponse{}, nil
+	}
+	return dispatch.IdempotencyReplay, dispatch.IdempotentResponse{Status: *status, Header: headers, Body: body}, nil
+}
+
+func (p *Postgres) CompleteRequest(ctx context.Context, key, fingerprint string, resp dispatch.IdempotentResponse, ttl time.Duration) (bool, error) {
+	tag, err := p.pool.Exec(ctx, `
+UPDATE idempotency_keys
+SET status_code = $3, response_headers = $4, response_body = $5, expires_at = NOW() + make_interval(secs => $6)
+WHERE key = $1 AND fingerprint = $2 AND status_code IS NULL
+`, key, fingerprint, resp.Status, resp.Header, resp.Body, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *Postgres) ReleaseRequest(ctx context.Context, key, fingerprint string) error {
+	_, err := p.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE key = $1 AND fingerprint = $2 AND status_code IS NULL`, key, fingerprint)
+	return err
+}
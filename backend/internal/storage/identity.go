@@ -5,8 +5,10 @@ import (
 	"errors"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"turbodriver/internal/auth"
 	"turbodriver/internal/dispatch"
 )
 
@@ -18,71 +20,140 @@ func NewIdentityStore(pool *pgxpool.Pool) *IdentityStore {
 	return &IdentityStore{pool: pool}
 }
 
-func (s *IdentityStore) EnsureSchema(ctx context.Context) error {
-	_, err := s.pool.Exec(ctx, `
-CREATE TABLE IF NOT EXISTS identities (
-	id TEXT PRIMARY KEY,
-	role TEXT NOT NULL,
-	token TEXT UNIQUE NOT NULL,
-	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-	expires_at TIMESTAMPTZ
-);
-`)
-	return err
+// HashLegacyTokens moves plaintext tokens left in identities.token into
+// identity_tokens and clears them, so existing sessions keep working.
+func (s *IdentityStore) HashLegacyTokens(ctx context.Context) error {
+	rows, err := s.pool.Query(ctx, `SELECT id, token, expires_at FROM identities WHERE token IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	type legacy struct {
+		id, token string
+		expires   *time.Time
+	}
+	var pending []legacy
+	for rows.Next() {
+		var l legacy
+		if err := rows.Scan(&l.id, &l.token, &l.expires); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, l := range pending {
+		rec := auth.HashToken(l.token)
+		rec.IdentityID = l.id
+		rec.ExpiresAt = l.expires
+		tx, err := s.pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		if err := insertToken(ctx, tx, rec); err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE identities SET token = NULL WHERE id = $1`, l.id); err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Save upserts the identity and stores a salted hash of its bearer token.
 func (s *IdentityStore) Save(ctx context.Context, ident dispatch.Identity, ttl time.Duration) (dispatch.Identity, error) {
 	var expires *time.Time
 	if ttl > 0 {
 		t := time.Now().Add(ttl)
 		expires = &t
 	}
-	_, err := s.pool.Exec(ctx, `
-INSERT INTO identities (id, role, token, expires_at)
-VALUES ($1,$2,$3,$4)
-ON CONFLICT (id) DO UPDATE SET role = EXCLUDED.role, token = EXCLUDED.token, expires_at = EXCLUDED.expires_at
-`, ident.ID, ident.Role, ident.Token, expires)
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return dispatch.Identity{}, err
 	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `
+INSERT INTO identities (id, role, expires_at)
+VALUES ($1,$2,$3)
+ON CONFLICT (id) DO UPDATE SET role = EXCLUDED.role, expires_at = EXCLUDED.expires_at
+`, ident.ID, ident.Role, expires)
+	if err != nil {
+		return dispatch.Identity{}, err
+	}
+	if ident.Token != "" {
+		rec := auth.HashToken(ident.Token)
+		rec.IdentityID = ident.ID
+		rec.ExpiresAt = expires
+		if err := insertToken(ctx, tx, rec); err != nil {
+			return dispatch.Identity{}, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return dispatch.Identity{}, err
+	}
 	ident.ExpiresAt = expires
 	return ident, nil
 }
 
+func insertToken(ctx context.Context, tx pgx.Tx, rec auth.TokenRecord) error {
+	_, err := tx.Exec(ctx, `
+INSERT INTO identity_tokens (selector, identity_id, salt, hash, expires_at)
+VALUES ($1,$2,$3,$4,$5)
+ON CONFLICT (selector) DO NOTHING
+`, rec.Selector, rec.IdentityID, rec.Salt, rec.Hash, rec.ExpiresAt)
+	return err
+}
+
 func (s *IdentityStore) Lookup(ctx context.Context, token string) (dispatch.Identity, bool, error) {
-	var ident dispatch.Identity
-	var expires *time.Time
+	selector, secret := auth.SplitToken(token)
+	var (
+		ident dispatch.Identity
+		rec   auth.TokenRecord
+	)
 	err := s.pool.QueryRow(ctx, `
-SELECT id, role, token, expires_at FROM identities WHERE token = $1
-`, token).Scan(&ident.ID, &ident.Role, &ident.Token, &expires)
+SELECT i.id, i.role, t.salt, t.hash, t.expires_at
+FROM identity_tokens t
+JOIN identities i ON i.id = t.identity_id
+WHERE t.selector = $1 AND t.revoked_at IS NULL
+`, selector).Scan(&ident.ID, &ident.Role, &rec.Salt, &rec.Hash, &rec.ExpiresAt)
 	if err != nil {
 		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 			return dispatch.Identity{}, false, err
 		}
-		if err.Error() == "no rows in result set" {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return dispatch.Identity{}, false, nil
 		}
 		return dispatch.Identity{}, false, err
 	}
-	if expires != nil && expires.Before(time.Now()) {
+	if !rec.Verify(secret) || rec.Expired(time.Now()) {
 		return dispatch.Identity{}, false, nil
 	}
+	ident.ExpiresAt = rec.ExpiresAt
 	return ident, true, nil
 }
 
-func (s *IdentityStore) All(ctx context.Context) ([]dispatch.Identity, error) {
-	rows, err := s.pool.Query(ctx, `SELECT id, role, token FROM identities`)
+// RevokeToken marks a single token revoked. Returns false if it was unknown or already revoked.
+func (s *IdentityStore) RevokeToken(ctx context.Context, token string) (bool, error) {
+	selector, _ := auth.SplitToken(token)
+	tag, err := s.pool.Exec(ctx, `UPDATE identity_tokens SET revoked_at = NOW() WHERE selector = $1 AND revoked_at IS NULL`, selector)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer rows.Close()
-	var out []dispatch.Identity
-	for rows.Next() {
-		var ident dispatch.Identity
-		if err := rows.Scan(&ident.ID, &ident.Role, &ident.Token); err != nil {
-			return nil, err
-		}
-		out = append(out, ident)
+	return tag.RowsAffected() > 0, nil
+}
+
+// RevokeIdentity revokes every live token of an identity and returns how many were revoked.
+func (s *IdentityStore) RevokeIdentity(ctx context.Context, identityID string) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE identity_tokens SET revoked_at = NOW() WHERE identity_id = $1 AND revoked_at IS NULL`, identityID)
+	if err != nil {
+		return 0, err
 	}
-	return out, rows.Err()
+	return tag.RowsAffected(), nil
 }
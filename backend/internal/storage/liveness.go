@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+const livenessColumns = `id, driver_id, COALESCE(challenge_id, ''), challenge_sequence, captures,
+	verification_status, verification, verification_attempts, verified, verified_at, created_at`
+
+// scanLiveness reads a driver_liveness_checks row, opening the captures.
+func (p *Postgres) scanLiveness(ctx context.Context, row pgx.Row) (dispatch.DriverLiveness, error) {
+	var (
+		liv                  dispatch.DriverLiveness
+		seqRaw, verification []byte
+		captures             string
+	)
+	if err := row.Scan(&liv.ID, &liv.DriverID, &liv.ChallengeID, &seqRaw, &captures,
+		&liv.Status, &verification, &liv.Attempts, &liv.Verified, &liv.VerifiedAt, &liv.CreatedAt); err != nil {
+		return liv, err
+	}
+	if captures != "" {
+		opened, err := p.open(ctx, piiCaptures, captures)
+		if err != nil {
+			return liv, err
+		}
+		liv.Captures = []byte(opened)
+	}
+	if len(seqRaw) > 0 {
+		_ = json.Unmarshal(seqRaw, &liv.ChallengeSequence)
+	}
+	if len(verification) > 0 {
+		var result dispatch.LivenessResult
+		if err := json.Unmarshal(verification, &result); err != nil {
+			return liv, err
+		}
+		liv.Result = &result
+	}
+	return liv, nil
+}
+
+func (p *Postgres) CreateLivenessChallenge(ctx context.Context, ch dispatch.LivenessChallenge) (dispatch.LivenessChallenge, error) {
+	seq, err := json.Marshal(ch.Sequence)
+	if err != nil {
+		return ch, err
+	}
+	err = p.pool.QueryRow(ctx, `
+INSERT INTO liveness_challenges (id, driver_id, sequence, created_at, expires_at)
+VALUES ($1,$2,$3,NOW(),$4)
+RETURNING created_at
+`, ch.ID, ch.DriverID, seq, ch.ExpiresAt).Scan(&ch.CreatedAt)
+	return ch, err
+}
+
+// ConsumeLivenessChallenge marks the driver's challenge used and returns it. It
+// reports false if the challenge is unknown, expired or already used.
+func (p *Postgres) ConsumeLivenessChallenge(ctx context.Context, driverID, id string) (dispatch.LivenessChallenge, bool, error) {
+	var (
+		ch  dispatch.LivenessChallenge
+		seq []byte
+	)
+	err := p.pool.QueryRow(ctx, `
+UPDATE liveness_challenges SET used_at = NOW()
+WHERE id = $1 AND driver_id = $2 AND used_at IS NULL AND expires_at > NOW()
+RETURNING id, driver_id, sequence, created_at, expires_at, used_at
+`, id, driverID).Scan(&ch.ID, &ch.DriverID, &seq, &ch.CreatedAt, &ch.ExpiresAt, &ch.UsedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return ch, false, nil
+		}
+		return ch, false, err
+	}
+	if err := json.Unmarshal(seq, &ch.Sequence); err != nil {
+		return ch, false, err
+	}
+	return ch, true, nil
+}
+
+// ClaimLivenessChecks leases captures waiting for verification by pushing
+// next_attempt_at past the lease, so a check whose worker dies is retried.
+func (p *Postgres) ClaimLivenessChecks(ctx context.Context, limit int, lease time.Duration) ([]dispatch.DriverLiveness, error) {
+	rows, err := p.pool.Query(ctx, `
+UPDATE driver_liveness_checks
+SET next_attempt_at = NOW() + make_interval(secs => $2), verification_attempts = verification_attempts + 1
+WHERE id IN (
+	SELECT id FROM driver_liveness_checks
+	WHERE verification_status = 'pending' AND next_attempt_at <= NOW()
+	ORDER BY next_attempt_at
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING `+livenessColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.DriverLiveness
+	for rows.Next() {
+		liv, err := p.scanLiveness(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, liv)
+	}
+	return out, rows.Err()
+}
+
+// SaveLivenessResult records the verification of a claimed check. It reports
+// false if the driver has resubmitted their captures since the claim.
+func (p *Postgres) SaveLivenessResult(ctx context.Context, liv dispatch.DriverLiveness) (bool, error) {
+	result, err := json.Marshal(liv.Result)
+	if err != nil {
+		return false, err
+	}
+	tag, err := p.pool.Exec(ctx, `
+UPDATE driver_liveness_checks
+SET verification_status = $3, verification = $4, verified = $5, verified_at = $6
+WHERE id = $1 AND COALESCE(challenge_id, '') = $2 AND verification_status = 'pending'
+`, liv.ID, liv.ChallengeID, liv.Status, result, liv.Verified, liv.VerifiedAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
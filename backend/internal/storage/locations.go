@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+func (p *Postgres) GetLocationSettings(ctx context.Context, locationCode string) (dispatch.LocationSettings, bool, error) {
+	var (
+		settings  dispatch.LocationSettings
+		updatedBy *string
+	)
+	err := p.pool.QueryRow(ctx, `
+SELECT location_code, pickup_pin_required, updated_by, updated_at
+FROM location_settings WHERE location_code = $1
+`, locationCode).Scan(&settings.LocationCode, &settings.PickupPINRequired, &updatedBy, &settings.UpdatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.LocationSettings{}, false, nil
+		}
+		return dispatch.LocationSettings{}, false, err
+	}
+	settings.UpdatedBy = derefString(updatedBy)
+	return settings, true, nil
+}
+
+func (p *Postgres) UpsertLocationSettings(ctx context.Context, settings dispatch.LocationSettings) (dispatch.LocationSettings, error) {
+	err := p.pool.QueryRow(ctx, `
+INSERT INTO location_settings (location_code, pickup_pin_required, updated_by, updated_at)
+VALUES ($1,$2,$3,NOW())
+ON CONFLICT (location_code) DO UPDATE SET
+  pickup_pin_required = EXCLUDED.pickup_pin_required,
+  updated_by = EXCLUDED.updated_by,
+  updated_at = NOW()
+RETURNING updated_at
+`, settings.LocationCode, settings.PickupPINRequired, settings.UpdatedBy).Scan(&settings.UpdatedAt)
+	return settings, err
+}
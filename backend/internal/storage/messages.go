@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+
+	"turbodriver/internal/dispatch"
+)
+
+func (p *Postgres) InsertRideMessage(ctx context.Context, msg dispatch.RideMessage) (dispatch.RideMessage, error) {
+	var quick *string
+	if msg.QuickReply != "" {
+		quick = &msg.QuickReply
+	}
+	err := p.pool.QueryRow(ctx, `
+INSERT INTO ride_messages (ride_id, sender_id, sender_role, body, quick_reply, created_at)
+VALUES ($1,$2,$3,$4,$5,NOW())
+RETURNING id, created_at
+`, msg.RideID, msg.SenderID, msg.SenderRole, msg.Body, quick).Scan(&msg.ID, &msg.CreatedAt)
+	return msg, err
+}
+
+func (p *Postgres) ListRideMessages(ctx context.Context, rideID string, limit, offset int) ([]dispatch.RideMessage, error) {
+	rows, err := p.pool.Query(ctx, `
+SELECT id, ride_id, sender_id, sender_role, body, quick_reply, read_at, created_at
+FROM ride_messages
+WHERE ride_id = $1
+ORDER BY created_at ASC, id ASC
+LIMIT $2 OFFSET $3
+`, rideID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.RideMessage
+	for rows.Next() {
+		var msg dispatch.RideMessage
+		var quick *string
+		if err := rows.Scan(&msg.ID, &msg.RideID, &msg.SenderID, &msg.SenderRole, &msg.Body, &quick, &msg.ReadAt, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		if quick != nil {
+			msg.QuickReply = *quick
+		}
+		out = append(out, msg)
+	}
+	return out, rows.Err()
+}
+
+func (p *Postgres) CountRideMessages(ctx context.Context, rideID string) (int, error) {
+	var count int
+	if err := p.pool.QueryRow(ctx, `SELECT COUNT(*) FROM ride_messages WHERE ride_id = $1`, rideID).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// MarkRideMessagesRead stamps read_at on messages sent to readerID, up to and
+// including upTo (0 marks everything). Returns the number of messages updated.
+func (p *Postgres) MarkRideMessagesRead(ctx context.Context, rideID, readerID string, upTo int64) (int64, error) {
+	tag, err := p.pool.Exec(ctx, `
+UPDATE ride_messages SET read_at = NOW()
+WHERE ride_id = $1 AND sender_id <> $2 AND read_at IS NULL AND ($3 = 0 OR id <= $3)
+`, rideID, readerID, upTo)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
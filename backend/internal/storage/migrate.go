@@ -3,51 +3,300 @@ package storage
 import (
 	"context"
 	"crypto/sha256"
+	"embed"
+	"errors"
 	"fmt"
-	"os"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// ApplySchema applies schema.sql once, recording hash in migrations table.
-func ApplySchema(ctx context.Context, pool *pgxpool.Pool) error {
-	if err := ensureMigrationTable(ctx, pool); err != nil {
-		return err
+// Migrations live in migrations/ as NNNN_name.up.sql and NNNN_name.down.sql and
+// are compiled into the binary. Applied versions are recorded in
+// schema_migrations; all runs hold a Postgres advisory lock so replicas starting
+// together apply each migration exactly once.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is an arbitrary constant identifying the migration advisory lock.
+const migrationLockID = 727_001
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus describes a known migration and whether it is applied.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+	// Modified is set when the applied checksum differs from the embedded file.
+	Modified bool
+}
+
+// LoadMigrations parses the embedded migration files, ordered by version.
+func LoadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: want NNNN_name.up.sql or .down.sql", name)
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		num, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: missing numeric version prefix", name)
+		}
+		body, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+			m.Checksum = fmt.Sprintf("%x", sha256.Sum256(body))
+		} else {
+			m.Down = string(body)
+		}
 	}
-	schema, err := os.ReadFile("schema.sql")
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Migrator applies and rolls back the embedded migrations.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+func NewMigrator(pool *pgxpool.Pool) (*Migrator, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+// Migrate applies every pending migration.
+func Migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	m, err := NewMigrator(pool)
 	if err != nil {
 		return err
 	}
-	hash := fmt.Sprintf("%x", sha256.Sum256(schema))
-	applied, err := isHashApplied(ctx, pool, hash)
+	_, err = m.Up(ctx)
+	return err
+}
+
+// Up applies pending migrations in order and returns the ones applied, then
+// makes sure upcoming monthly partitions exist.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := done[mig.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, mig, true); err != nil {
+				return err
+			}
+			applied = append(applied, mig)
+		}
+		_, err = ensurePartitions(ctx, conn, time.Now(), PartitionsAhead)
+		return err
+	})
+	return applied, err
+}
+
+// Down rolls back the latest steps applied migrations and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		var err error
+		reverted, err = m.down(ctx, conn, steps)
+		return err
+	})
+	return reverted, err
+}
+
+// Redo rolls back the latest applied migration and applies it again.
+func (m *Migrator) Redo(ctx context.Context) (Migration, error) {
+	var redone Migration
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		reverted, err := m.down(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		if len(reverted) == 0 {
+			return errors.New("no applied migration to redo")
+		}
+		redone = reverted[0]
+		return runMigration(ctx, conn, redone, true)
+	})
+	return redone, err
+}
+
+func (m *Migrator) down(ctx context.Context, conn *pgxpool.Conn, steps int) ([]Migration, error) {
+	done, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var reverted []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := done[mig.Version]; !ok {
+			continue
+		}
+		if mig.Down == "" {
+			return reverted, fmt.Errorf("migration %04d_%s has no down file", mig.Version, mig.Name)
+		}
+		if err := runMigration(ctx, conn, mig, false); err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, mig)
+	}
+	return reverted, nil
+}
+
+// Status lists every known migration with its applied state.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	if err := ensureMigrationTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	done, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		st := MigrationStatus{Migration: mig}
+		if rec, ok := done[mig.Version]; ok {
+			at := rec.appliedAt
+			st.AppliedAt = &at
+			st.Modified = rec.checksum != mig.Checksum
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// locked runs fn on a single connection holding the migration advisory lock.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
 	if err != nil {
 		return err
 	}
-	if applied {
-		return nil
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
 	}
-	if _, err := pool.Exec(ctx, string(schema)); err != nil {
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	if err := ensureMigrationTable(ctx, conn); err != nil {
 		return err
 	}
-	_, err = pool.Exec(ctx, `INSERT INTO migrations (name, hash) VALUES ($1,$2)`, "schema.sql", hash)
-	return err
+	return fn(conn)
 }
 
-func ensureMigrationTable(ctx context.Context, pool *pgxpool.Pool) error {
-	_, err := pool.Exec(ctx, `
-CREATE TABLE IF NOT EXISTS migrations (
-	id SERIAL PRIMARY KEY,
+func ensureMigrationTable(ctx context.Context, conn *pgxpool.Conn) error {
+	_, err := conn.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INT PRIMARY KEY,
 	name TEXT NOT NULL,
-	hash TEXT NOT NULL,
+	checksum TEXT NOT NULL,
 	applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
-CREATE UNIQUE INDEX IF NOT EXISTS migrations_name_hash_idx ON migrations(name, hash);
 `)
 	return err
 }
 
-func isHashApplied(ctx context.Context, pool *pgxpool.Pool, hash string) (bool, error) {
-	var exists bool
-	err := pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM migrations WHERE name=$1 AND hash=$2)`, "schema.sql", hash).Scan(&exists)
-	return exists, err
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.Query(ctx, `SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]appliedMigration)
+	for rows.Next() {
+		var (
+			version int
+			rec     appliedMigration
+		)
+		if err := rows.Scan(&version, &rec.checksum, &rec.appliedAt); err != nil {
+			return nil, err
+		}
+		out[version] = rec
+	}
+	return out, rows.Err()
+}
+
+// runMigration applies one direction of a migration and its bookkeeping in a
+// single transaction, so a failing migration leaves no partial changes.
+func runMigration(ctx context.Context, conn *pgxpool.Conn, mig Migration, up bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	script := mig.Up
+	if !up {
+		script = mig.Down
+	}
+	if _, err := tx.Exec(ctx, script); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+	}
+	if up {
+		_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1,$2,$3)`, mig.Version, mig.Name, mig.Checksum)
+	} else {
+		_, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
@@ -0,0 +1,23 @@
+-- Drops every table created by the baseline, dependents first.
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS location_settings;
+DROP TABLE IF EXISTS safety_incidents;
+DROP TABLE IF EXISTS ride_shares;
+DROP TABLE IF EXISTS ride_messages;
+DROP TABLE IF EXISTS ride_ratings;
+DROP TABLE IF EXISTS driver_liveness_checks;
+DROP TABLE IF EXISTS vehicle_photos;
+DROP TABLE IF EXISTS driver_vehicles;
+DROP TABLE IF EXISTS driver_licenses;
+DROP TABLE IF EXISTS driver_applications;
+DROP TABLE IF EXISTS location_rules;
+DROP TABLE IF EXISTS passenger_profiles;
+DROP TABLE IF EXISTS partner_api_keys;
+DROP TABLE IF EXISTS phone_identities;
+DROP TABLE IF EXISTS otp_challenges;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS identity_tokens;
+DROP TABLE IF EXISTS identities;
+DROP TABLE IF EXISTS ride_events;
+DROP TABLE IF EXISTS rides;
+DROP TABLE IF EXISTS drivers;
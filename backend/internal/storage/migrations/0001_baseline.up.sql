@@ -1,4 +1,5 @@
--- TurboDriver database schema
+-- Baseline: the schema previously kept in schema.sql. Every statement is
+-- idempotent so databases created from schema.sql adopt it unchanged.
 
 -- Drivers: latest driver state (replace with more granular history later)
 CREATE TABLE IF NOT EXISTS drivers (
@@ -26,6 +27,11 @@ CREATE TABLE IF NOT EXISTS rides (
     pickup_ts TIMESTAMPTZ NOT NULL,
     created_at TIMESTAMPTZ NOT NULL
 );
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS location_code TEXT;
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS pickup_pin TEXT; -- issued at acceptance, shown to passenger only
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS dropoff_lat DOUBLE PRECISION;
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS dropoff_long DOUBLE PRECISION;
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS booked_by TEXT; -- partner org that booked on the passenger's behalf
 
 -- Ride events: append-only audit log
 CREATE TABLE IF NOT EXISTS ride_events (
@@ -39,14 +45,79 @@ CREATE TABLE IF NOT EXISTS ride_events (
 );
 CREATE INDEX IF NOT EXISTS ride_events_ride_id_idx ON ride_events(ride_id, created_at);
 
--- Identities: issued tokens with optional expiry
+-- Identities with optional expiry; token is legacy plaintext, cleared once hashed
 CREATE TABLE IF NOT EXISTS identities (
     id TEXT PRIMARY KEY,
     role TEXT NOT NULL,
-    token TEXT UNIQUE NOT NULL,
+    token TEXT UNIQUE,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     expires_at TIMESTAMPTZ
 );
+ALTER TABLE identities ALTER COLUMN token DROP NOT NULL;
+
+-- Bearer tokens: only a selector and a salted hash of the secret are stored
+CREATE TABLE IF NOT EXISTS identity_tokens (
+    selector TEXT PRIMARY KEY,
+    identity_id TEXT NOT NULL REFERENCES identities(id) ON DELETE CASCADE,
+    salt TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS identity_tokens_identity_idx ON identity_tokens(identity_id);
+
+-- Rotating refresh tokens; a family shares one login and is revoked on reuse
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    selector TEXT PRIMARY KEY,
+    family_id TEXT NOT NULL,
+    identity_id TEXT NOT NULL REFERENCES identities(id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    salt TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_identity_idx ON refresh_tokens(identity_id);
+
+-- Phone OTP login: pending codes (hashed) and one identity per phone and role
+CREATE TABLE IF NOT EXISTS otp_challenges (
+    phone TEXT NOT NULL,
+    role TEXT NOT NULL,
+    code_salt TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    last_sent_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (phone, role)
+);
+CREATE TABLE IF NOT EXISTS phone_identities (
+    phone TEXT NOT NULL,
+    role TEXT NOT NULL,
+    identity_id TEXT NOT NULL REFERENCES identities(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (phone, role)
+);
+
+-- Partner (B2B) API keys; only a salted hash of the secret is stored
+CREATE TABLE IF NOT EXISTS partner_api_keys (
+    id TEXT PRIMARY KEY,
+    org_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    selector TEXT NOT NULL UNIQUE,
+    salt TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    rate_per_minute INT NOT NULL DEFAULT 0,
+    usage_count BIGINT NOT NULL DEFAULT 0,
+    last_used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS partner_api_keys_org_idx ON partner_api_keys(org_id);
 
 -- Passenger profile info
 CREATE TABLE IF NOT EXISTS passenger_profiles (
@@ -82,7 +153,6 @@ CREATE TABLE IF NOT EXISTS driver_applications (
     updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 CREATE UNIQUE INDEX IF NOT EXISTS driver_applications_driver_idx ON driver_applications(driver_id);
-CREATE INDEX IF NOT EXISTS driver_applications_driver_idx ON driver_applications(driver_id);
 
 -- Driver license details with remunerated-permission flag
 CREATE TABLE IF NOT EXISTS driver_licenses (
@@ -152,3 +222,67 @@ CREATE TABLE IF NOT EXISTS ride_ratings (
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 CREATE UNIQUE INDEX IF NOT EXISTS ride_ratings_unique_role ON ride_ratings(ride_id, rater_role);
+
+-- In-ride chat between passenger and driver
+CREATE TABLE IF NOT EXISTS ride_messages (
+    id BIGSERIAL PRIMARY KEY,
+    ride_id TEXT NOT NULL,
+    sender_id TEXT NOT NULL,
+    sender_role TEXT NOT NULL, -- driver | passenger
+    body TEXT NOT NULL,
+    quick_reply TEXT, -- canned reply key, when used
+    read_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS ride_messages_ride_idx ON ride_messages(ride_id, created_at);
+
+-- Trip sharing links: scoped, expiring read-only tokens for a single ride
+CREATE TABLE IF NOT EXISTS ride_shares (
+    id BIGSERIAL PRIMARY KEY,
+    ride_id TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL, -- sha256 of the share token
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS ride_shares_ride_idx ON ride_shares(ride_id);
+
+-- Safety incidents (SOS) with a snapshot of ride context at report time
+CREATE TABLE IF NOT EXISTS safety_incidents (
+    id BIGSERIAL PRIMARY KEY,
+    ride_id TEXT NOT NULL,
+    kind TEXT NOT NULL DEFAULT 'sos',
+    reporter_id TEXT,
+    reporter_role TEXT,
+    status TEXT NOT NULL DEFAULT 'open', -- open | acknowledged | escalated | resolved
+    note TEXT,
+    snapshot JSONB NOT NULL, -- ride, driver location, recent track points
+    acknowledged_by TEXT,
+    acknowledged_at TIMESTAMPTZ,
+    escalated_by TEXT,
+    escalated_at TIMESTAMPTZ,
+    resolved_by TEXT,
+    resolved_at TIMESTAMPTZ,
+    resolution TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS safety_incidents_status_idx ON safety_incidents(status, created_at);
+CREATE INDEX IF NOT EXISTS safety_incidents_ride_idx ON safety_incidents(ride_id);
+
+-- Per-location feature switches (e.g. pickup PIN verification)
+CREATE TABLE IF NOT EXISTS location_settings (
+    location_code TEXT PRIMARY KEY,
+    pickup_pin_required BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_by TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Idempotency keys for ride requests (TTL enforced on read)
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    ride_id TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys(expires_at);
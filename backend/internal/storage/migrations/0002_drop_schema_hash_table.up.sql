@@ -0,0 +1,3 @@
+-- schema.sql was applied as a whole and tracked by file hash in "migrations";
+-- versions are now tracked in schema_migrations.
+DROP TABLE IF EXISTS migrations;
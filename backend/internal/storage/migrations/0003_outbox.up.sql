@@ -0,0 +1,17 @@
+-- Ride transitions awaiting delivery to the hub, webhooks and notifications.
+-- Rows are written in the same transaction as the ride update and its event.
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    dedupe_key TEXT NOT NULL UNIQUE,
+    ride_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    ride JSONB NOT NULL,
+    payload JSONB,
+    attempts INT NOT NULL DEFAULT 0,
+    delivered_sinks TEXT[] NOT NULL DEFAULT '{}',
+    last_error TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox(next_attempt_at) WHERE delivered_at IS NULL;
@@ -0,0 +1,2 @@
+-- Incremented on every ride transition; updates are conditional on it.
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
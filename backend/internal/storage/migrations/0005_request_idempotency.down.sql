@@ -0,0 +1,6 @@
+DELETE FROM idempotency_keys WHERE ride_id IS NULL;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS response_body;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS response_headers;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS status_code;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS fingerprint;
+ALTER TABLE idempotency_keys ALTER COLUMN ride_id SET NOT NULL;
@@ -0,0 +1,7 @@
+-- Idempotency-Key requests store their fingerprint and response next to the
+-- ride keys; rows without a status_code are requests still in flight.
+ALTER TABLE idempotency_keys ALTER COLUMN ride_id DROP NOT NULL;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS fingerprint TEXT;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS status_code INT;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response_headers JSONB;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response_body BYTEA;
@@ -0,0 +1,25 @@
+-- Events already archived stay in their exports; only rows still in the
+-- partitions are copied back.
+DROP TABLE IF EXISTS event_archive_rides;
+DROP TABLE IF EXISTS event_archives;
+
+ALTER TABLE ride_events RENAME TO ride_events_partitioned;
+ALTER TABLE ride_events_partitioned RENAME CONSTRAINT ride_events_pkey TO ride_events_partitioned_pkey;
+ALTER INDEX ride_events_ride_id_idx RENAME TO ride_events_partitioned_ride_id_idx;
+ALTER SEQUENCE ride_events_id_seq OWNED BY NONE;
+
+CREATE TABLE ride_events (
+    id BIGINT PRIMARY KEY DEFAULT nextval('ride_events_id_seq'),
+    ride_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload JSONB,
+    actor_id TEXT,
+    actor_role TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+ALTER SEQUENCE ride_events_id_seq OWNED BY ride_events.id;
+CREATE INDEX ride_events_ride_id_idx ON ride_events(ride_id, created_at);
+
+INSERT INTO ride_events (id, ride_id, event_type, payload, actor_id, actor_role, created_at)
+SELECT id, ride_id, event_type, payload, actor_id, actor_role, created_at FROM ride_events_partitioned;
+DROP TABLE ride_events_partitioned;
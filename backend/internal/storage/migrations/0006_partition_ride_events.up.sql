@@ -0,0 +1,63 @@
+-- ride_events is partitioned by month on created_at. The migrator creates the
+-- monthly partitions ahead of time (see EnsurePartitions); ride_events_default
+-- only catches rows outside them. Partitions past retention are exported and
+-- dropped by cmd/archive.
+ALTER TABLE ride_events RENAME TO ride_events_unpartitioned;
+ALTER TABLE ride_events_unpartitioned RENAME CONSTRAINT ride_events_pkey TO ride_events_unpartitioned_pkey;
+ALTER INDEX ride_events_ride_id_idx RENAME TO ride_events_unpartitioned_ride_id_idx;
+ALTER SEQUENCE ride_events_id_seq OWNED BY NONE;
+
+CREATE TABLE ride_events (
+    id BIGINT NOT NULL DEFAULT nextval('ride_events_id_seq'),
+    ride_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload JSONB,
+    actor_id TEXT,
+    actor_role TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+ALTER SEQUENCE ride_events_id_seq OWNED BY ride_events.id;
+CREATE INDEX ride_events_ride_id_idx ON ride_events(ride_id, created_at);
+CREATE TABLE ride_events_default PARTITION OF ride_events DEFAULT;
+
+-- A partition for every month that already has events, named like the ones
+-- the migrator creates (ride_events_YYYY_MM, bounds in UTC).
+DO $$
+DECLARE
+    m TIMESTAMP;
+BEGIN
+    FOR m IN SELECT DISTINCT date_trunc('month', created_at AT TIME ZONE 'UTC') FROM ride_events_unpartitioned LOOP
+        EXECUTE format('CREATE TABLE %I PARTITION OF ride_events FOR VALUES FROM (%L) TO (%L)',
+            'ride_events_' || to_char(m, 'YYYY_MM'),
+            m AT TIME ZONE 'UTC',
+            (m + INTERVAL '1 month') AT TIME ZONE 'UTC');
+    END LOOP;
+END $$;
+
+INSERT INTO ride_events (id, ride_id, event_type, payload, actor_id, actor_role, created_at)
+SELECT id, ride_id, event_type, payload, actor_id, actor_role, created_at FROM ride_events_unpartitioned;
+DROP TABLE ride_events_unpartitioned;
+
+-- Archived exports of ride_events. whole_partition rows replaced a dropped
+-- partition; the others hold event types with shorter retention that were
+-- deleted from a partition still kept.
+CREATE TABLE IF NOT EXISTS event_archives (
+    id BIGSERIAL PRIMARY KEY,
+    table_name TEXT NOT NULL,
+    partition_name TEXT NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    whole_partition BOOLEAN NOT NULL,
+    event_types TEXT[],
+    object_key TEXT NOT NULL,
+    row_count BIGINT NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Which archives hold events for a ride, so timelines can still be found.
+CREATE TABLE IF NOT EXISTS event_archive_rides (
+    ride_id TEXT NOT NULL,
+    archive_id BIGINT NOT NULL REFERENCES event_archives(id) ON DELETE CASCADE,
+    PRIMARY KEY (ride_id, archive_id)
+);
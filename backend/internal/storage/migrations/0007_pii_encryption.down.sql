@@ -0,0 +1,6 @@
+-- Fails while any liveness captures are still encrypted.
+DROP INDEX IF EXISTS driver_licenses_license_number_bidx_idx;
+DROP INDEX IF EXISTS passenger_profiles_government_id_bidx_idx;
+ALTER TABLE driver_licenses DROP COLUMN IF EXISTS license_number_bidx;
+ALTER TABLE passenger_profiles DROP COLUMN IF EXISTS government_id_bidx;
+ALTER TABLE driver_liveness_checks ALTER COLUMN captures TYPE JSONB USING captures::jsonb;
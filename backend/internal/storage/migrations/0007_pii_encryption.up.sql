@@ -0,0 +1,8 @@
+-- PII columns hold envelope-encrypted text (see internal/pii). Liveness captures
+-- are sealed as a whole, so they can no longer be JSONB. Values looked up by
+-- equality get a blind index next to them.
+ALTER TABLE driver_liveness_checks ALTER COLUMN captures TYPE TEXT USING captures::text;
+ALTER TABLE passenger_profiles ADD COLUMN IF NOT EXISTS government_id_bidx TEXT;
+ALTER TABLE driver_licenses ADD COLUMN IF NOT EXISTS license_number_bidx TEXT;
+CREATE INDEX IF NOT EXISTS passenger_profiles_government_id_bidx_idx ON passenger_profiles(government_id_bidx);
+CREATE INDEX IF NOT EXISTS driver_licenses_license_number_bidx_idx ON driver_licenses(license_number_bidx);
@@ -0,0 +1,15 @@
+-- Data subject requests (export and erasure), one row per step. Rows outlive
+-- the identity they describe, so they only name it by its opaque ID.
+CREATE TABLE IF NOT EXISTS compliance_audit (
+    id BIGSERIAL PRIMARY KEY,
+    request_id TEXT NOT NULL, -- groups the steps of one request
+    subject_id TEXT NOT NULL,
+    subject_role TEXT NOT NULL,
+    request TEXT NOT NULL, -- export | erasure
+    step TEXT NOT NULL,
+    detail JSONB,
+    actor_id TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS compliance_audit_subject_idx ON compliance_audit(subject_id, created_at);
+CREATE INDEX IF NOT EXISTS compliance_audit_request_idx ON compliance_audit(request_id);
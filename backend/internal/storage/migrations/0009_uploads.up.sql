@@ -0,0 +1,19 @@
+-- Files received through POST /api/uploads. Pending rows wait for a direct
+-- (pre-signed) upload and are checked when the client completes them; only
+-- ready uploads can be referenced from a driver application.
+CREATE TABLE IF NOT EXISTS uploads (
+    id TEXT PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    purpose TEXT NOT NULL, -- license_document | vehicle_document | vehicle_contract | vehicle_photo | liveness_capture
+    status TEXT NOT NULL DEFAULT 'pending', -- pending | ready
+    object_key TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    sha256 TEXT NOT NULL, -- hex; declared by the client while pending
+    width INT,
+    height INT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ, -- pending uploads must complete before this
+    completed_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS uploads_owner_idx ON uploads(owner_id, created_at);
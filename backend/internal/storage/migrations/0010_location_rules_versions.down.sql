@@ -0,0 +1,4 @@
+ALTER TABLE driver_applications DROP COLUMN IF EXISTS rules_accepted_at;
+DROP INDEX IF EXISTS location_rules_version_idx;
+ALTER TABLE location_rules DROP COLUMN IF EXISTS created_by;
+ALTER TABLE location_rules DROP COLUMN IF EXISTS version;
@@ -0,0 +1,13 @@
+-- Location rules are versioned per location_code: each version is a new row
+-- that takes over from the previous one at effective_at. Versions already in
+-- force are never edited, since drivers have accepted them.
+ALTER TABLE location_rules ADD COLUMN IF NOT EXISTS version INT;
+ALTER TABLE location_rules ADD COLUMN IF NOT EXISTS created_by TEXT;
+UPDATE location_rules l SET version = v.n
+FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY location_code ORDER BY effective_at, id) AS n FROM location_rules) v
+WHERE l.id = v.id AND l.version IS NULL;
+ALTER TABLE location_rules ALTER COLUMN version SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS location_rules_version_idx ON location_rules(location_code, version);
+
+-- When the driver accepted rules_version_id.
+ALTER TABLE driver_applications ADD COLUMN IF NOT EXISTS rules_accepted_at TIMESTAMPTZ;
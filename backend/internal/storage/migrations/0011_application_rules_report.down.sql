@@ -0,0 +1,3 @@
+ALTER TABLE driver_applications DROP COLUMN IF EXISTS rules_report;
+ALTER TABLE driver_vehicles DROP COLUMN IF EXISTS model_year;
+ALTER TABLE driver_licenses DROP COLUMN IF EXISTS issued_at;
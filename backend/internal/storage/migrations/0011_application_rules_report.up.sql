@@ -0,0 +1,5 @@
+-- Inputs to the location rules checks, and the per-check report of the last
+-- evaluation (see internal/eligibility).
+ALTER TABLE driver_licenses ADD COLUMN IF NOT EXISTS issued_at TIMESTAMPTZ;
+ALTER TABLE driver_vehicles ADD COLUMN IF NOT EXISTS model_year INT;
+ALTER TABLE driver_applications ADD COLUMN IF NOT EXISTS rules_report JSONB;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS driver_applications_status_idx;
+DROP TABLE IF EXISTS application_reviews;
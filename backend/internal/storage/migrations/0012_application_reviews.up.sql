@@ -0,0 +1,17 @@
+-- Reviewer decisions on driver applications, newest last. driver_applications
+-- keeps only the current status.
+CREATE TABLE IF NOT EXISTS application_reviews (
+    id BIGSERIAL PRIMARY KEY,
+    application_id BIGINT NOT NULL REFERENCES driver_applications(id) ON DELETE CASCADE,
+    driver_id TEXT NOT NULL,
+    reviewer_id TEXT NOT NULL DEFAULT '',
+    decision TEXT NOT NULL, -- pending | approved | rejected | needs_review | changes_requested
+    reason TEXT NOT NULL DEFAULT '',
+    findings JSONB NOT NULL DEFAULT '[]', -- [{document, verdict, note}]
+    sections JSONB NOT NULL DEFAULT '[]', -- sections to resubmit for changes_requested
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS application_reviews_application_idx ON application_reviews(application_id, created_at);
+
+-- Review queue: applications by status, oldest first.
+CREATE INDEX IF NOT EXISTS driver_applications_status_idx ON driver_applications(status, updated_at);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS driver_liveness_pending_idx;
+ALTER TABLE driver_liveness_checks DROP COLUMN IF EXISTS next_attempt_at;
+ALTER TABLE driver_liveness_checks DROP COLUMN IF EXISTS verification_attempts;
+ALTER TABLE driver_liveness_checks DROP COLUMN IF EXISTS verification;
+ALTER TABLE driver_liveness_checks DROP COLUMN IF EXISTS verification_status;
+ALTER TABLE driver_liveness_checks DROP COLUMN IF EXISTS challenge_id;
+DROP TABLE IF EXISTS liveness_challenges;
@@ -0,0 +1,22 @@
+-- Server-issued liveness challenges; each is consumed by one submission.
+CREATE TABLE IF NOT EXISTS liveness_challenges (
+    id TEXT PRIMARY KEY,
+    driver_id TEXT NOT NULL REFERENCES identities(id) ON DELETE CASCADE,
+    sequence JSONB NOT NULL, -- e.g., ["left","up","right","down"]
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS liveness_challenges_driver_idx ON liveness_challenges(driver_id);
+
+-- Verification of the captures by the configured verifier (LIVENESS_VERIFIER).
+-- next_attempt_at doubles as the lease of the worker checking a row.
+ALTER TABLE driver_liveness_checks ADD COLUMN IF NOT EXISTS challenge_id TEXT;
+ALTER TABLE driver_liveness_checks ADD COLUMN IF NOT EXISTS verification_status TEXT NOT NULL DEFAULT 'pending'; -- pending | verified | failed | error
+ALTER TABLE driver_liveness_checks ADD COLUMN IF NOT EXISTS verification JSONB;
+ALTER TABLE driver_liveness_checks ADD COLUMN IF NOT EXISTS verification_attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE driver_liveness_checks ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+UPDATE driver_liveness_checks SET verification_status = 'verified' WHERE verified;
+-- Captures sent before challenges existed cannot be verified; leave them to reviewers.
+UPDATE driver_liveness_checks SET verification_status = 'error' WHERE NOT verified AND challenge_id IS NULL;
+CREATE INDEX IF NOT EXISTS driver_liveness_pending_idx ON driver_liveness_checks(next_attempt_at) WHERE verification_status = 'pending';
@@ -0,0 +1,2 @@
+-- Wrong pickup PINs entered for a ride, across replicas and restarts.
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS pickup_pin_failures INT NOT NULL DEFAULT 0;
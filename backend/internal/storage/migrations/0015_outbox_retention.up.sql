@@ -0,0 +1,4 @@
+-- Outbox rows no longer carry the pickup PIN; scrub the ones that do.
+UPDATE outbox SET ride = ride - 'pickupPin' WHERE ride ? 'pickupPin';
+-- Delivered rows are pruned after OUTBOX_RETENTION.
+CREATE INDEX IF NOT EXISTS outbox_delivered_idx ON outbox(delivered_at) WHERE delivered_at IS NOT NULL;
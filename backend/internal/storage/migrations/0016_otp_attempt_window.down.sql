@@ -0,0 +1 @@
+ALTER TABLE otp_challenges DROP COLUMN IF EXISTS window_started_at;
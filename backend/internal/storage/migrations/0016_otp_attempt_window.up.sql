@@ -0,0 +1,3 @@
+-- OTP attempts are counted per window rather than per code, so resending a
+-- code does not hand out fresh guesses.
+ALTER TABLE otp_challenges ADD COLUMN IF NOT EXISTS window_started_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
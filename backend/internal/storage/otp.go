@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/auth"
+	"turbodriver/internal/dispatch"
+)
+
+func (s *IdentityStore) GetOTPChallenge(ctx context.Context, phone string, role dispatch.IdentityRole) (auth.OTPChallenge, bool, error) {
+	ch := auth.OTPChallenge{Phone: phone, Role: role}
+	err := s.pool.QueryRow(ctx, `
+SELECT code_salt, code_hash, attempts, expires_at, last_sent_at, window_started_at
+FROM otp_challenges WHERE phone = $1 AND role = $2
+`, phone, role).Scan(&ch.Salt, &ch.Hash, &ch.Attempts, &ch.ExpiresAt, &ch.LastSentAt, &ch.WindowStartedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return auth.OTPChallenge{}, false, nil
+		}
+		return auth.OTPChallenge{}, false, err
+	}
+	return ch, true, nil
+}
+
+// SaveOTPChallenge replaces any pending challenge for the phone and role,
+// attempts and window included.
+func (s *IdentityStore) SaveOTPChallenge(ctx context.Context, ch auth.OTPChallenge) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO otp_challenges (phone, role, code_salt, code_hash, attempts, expires_at, last_sent_at, window_started_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+ON CONFLICT (phone, role) DO UPDATE SET
+  code_salt = EXCLUDED.code_salt,
+  code_hash = EXCLUDED.code_hash,
+  attempts = EXCLUDED.attempts,
+  expires_at = EXCLUDED.expires_at,
+  last_sent_at = EXCLUDED.last_sent_at,
+  window_started_at = EXCLUDED.window_started_at
+`, ch.Phone, ch.Role, ch.Salt, ch.Hash, ch.Attempts, ch.ExpiresAt, ch.LastSentAt, ch.WindowStartedAt)
+	return err
+}
+
+func (s *IdentityStore) RecordOTPAttempt(ctx context.Context, phone string, role dispatch.IdentityRole, max int) (auth.OTPChallenge, bool, error) {
+	ch := auth.OTPChallenge{Phone: phone, Role: role}
+	err := s.pool.QueryRow(ctx, `
+UPDATE otp_challenges SET attempts = attempts + 1
+WHERE phone = $1 AND role = $2 AND attempts < $3
+RETURNING code_salt, code_hash, attempts, expires_at, last_sent_at, window_started_at
+`, phone, role, max).Scan(&ch.Salt, &ch.Hash, &ch.Attempts, &ch.ExpiresAt, &ch.LastSentAt, &ch.WindowStartedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return auth.OTPChallenge{}, false, nil
+		}
+		return auth.OTPChallenge{}, false, err
+	}
+	return ch, true, nil
+}
+
+func (s *IdentityStore) DeleteOTPChallenge(ctx context.Context, phone string, role dispatch.IdentityRole) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM otp_challenges WHERE phone = $1 AND role = $2`, phone, role)
+	return err
+}
+
+func (s *IdentityStore) PhoneIdentity(ctx context.Context, phone string, role dispatch.IdentityRole) (string, bool, error) {
+	var id string
+	err := s.pool.QueryRow(ctx, `SELECT identity_id FROM phone_identities WHERE phone = $1 AND role = $2`, phone, role).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return id, true, nil
+}
+
+// LinkPhoneIdentity records the mapping; if a concurrent verify linked first, its identity wins.
+func (s *IdentityStore) LinkPhoneIdentity(ctx context.Context, phone string, role dispatch.IdentityRole, identityID string) (string, error) {
+	if _, err := s.pool.Exec(ctx, `
+INSERT INTO phone_identities (phone, role, identity_id)
+VALUES ($1,$2,$3)
+ON CONFLICT (phone, role) DO NOTHING
+`, phone, role, identityID); err != nil {
+		return "", err
+	}
+	linked, _, err := s.PhoneIdentity(ctx, phone, role)
+	return linked, err
+}
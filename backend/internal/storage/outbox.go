@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"turbodriver/internal/dispatch"
+)
+
+// ClaimOutbox leases due messages by pushing next_attempt_at past the lease;
+// SKIP LOCKED lets relays on several replicas claim disjoint batches.
+func (p *Postgres) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]dispatch.OutboxMessage, error) {
+	rows, err := p.pool.Query(ctx, `
+UPDATE outbox SET next_attempt_at = NOW() + make_interval(secs => $2)
+WHERE id IN (
+	SELECT id FROM outbox
+	WHERE delivered_at IS NULL AND next_attempt_at <= NOW()
+	ORDER BY id
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, dedupe_key, ride_id, event_type, ride, payload, attempts, delivered_sinks, created_at
+`, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.OutboxMessage
+	for rows.Next() {
+		var (
+			msg      dispatch.OutboxMessage
+			snapshot []byte
+		)
+		if err := rows.Scan(&msg.ID, &msg.DedupeKey, &msg.RideID, &msg.EventType, &snapshot, &msg.Payload, &msg.Attempts, &msg.DeliveredSinks, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, &msg.Ride); err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// PruneOutbox deletes messages delivered before cutoff.
+func (p *Postgres) PruneOutbox(ctx context.Context, cutoff time.Time) (int64, error) {
+	tag, err := p.pool.Exec(ctx, `DELETE FROM outbox WHERE delivered_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (p *Postgres) MarkOutboxDelivered(ctx context.Context, id int64) error {
+	_, err := p.pool.Exec(ctx, `
+UPDATE outbox SET delivered_at = NOW(), attempts = attempts + 1, last_error = NULL WHERE id = $1
+`, id)
+	return err
+}
+
+func (p *Postgres) MarkOutboxFailed(ctx context.Context, id int64, deliveredSinks []string, retryAt time.Time, reason string) error {
+	if deliveredSinks == nil {
+		deliveredSinks = []string{}
+	}
+	_, err := p.pool.Exec(ctx, `
+UPDATE outbox SET attempts = attempts + 1, delivered_sinks = $2, next_attempt_at = $3, last_error = $4 WHERE id = $1
+`, id, deliveredSinks, retryAt, reason)
+	return err
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Tables partitioned by month on created_at. Each has a <table>_default
+// partition and monthly partitions named <table>_YYYY_MM with UTC bounds.
+var partitionedTables = []string{"ride_events"}
+
+// PartitionsAhead is how many months past the current one EnsurePartitions
+// creates by default.
+const PartitionsAhead = 3
+
+// Partition is one monthly partition of a partitioned table.
+type Partition struct {
+	Table string
+	Name  string
+	From  time.Time
+	To    time.Time
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func partitionName(table string, month time.Time) string {
+	return table + "_" + month.Format("2006_01")
+}
+
+// EnsurePartitions creates the monthly partitions from now's month through
+// ahead months later, under the migration lock.
+func (m *Migrator) EnsurePartitions(ctx context.Context, now time.Time, ahead int) ([]Partition, error) {
+	var created []Partition
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		var err error
+		created, err = ensurePartitions(ctx, conn, now, ahead)
+		return err
+	})
+	return created, err
+}
+
+func ensurePartitions(ctx context.Context, conn *pgxpool.Conn, now time.Time, ahead int) ([]Partition, error) {
+	var created []Partition
+	for _, table := range partitionedTables {
+		var partitioned bool
+		if err := conn.QueryRow(ctx, `
+SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass($1))
+`, table).Scan(&partitioned); err != nil {
+			return created, err
+		}
+		if !partitioned {
+			// Not yet migrated (or rolled back); nothing to manage.
+			continue
+		}
+		start := monthStart(now)
+		for i := 0; i <= ahead; i++ {
+			month := start.AddDate(0, i, 0)
+			ok, err := ensureMonthPartition(ctx, conn, table, month)
+			if err != nil {
+				return created, err
+			}
+			if ok {
+				created = append(created, Partition{Table: table, Name: partitionName(table, month), From: month, To: month.AddDate(0, 1, 0)})
+			}
+		}
+	}
+	return created, nil
+}
+
+// ensureMonthPartition creates a month's partition if missing. Rows for that
+// month that already landed in the default partition are moved into it, as
+// Postgres refuses to attach a range the default partition has rows for.
+func ensureMonthPartition(ctx context.Context, conn *pgxpool.Conn, table string, month time.Time) (bool, error) {
+	name := partitionName(table, month)
+	var exists bool
+	if err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	from, to := month, month.AddDate(0, 1, 0)
+	parent := pgx.Identifier{table}.Sanitize()
+	part := pgx.Identifier{name}.Sanitize()
+	def := pgx.Identifier{table + "_default"}.Sanitize()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, part, parent)); err != nil {
+		return false, fmt.Errorf("create %s: %w", name, err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`
+WITH moved AS (DELETE FROM %s WHERE created_at >= $1 AND created_at < $2 RETURNING *)
+INSERT INTO %s SELECT * FROM moved
+`, def, part), from, to); err != nil {
+		return false, fmt.Errorf("move default rows into %s: %w", name, err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`,
+		parent, part, from.Format(time.RFC3339), to.Format(time.RFC3339))); err != nil {
+		return false, fmt.Errorf("attach %s: %w", name, err)
+	}
+	return true, tx.Commit(ctx)
+}
+
+// listPartitions returns a table's monthly partitions, oldest first. The
+// default partition is not included.
+func listPartitions(ctx context.Context, pool *pgxpool.Pool, table string) ([]Partition, error) {
+	rows, err := pool.Query(ctx, `
+SELECT c.relname
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = to_regclass($1)
+`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Partition
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		month, err := time.Parse("2006_01", strings.TrimPrefix(name, table+"_"))
+		if err != nil {
+			continue
+		}
+		out = append(out, Partition{Table: table, Name: name, From: month, To: month.AddDate(0, 1, 0)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].From.Before(out[j].From) })
+	return out, rows.Err()
+}
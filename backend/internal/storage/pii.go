@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"turbodriver/internal/pii"
+)
+
+// piiColumn is a column holding personal data, sealed with the attached
+// encryptor. Columns with an index column also keep a blind index for lookups.
+type piiColumn struct {
+	table  string
+	column string
+	index  string
+}
+
+func (c piiColumn) String() string {
+	return c.table + "." + c.column
+}
+
+var (
+	piiAddress         = piiColumn{table: "passenger_profiles", column: "address"}
+	piiGovernmentID    = piiColumn{table: "passenger_profiles", column: "government_id", index: "government_id_bidx"}
+	piiLicenseNumber   = piiColumn{table: "driver_licenses", column: "license_number", index: "license_number_bidx"}
+	piiLicenseDoc      = piiColumn{table: "driver_licenses", column: "document_url"}
+	piiVehicleDoc      = piiColumn{table: "driver_vehicles", column: "document_url"}
+	piiVehicleContract = piiColumn{table: "driver_vehicles", column: "contract_url"}
+	piiCaptures        = piiColumn{table: "driver_liveness_checks", column: "captures"}
+)
+
+var piiColumns = []piiColumn{
+	piiAddress, piiGovernmentID, piiLicenseNumber, piiLicenseDoc,
+	piiVehicleDoc, piiVehicleContract, piiCaptures,
+}
+
+// AttachEncryption seals PII columns on write. Without it values are written
+// in plaintext, and encrypted values fail to read.
+func (p *Postgres) AttachEncryption(enc *pii.Encryptor) {
+	p.pii = enc
+}
+
+func (p *Postgres) seal(ctx context.Context, col piiColumn, value string) (string, error) {
+	return p.pii.Encrypt(ctx, col.String(), value)
+}
+
+func (p *Postgres) open(ctx context.Context, col piiColumn, stored string) (string, error) {
+	return p.pii.Decrypt(ctx, col.String(), stored)
+}
+
+// sealFields seals several values, stopping at the first failure.
+func (p *Postgres) sealFields(ctx context.Context, fields map[piiColumn]*string) error {
+	for col, value := range fields {
+		sealed, err := p.seal(ctx, col, *value)
+		if err != nil {
+			return err
+		}
+		*value = sealed
+	}
+	return nil
+}
+
+// openFields is sealFields in reverse.
+func (p *Postgres) openFields(ctx context.Context, fields map[piiColumn]*string) error {
+	for col, value := range fields {
+		opened, err := p.open(ctx, col, *value)
+		if err != nil {
+			return err
+		}
+		*value = opened
+	}
+	return nil
+}
+
+// FindPassengersByGovernmentID returns the passengers whose profile holds the
+// government ID. It needs encryption attached, as lookups go through the
+// blind index.
+func (p *Postgres) FindPassengersByGovernmentID(ctx context.Context, governmentID string) ([]string, error) {
+	return p.findByIndex(ctx, piiGovernmentID, "passenger_id", governmentID)
+}
+
+// FindDriversByLicenseNumber returns the drivers whose license has the number.
+func (p *Postgres) FindDriversByLicenseNumber(ctx context.Context, number string) ([]string, error) {
+	return p.findByIndex(ctx, piiLicenseNumber, "driver_id", number)
+}
+
+func (p *Postgres) findByIndex(ctx context.Context, col piiColumn, owner, value string) ([]string, error) {
+	idx := p.pii.BlindIndex(col.String(), value)
+	if idx == nil {
+		return nil, nil
+	}
+	rows, err := p.pool.Query(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE %s = $1`,
+		pgx.Identifier{owner}.Sanitize(), pgx.Identifier{col.table}.Sanitize(), pgx.Identifier{col.index}.Sanitize()), *idx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// ReencryptPII seals plaintext values and re-seals values under old master
+// keys with the current one, filling in missing blind indexes on the way. It
+// works through each column in batches and returns the rows rewritten per
+// column. Rows changed concurrently are skipped and picked up by the next run.
+func (p *Postgres) ReencryptPII(ctx context.Context, batch int) (map[string]int, error) {
+	if p.pii == nil {
+		return nil, pii.ErrNoKeys
+	}
+	counts := map[string]int{}
+	for _, col := range piiColumns {
+		n, err := p.reencryptColumn(ctx, col, batch)
+		counts[col.String()] = n
+		if err != nil {
+			return counts, fmt.Errorf("%s: %w", col, err)
+		}
+	}
+	return counts, nil
+}
+
+func (p *Postgres) reencryptColumn(ctx context.Context, col piiColumn, batch int) (int, error) {
+	table := pgx.Identifier{col.table}.Sanitize()
+	column := pgx.Identifier{col.column}.Sanitize()
+	index := "NULL::text"
+	if col.index != "" {
+		index = pgx.Identifier{col.index}.Sanitize()
+	}
+	type row struct {
+		id     int64
+		stored string
+		index  *string
+	}
+	var (
+		lastID    int64
+		rewritten int
+	)
+	for {
+		rows, err := p.pool.Query(ctx, fmt.Sprintf(`
+SELECT id, %s, %s FROM %s WHERE id > $1 AND %s IS NOT NULL AND %s <> '' ORDER BY id LIMIT $2
+`, column, index, table, column, column), lastID, batch)
+		if err != nil {
+			return rewritten, err
+		}
+		var page []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.stored, &r.index); err != nil {
+				rows.Close()
+				return rewritten, err
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rewritten, err
+		}
+		for _, r := range page {
+			lastID = r.id
+			missingIndex := col.index != "" && r.index == nil
+			if !p.pii.NeedsRotation(r.stored) && !missingIndex {
+				continue
+			}
+			value, err := p.open(ctx, col, r.stored)
+			if err != nil {
+				return rewritten, fmt.Errorf("row %d: %w", r.id, err)
+			}
+			sealed, err := p.seal(ctx, col, value)
+			if err != nil {
+				return rewritten, err
+			}
+			var tag pgconn.CommandTag
+			if col.index != "" {
+				tag, err = p.pool.Exec(ctx, fmt.Sprintf(`UPDATE %s SET %s = $2, %s = $3 WHERE id = $1 AND %s = $4`, table, column, index, column),
+					r.id, sealed, p.pii.BlindIndex(col.String(), value), r.stored)
+			} else {
+				tag, err = p.pool.Exec(ctx, fmt.Sprintf(`UPDATE %s SET %s = $2 WHERE id = $1 AND %s = $3`, table, column, column),
+					r.id, sealed, r.stored)
+			}
+			if err != nil {
+				return rewritten, fmt.Errorf("row %d: %w", r.id, err)
+			}
+			if tag.RowsAffected() == 1 {
+				rewritten++
+			}
+		}
+		if len(page) < batch {
+			return rewritten, nil
+		}
+	}
+}
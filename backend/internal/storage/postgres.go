@@ -9,23 +9,25 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"turbodriver/internal/dispatch"
+	"turbodriver/internal/pii"
 )
 
 type Postgres struct {
 	pool *pgxpool.Pool
+	// archive holds exported ride events; see AttachArchive.
+	archive BlobStore
+	// uploads holds files received through the upload API; see AttachUploads.
+	uploads BlobStore
+	// pii seals personal data columns; see AttachEncryption.
+	pii *pii.Encryptor
 }
 
 func NewPostgres(pool *pgxpool.Pool) *Postgres {
 	return &Postgres{pool: pool}
 }
 
-// EnsureSchema creates minimal tables for rides and drivers if they do not exist.
-func EnsureSchema(ctx context.Context, pool *pgxpool.Pool) error {
-	return ApplySchema(ctx, pool)
-}
-
-func (p *Postgres) SaveDriver(d dispatch.DriverState) error {
-	_, err := p.pool.Exec(context.Background(), `
+func (p *Postgres) SaveDriver(ctx context.Context, d dispatch.DriverState) error {
+	_, err := p.pool.Exec(ctx, `
 INSERT INTO drivers (id, latitude, longitude, accuracy, ts, status, ride_id, radius_km, available, updated_at)
 VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
 ON CONFLICT (id) DO UPDATE SET
@@ -42,41 +44,59 @@ ON CONFLICT (id) DO UPDATE SET
 	return err
 }
 
-func (p *Postgres) SaveRide(r dispatch.Ride) error {
-	_, err := p.pool.Exec(context.Background(), `
-INSERT INTO rides (id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at)
-VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+func (p *Postgres) SaveRide(ctx context.Context, r dispatch.Ride) error {
+	_, err := p.pool.Exec(ctx, `
+INSERT INTO rides (id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at, location_code, pickup_pin, dropoff_lat, dropoff_long, booked_by, version)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
 ON CONFLICT (id) DO UPDATE SET
 	driver_id = EXCLUDED.driver_id,
-	status = EXCLUDED.status
-`, r.ID, r.PassengerID, r.DriverID, r.Status, r.Pickup.Latitude, r.Pickup.Longitude, r.Pickup.Accuracy, r.Pickup.At, r.CreatedAt)
+	status = EXCLUDED.status,
+	pickup_pin = EXCLUDED.pickup_pin,
+	version = EXCLUDED.version
+`, r.ID, r.PassengerID, r.DriverID, r.Status, r.Pickup.Latitude, r.Pickup.Longitude, r.Pickup.Accuracy, r.Pickup.At, r.CreatedAt, r.LocationCode, r.PickupPIN, dropoffLat(r), dropoffLong(r), nullIfEmpty(r.BookedBy), r.Version)
 	return err
 }
 
-func (p *Postgres) UpdateRideStatus(id string, status dispatch.RideStatus) error {
-	_, err := p.pool.Exec(context.Background(), `
-UPDATE rides SET status = $2 WHERE id = $1
+func (p *Postgres) UpdateRideStatus(ctx context.Context, id string, status dispatch.RideStatus) error {
+	_, err := p.pool.Exec(ctx, `
+UPDATE rides SET status = $2, version = version + 1 WHERE id = $1
 `, id, status)
 	return err
 }
 
-func (p *Postgres) SetDriverRide(driverID, rideID, status string, available bool) error {
-	_, err := p.pool.Exec(context.Background(), `
+// RecordPINFailure counts a wrong pickup PIN for the ride and returns the
+// total so far.
+func (p *Postgres) RecordPINFailure(ctx context.Context, rideID string) (int, error) {
+	var failures int
+	err := p.pool.QueryRow(ctx, `
+UPDATE rides SET pickup_pin_failures = pickup_pin_failures + 1 WHERE id = $1
+RETURNING pickup_pin_failures
+`, rideID).Scan(&failures)
+	return failures, err
+}
+
+func (p *Postgres) SetDriverRide(ctx context.Context, driverID, rideID, status string, available bool) error {
+	_, err := p.pool.Exec(ctx, `
 UPDATE drivers SET ride_id = $2, status = $3, available = $4 WHERE id = $1
 `, driverID, rideID, status, available)
 	return err
 }
 
-func (p *Postgres) GetRide(id string) (dispatch.Ride, bool, error) {
-	row := p.pool.QueryRow(context.Background(), `
-SELECT id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at
+func (p *Postgres) GetRide(ctx context.Context, id string) (dispatch.Ride, bool, error) {
+	row := p.pool.QueryRow(ctx, `
+SELECT id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at, location_code, pickup_pin, dropoff_lat, dropoff_long, booked_by, version, pickup_pin_failures
 FROM rides WHERE id = $1
 `, id)
 	var (
-		ride dispatch.Ride
-		acc  *float64
+		ride     dispatch.Ride
+		acc      *float64
+		location *string
+		pin      *string
+		dropLat  *float64
+		dropLong *float64
+		bookedBy *string
 	)
-	err := row.Scan(&ride.ID, &ride.PassengerID, &ride.DriverID, &ride.Status, &ride.Pickup.Latitude, &ride.Pickup.Longitude, &acc, &ride.Pickup.At, &ride.CreatedAt)
+	err := row.Scan(&ride.ID, &ride.PassengerID, &ride.DriverID, &ride.Status, &ride.Pickup.Latitude, &ride.Pickup.Longitude, &acc, &ride.Pickup.At, &ride.CreatedAt, &location, &pin, &dropLat, &dropLong, &bookedBy, &ride.Version, &ride.PINFailures)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return dispatch.Ride{}, false, nil
@@ -86,12 +106,32 @@ FROM rides WHERE id = $1
 	if acc != nil {
 		ride.Pickup.Accuracy = *acc
 	}
+	ride.LocationCode = derefString(location)
+	ride.PickupPIN = derefString(pin)
+	ride.BookedBy = derefString(bookedBy)
+	if dropLat != nil && dropLong != nil {
+		ride.Dropoff = &dispatch.Coordinate{Latitude: *dropLat, Longitude: *dropLong}
+	}
 	return ride, true, nil
 }
 
+func dropoffLat(r dispatch.Ride) *float64 {
+	if r.Dropoff == nil {
+		return nil
+	}
+	return &r.Dropoff.Latitude
+}
+
+func dropoffLong(r dispatch.Ride) *float64 {
+	if r.Dropoff == nil {
+		return nil
+	}
+	return &r.Dropoff.Longitude
+}
+
 func (p *Postgres) ListRidesByPassenger(ctx context.Context, passengerID string, limit, offset int) ([]dispatch.Ride, error) {
 	rows, err := p.pool.Query(ctx, `
-SELECT id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at
+SELECT id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at, version
 FROM rides
 WHERE passenger_id = $1
 ORDER BY created_at DESC
@@ -105,7 +145,7 @@ LIMIT $2 OFFSET $3
 	for rows.Next() {
 		var r dispatch.Ride
 		var acc *float64
-		if err := rows.Scan(&r.ID, &r.PassengerID, &r.DriverID, &r.Status, &r.Pickup.Latitude, &r.Pickup.Longitude, &acc, &r.Pickup.At, &r.CreatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.PassengerID, &r.DriverID, &r.Status, &r.Pickup.Latitude, &r.Pickup.Longitude, &acc, &r.Pickup.At, &r.CreatedAt, &r.Version); err != nil {
 			return nil, err
 		}
 		if acc != nil {
@@ -118,7 +158,7 @@ LIMIT $2 OFFSET $3
 
 func (p *Postgres) ListRidesByDriver(ctx context.Context, driverID string, limit, offset int) ([]dispatch.Ride, error) {
 	rows, err := p.pool.Query(ctx, `
-SELECT id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at
+SELECT id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at, version
 FROM rides
 WHERE driver_id = $1
 ORDER BY created_at DESC
@@ -132,7 +172,7 @@ LIMIT $2 OFFSET $3
 	for rows.Next() {
 		var r dispatch.Ride
 		var acc *float64
-		if err := rows.Scan(&r.ID, &r.PassengerID, &r.DriverID, &r.Status, &r.Pickup.Latitude, &r.Pickup.Longitude, &acc, &r.Pickup.At, &r.CreatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.PassengerID, &r.DriverID, &r.Status, &r.Pickup.Latitude, &r.Pickup.Longitude, &acc, &r.Pickup.At, &r.CreatedAt, &r.Version); err != nil {
 			return nil, err
 		}
 		if acc != nil {
@@ -164,26 +204,30 @@ func (p *Postgres) CountRidesByDriver(ctx context.Context, driverID string) (int
 func (p *Postgres) UpsertDriverApplication(ctx context.Context, app dispatch.DriverApplication) (int64, error) {
 	var id int64
 	err := p.pool.QueryRow(ctx, `
-INSERT INTO driver_applications (driver_id, location_code, rules_version_id, status, created_at, updated_at)
-VALUES ($1,$2,$3,$4,NOW(),NOW())
+INSERT INTO driver_applications (driver_id, location_code, rules_version_id, rules_accepted_at, status, created_at, updated_at)
+VALUES ($1,$2,$3,$4,$5,NOW(),NOW())
 ON CONFLICT (driver_id) DO UPDATE SET
   location_code = EXCLUDED.location_code,
   rules_version_id = EXCLUDED.rules_version_id,
+  rules_accepted_at = EXCLUDED.rules_accepted_at,
   status = EXCLUDED.status,
   updated_at = NOW()
 RETURNING id
-`, app.DriverID, app.LocationCode, app.RulesVersion, app.Status).Scan(&id)
+`, app.DriverID, app.LocationCode, app.RulesVersion, app.RulesAcceptedAt, app.Status).Scan(&id)
 	return id, err
 }
 
 func (p *Postgres) GetDriverApplication(ctx context.Context, driverID string) (dispatch.DriverApplication, bool, error) {
-	var app dispatch.DriverApplication
-	var rules *int64
+	var (
+		app    dispatch.DriverApplication
+		rules  *int64
+		report []byte
+	)
 	err := p.pool.QueryRow(ctx, `
-SELECT id, driver_id, location_code, rules_version_id, status, created_at, updated_at
+SELECT id, driver_id, location_code, rules_version_id, rules_accepted_at, rules_report, status, created_at, updated_at
 FROM driver_applications
 WHERE driver_id = $1
-`, driverID).Scan(&app.ID, &app.DriverID, &app.LocationCode, &rules, &app.Status, &app.CreatedAt, &app.UpdatedAt)
+`, driverID).Scan(&app.ID, &app.DriverID, &app.LocationCode, &rules, &app.RulesAcceptedAt, &report, &app.Status, &app.CreatedAt, &app.UpdatedAt)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return dispatch.DriverApplication{}, false, nil
@@ -191,9 +235,28 @@ WHERE driver_id = $1
 		return dispatch.DriverApplication{}, false, err
 	}
 	app.RulesVersion = rules
+	if len(report) > 0 {
+		app.RulesReport = &dispatch.RulesReport{}
+		if err := json.Unmarshal(report, app.RulesReport); err != nil {
+			return dispatch.DriverApplication{}, false, err
+		}
+	}
 	return app, true, nil
 }
 
+// SaveRulesReport stores the evaluation of an application and moves it to
+// status, normally the report's decision.
+func (p *Postgres) SaveRulesReport(ctx context.Context, driverID string, report dispatch.RulesReport, status dispatch.DriverApplicationStatus) error {
+	raw, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = p.pool.Exec(ctx, `
+UPDATE driver_applications SET status = $2, rules_report = $3, updated_at = NOW() WHERE driver_id = $1
+`, driverID, status, raw)
+	return err
+}
+
 func (p *Postgres) UpdateApplicationStatus(ctx context.Context, driverID string, status dispatch.DriverApplicationStatus) error {
 	_, err := p.pool.Exec(ctx, `
 UPDATE driver_applications SET status = $2, updated_at = NOW() WHERE driver_id = $1
@@ -203,31 +266,47 @@ UPDATE driver_applications SET status = $2, updated_at = NOW() WHERE driver_id =
 
 func (p *Postgres) UpsertDriverLicense(ctx context.Context, lic dispatch.DriverLicense) (int64, error) {
 	var id int64
+	numberIndex := p.pii.BlindIndex(piiLicenseNumber.String(), lic.Number)
+	if err := p.sealFields(ctx, map[piiColumn]*string{
+		piiLicenseNumber: &lic.Number,
+		piiLicenseDoc:    &lic.DocumentURL,
+	}); err != nil {
+		return 0, err
+	}
 	err := p.pool.QueryRow(ctx, `
-INSERT INTO driver_licenses (driver_id, license_number, country, region, expires_at, remunerated, document_url, verified_at, created_at, updated_at)
-VALUES ($1,$2,$3,$4,$5,$6,$7,$8,NOW(),NOW())
+INSERT INTO driver_licenses (driver_id, license_number, country, region, expires_at, remunerated, document_url, verified_at, license_number_bidx, issued_at, created_at, updated_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,NOW(),NOW())
 ON CONFLICT (driver_id) DO UPDATE SET
   license_number = EXCLUDED.license_number,
+  license_number_bidx = EXCLUDED.license_number_bidx,
   country = EXCLUDED.country,
   region = EXCLUDED.region,
+  issued_at = EXCLUDED.issued_at,
   expires_at = EXCLUDED.expires_at,
   remunerated = EXCLUDED.remunerated,
   document_url = EXCLUDED.document_url,
   verified_at = EXCLUDED.verified_at,
   updated_at = NOW()
 RETURNING id
-`, lic.DriverID, lic.Number, lic.Country, lic.Region, lic.ExpiresAt, lic.Remunerated, lic.DocumentURL, lic.VerifiedAt).Scan(&id)
+`, lic.DriverID, lic.Number, lic.Country, lic.Region, lic.ExpiresAt, lic.Remunerated, lic.DocumentURL, lic.VerifiedAt, numberIndex, lic.IssuedAt).Scan(&id)
 	return id, err
 }
 
 func (p *Postgres) UpsertDriverVehicle(ctx context.Context, veh dispatch.DriverVehicle) (int64, error) {
 	var id int64
+	if err := p.sealFields(ctx, map[piiColumn]*string{
+		piiVehicleDoc:      &veh.DocumentURL,
+		piiVehicleContract: &veh.ContractURL,
+	}); err != nil {
+		return 0, err
+	}
 	err := p.pool.QueryRow(ctx, `
-INSERT INTO driver_vehicles (driver_id, vehicle_type, plate_number, document_number, document_expires_at, ownership, contract_url, contract_expires_at, document_url, created_at, updated_at)
-VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,NOW(),NOW())
+INSERT INTO driver_vehicles (driver_id, vehicle_type, plate_number, document_number, document_expires_at, ownership, contract_url, contract_expires_at, document_url, model_year, created_at, updated_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,NOW(),NOW())
 ON CONFLICT (driver_id) DO UPDATE SET
   vehicle_type = EXCLUDED.vehicle_type,
   plate_number = EXCLUDED.plate_number,
+  model_year = EXCLUDED.model_year,
   document_number = EXCLUDED.document_number,
   document_expires_at = EXCLUDED.document_expires_at,
   ownership = EXCLUDED.ownership,
@@ -236,7 +315,7 @@ ON CONFLICT (driver_id) DO UPDATE SET
   document_url = EXCLUDED.document_url,
   updated_at = NOW()
 RETURNING id
-`, veh.DriverID, veh.Type, veh.PlateNumber, veh.DocumentNumber, veh.DocumentExpires, veh.Ownership, veh.ContractURL, veh.ContractExpires, veh.DocumentURL).Scan(&id)
+`, veh.DriverID, veh.Type, veh.PlateNumber, veh.DocumentNumber, veh.DocumentExpires, veh.Ownership, veh.ContractURL, veh.ContractExpires, veh.DocumentURL, nullIfZero(veh.Year)).Scan(&id)
 	return id, err
 }
 
@@ -264,16 +343,26 @@ VALUES ($1,$2,$3,NOW())
 func (p *Postgres) UpsertLiveness(ctx context.Context, liv dispatch.DriverLiveness) (int64, error) {
 	var id int64
 	seqJSON, _ := json.Marshal(liv.ChallengeSequence)
-	err := p.pool.QueryRow(ctx, `
-INSERT INTO driver_liveness_checks (driver_id, challenge_sequence, captures, verified, verified_at, created_at)
-VALUES ($1,$2,$3,$4,$5,NOW())
+	captures, err := p.seal(ctx, piiCaptures, string(liv.Captures))
+	if err != nil {
+		return 0, err
+	}
+	// New captures wait for verification again.
+	err = p.pool.QueryRow(ctx, `
+INSERT INTO driver_liveness_checks (driver_id, challenge_id, challenge_sequence, captures, verified, verified_at, created_at)
+VALUES ($1,NULLIF($2, ''),$3,$4,$5,$6,NOW())
 ON CONFLICT (driver_id) DO UPDATE SET
+  challenge_id = EXCLUDED.challenge_id,
   challenge_sequence = EXCLUDED.challenge_sequence,
   captures = EXCLUDED.captures,
   verified = EXCLUDED.verified,
-  verified_at = EXCLUDED.verified_at
+  verified_at = EXCLUDED.verified_at,
+  verification_status = 'pending',
+  verification = NULL,
+  verification_attempts = 0,
+  next_attempt_at = NOW()
 RETURNING id
-`, liv.DriverID, seqJSON, liv.Captures, liv.Verified, liv.VerifiedAt).Scan(&id)
+`, liv.DriverID, liv.ChallengeID, seqJSON, captures, liv.Verified, liv.VerifiedAt).Scan(&id)
 	return id, err
 }
 
@@ -284,16 +373,24 @@ func (p *Postgres) LoadApplicationDetails(ctx context.Context, driverID string)
 	}
 	// license
 	if err := p.pool.QueryRow(ctx, `
-SELECT id, driver_id, license_number, country, region, expires_at, remunerated, document_url, verified_at, created_at, updated_at
+SELECT id, driver_id, license_number, country, region, issued_at, expires_at, remunerated, document_url, verified_at, created_at, updated_at
 FROM driver_licenses WHERE driver_id = $1
-`, driverID).Scan(&app.License.ID, &app.License.DriverID, &app.License.Number, &app.License.Country, &app.License.Region, &app.License.ExpiresAt, &app.License.Remunerated, &app.License.DocumentURL, &app.License.VerifiedAt, &app.License.CreatedAt, &app.License.UpdatedAt); err != nil && err != pgx.ErrNoRows {
+`, driverID).Scan(&app.License.ID, &app.License.DriverID, &app.License.Number, &app.License.Country, &app.License.Region, &app.License.IssuedAt, &app.License.ExpiresAt, &app.License.Remunerated, &app.License.DocumentURL, &app.License.VerifiedAt, &app.License.CreatedAt, &app.License.UpdatedAt); err != nil && err != pgx.ErrNoRows {
 		return app, false, err
 	}
 	// vehicle
 	if err := p.pool.QueryRow(ctx, `
-SELECT id, driver_id, vehicle_type, plate_number, document_number, document_expires_at, ownership, contract_url, contract_expires_at, document_url, created_at, updated_at
+SELECT id, driver_id, vehicle_type, plate_number, COALESCE(model_year, 0), document_number, document_expires_at, ownership, contract_url, contract_expires_at, document_url, created_at, updated_at
 FROM driver_vehicles WHERE driver_id = $1
-`, driverID).Scan(&app.Vehicle.ID, &app.Vehicle.DriverID, &app.Vehicle.Type, &app.Vehicle.PlateNumber, &app.Vehicle.DocumentNumber, &app.Vehicle.DocumentExpires, &app.Vehicle.Ownership, &app.Vehicle.ContractURL, &app.Vehicle.ContractExpires, &app.Vehicle.DocumentURL, &app.Vehicle.CreatedAt, &app.Vehicle.UpdatedAt); err != nil && err != pgx.ErrNoRows {
+`, driverID).Scan(&app.Vehicle.ID, &app.Vehicle.DriverID, &app.Vehicle.Type, &app.Vehicle.PlateNumber, &app.Vehicle.Year, &app.Vehicle.DocumentNumber, &app.Vehicle.DocumentExpires, &app.Vehicle.Ownership, &app.Vehicle.ContractURL, &app.Vehicle.ContractExpires, &app.Vehicle.DocumentURL, &app.Vehicle.CreatedAt, &app.Vehicle.UpdatedAt); err != nil && err != pgx.ErrNoRows {
+		return app, false, err
+	}
+	if err := p.openFields(ctx, map[piiColumn]*string{
+		piiLicenseNumber:   &app.License.Number,
+		piiLicenseDoc:      &app.License.DocumentURL,
+		piiVehicleDoc:      &app.Vehicle.DocumentURL,
+		piiVehicleContract: &app.Vehicle.ContractURL,
+	}); err != nil {
 		return app, false, err
 	}
 	if app.Vehicle.ID > 0 {
@@ -316,16 +413,13 @@ SELECT id, vehicle_id, angle, photo_url, created_at FROM vehicle_photos WHERE ve
 		}
 	}
 	// liveness
-	var seqRaw []byte
-	if err := p.pool.QueryRow(ctx, `
-SELECT id, driver_id, challenge_sequence, captures, verified, verified_at, created_at
-FROM driver_liveness_checks WHERE driver_id = $1
-`, driverID).Scan(&app.Liveness.ID, &app.Liveness.DriverID, &seqRaw, &app.Liveness.Captures, &app.Liveness.Verified, &app.Liveness.VerifiedAt, &app.Liveness.CreatedAt); err != nil && err != pgx.ErrNoRows {
+	liv, err := p.scanLiveness(ctx, p.pool.QueryRow(ctx, `SELECT `+livenessColumns+` FROM driver_liveness_checks WHERE driver_id = $1`, driverID))
+	switch {
+	case err == nil:
+		app.Liveness = liv
+	case err != pgx.ErrNoRows:
 		return app, false, err
 	}
-	if len(seqRaw) > 0 {
-		_ = json.Unmarshal(seqRaw, &app.Liveness.ChallengeSequence)
-	}
 	return app, true, nil
 }
 
@@ -333,16 +427,24 @@ FROM driver_liveness_checks WHERE driver_id = $1
 
 func (p *Postgres) UpsertPassengerProfile(ctx context.Context, prof dispatch.PassengerProfile) (int64, error) {
 	var id int64
+	govIndex := p.pii.BlindIndex(piiGovernmentID.String(), prof.GovernmentID)
+	if err := p.sealFields(ctx, map[piiColumn]*string{
+		piiAddress:      &prof.Address,
+		piiGovernmentID: &prof.GovernmentID,
+	}); err != nil {
+		return 0, err
+	}
 	err := p.pool.QueryRow(ctx, `
-INSERT INTO passenger_profiles (passenger_id, full_name, address, government_id, created_at, updated_at)
-VALUES ($1,$2,$3,$4,NOW(),NOW())
+INSERT INTO passenger_profiles (passenger_id, full_name, address, government_id, government_id_bidx, created_at, updated_at)
+VALUES ($1,$2,$3,$4,$5,NOW(),NOW())
 ON CONFLICT (passenger_id) DO UPDATE SET
   full_name = EXCLUDED.full_name,
   address = EXCLUDED.address,
   government_id = EXCLUDED.government_id,
+  government_id_bidx = EXCLUDED.government_id_bidx,
   updated_at = NOW()
 RETURNING id
-`, prof.PassengerID, prof.FullName, prof.Address, prof.GovernmentID).Scan(&id)
+`, prof.PassengerID, prof.FullName, prof.Address, prof.GovernmentID, govIndex).Scan(&id)
 	return id, err
 }
 
@@ -359,6 +461,12 @@ WHERE passenger_id = $1
 		}
 		return dispatch.PassengerProfile{}, false, err
 	}
+	if err := p.openFields(ctx, map[piiColumn]*string{
+		piiAddress:      &prof.Address,
+		piiGovernmentID: &prof.GovernmentID,
+	}); err != nil {
+		return dispatch.PassengerProfile{}, false, err
+	}
 	return prof, true, nil
 }
 
@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"turbodriver/internal/dispatch"
+)
+
+// RecordComplianceEvent appends a step of a data subject request to the
+// compliance audit log.
+func (p *Postgres) RecordComplianceEvent(ctx context.Context, ev dispatch.ComplianceEvent) error {
+	return recordCompliance(ctx, p.pool, ev)
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func recordCompliance(ctx context.Context, db execer, ev dispatch.ComplianceEvent) error {
+	var detail []byte
+	if len(ev.Detail) > 0 {
+		var err error
+		if detail, err = json.Marshal(ev.Detail); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(ctx, `
+INSERT INTO compliance_audit (request_id, subject_id, subject_role, request, step, detail, actor_id)
+VALUES ($1,$2,$3,$4,$5,$6,$7)
+`, ev.RequestID, ev.SubjectID, ev.SubjectRole, ev.Request, ev.Step, detail, nullIfEmpty(ev.ActorID))
+	return err
+}
+
+// ExportSubject gathers what is stored about an identity: its profile or
+// driver application (decrypted) with its reviews, the files it uploaded
+// (metadata only), the rides it took part in, ratings given and received, chat
+// messages on those rides and the track points captured with safety
+// incidents. Pickup PINs are left out.
+func (p *Postgres) ExportSubject(ctx context.Context, subject dispatch.Identity) (dispatch.DataExport, error) {
+	out := dispatch.DataExport{
+		Identity:    dispatch.ExportedIdentity{ID: subject.ID, Role: subject.Role},
+		Rides:       []dispatch.Ride{},
+		Ratings:     []dispatch.Rating{},
+		Messages:    []dispatch.RideMessage{},
+		TrackPoints: []dispatch.TrackPoint{},
+		Uploads:     []dispatch.Upload{},
+	}
+	err := p.pool.QueryRow(ctx, `SELECT created_at, expires_at FROM identities WHERE id = $1`, subject.ID).
+		Scan(&out.Identity.CreatedAt, &out.Identity.ExpiresAt)
+	if err != nil && err != pgx.ErrNoRows {
+		return out, err
+	}
+	if out.Identity.Phones, err = queryStrings(ctx, p.pool, `SELECT phone FROM phone_identities WHERE identity_id = $1 ORDER BY phone`, subject.ID); err != nil {
+		return out, err
+	}
+	uploads, err := p.ListUploadsByOwner(ctx, subject.ID)
+	if err != nil {
+		return out, fmt.Errorf("uploads: %w", err)
+	}
+	out.Uploads = append(out.Uploads, uploads...)
+
+	switch subject.Role {
+	case dispatch.RolePassenger:
+		prof, ok, err := p.GetPassengerProfile(ctx, subject.ID)
+		if err != nil {
+			return out, fmt.Errorf("profile: %w", err)
+		}
+		if ok {
+			out.Profile = &prof
+		}
+	case dispatch.RoleDriver:
+		app, ok, err := p.LoadApplicationDetails(ctx, subject.ID)
+		if err != nil {
+			return out, fmt.Errorf("application: %w", err)
+		}
+		if ok {
+			out.Application = &app
+		}
+		if out.Reviews, err = p.ListApplicationReviews(ctx, subject.ID); err != nil {
+			return out, fmt.Errorf("reviews: %w", err)
+		}
+		var last dispatch.Coordinate
+		err = p.pool.QueryRow(ctx, `SELECT latitude, longitude, COALESCE(accuracy, 0), ts FROM drivers WHERE id = $1`, subject.ID).
+			Scan(&last.Latitude, &last.Longitude, &last.Accuracy, &last.At)
+		if err == nil {
+			out.TrackPoints = append(out.TrackPoints, dispatch.TrackPoint{Source: "last_known", Coordinate: last})
+		} else if err != pgx.ErrNoRows {
+			return out, err
+		}
+	}
+
+	rows, err := p.pool.Query(ctx, `
+SELECT id, passenger_id, COALESCE(driver_id, ''), status, pickup_lat, pickup_long, COALESCE(pickup_accuracy, 0), pickup_ts, created_at,
+	COALESCE(location_code, ''), dropoff_lat, dropoff_long, COALESCE(booked_by, ''), version
+FROM rides WHERE passenger_id = $1 OR driver_id = $1
+ORDER BY created_at
+`, subject.ID)
+	if err != nil {
+		return out, err
+	}
+	var rideIDs []string
+	for rows.Next() {
+		var (
+			r                 dispatch.Ride
+			dropLat, dropLong *float64
+		)
+		if err := rows.Scan(&r.ID, &r.PassengerID, &r.DriverID, &r.Status, &r.Pickup.Latitude, &r.Pickup.Longitude, &r.Pickup.Accuracy, &r.Pickup.At, &r.CreatedAt,
+			&r.LocationCode, &dropLat, &dropLong, &r.BookedBy, &r.Version); err != nil {
+			rows.Close()
+			return out, err
+		}
+		if dropLat != nil && dropLong != nil {
+			r.Dropoff = &dispatch.Coordinate{Latitude: *dropLat, Longitude: *dropLong}
+		}
+		out.Rides = append(out.Rides, r)
+		rideIDs = append(rideIDs, r.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return out, err
+	}
+
+	rows, err = p.pool.Query(ctx, `
+SELECT id, ride_id, rater_role, rater_id, ratee_id, stars, COALESCE(comment, ''), requires_attention, created_at
+FROM ride_ratings WHERE rater_id = $1 OR ratee_id = $1
+ORDER BY created_at
+`, subject.ID)
+	if err != nil {
+		return out, err
+	}
+	for rows.Next() {
+		var r dispatch.Rating
+		if err := rows.Scan(&r.ID, &r.RideID, &r.RaterRole, &r.RaterID, &r.RateeID, &r.Stars, &r.Comment, &r.RequiresAttention, &r.CreatedAt); err != nil {
+			rows.Close()
+			return out, err
+		}
+		out.Ratings = append(out.Ratings, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return out, err
+	}
+	if len(rideIDs) == 0 {
+		return out, nil
+	}
+
+	rows, err = p.pool.Query(ctx, `
+SELECT id, ride_id, sender_id, sender_role, body, COALESCE(quick_reply, ''), read_at, created_at
+FROM ride_messages WHERE ride_id = ANY($1)
+ORDER BY created_at, id
+`, rideIDs)
+	if err != nil {
+		return out, err
+	}
+	for rows.Next() {
+		var msg dispatch.RideMessage
+		if err := rows.Scan(&msg.ID, &msg.RideID, &msg.SenderID, &msg.SenderRole, &msg.Body, &msg.QuickReply, &msg.ReadAt, &msg.CreatedAt); err != nil {
+			rows.Close()
+			return out, err
+		}
+		out.Messages = append(out.Messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return out, err
+	}
+
+	rows, err = p.pool.Query(ctx, `SELECT ride_id, snapshot FROM safety_incidents WHERE ride_id = ANY($1) ORDER BY created_at`, rideIDs)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			rideID string
+			raw    []byte
+			snap   dispatch.SafetySnapshot
+		)
+		if err := rows.Scan(&rideID, &raw); err != nil {
+			return out, err
+		}
+		if err := json.Unmarshal(raw, &snap); err != nil {
+			continue
+		}
+		for _, c := range snap.Track {
+			out.TrackPoints = append(out.TrackPoints, dispatch.TrackPoint{RideID: rideID, Source: "safety_incident", Coordinate: c})
+		}
+	}
+	return out, rows.Err()
+}
+
+// EraseSubject deletes an identity's personal data and pseudonymizes what has
+// to be retained, in one transaction that also records every step in the
+// compliance audit log under requestID.
+//
+// Deleted: profile, driver application, license, vehicle, photos, liveness
+// captures and challenges (with the document references they hold), uploaded
+// files, phone logins and pending codes, driver location, request idempotency
+// keys, the identity and, through it, every token. Uploaded files are removed
+// from the blob store after the transaction commits; if that fails the
+// pseudonym is still returned with the error, as the erasure itself went
+// through. Retained with the identity replaced by a random pseudonym: rides
+// (accounting), ride events, ratings (the other party's average), safety
+// incidents (investigations), share links and the outbox.
+// Chat messages the subject sent and their rating comments are blanked.
+// Ride events already archived to blob storage are not rewritten; the step
+// archived_events_retained records how many archives hold the subject's rides.
+func (p *Postgres) EraseSubject(ctx context.Context, subject dispatch.Identity, requestID, actorID string) (string, []dispatch.ErasureStep, error) {
+	pseudonym, err := newPseudonym()
+	if err != nil {
+		return "", nil, err
+	}
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rideIDs, err := queryStrings(ctx, tx, `SELECT id FROM rides WHERE passenger_id = $1 OR driver_id = $1`, subject.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	phones, err := queryStrings(ctx, tx, `SELECT phone FROM phone_identities WHERE identity_id = $1`, subject.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	objectKeys, err := queryStrings(ctx, tx, `SELECT object_key FROM uploads WHERE owner_id = $1`, subject.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var steps []dispatch.ErasureStep
+	run := func(step string, detail map[string]any, stmts ...statement) error {
+		var rows int64
+		for _, st := range stmts {
+			tag, err := tx.Exec(ctx, st.sql, st.args...)
+			if err != nil {
+				return fmt.Errorf("%s: %w", step, err)
+			}
+			rows += tag.RowsAffected()
+		}
+		steps = append(steps, dispatch.ErasureStep{Step: step, Rows: rows})
+		if detail == nil {
+			detail = map[string]any{}
+		}
+		detail["rows"] = rows
+		return recordCompliance(ctx, tx, dispatch.ComplianceEvent{
+			RequestID: requestID, SubjectID: subject.ID, SubjectRole: subject.Role,
+			Request: dispatch.ComplianceErasure, Step: step, Detail: detail, ActorID: actorID,
+		})
+	}
+
+	id := subject.ID
+	var documents, archives int64
+	if err := tx.QueryRow(ctx, `
+SELECT
+	(SELECT COUNT(*) FROM driver_licenses WHERE driver_id = $1 AND COALESCE(document_url, '') <> '') +
+	(SELECT COUNT(*) FROM driver_vehicles WHERE driver_id = $1 AND COALESCE(document_url, '') <> '') +
+	(SELECT COUNT(*) FROM driver_vehicles WHERE driver_id = $1 AND COALESCE(contract_url, '') <> '') +
+	(SELECT COUNT(*) FROM vehicle_photos ph JOIN driver_vehicles v ON v.id = ph.vehicle_id WHERE v.driver_id = $1) +
+	(SELECT COUNT(*) FROM driver_liveness_checks WHERE driver_id = $1),
+	(SELECT COUNT(DISTINCT archive_id) FROM event_archive_rides WHERE ride_id = ANY($2))
+`, id, rideIDs).Scan(&documents, &archives); err != nil {
+		return "", nil, err
+	}
+	err = run("documents_deleted", map[string]any{"documents": documents},
+		stmt(`DELETE FROM driver_liveness_checks WHERE driver_id = $1`, id),
+		stmt(`DELETE FROM liveness_challenges WHERE driver_id = $1`, id),
+		stmt(`DELETE FROM vehicle_photos WHERE vehicle_id IN (SELECT id FROM driver_vehicles WHERE driver_id = $1)`, id),
+		stmt(`DELETE FROM driver_vehicles WHERE driver_id = $1`, id),
+		stmt(`DELETE FROM driver_licenses WHERE driver_id = $1`, id),
+	)
+	if err == nil {
+		err = run("uploads_deleted", nil, stmt(`DELETE FROM uploads WHERE owner_id = $1`, id))
+	}
+	if err == nil {
+		err = run("profile_deleted", nil,
+			stmt(`DELETE FROM passenger_profiles WHERE passenger_id = $1`, id),
+			stmt(`DELETE FROM driver_applications WHERE driver_id = $1`, id),
+		)
+	}
+	if err == nil {
+		err = run("rides_pseudonymized", map[string]any{"rides": len(rideIDs)},
+			stmt(`UPDATE rides SET passenger_id = $2, pickup_pin = NULL WHERE passenger_id = $1`, id, pseudonym),
+			stmt(`UPDATE rides SET driver_id = $2 WHERE driver_id = $1`, id, pseudonym),
+		)
+	}
+	if err == nil {
+		err = run("ride_events_pseudonymized", nil,
+			stmt(`
+UPDATE ride_events SET actor_id = CASE WHEN actor_id = $1 THEN $2 ELSE actor_id END,
+	payload = replace(payload::text, $1, $2)::jsonb
+WHERE ride_id = ANY($3) OR actor_id = $1
+`, id, pseudonym, rideIDs),
+			stmt(`
+UPDATE outbox SET ride = replace(ride::text, $1, $2)::jsonb, payload = replace(payload::text, $1, $2)::jsonb
+WHERE ride_id = ANY($3)
+`, id, pseudonym, rideIDs),
+		)
+	}
+	if err == nil {
+		err = run("messages_erased", nil,
+			stmt(`UPDATE ride_messages SET sender_id = $2, body = '' WHERE sender_id = $1`, id, pseudonym),
+		)
+	}
+	if err == nil {
+		err = run("ratings_pseudonymized", nil,
+			stmt(`UPDATE ride_ratings SET rater_id = $2, comment = '' WHERE rater_id = $1`, id, pseudonym),
+			stmt(`UPDATE ride_ratings SET ratee_id = $2 WHERE ratee_id = $1`, id, pseudonym),
+		)
+	}
+	if err == nil {
+		err = run("safety_incidents_pseudonymized", nil,
+			stmt(`
+UPDATE safety_incidents SET reporter_id = CASE WHEN reporter_id = $1 THEN $2 ELSE reporter_id END,
+	snapshot = replace(snapshot::text, $1, $2)::jsonb, updated_at = NOW()
+WHERE ride_id = ANY($3) OR reporter_id = $1
+`, id, pseudonym, rideIDs),
+			stmt(`UPDATE ride_shares SET created_by = $2 WHERE created_by = $1`, id, pseudonym),
+		)
+	}
+	if err == nil {
+		err = run("archived_events_retained", map[string]any{"archives": archives})
+	}
+	if err == nil {
+		err = run("logins_deleted", nil,
+			stmt(`DELETE FROM otp_challenges WHERE phone = ANY($1) AND role = $2`, phones, subject.Role),
+			stmt(`DELETE FROM idempotency_keys WHERE starts_with(key, $1)`, "http:"+string(subject.Role)+":"+id+":"),
+			stmt(`DELETE FROM drivers WHERE id = $1`, id),
+		)
+	}
+	if err == nil {
+		// Tokens, refresh tokens and phone links cascade.
+		err = run("identity_deleted", nil, stmt(`DELETE FROM identities WHERE id = $1`, id))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", nil, err
+	}
+
+	if len(objectKeys) > 0 && p.uploads != nil {
+		var deleted, failed int64
+		for _, key := range objectKeys {
+			if err := p.uploads.Delete(ctx, key); err != nil {
+				failed++
+				continue
+			}
+			deleted++
+		}
+		steps = append(steps, dispatch.ErasureStep{Step: "upload_objects_deleted", Rows: deleted})
+		err := recordCompliance(ctx, p.pool, dispatch.ComplianceEvent{
+			RequestID: requestID, SubjectID: subject.ID, SubjectRole: subject.Role,
+			Request: dispatch.ComplianceErasure, Step: "upload_objects_deleted", ActorID: actorID,
+			Detail: map[string]any{"rows": deleted, "failed": failed},
+		})
+		if err == nil && failed > 0 {
+			err = fmt.Errorf("%d uploaded files could not be deleted", failed)
+		}
+		return pseudonym, steps, err
+	}
+	return pseudonym, steps, nil
+}
+
+type statement struct {
+	sql  string
+	args []any
+}
+
+func stmt(sql string, args ...any) statement {
+	return statement{sql: sql, args: args}
+}
+
+func newPseudonym() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "erased_" + hex.EncodeToString(b), nil
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func queryStrings(ctx context.Context, db querier, sql string, args ...any) ([]string, error) {
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/auth"
+)
+
+func (s *IdentityStore) SaveRefreshToken(ctx context.Context, rec auth.RefreshRecord) error {
+	_, err := s.pool.Exec(ctx, `
+INSERT INTO refresh_tokens (selector, family_id, identity_id, role, salt, hash, expires_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7)
+`, rec.Selector, rec.FamilyID, rec.IdentityID, rec.Role, rec.Salt, rec.Hash, rec.ExpiresAt)
+	return err
+}
+
+func (s *IdentityStore) GetRefreshToken(ctx context.Context, selector string) (auth.RefreshRecord, bool, error) {
+	var rec auth.RefreshRecord
+	err := s.pool.QueryRow(ctx, `
+SELECT selector, family_id, identity_id, role, salt, hash, expires_at, used_at, revoked_at
+FROM refresh_tokens WHERE selector = $1
+`, selector).Scan(&rec.Selector, &rec.FamilyID, &rec.IdentityID, &rec.Role, &rec.Salt, &rec.Hash, &rec.ExpiresAt, &rec.UsedAt, &rec.RevokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return auth.RefreshRecord{}, false, nil
+		}
+		return auth.RefreshRecord{}, false, err
+	}
+	return rec, true, nil
+}
+
+// ClaimRefreshToken marks the token used exactly once; concurrent claims lose.
+func (s *IdentityStore) ClaimRefreshToken(ctx context.Context, selector string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `
+UPDATE refresh_tokens SET used_at = NOW()
+WHERE selector = $1 AND used_at IS NULL AND revoked_at IS NULL
+`, selector)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *IdentityStore) RevokeRefreshFamily(ctx context.Context, familyID string) error {
+	_, err := s.pool.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, familyID)
+	return err
+}
+
+func (s *IdentityStore) RevokeRefreshForIdentity(ctx context.Context, identityID string) error {
+	_, err := s.pool.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE identity_id = $1 AND revoked_at IS NULL`, identityID)
+	return err
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+
+	"turbodriver/internal/dispatch"
+)
+
+// EachRideLog streams ride_events grouped by ride, oldest event first, calling
+// fn once per ride. An empty rideID streams every ride.
+func (p *Postgres) EachRideLog(ctx context.Context, rideID string, fn func(rideID string, events []dispatch.RideEvent) error) error {
+	rows, err := p.pool.Query(ctx, `
+SELECT ride_id, event_type, payload, COALESCE(actor_id, ''), COALESCE(actor_role, ''), created_at
+FROM ride_events
+WHERE $1 = '' OR ride_id = $1
+ORDER BY ride_id, id
+`, rideID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var (
+		current string
+		events  []dispatch.RideEvent
+	)
+	for rows.Next() {
+		var evt dispatch.RideEvent
+		if err := rows.Scan(&evt.RideID, &evt.Type, &evt.Payload, &evt.ActorID, &evt.ActorRole, &evt.CreatedAt); err != nil {
+			return err
+		}
+		if evt.RideID != current && len(events) > 0 {
+			if err := fn(current, events); err != nil {
+				return err
+			}
+			events = nil
+		}
+		current = evt.RideID
+		events = append(events, evt)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(events) > 0 {
+		return fn(current, events)
+	}
+	return nil
+}
+
+// RestoreRide overwrites every column of a ride, inserting it if missing. It is
+// for repairs; live transitions go through UpdateRideWithEvent.
+func (p *Postgres) RestoreRide(ctx context.Context, r dispatch.Ride) error {
+	_, err := p.pool.Exec(ctx, `
+INSERT INTO rides (id, passenger_id, driver_id, status, pickup_lat, pickup_long, pickup_accuracy, pickup_ts, created_at, location_code, pickup_pin, dropoff_lat, dropoff_long, booked_by, version)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
+ON CONFLICT (id) DO UPDATE SET
+	passenger_id = EXCLUDED.passenger_id,
+	driver_id = EXCLUDED.driver_id,
+	status = EXCLUDED.status,
+	pickup_lat = EXCLUDED.pickup_lat,
+	pickup_long = EXCLUDED.pickup_long,
+	pickup_accuracy = EXCLUDED.pickup_accuracy,
+	pickup_ts = EXCLUDED.pickup_ts,
+	created_at = EXCLUDED.created_at,
+	location_code = EXCLUDED.location_code,
+	pickup_pin = EXCLUDED.pickup_pin,
+	dropoff_lat = EXCLUDED.dropoff_lat,
+	dropoff_long = EXCLUDED.dropoff_long,
+	booked_by = EXCLUDED.booked_by,
+	version = EXCLUDED.version
+`, r.ID, r.PassengerID, r.DriverID, r.Status, r.Pickup.Latitude, r.Pickup.Longitude, r.Pickup.Accuracy, r.Pickup.At, r.CreatedAt, r.LocationCode, r.PickupPIN, dropoffLat(r), dropoffLong(r), nullIfEmpty(r.BookedBy), r.Version)
+	return err
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+// RecordApplicationReview stores a reviewer decision and moves the driver's
+// application to it. It reports false if the driver has no application.
+func (p *Postgres) RecordApplicationReview(ctx context.Context, review dispatch.ApplicationReview) (dispatch.ApplicationReview, bool, error) {
+	findings, err := json.Marshal(review.Findings)
+	if err != nil {
+		return review, false, err
+	}
+	sections, err := json.Marshal(review.Sections)
+	if err != nil {
+		return review, false, err
+	}
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return review, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
+UPDATE driver_applications SET status = $2, updated_at = NOW() WHERE driver_id = $1
+RETURNING id
+`, review.DriverID, review.Decision).Scan(&review.ApplicationID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return review, false, nil
+		}
+		return review, false, err
+	}
+	err = tx.QueryRow(ctx, `
+INSERT INTO application_reviews (application_id, driver_id, reviewer_id, decision, reason, findings, sections, created_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,NOW())
+RETURNING id, created_at
+`, review.ApplicationID, review.DriverID, review.ReviewerID, review.Decision, review.Reason, findings, sections).Scan(&review.ID, &review.CreatedAt)
+	if err != nil {
+		return review, false, err
+	}
+	return review, true, tx.Commit(ctx)
+}
+
+// ListApplicationReviews returns the reviews of a driver's application, oldest first.
+func (p *Postgres) ListApplicationReviews(ctx context.Context, driverID string) ([]dispatch.ApplicationReview, error) {
+	rows, err := p.pool.Query(ctx, `
+SELECT id, application_id, driver_id, reviewer_id, decision, reason, findings, sections, created_at
+FROM application_reviews WHERE driver_id = $1
+ORDER BY created_at, id
+`, driverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.ApplicationReview
+	for rows.Next() {
+		var (
+			rv                 dispatch.ApplicationReview
+			findings, sections []byte
+		)
+		if err := rows.Scan(&rv.ID, &rv.ApplicationID, &rv.DriverID, &rv.ReviewerID, &rv.Decision, &rv.Reason, &findings, &sections, &rv.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(findings, &rv.Findings); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(sections, &rv.Sections); err != nil {
+			return nil, err
+		}
+		out = append(out, rv)
+	}
+	return out, rows.Err()
+}
+
+// ListApplicationQueue returns applications in the given statuses that have
+// waited at least minAge since their last change, oldest first, with the total.
+func (p *Postgres) ListApplicationQueue(ctx context.Context, statuses []dispatch.DriverApplicationStatus, minAge time.Duration, limit, offset int) ([]dispatch.ApplicationQueueItem, int, error) {
+	names := make([]string, len(statuses))
+	for i, s := range statuses {
+		names[i] = string(s)
+	}
+	cutoff := time.Now().Add(-minAge)
+	var total int
+	if err := p.pool.QueryRow(ctx, `
+SELECT COUNT(*) FROM driver_applications WHERE status = ANY($1) AND updated_at <= $2
+`, names, cutoff).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := p.pool.Query(ctx, `
+SELECT a.id, a.driver_id, a.location_code, a.status, COALESCE(a.rules_report->>'decision', ''),
+       (SELECT COUNT(*) FROM application_reviews r WHERE r.application_id = a.id),
+       a.created_at, a.updated_at, EXTRACT(EPOCH FROM NOW() - a.updated_at)::BIGINT
+FROM driver_applications a
+WHERE a.status = ANY($1) AND a.updated_at <= $2
+ORDER BY a.updated_at, a.id
+LIMIT $3 OFFSET $4
+`, names, cutoff, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []dispatch.ApplicationQueueItem{}
+	for rows.Next() {
+		var item dispatch.ApplicationQueueItem
+		if err := rows.Scan(&item.ApplicationID, &item.DriverID, &item.LocationCode, &item.Status, &item.RulesDecision,
+			&item.Reviews, &item.SubmittedAt, &item.UpdatedAt, &item.WaitingSeconds); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, item)
+	}
+	return out, total, rows.Err()
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+var (
+	// ErrRulesInForce is returned when changing a rules version drivers may
+	// already have accepted.
+	ErrRulesInForce = errors.New("rules version already in force")
+	// ErrRulesOrder is returned when a version would take effect before an
+	// earlier version or after a later one.
+	ErrRulesOrder = errors.New("rules versions must take effect in version order")
+	// ErrRulesNotLatest is returned when deleting a version that is not the latest.
+	ErrRulesNotLatest = errors.New("only the latest rules version can be deleted")
+)
+
+const locationRuleColumns = `id, location_code, version, name, rules, effective_at, COALESCE(created_by, ''), created_at`
+
+func scanLocationRule(row pgx.Row) (dispatch.LocationRule, error) {
+	var rule dispatch.LocationRule
+	err := row.Scan(&rule.ID, &rule.LocationCode, &rule.Version, &rule.Name, &rule.Rules, &rule.EffectiveAt, &rule.CreatedBy, &rule.CreatedAt)
+	return rule, err
+}
+
+// CreateLocationRule adds the next version of a location's rules. It must not
+// take effect before the latest existing version.
+func (p *Postgres) CreateLocationRule(ctx context.Context, rule dispatch.LocationRule) (dispatch.LocationRule, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return dispatch.LocationRule{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialise version numbering per location.
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('location_rules:' || $1))`, rule.LocationCode); err != nil {
+		return dispatch.LocationRule{}, err
+	}
+	var outOfOrder bool
+	if err := tx.QueryRow(ctx, `
+SELECT EXISTS (SELECT 1 FROM location_rules WHERE location_code = $1 AND effective_at > $2)
+`, rule.LocationCode, rule.EffectiveAt).Scan(&outOfOrder); err != nil {
+		return dispatch.LocationRule{}, err
+	}
+	if outOfOrder {
+		return dispatch.LocationRule{}, ErrRulesOrder
+	}
+	saved, err := scanLocationRule(tx.QueryRow(ctx, `
+INSERT INTO location_rules (location_code, version, name, rules, effective_at, created_by, created_at)
+SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, NULLIF($5, ''), NOW()
+FROM location_rules WHERE location_code = $1
+RETURNING `+locationRuleColumns,
+		rule.LocationCode, rule.Name, rule.Rules, rule.EffectiveAt, rule.CreatedBy))
+	if err != nil {
+		return dispatch.LocationRule{}, err
+	}
+	return saved, tx.Commit(ctx)
+}
+
+func (p *Postgres) GetLocationRule(ctx context.Context, id int64) (dispatch.LocationRule, bool, error) {
+	rule, err := scanLocationRule(p.pool.QueryRow(ctx, `SELECT `+locationRuleColumns+` FROM location_rules WHERE id = $1`, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.LocationRule{}, false, nil
+		}
+		return dispatch.LocationRule{}, false, err
+	}
+	return rule, true, nil
+}
+
+// ListLocationRules returns every version for a location, newest first.
+func (p *Postgres) ListLocationRules(ctx context.Context, locationCode string) ([]dispatch.LocationRule, error) {
+	rows, err := p.pool.Query(ctx, `
+SELECT `+locationRuleColumns+`
+FROM location_rules WHERE location_code = $1
+ORDER BY version DESC
+`, locationCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.LocationRule
+	for rows.Next() {
+		rule, err := scanLocationRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, rows.Err()
+}
+
+// CurrentLocationRule returns the version in force for a location, if any.
+func (p *Postgres) CurrentLocationRule(ctx context.Context, locationCode string) (dispatch.LocationRule, bool, error) {
+	rule, err := scanLocationRule(p.pool.QueryRow(ctx, `
+SELECT `+locationRuleColumns+`
+FROM location_rules WHERE location_code = $1 AND effective_at <= NOW()
+ORDER BY effective_at DESC, version DESC
+LIMIT 1
+`, locationCode))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.LocationRule{}, false, nil
+		}
+		return dispatch.LocationRule{}, false, err
+	}
+	return rule, true, nil
+}
+
+// UpdateLocationRule changes the name, rules and effective date of a version
+// that has not taken effect yet.
+func (p *Postgres) UpdateLocationRule(ctx context.Context, rule dispatch.LocationRule) (dispatch.LocationRule, bool, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return dispatch.LocationRule{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := scanLocationRule(tx.QueryRow(ctx, `SELECT `+locationRuleColumns+` FROM location_rules WHERE id = $1 FOR UPDATE`, rule.ID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.LocationRule{}, false, nil
+		}
+		return dispatch.LocationRule{}, false, err
+	}
+	var inForce, outOfOrder bool
+	if err := tx.QueryRow(ctx, `
+SELECT $2::timestamptz <= NOW(),
+       EXISTS (SELECT 1 FROM location_rules WHERE location_code = $1
+               AND ((version < $3 AND effective_at > $4) OR (version > $3 AND effective_at < $4)))
+`, current.LocationCode, current.EffectiveAt, current.Version, rule.EffectiveAt).Scan(&inForce, &outOfOrder); err != nil {
+		return dispatch.LocationRule{}, false, err
+	}
+	if inForce {
+		return current, true, ErrRulesInForce
+	}
+	if outOfOrder {
+		return current, true, ErrRulesOrder
+	}
+	saved, err := scanLocationRule(tx.QueryRow(ctx, `
+UPDATE location_rules SET name = $2, rules = $3, effective_at = $4
+WHERE id = $1
+RETURNING `+locationRuleColumns,
+		rule.ID, rule.Name, rule.Rules, rule.EffectiveAt))
+	if err != nil {
+		return dispatch.LocationRule{}, false, err
+	}
+	return saved, true, tx.Commit(ctx)
+}
+
+// DeleteLocationRule removes the latest version of a location's rules if it
+// has not taken effect yet.
+func (p *Postgres) DeleteLocationRule(ctx context.Context, id int64) (bool, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var inForce, latest bool
+	err = tx.QueryRow(ctx, `
+SELECT r.effective_at <= NOW(),
+       NOT EXISTS (SELECT 1 FROM location_rules l WHERE l.location_code = r.location_code AND l.version > r.version)
+FROM location_rules r WHERE r.id = $1
+FOR UPDATE
+`, id).Scan(&inForce, &latest)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	switch {
+	case inForce:
+		return true, ErrRulesInForce
+	case !latest:
+		return true, ErrRulesNotLatest
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM location_rules WHERE id = $1`, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// RulesAcceptance reports which rules version the driver accepted and which
+// is in force for their application's location.
+func (p *Postgres) RulesAcceptance(ctx context.Context, driverID string) (dispatch.RulesAcceptance, bool, error) {
+	var acc dispatch.RulesAcceptance
+	err := p.pool.QueryRow(ctx, `
+SELECT a.location_code, a.rules_version_id, a.rules_accepted_at, cur.id
+FROM driver_applications a
+LEFT JOIN LATERAL (
+  SELECT r.id FROM location_rules r
+  WHERE r.location_code = a.location_code AND r.effective_at <= NOW()
+  ORDER BY r.effective_at DESC, r.version DESC
+  LIMIT 1
+) cur ON TRUE
+WHERE a.driver_id = $1
+`, driverID).Scan(&acc.LocationCode, &acc.AcceptedVersion, &acc.AcceptedAt, &acc.CurrentVersion)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.RulesAcceptance{}, false, nil
+		}
+		return dispatch.RulesAcceptance{}, false, err
+	}
+	return acc, true, nil
+}
+
+// AcceptLocationRules records that the driver accepted a rules version of
+// their application's location. It reports false if the driver has no
+// application there.
+func (p *Postgres) AcceptLocationRules(ctx context.Context, driverID string, ruleID int64) (bool, error) {
+	tag, err := p.pool.Exec(ctx, `
+UPDATE driver_applications a SET rules_version_id = r.id, rules_accepted_at = NOW(), updated_at = NOW()
+FROM location_rules r
+WHERE a.driver_id = $1 AND r.id = $2 AND r.location_code = a.location_code
+`, driverID, ruleID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+const safetyIncidentColumns = `id, ride_id, kind, reporter_id, reporter_role, status, note, snapshot,
+acknowledged_by, acknowledged_at, escalated_by, escalated_at, resolved_by, resolved_at, resolution, created_at, updated_at`
+
+func (p *Postgres) CreateSafetyIncident(ctx context.Context, inc dispatch.SafetyIncident) (dispatch.SafetyIncident, error) {
+	snapshot, err := json.Marshal(inc.Snapshot)
+	if err != nil {
+		return dispatch.SafetyIncident{}, err
+	}
+	if inc.Status == "" {
+		inc.Status = dispatch.IncidentOpen
+	}
+	err = p.pool.QueryRow(ctx, `
+INSERT INTO safety_incidents (ride_id, kind, reporter_id, reporter_role, status, note, snapshot, created_at, updated_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,NOW(),NOW())
+RETURNING id, created_at, updated_at
+`, inc.RideID, inc.Kind, inc.ReporterID, inc.ReporterRole, inc.Status, inc.Note, snapshot).Scan(&inc.ID, &inc.CreatedAt, &inc.UpdatedAt)
+	return inc, err
+}
+
+func (p *Postgres) GetSafetyIncident(ctx context.Context, id int64) (dispatch.SafetyIncident, bool, error) {
+	row := p.pool.QueryRow(ctx, `SELECT `+safetyIncidentColumns+` FROM safety_incidents WHERE id = $1`, id)
+	inc, err := scanSafetyIncident(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.SafetyIncident{}, false, nil
+		}
+		return dispatch.SafetyIncident{}, false, err
+	}
+	return inc, true, nil
+}
+
+// ListSafetyIncidents returns incidents newest first; an empty status lists all.
+func (p *Postgres) ListSafetyIncidents(ctx context.Context, status dispatch.SafetyIncidentStatus, limit, offset int) ([]dispatch.SafetyIncident, error) {
+	rows, err := p.pool.Query(ctx, `
+SELECT `+safetyIncidentColumns+`
+FROM safety_incidents
+WHERE ($1::text = '' OR status = $1::text)
+ORDER BY created_at DESC
+LIMIT $2 OFFSET $3
+`, string(status), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.SafetyIncident
+	for rows.Next() {
+		inc, err := scanSafetyIncident(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, inc)
+	}
+	return out, rows.Err()
+}
+
+func (p *Postgres) CountSafetyIncidents(ctx context.Context, status dispatch.SafetyIncidentStatus) (int, error) {
+	var count int
+	if err := p.pool.QueryRow(ctx, `SELECT COUNT(*) FROM safety_incidents WHERE ($1::text = '' OR status = $1::text)`, string(status)).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// TransitionSafetyIncident moves an incident from one status to the next, stamping
+// the actor for that step. Returns false when the incident is no longer in from.
+func (p *Postgres) TransitionSafetyIncident(ctx context.Context, id int64, from, to dispatch.SafetyIncidentStatus, actorID, note string) (dispatch.SafetyIncident, bool, error) {
+	row := p.pool.QueryRow(ctx, `
+UPDATE safety_incidents SET
+  status = $3::text,
+  acknowledged_by = CASE WHEN $3::text = 'acknowledged' THEN $4::text ELSE acknowledged_by END,
+  acknowledged_at = CASE WHEN $3::text = 'acknowledged' THEN NOW() ELSE acknowledged_at END,
+  escalated_by = CASE WHEN $3::text = 'escalated' THEN $4::text ELSE escalated_by END,
+  escalated_at = CASE WHEN $3::text = 'escalated' THEN NOW() ELSE escalated_at END,
+  resolved_by = CASE WHEN $3::text = 'resolved' THEN $4::text ELSE resolved_by END,
+  resolved_at = CASE WHEN $3::text = 'resolved' THEN NOW() ELSE resolved_at END,
+  resolution = CASE WHEN $3::text = 'resolved' THEN $5::text ELSE resolution END,
+  updated_at = NOW()
+WHERE id = $1 AND status = $2
+RETURNING `+safetyIncidentColumns, id, string(from), string(to), actorID, note)
+	inc, err := scanSafetyIncident(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.SafetyIncident{}, false, nil
+		}
+		return dispatch.SafetyIncident{}, false, err
+	}
+	return inc, true, nil
+}
+
+func scanSafetyIncident(row pgx.Row) (dispatch.SafetyIncident, error) {
+	var (
+		inc                             dispatch.SafetyIncident
+		reporterID, reporterRole, note  *string
+		ackBy, escBy, resBy, resolution *string
+		snapshot                        []byte
+	)
+	if err := row.Scan(&inc.ID, &inc.RideID, &inc.Kind, &reporterID, &reporterRole, &inc.Status, &note, &snapshot,
+		&ackBy, &inc.AcknowledgedAt, &escBy, &inc.EscalatedAt, &resBy, &inc.ResolvedAt, &resolution, &inc.CreatedAt, &inc.UpdatedAt); err != nil {
+		return dispatch.SafetyIncident{}, err
+	}
+	inc.ReporterID = derefString(reporterID)
+	inc.ReporterRole = dispatch.IdentityRole(derefString(reporterRole))
+	inc.Note = derefString(note)
+	inc.AcknowledgedBy = derefString(ackBy)
+	inc.EscalatedBy = derefString(escBy)
+	inc.ResolvedBy = derefString(resBy)
+	inc.Resolution = derefString(resolution)
+	if len(snapshot) > 0 {
+		_ = json.Unmarshal(snapshot, &inc.Snapshot)
+	}
+	return inc, nil
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+func (p *Postgres) CreateRideShare(ctx context.Context, share dispatch.RideShare) (dispatch.RideShare, error) {
+	err := p.pool.QueryRow(ctx, `
+INSERT INTO ride_shares (ride_id, created_by, token_hash, expires_at, created_at)
+VALUES ($1,$2,$3,$4,NOW())
+RETURNING id, created_at
+`, share.RideID, share.CreatedBy, share.TokenHash, share.ExpiresAt).Scan(&share.ID, &share.CreatedAt)
+	return share, err
+}
+
+func (p *Postgres) LookupRideShare(ctx context.Context, tokenHash string) (dispatch.RideShare, bool, error) {
+	var share dispatch.RideShare
+	err := p.pool.QueryRow(ctx, `
+SELECT id, ride_id, created_by, token_hash, expires_at, revoked_at, created_at
+FROM ride_shares WHERE token_hash = $1
+`, tokenHash).Scan(&share.ID, &share.RideID, &share.CreatedBy, &share.TokenHash, &share.ExpiresAt, &share.RevokedAt, &share.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.RideShare{}, false, nil
+		}
+		return dispatch.RideShare{}, false, err
+	}
+	return share, true, nil
+}
+
+func (p *Postgres) ListRideShares(ctx context.Context, rideID string) ([]dispatch.RideShare, error) {
+	rows, err := p.pool.Query(ctx, `
+SELECT id, ride_id, created_by, token_hash, expires_at, revoked_at, created_at
+FROM ride_shares WHERE ride_id = $1
+ORDER BY created_at DESC
+`, rideID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.RideShare
+	for rows.Next() {
+		var share dispatch.RideShare
+		if err := rows.Scan(&share.ID, &share.RideID, &share.CreatedBy, &share.TokenHash, &share.ExpiresAt, &share.RevokedAt, &share.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, share)
+	}
+	return out, rows.Err()
+}
+
+// RevokeRideShare marks a share revoked; returns false when it was not found or already revoked.
+func (p *Postgres) RevokeRideShare(ctx context.Context, rideID string, shareID int64) (bool, error) {
+	tag, err := p.pool.Exec(ctx, `
+UPDATE ride_shares SET revoked_at = NOW()
+WHERE id = $1 AND ride_id = $2 AND revoked_at IS NULL
+`, shareID, rideID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
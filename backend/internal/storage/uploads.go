@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"turbodriver/internal/dispatch"
+)
+
+var ErrUploadsUnavailable = errors.New("no upload store attached")
+
+// AttachUploads keeps uploaded files in blobs.
+func (p *Postgres) AttachUploads(blobs BlobStore) {
+	p.uploads = blobs
+}
+
+// UploadObjectKey is where an upload's content is kept in the blob store.
+func UploadObjectKey(ownerID, uploadID string) string {
+	return "uploads/" + ownerID + "/" + uploadID
+}
+
+func (p *Postgres) InsertUpload(ctx context.Context, up dispatch.Upload) error {
+	_, err := p.pool.Exec(ctx, `
+INSERT INTO uploads (id, owner_id, purpose, status, object_key, content_type, size_bytes, sha256, width, height, created_at, expires_at, completed_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+`, up.ID, up.OwnerID, up.Purpose, up.Status, up.ObjectKey, up.ContentType, up.Size, up.SHA256,
+		nullIfZero(up.Width), nullIfZero(up.Height), up.CreatedAt, up.ExpiresAt, up.CompletedAt)
+	return err
+}
+
+func (p *Postgres) GetUpload(ctx context.Context, id string) (dispatch.Upload, bool, error) {
+	var (
+		up            dispatch.Upload
+		width, height *int
+	)
+	err := p.pool.QueryRow(ctx, `
+SELECT id, owner_id, purpose, status, object_key, content_type, size_bytes, sha256, width, height, created_at, expires_at, completed_at
+FROM uploads WHERE id = $1
+`, id).Scan(&up.ID, &up.OwnerID, &up.Purpose, &up.Status, &up.ObjectKey, &up.ContentType, &up.Size, &up.SHA256,
+		&width, &height, &up.CreatedAt, &up.ExpiresAt, &up.CompletedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return dispatch.Upload{}, false, nil
+		}
+		return dispatch.Upload{}, false, err
+	}
+	if width != nil {
+		up.Width = *width
+	}
+	if height != nil {
+		up.Height = *height
+	}
+	return up, true, nil
+}
+
+// CompleteUpload marks a pending upload ready with its measured content
+// type, size and dimensions. It reports false if the upload was not pending.
+func (p *Postgres) CompleteUpload(ctx context.Context, up dispatch.Upload) (bool, error) {
+	tag, err := p.pool.Exec(ctx, `
+UPDATE uploads SET status = $2, content_type = $3, size_bytes = $4, width = $5, height = $6, completed_at = NOW(), expires_at = NULL
+WHERE id = $1 AND status = $7
+`, up.ID, dispatch.UploadReady, up.ContentType, up.Size, nullIfZero(up.Width), nullIfZero(up.Height), dispatch.UploadPending)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteUpload removes the upload's content and then its row.
+func (p *Postgres) DeleteUpload(ctx context.Context, up dispatch.Upload) error {
+	if p.uploads != nil {
+		if err := p.uploads.Delete(ctx, up.ObjectKey); err != nil {
+			return err
+		}
+	}
+	_, err := p.pool.Exec(ctx, `DELETE FROM uploads WHERE id = $1`, up.ID)
+	return err
+}
+
+func (p *Postgres) PutUploadObject(ctx context.Context, up dispatch.Upload, body io.Reader) error {
+	if p.uploads == nil {
+		return ErrUploadsUnavailable
+	}
+	return p.uploads.Put(ctx, up.ObjectKey, up.ContentType, body, up.Size)
+}
+
+func (p *Postgres) OpenUploadObject(ctx context.Context, up dispatch.Upload) (io.ReadCloser, error) {
+	if p.uploads == nil {
+		return nil, ErrUploadsUnavailable
+	}
+	return p.uploads.Get(ctx, up.ObjectKey)
+}
+
+// PresignUpload returns a URL the client can PUT the content to directly, or
+// false when the blob store does not support pre-signed uploads.
+func (p *Postgres) PresignUpload(ctx context.Context, up dispatch.Upload, ttl time.Duration) (string, bool, error) {
+	presigner, ok := p.uploads.(BlobPresigner)
+	if !ok {
+		return "", false, nil
+	}
+	url, err := presigner.PresignPut(up.ObjectKey, up.ContentType, ttl)
+	return url, err == nil, err
+}
+
+// ListUploadsByOwner returns the owner's uploads, oldest first.
+func (p *Postgres) ListUploadsByOwner(ctx context.Context, ownerID string) ([]dispatch.Upload, error) {
+	rows, err := p.pool.Query(ctx, `
+SELECT id, owner_id, purpose, status, object_key, content_type, size_bytes, sha256, COALESCE(width, 0), COALESCE(height, 0), created_at, expires_at, completed_at
+FROM uploads WHERE owner_id = $1
+ORDER BY created_at
+`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []dispatch.Upload
+	for rows.Next() {
+		var up dispatch.Upload
+		if err := rows.Scan(&up.ID, &up.OwnerID, &up.Purpose, &up.Status, &up.ObjectKey, &up.ContentType, &up.Size, &up.SHA256,
+			&up.Width, &up.Height, &up.CreatedAt, &up.ExpiresAt, &up.CompletedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, up)
+	}
+	return out, rows.Err()
+}
+
+func nullIfZero(n int) *int {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
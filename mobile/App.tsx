@@ -75,6 +75,7 @@ export default function App() {
   const [livenessDown, setLivenessDown] = useState('');
   const [livenessLeft, setLivenessLeft] = useState('');
   const [livenessRight, setLivenessRight] = useState('');
+  const [livenessChallenge, setLivenessChallenge] = useState<{id: string; sequence: string[]} | null>(null);
   const [applicationStatus, setApplicationStatus] = useState('unknown');
 
   const logLine = (msg: string) =>
@@ -158,6 +159,26 @@ export default function App() {
     socket.onclose = () => logLine('ws closed');
   };
 
+  // The server picks the head-turn order; capture in that order after starting.
+  const startLivenessChallenge = async () => {
+    if (!driverToken || !driverID) {
+      logLine('driver token required');
+      return;
+    }
+    try {
+      const res = await fetch(`${apiBase}/api/drivers/${driverID}/liveness/challenge`, {
+        method: 'POST',
+        headers: apiHeaders(driverToken),
+      });
+      const json = await res.json();
+      if (!res.ok) throw new Error(json.error || `status ${res.status}`);
+      setLivenessChallenge({id: json.id, sequence: json.sequence});
+      logLine(`liveness challenge: ${json.sequence.join(', ')}`);
+    } catch (err: any) {
+      logLine(`liveness challenge failed: ${err.message}`);
+    }
+  };
+
   const submitApplication = async () => {
     if (!driverToken) {
       logLine('driver token required');
@@ -167,34 +188,50 @@ export default function App() {
       logLine('location and license required');
       return;
     }
-    const challengeSequence = shuffle(['up', 'down', 'left', 'right']);
+    if (!livenessChallenge) {
+      logLine('start the liveness challenge first');
+      return;
+    }
     const photos = [
-      {angle: 'front', photoUrl: frontUrl},
-      {angle: 'back', photoUrl: backUrl},
-      {angle: 'left', photoUrl: leftUrl},
-      {angle: 'right', photoUrl: rightUrl},
+      {angle: 'front', uploadId: frontUrl},
+      {angle: 'back', uploadId: backUrl},
+      {angle: 'left', uploadId: leftUrl},
+      {angle: 'right', uploadId: rightUrl},
     ];
+    // Submitting accepts the rules in force for the location, if it has any.
+    let rulesVersionId: number | undefined;
+    try {
+      const rulesRes = await fetch(`${apiBase}/api/locations/${encodeURIComponent(locationCode)}/rules`);
+      if (rulesRes.ok) {
+        const rules = await rulesRes.json();
+        rulesVersionId = rules.id;
+        logLine(`accepting ${rules.name} (v${rules.version})`);
+      }
+    } catch (e: any) {
+      logLine(`rules lookup failed: ${e.message}`);
+    }
     const body = {
       locationCode,
+      rulesVersionId,
       license: {
         number: licenseNumber,
         country: licenseCountry,
         region: licenseRegion,
         expiresAt: licenseExpires,
         remunerated,
-        documentUrl: licenseDocUrl,
+        documentUploadId: licenseDocUrl,
       },
       vehicle: {
         type: vehicleType,
         plateNumber,
-        documentUrl: vehicleDocUrl,
+        documentUploadId: vehicleDocUrl,
         documentExpiresAt: vehicleDocExpires,
         ownership: vehicleOwnership,
-        contractUrl,
+        contractUploadId: contractUrl,
       },
       photos,
       liveness: {
-        challengeSequence,
+        challengeId: livenessChallenge.id,
         captures: {
           up: livenessUp,
           down: livenessDown,
@@ -212,6 +249,7 @@ export default function App() {
       const json = await res.json();
       if (!res.ok) throw new Error(json.error || `status ${res.status}`);
       setApplicationStatus(json.status || 'pending');
+      setLivenessChallenge(null);
       logLine('application submitted');
     } catch (err: any) {
       logLine(`application failed: ${err.message}`);
@@ -439,7 +477,7 @@ export default function App() {
           styles={styles}
         />
         <LabelInput
-          label="License Document URL"
+          label="License Document Upload ID"
           value={licenseDocUrl}
           onChangeText={setLicenseDocUrl}
           styles={styles}
@@ -471,7 +509,7 @@ export default function App() {
           styles={styles}
         />
         <LabelInput
-          label="Vehicle Document URL"
+          label="Vehicle Document Upload ID"
           value={vehicleDocUrl}
           onChangeText={setVehicleDocUrl}
           styles={styles}
@@ -483,17 +521,23 @@ export default function App() {
           styles={styles}
         />
         <LabelInput
-          label="Contract URL (if renting/lent)"
+          label="Contract Upload ID (if renting/lent)"
           value={contractUrl}
           onChangeText={setContractUrl}
           styles={styles}
         />
-        <Text style={[styles.subhead, {marginTop: 12}]}>Vehicle Photos (URLs)</Text>
+        <Text style={[styles.subhead, {marginTop: 12}]}>Vehicle Photos (Upload IDs)</Text>
         <LabelInput label="Front" value={frontUrl} onChangeText={setFrontUrl} styles={styles} />
         <LabelInput label="Back" value={backUrl} onChangeText={setBackUrl} styles={styles} />
         <LabelInput label="Left" value={leftUrl} onChangeText={setLeftUrl} styles={styles} />
         <LabelInput label="Right" value={rightUrl} onChangeText={setRightUrl} styles={styles} />
-        <Text style={[styles.subhead, {marginTop: 12}]}>Liveness Captures (URLs)</Text>
+        <Text style={[styles.subhead, {marginTop: 12}]}>Liveness Captures (Upload IDs)</Text>
+        <View style={styles.actions}>
+          <Button title="Start Liveness Challenge" onPress={startLivenessChallenge} />
+        </View>
+        {livenessChallenge && (
+          <Text style={styles.subhead}>Turn: {livenessChallenge.sequence.join(' → ')}</Text>
+        )}
         <LabelInput label="Up" value={livenessUp} onChangeText={setLivenessUp} styles={styles} />
         <LabelInput label="Down" value={livenessDown} onChangeText={setLivenessDown} styles={styles} />
         <LabelInput label="Left" value={livenessLeft} onChangeText={setLivenessLeft} styles={styles} />
@@ -957,12 +1001,3 @@ const createStyles = (theme: typeof lightTheme) =>
       marginVertical: 8,
     },
   });
-
-function shuffle(arr: string[]) {
-  const a = [...arr];
-  for (let i = a.length - 1; i > 0; i--) {
-    const j = Math.floor(Math.random() * (i + 1));
-    [a[i], a[j]] = [a[j], a[i]];
-  }
-  return a;
-}